@@ -0,0 +1,238 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package cli implements the /cli commands, which drive the manager service from scripts.
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/l18n"
+	"golang.zx2c4.com/wireguard/windows/manager"
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
+)
+
+// Exit codes are relied upon by scripts, so they must never change.
+const (
+	ExitSuccess      = 0
+	ExitFailure      = 1
+	ExitUsage        = 2
+	ExitNotFound     = 3
+	ExitAccessDenied = 4
+	ExitTimeout      = 5
+	ExitNoManager    = 6
+	ExitConflict     = 7
+)
+
+const defaultTimeout = time.Second * 30
+
+var errTimeout = errors.New("Timed out")
+
+type options struct {
+	json    bool
+	wait    bool
+	timeout time.Duration
+	tag     string
+	sortBy  string
+	trust   bool
+	args    []string
+}
+
+type invocation struct {
+	options
+	stdout io.Writer
+	stderr io.Writer
+}
+
+type command struct {
+	usage   string
+	flags   []string
+	minArgs int
+	maxArgs int
+	run     func(inv *invocation) error
+}
+
+var commands = map[string]*command{
+	"list": {
+		usage: "/cli list [/tag TAG] [/sort name|tag] [/json]",
+		flags: []string{"/tag", "/sort", "/json"},
+		run:   list,
+	},
+	"up": {
+		usage:   "/cli up TUNNEL_NAME [/wait] [/timeout SECONDS]",
+		flags:   []string{"/wait", "/timeout"},
+		minArgs: 1,
+		maxArgs: 1,
+		run:     up,
+	},
+	"down": {
+		usage:   "/cli down TUNNEL_NAME [/wait] [/timeout SECONDS]",
+		flags:   []string{"/wait", "/timeout"},
+		minArgs: 1,
+		maxArgs: 1,
+		run:     down,
+	},
+	"show": {
+		usage:   "/cli show TUNNEL_NAME [/json]",
+		flags:   []string{"/json"},
+		minArgs: 1,
+		maxArgs: 1,
+		run:     show,
+	},
+	"import": {
+		usage:   "/cli import CONFIG_PATH [/trustmetadata] [/json]",
+		flags:   []string{"/trustmetadata", "/json"},
+		minArgs: 1,
+		maxArgs: 1,
+		run:     importConfig,
+	},
+	"export": {
+		usage:   "/cli export TUNNEL_NAME [OUTPUT_PATH]",
+		minArgs: 1,
+		maxArgs: 2,
+		run:     exportConfig,
+	},
+	"update": {
+		usage: "/cli update [/json]",
+		flags: []string{"/json"},
+		run:   updateStatus,
+	},
+}
+
+// knownFlags are the options of every command. Other arguments beginning with a slash are taken as
+// positional, so that paths on other platforms work.
+var knownFlags = map[string]bool{"/json": true, "/wait": true, "/timeout": true, "/tag": true, "/sort": true, "/trustmetadata": true}
+
+var commandOrder = []string{"list", "up", "down", "show", "import", "export", "update"}
+
+func writeUsage(w io.Writer) {
+	fmt.Fprintln(w, l18n.Sprintf("Usage:"))
+	for _, name := range commandOrder {
+		fmt.Fprintf(w, "    %s\n", commands[name].usage)
+	}
+	fmt.Fprintln(w, l18n.Sprintf("Exit codes: %d success, %d failure, %d usage, %d not found, %d access denied, %d timeout, %d manager not running, %d conflict with running tunnels",
+		ExitSuccess, ExitFailure, ExitUsage, ExitNotFound, ExitAccessDenied, ExitTimeout, ExitNoManager, ExitConflict))
+}
+
+func parseOptions(cmd *command, args []string) (*options, error) {
+	opts := &options{}
+	allowed := make(map[string]bool, len(cmd.flags))
+	for _, flag := range cmd.flags {
+		allowed[flag] = true
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		flag := strings.ToLower(arg)
+		if !knownFlags[flag] {
+			opts.args = append(opts.args, arg)
+			continue
+		}
+		if !allowed[flag] {
+			return nil, fmt.Errorf("Unknown option %s", arg)
+		}
+		switch flag {
+		case "/json":
+			opts.json = true
+		case "/wait":
+			opts.wait = true
+		case "/timeout":
+			i++
+			if i == len(args) {
+				return nil, errors.New("Missing number of seconds after /timeout")
+			}
+			seconds, err := strconv.ParseUint(args[i], 10, 32)
+			if err != nil || seconds == 0 {
+				return nil, fmt.Errorf("Invalid timeout %#q", args[i])
+			}
+			opts.timeout = time.Duration(seconds) * time.Second
+			opts.wait = true
+		case "/tag":
+			i++
+			if i == len(args) {
+				return nil, errors.New("Missing tag after /tag")
+			}
+			opts.tag = args[i]
+		case "/sort":
+			i++
+			if i == len(args) {
+				return nil, errors.New("Missing key after /sort")
+			}
+			opts.sortBy = strings.ToLower(args[i])
+			if opts.sortBy != "name" && opts.sortBy != "tag" {
+				return nil, fmt.Errorf("Invalid sort key %#q", args[i])
+			}
+		case "/trustmetadata":
+			opts.trust = true
+		}
+	}
+	if len(opts.args) < cmd.minArgs || len(opts.args) > cmd.maxArgs {
+		return nil, errors.New("Wrong number of arguments")
+	}
+	if opts.wait && opts.timeout == 0 {
+		opts.timeout = defaultTimeout
+	}
+	return opts, nil
+}
+
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitSuccess
+	case errors.Is(err, errTimeout):
+		return ExitTimeout
+	case rpc.Code(err) == rpc.ErrorNotFound:
+		return ExitNotFound
+	case rpc.Code(err) == rpc.ErrorAccessDenied:
+		return ExitAccessDenied
+	case rpc.Code(err) == rpc.ErrorConflict:
+		return ExitConflict
+	default:
+		return ExitFailure
+	}
+}
+
+func (inv *invocation) writeJSON(v interface{}) error {
+	encoder := json.NewEncoder(inv.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// Run runs the command given by args, the arguments following /cli, against the manager reached
+// through dial, and returns the process exit code.
+func Run(args []string, dial manager.Dialer, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		writeUsage(stderr)
+		return ExitUsage
+	}
+	cmd, ok := commands[strings.ToLower(args[0])]
+	if !ok {
+		fmt.Fprintln(stderr, l18n.Sprintf("Unknown command %#q", args[0]))
+		writeUsage(stderr)
+		return ExitUsage
+	}
+	opts, err := parseOptions(cmd, args[1:])
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		fmt.Fprintln(stderr, l18n.Sprintf("Usage: %s", cmd.usage))
+		return ExitUsage
+	}
+	err = manager.ConnectIPCClient(dial)
+	if err != nil {
+		fmt.Fprintln(stderr, l18n.Sprintf("Unable to connect to the manager service: %v", err))
+		return ExitNoManager
+	}
+	defer manager.DisconnectIPCClient()
+	err = cmd.run(&invocation{options: *opts, stdout: stdout, stderr: stderr})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+	}
+	return exitCode(err)
+}
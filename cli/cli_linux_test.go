@@ -0,0 +1,340 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/manager"
+)
+
+const testConfig = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+ListenPort = 51820
+Address = 10.192.122.1/24
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+Endpoint = 192.95.5.67:1234
+AllowedIPs = 10.192.122.3/32
+PersistentKeepalive = 25
+`
+
+// fakeBackend implements only what the commands use; anything else panics on the nil interface.
+type fakeBackend struct {
+	manager.TunnelBackend
+	sync.Mutex
+	configs  map[string]*conf.Config
+	states   map[string]manager.TunnelState
+	metadata map[string]*conf.Metadata
+	stuck    bool
+}
+
+func (b *fakeBackend) StoredConfig(tunnelName string) (*conf.Config, error) {
+	b.Lock()
+	defer b.Unlock()
+	config, ok := b.configs[tunnelName]
+	if !ok {
+		return nil, fmt.Errorf("Tunnel ‘%s’: %w", tunnelName, os.ErrNotExist)
+	}
+	return config, nil
+}
+
+func (b *fakeBackend) RuntimeConfig(tunnelName string) (*conf.Config, error) {
+	config, err := b.StoredConfig(tunnelName)
+	if err != nil {
+		return nil, err
+	}
+	runtime := *config
+	runtime.Peers = append([]conf.Peer(nil), config.Peers...)
+	runtime.Peers[0].RxBytes = 2048
+	runtime.Peers[0].TxBytes = 1024
+	return &runtime, nil
+}
+
+func (b *fakeBackend) StoredMetadata(tunnelName string) (*conf.Metadata, error) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.configs[tunnelName]; !ok {
+		return nil, fmt.Errorf("Tunnel ‘%s’: %w", tunnelName, os.ErrNotExist)
+	}
+	if metadata, ok := b.metadata[tunnelName]; ok {
+		return metadata, nil
+	}
+	return &conf.Metadata{Version: conf.MetadataVersion}, nil
+}
+
+func (b *fakeBackend) SetMetadata(tunnelName string, metadata *conf.Metadata) error {
+	err := metadata.Validate()
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.metadata[tunnelName] = metadata
+	return nil
+}
+
+func (b *fakeBackend) setState(tunnelName string, state manager.TunnelState) error {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.configs[tunnelName]; !ok {
+		return fmt.Errorf("Tunnel ‘%s’: %w", tunnelName, os.ErrNotExist)
+	}
+	b.states[tunnelName] = state
+	manager.IPCServerNotifyTunnelChange(tunnelName, state, state, nil)
+	return nil
+}
+
+func (b *fakeBackend) Start(tunnelName string) error {
+	err := b.setState(tunnelName, manager.TunnelStarting)
+	if err != nil || b.stuck {
+		return err
+	}
+	go b.setState(tunnelName, manager.TunnelStarted)
+	return nil
+}
+
+func (b *fakeBackend) Stop(tunnelName string) error {
+	return b.setState(tunnelName, manager.TunnelStopped)
+}
+
+func (b *fakeBackend) State(tunnelName string) (manager.TunnelState, error) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.configs[tunnelName]; !ok {
+		return manager.TunnelUnknown, fmt.Errorf("Tunnel ‘%s’: %w", tunnelName, os.ErrNotExist)
+	}
+	return b.states[tunnelName], nil
+}
+
+func (b *fakeBackend) Create(tunnelConfig *conf.Config) (*manager.Tunnel, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.configs[tunnelConfig.Name] = tunnelConfig
+	b.states[tunnelConfig.Name] = manager.TunnelStopped
+	return &manager.Tunnel{Name: tunnelConfig.Name}, nil
+}
+
+func (b *fakeBackend) Tunnels() ([]manager.Tunnel, error) {
+	b.Lock()
+	defer b.Unlock()
+	tunnels := make([]manager.Tunnel, 0, len(b.configs))
+	for name := range b.configs {
+		tunnels = append(tunnels, manager.Tunnel{Name: name})
+	}
+	return tunnels, nil
+}
+
+func (b *fakeBackend) UpdateState() manager.UpdateState {
+	return manager.UpdateStateFoundUpdate
+}
+
+func (b *fakeBackend) UpdateDetails() manager.UpdateDetails {
+	return manager.UpdateDetails{Channel: "stable"}
+}
+
+// startManager serves a backend holding the tunnels "office" and "home" on a Unix domain socket,
+// and returns a dialer for it.
+func startManager(t *testing.T) (*fakeBackend, manager.Dialer) {
+	backend := &fakeBackend{configs: make(map[string]*conf.Config), states: make(map[string]manager.TunnelState), metadata: make(map[string]*conf.Metadata)}
+	for _, name := range []string{"office", "home"} {
+		config, err := conf.FromWgQuick(testConfig, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend.configs[name] = config
+		backend.states[name] = manager.TunnelStopped
+	}
+	backend.states["office"] = manager.TunnelStarted
+	listener, err := manager.ListenUnixSocket(filepath.Join(t.TempDir(), "manager.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go manager.IPCServe(listener, backend, manager.AllowAll)
+	t.Cleanup(func() { listener.Close() })
+	return backend, manager.UnixSocketDialer(listener.Addr().String())
+}
+
+func run(dial manager.Dialer, args ...string) (code int, stdout string, stderr string) {
+	var out, errOut bytes.Buffer
+	code = Run(args, dial, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestList(t *testing.T) {
+	backend, dial := startManager(t)
+	code, stdout, stderr := run(dial, "list")
+	if code != ExitSuccess || stdout != "home    stopped\noffice  started\n" {
+		t.Errorf("list exited with %d, printing %q and %q", code, stdout, stderr)
+	}
+	backend.SetMetadata("home", &conf.Metadata{Tags: []string{"personal"}})
+	code, stdout, _ = run(dial, "list", "/sort", "tag")
+	if code != ExitSuccess || stdout != "home    stopped    personal\noffice  started\n" {
+		t.Errorf("list /sort tag exited with %d, printing %q", code, stdout)
+	}
+	code, stdout, _ = run(dial, "list", "/json")
+	var entries []manager.TunnelSummary
+	if code != ExitSuccess || json.Unmarshal([]byte(stdout), &entries) != nil || len(entries) != 2 || !reflect.DeepEqual(entries[1], manager.TunnelSummary{Name: "office", State: "started"}) {
+		t.Errorf("list /json exited with %d, printing %q", code, stdout)
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	backend, dial := startManager(t)
+	code, _, stderr := run(dial, "up", "home", "/wait")
+	if code != ExitSuccess {
+		t.Errorf("up /wait exited with %d: %s", code, stderr)
+	}
+	if state, _ := backend.State("home"); state != manager.TunnelStarted {
+		t.Errorf("Tunnel is %s after up /wait", state)
+	}
+	code, _, stderr = run(dial, "down", "home", "/wait")
+	if code != ExitSuccess {
+		t.Errorf("down /wait exited with %d: %s", code, stderr)
+	}
+	code, _, _ = run(dial, "up", "missing")
+	if code != ExitNotFound {
+		t.Errorf("up of a missing tunnel exited with %d, want %d", code, ExitNotFound)
+	}
+	backend.stuck = true
+	code, _, stderr = run(dial, "up", "home", "/timeout", "1")
+	if code != ExitTimeout || !strings.Contains(stderr, "Timed out") {
+		t.Errorf("up of a stuck tunnel exited with %d, printing %q", code, stderr)
+	}
+}
+
+func TestShow(t *testing.T) {
+	_, dial := startManager(t)
+	code, stdout, stderr := run(dial, "show", "office")
+	if code != ExitSuccess {
+		t.Fatalf("show exited with %d: %s", code, stderr)
+	}
+	for _, line := range []string{
+		"interface: office",
+		"  public key: HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=",
+		"  listening port: 51820",
+		"peer: xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+		"  endpoint: 192.95.5.67:1234",
+		"  allowed ips: 10.192.122.3/32",
+		"  transfer: 2.00\u00a0KiB received, 1.00\u00a0KiB sent",
+		"  persistent keepalive: every 25 seconds",
+	} {
+		if !strings.Contains(stdout, line+"\n") {
+			t.Errorf("show output is missing %q:\n%s", line, stdout)
+		}
+	}
+	if strings.Contains(stdout, "yAnz5TF") {
+		t.Error("show printed the private key")
+	}
+	code, stdout, _ = run(dial, "show", "office", "/json")
+	var entry manager.RuntimeInterface
+	if code != ExitSuccess || json.Unmarshal([]byte(stdout), &entry) != nil || len(entry.Peers) != 1 || entry.Peers[0].RxBytes != 2048 {
+		t.Errorf("show /json exited with %d, printing %q", code, stdout)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	backend, dial := startManager(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lab.conf")
+	err := ioutil.WriteFile(path, []byte("#! Metadata = {\"Version\":1,\"DisplayName\":\"Lab\",\"Tags\":[\"test\"]}\n"+testConfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, stderr := run(dial, "import", path)
+	if code != ExitSuccess {
+		t.Fatalf("import exited with %d: %s", code, stderr)
+	}
+	if _, err := backend.StoredConfig("lab"); err != nil {
+		t.Error(err)
+	}
+	if metadata, _ := backend.StoredMetadata("lab"); metadata.DisplayName != "Lab" || !metadata.HasTag("test") {
+		t.Errorf("Imported metadata is %+v", metadata)
+	}
+	code, stdout, _ := run(dial, "list", "/tag", "TEST")
+	if code != ExitSuccess || stdout != "lab  stopped  Lab  test\n" {
+		t.Errorf("list /tag exited with %d, printing %q", code, stdout)
+	}
+	code, _, _ = run(dial, "import", path)
+	if code != ExitFailure {
+		t.Errorf("Importing a duplicate tunnel exited with %d, want %d", code, ExitFailure)
+	}
+
+	exported := filepath.Join(dir, "exported.conf")
+	code, stdout, _ = run(dial, "export", "lab")
+	if code != ExitSuccess || !strings.Contains(stdout, "PrivateKey = yAnz5TF") || !strings.HasPrefix(stdout, "#! Metadata = ") {
+		t.Errorf("export exited with %d, printing %q", code, stdout)
+	}
+	code, _, _ = run(dial, "export", "lab", exported)
+	written, err := ioutil.ReadFile(exported)
+	if code != ExitSuccess || err != nil || string(written) != stdout {
+		t.Errorf("export to a file exited with %d, writing %q, %v", code, written, err)
+	}
+}
+
+func TestImportAutomation(t *testing.T) {
+	backend, dial := startManager(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lab.conf")
+	err := ioutil.WriteFile(path, []byte("#! Metadata = {\"Version\":3,\"DisplayName\":\"Lab\",\"OnDemand\":[{\"Action\":\"connect\"}],\"Health\":{\"Action\":\"restart\"}}\n"+testConfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, stderr := run(dial, "import", path)
+	if code != ExitSuccess || !strings.Contains(stderr, "/trustmetadata") {
+		t.Fatalf("import exited with %d, warning %q", code, stderr)
+	}
+	if metadata, _ := backend.StoredMetadata("lab"); metadata.DisplayName != "Lab" || len(metadata.Automation()) != 0 {
+		t.Errorf("Imported metadata without trusting it is %+v", metadata)
+	}
+
+	path = filepath.Join(dir, "lab2.conf")
+	err = ioutil.WriteFile(path, []byte("#! Metadata = {\"Version\":3,\"OnDemand\":[{\"Action\":\"connect\"}],\"Health\":{\"Action\":\"restart\"}}\n"+testConfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, stderr = run(dial, "import", path, "/trustmetadata")
+	if code != ExitSuccess || len(stderr) != 0 {
+		t.Fatalf("import /trustmetadata exited with %d: %s", code, stderr)
+	}
+	if metadata, _ := backend.StoredMetadata("lab2"); len(metadata.OnDemand) != 1 || metadata.Health == nil {
+		t.Errorf("Imported trusted metadata is %+v", metadata)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	_, dial := startManager(t)
+	for _, args := range [][]string{
+		{},
+		{"bogus"},
+		{"up"},
+		{"show", "office", "/wait"},
+		{"up", "office", "/timeout", "soon"},
+	} {
+		if code, _, _ := run(dial, args...); code != ExitUsage {
+			t.Errorf("%q exited with %d, want %d", args, code, ExitUsage)
+		}
+	}
+	code, stdout, _ := run(dial, "update", "/json")
+	if code != ExitSuccess || !strings.Contains(stdout, `"channel": "stable"`) {
+		t.Errorf("update /json exited with %d, printing %q", code, stdout)
+	}
+	dead := manager.UnixSocketDialer(filepath.Join(t.TempDir(), "missing.sock"))
+	if code, _, _ := run(dead, "list"); code != ExitNoManager {
+		t.Errorf("list without a manager exited with %d, want %d", code, ExitNoManager)
+	}
+}
@@ -0,0 +1,249 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/l18n"
+	"golang.zx2c4.com/wireguard/windows/manager"
+)
+
+func list(inv *invocation) error {
+	tunnels, err := manager.IPCClientListTunnels(inv.tag, inv.sortBy == "tag")
+	if err != nil {
+		return err
+	}
+	entries := make([]manager.TunnelSummary, 0, len(tunnels))
+	for i := range tunnels {
+		state, err := (&manager.Tunnel{Name: tunnels[i].Name}).State()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, *manager.NewTunnelSummary(tunnels[i].Name, state, &tunnels[i].Metadata))
+	}
+	if inv.json {
+		return inv.writeJSON(entries)
+	}
+	w := tabwriter.NewWriter(inv.stdout, 0, 0, 2, ' ', 0)
+	for _, entry := range entries {
+		cells := []string{entry.Name, entry.State, entry.DisplayName, strings.Join(entry.Tags, ",")}
+		for len(cells[len(cells)-1]) == 0 {
+			cells = cells[:len(cells)-1]
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	return w.Flush()
+}
+
+type tunnelChange struct {
+	state manager.TunnelState
+	err   error
+}
+
+// watchTunnel returns the changes to a tunnel's state, which are reported until unregister is
+// called.
+func watchTunnel(tunnelName string) (changes chan tunnelChange, unregister func()) {
+	changes = make(chan tunnelChange, 16)
+	cb := manager.IPCClientRegisterTunnelChange(func(tunnel *manager.Tunnel, state manager.TunnelState, globalState manager.TunnelState, err error) {
+		if tunnel.Name != tunnelName {
+			return
+		}
+		select {
+		case changes <- tunnelChange{state, err}:
+		default:
+		}
+	})
+	return changes, cb.Unregister
+}
+
+// waitForState waits until the tunnel reaches the wanted state, or fails to. Notifications say
+// promptly when that happens, but the state is also polled, in case a notification is missed.
+func waitForState(tunnel *manager.Tunnel, want manager.TunnelState, timeout time.Duration, changes chan tunnelChange) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+	for {
+		state, err := tunnel.State()
+		if err != nil {
+			return err
+		}
+		if state == want {
+			return nil
+		}
+		select {
+		case change := <-changes:
+			if change.err != nil {
+				return change.err
+			}
+		case <-poll.C:
+		case <-deadline.C:
+			return fmt.Errorf("%w waiting for tunnel ‘%s’ to become %s", errTimeout, tunnel.Name, want)
+		}
+	}
+}
+
+func up(inv *invocation) error {
+	tunnel := &manager.Tunnel{Name: inv.args[0]}
+	changes, unregister := watchTunnel(tunnel.Name)
+	defer unregister()
+	err := tunnel.Start()
+	if err != nil || !inv.wait {
+		return err
+	}
+	return waitForState(tunnel, manager.TunnelStarted, inv.timeout, changes)
+}
+
+func down(inv *invocation) error {
+	tunnel := &manager.Tunnel{Name: inv.args[0]}
+	changes, unregister := watchTunnel(tunnel.Name)
+	defer unregister()
+	err := tunnel.Stop()
+	if err != nil || !inv.wait {
+		return err
+	}
+	return waitForState(tunnel, manager.TunnelStopped, inv.timeout, changes)
+}
+
+// show prints the running configuration much as `wg show` does, but never the private key.
+func show(inv *invocation) error {
+	tunnel := &manager.Tunnel{Name: inv.args[0]}
+	config, err := tunnel.RuntimeConfig()
+	if err != nil {
+		return err
+	}
+	entry := manager.NewRuntimeInterface(&config)
+	if inv.json {
+		return inv.writeJSON(entry)
+	}
+
+	fmt.Fprintf(inv.stdout, "interface: %s\n", entry.Name)
+	if len(entry.PublicKey) > 0 {
+		fmt.Fprintf(inv.stdout, "  public key: %s\n", entry.PublicKey)
+	}
+	if entry.ListenPort > 0 {
+		fmt.Fprintf(inv.stdout, "  listening port: %d\n", entry.ListenPort)
+	}
+	for i, peer := range config.Peers {
+		fmt.Fprintf(inv.stdout, "\npeer: %s\n", entry.Peers[i].PublicKey)
+		if len(entry.Peers[i].Endpoint) > 0 {
+			fmt.Fprintf(inv.stdout, "  endpoint: %s\n", entry.Peers[i].Endpoint)
+		}
+		fmt.Fprintf(inv.stdout, "  allowed ips: %s\n", strings.Join(entry.Peers[i].AllowedIPs, ", "))
+		if !peer.LastHandshakeTime.IsEmpty() {
+			fmt.Fprintf(inv.stdout, "  latest handshake: %s\n", peer.LastHandshakeTime.String())
+		}
+		if peer.RxBytes > 0 || peer.TxBytes > 0 {
+			fmt.Fprintf(inv.stdout, "  transfer: %s\n", l18n.Sprintf("%s received, %s sent", peer.RxBytes.String(), peer.TxBytes.String()))
+		}
+		if peer.PersistentKeepalive > 0 {
+			fmt.Fprintf(inv.stdout, "  persistent keepalive: %s\n", l18n.Sprintf("every %d seconds", peer.PersistentKeepalive))
+		}
+	}
+	return nil
+}
+
+func importConfig(inv *invocation) error {
+	path := inv.args[0]
+	if conf.PathIsEncrypted(path) {
+		return fmt.Errorf("Encrypted configuration %s can only be imported by copying it into the configuration directory", path)
+	}
+	name, err := conf.NameFromPath(path)
+	if err != nil {
+		return err
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	existing, err := manager.IPCClientTunnels()
+	if err != nil {
+		return err
+	}
+	imported, err := manager.ParseImport(string(bytes), name, inv.trust, existing)
+	if err != nil {
+		return err
+	}
+	metadata := imported.Metadata
+	tunnel, err := manager.IPCClientNewTunnel(imported.Config)
+	if err != nil {
+		return err
+	}
+	if !metadata.IsEmpty() {
+		err = tunnel.SetMetadata(metadata)
+		if err != nil {
+			return err
+		}
+	}
+	if len(imported.Ignored) > 0 {
+		fmt.Fprintln(inv.stderr, l18n.Sprintf("Ignored %s from the metadata of ‘%s’; import with /trustmetadata to keep them", strings.Join(imported.Ignored, ", "), tunnel.Name))
+	}
+	if inv.json {
+		return inv.writeJSON(manager.NewTunnelSummary(tunnel.Name, manager.TunnelStopped, metadata))
+	}
+	fmt.Fprintln(inv.stdout, l18n.Sprintf("Imported tunnel ‘%s’", tunnel.Name))
+	return nil
+}
+
+func exportConfig(inv *invocation) error {
+	tunnel := &manager.Tunnel{Name: inv.args[0]}
+	config, err := tunnel.StoredConfig()
+	if err != nil {
+		return err
+	}
+	metadata, err := tunnel.StoredMetadata()
+	if err != nil {
+		return err
+	}
+	exported := metadata.ToWgQuickComment() + config.ToWgQuick()
+	if len(inv.args) == 1 {
+		_, err = fmt.Fprint(inv.stdout, exported)
+		return err
+	}
+	return ioutil.WriteFile(inv.args[1], []byte(exported), 0600)
+}
+
+func updateStatus(inv *invocation) error {
+	state, err := manager.IPCClientUpdateState()
+	if err != nil {
+		return err
+	}
+	details, err := manager.IPCClientUpdateDetails()
+	if err != nil {
+		return err
+	}
+	entry := manager.NewUpdateStatus(state, details)
+	if inv.json {
+		return inv.writeJSON(entry)
+	}
+	w := tabwriter.NewWriter(inv.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "state:\t%s\n", entry.State)
+	if len(entry.Channel) > 0 {
+		fmt.Fprintf(w, "channel:\t%s\n", entry.Channel)
+	}
+	if len(entry.Mirror) > 0 {
+		fmt.Fprintf(w, "mirror:\t%s\n", entry.Mirror)
+	}
+	if len(entry.HeldBack) > 0 {
+		fmt.Fprintf(w, "held back:\t%s\n", entry.HeldBack)
+	}
+	if entry.LastChecked != nil {
+		fmt.Fprintf(w, "last checked:\t%s\n", entry.LastChecked.Format(time.RFC1123))
+	}
+	if len(entry.LastError) > 0 {
+		fmt.Fprintf(w, "last error:\t%s\n", entry.LastError)
+	}
+	if entry.ScheduledFor != nil {
+		fmt.Fprintf(w, "scheduled for:\t%s\n", entry.ScheduledFor.Format(time.RFC1123))
+	}
+	return w.Flush()
+}
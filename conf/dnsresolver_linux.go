@@ -0,0 +1,29 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"net"
+)
+
+// This isn't a Linux program, yes, but having the conf package work across platforms is quite helpful for testing.
+
+func resolveHostname(name string) (resolvedIPString string, err error) {
+	ips, err := net.LookupIP(name)
+	if err != nil {
+		return "", err
+	}
+	ipv6 := ""
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String(), nil
+		}
+		if len(ipv6) == 0 {
+			ipv6 = ip.String()
+		}
+	}
+	return ipv6, nil
+}
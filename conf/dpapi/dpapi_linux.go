@@ -0,0 +1,20 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package dpapi
+
+import (
+	"errors"
+)
+
+// This isn't a Linux program, yes, but having the conf package work across platforms is quite helpful for testing.
+
+func Encrypt(data []byte, name string) ([]byte, error) {
+	return nil, errors.New("DPAPI is only available on Windows")
+}
+
+func Decrypt(data []byte, name string) ([]byte, error) {
+	return nil, errors.New("DPAPI is only available on Windows")
+}
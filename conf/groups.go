@@ -0,0 +1,199 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const groupsFileName = "groups.json"
+
+// GroupKind values are stored by name, so they must never be renamed.
+type GroupKind string
+
+const (
+	// Starting any member of an exclusive group stops the others.
+	GroupExclusive GroupKind = "exclusive"
+	// A bundle is started as a whole, bringing up its members in order and tearing them down in
+	// reverse.
+	GroupBundle GroupKind = "bundle"
+)
+
+type TunnelGroup struct {
+	Name    string
+	Kind    GroupKind
+	Members []string
+}
+
+func (group *TunnelGroup) Validate() error {
+	if !TunnelNameIsValid(group.Name) {
+		return errors.New("Group name is not valid")
+	}
+	if group.Kind != GroupExclusive && group.Kind != GroupBundle {
+		return fmt.Errorf("Group kind %#q is not valid", group.Kind)
+	}
+	seen := make(map[string]bool, len(group.Members))
+	for _, member := range group.Members {
+		if !TunnelNameIsValid(member) {
+			return fmt.Errorf("Member %#q is not a valid tunnel name", member)
+		}
+		if seen[strings.ToLower(member)] {
+			return fmt.Errorf("Tunnel ‘%s’ is listed twice", member)
+		}
+		seen[strings.ToLower(member)] = true
+	}
+	return nil
+}
+
+func (group *TunnelGroup) HasMember(tunnelName string) bool {
+	for _, member := range group.Members {
+		if strings.EqualFold(member, tunnelName) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupsLock serializes the read-modify-write cycles of the groups file.
+var groupsLock sync.Mutex
+
+func groupsPath() (string, error) {
+	configFileDir, err := tunnelConfigurationsDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configFileDir, groupsFileName), nil
+}
+
+func loadGroups() ([]TunnelGroup, error) {
+	path, err := groupsPath()
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var groups []TunnelGroup
+	err = json.Unmarshal(bytes, &groups)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %w", groupsFileName, err)
+	}
+	return groups, nil
+}
+
+func saveGroups(groups []TunnelGroup) error {
+	path, err := groupsPath()
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(groups, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, bytes)
+}
+
+// LoadGroups returns the tunnel groups, which are stored next to the configurations.
+func LoadGroups() ([]TunnelGroup, error) {
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	return loadGroups()
+}
+
+// SaveGroup adds group, or replaces the group of the same name.
+func SaveGroup(group *TunnelGroup) error {
+	err := group.Validate()
+	if err != nil {
+		return err
+	}
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	groups, err := loadGroups()
+	if err != nil {
+		return err
+	}
+	for i := range groups {
+		if strings.EqualFold(groups[i].Name, group.Name) {
+			groups[i] = *group
+			return saveGroups(groups)
+		}
+	}
+	return saveGroups(append(groups, *group))
+}
+
+func DeleteGroup(groupName string) error {
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	groups, err := loadGroups()
+	if err != nil {
+		return err
+	}
+	for i := range groups {
+		if strings.EqualFold(groups[i].Name, groupName) {
+			return saveGroups(append(groups[:i], groups[i+1:]...))
+		}
+	}
+	return fmt.Errorf("Group ‘%s’: %w", groupName, os.ErrNotExist)
+}
+
+// RemoveFromGroups takes a deleted tunnel out of every group it was a member of.
+func RemoveFromGroups(tunnelName string) error {
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	groups, err := loadGroups()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i := range groups {
+		members := groups[i].Members[:0]
+		for _, member := range groups[i].Members {
+			if strings.EqualFold(member, tunnelName) {
+				changed = true
+				continue
+			}
+			members = append(members, member)
+		}
+		groups[i].Members = members
+	}
+	if !changed {
+		return nil
+	}
+	return saveGroups(groups)
+}
+
+// RenameInGroups follows a renamed tunnel in every group it is a member of.
+func RenameInGroups(oldName string, newName string) error {
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	groups, err := loadGroups()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i := range groups {
+		for j := range groups[i].Members {
+			if strings.EqualFold(groups[i].Members[j], oldName) {
+				groups[i].Members[j] = newName
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return saveGroups(groups)
+}
@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGroupStorage(t *testing.T) {
+	PresetRootDirectory(t.TempDir())
+
+	groups, err := LoadGroups()
+	if err != nil || len(groups) != 0 {
+		t.Fatalf("Groups before any were saved: %v, %v", groups, err)
+	}
+	lab := TunnelGroup{Name: "lab", Kind: GroupBundle, Members: []string{"alpha", "beta"}}
+	sites := TunnelGroup{Name: "sites", Kind: GroupExclusive, Members: []string{"beta", "gamma"}}
+	for _, group := range []*TunnelGroup{&lab, &sites} {
+		err = SaveGroup(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, invalid := range []TunnelGroup{
+		{Name: "bad name", Kind: GroupBundle},
+		{Name: "lab", Kind: "sometimes"},
+		{Name: "lab", Kind: GroupBundle, Members: []string{"alpha", "ALPHA"}},
+		{Name: "lab", Kind: GroupBundle, Members: []string{"CON"}},
+	} {
+		if SaveGroup(&invalid) == nil {
+			t.Errorf("Invalid group %+v was saved", invalid)
+		}
+	}
+
+	lab.Members = []string{"beta", "alpha"}
+	err = SaveGroup(&lab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err = LoadGroups()
+	if err != nil || !reflect.DeepEqual(groups, []TunnelGroup{lab, sites}) {
+		t.Errorf("Groups after replacing one: %+v, %v", groups, err)
+	}
+
+	err = RemoveFromGroups("beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, _ = LoadGroups()
+	if len(groups) != 2 || !reflect.DeepEqual(groups[0].Members, []string{"alpha"}) || !reflect.DeepEqual(groups[1].Members, []string{"gamma"}) {
+		t.Errorf("Groups after removing a tunnel: %+v", groups)
+	}
+
+	err = RenameInGroups("GAMMA", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, _ = LoadGroups()
+	if len(groups) != 2 || !reflect.DeepEqual(groups[1].Members, []string{"delta"}) {
+		t.Errorf("Groups after renaming a tunnel: %+v", groups)
+	}
+
+	err = DeleteGroup("LAB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteGroup("lab")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Deleting a missing group returned %v", err)
+	}
+	groups, _ = LoadGroups()
+	if len(groups) != 1 || groups[0].Name != "sites" {
+		t.Errorf("Groups after deleting one: %+v", groups)
+	}
+}
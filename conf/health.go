@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HealthAction values are stored by name, so they must never be renamed.
+type HealthAction string
+
+const (
+	// Every change of health is notified, whatever the action, so this does nothing more.
+	HealthNotify HealthAction = "notify"
+	// A dead tunnel is stopped and started again.
+	HealthRestart HealthAction = "restart"
+	// A dead tunnel is stopped, and FailoverTo started in its place.
+	HealthFailover HealthAction = "failover"
+)
+
+const (
+	// DefaultHealthDegradedAfter is a little past when WireGuard stops using a session's keys,
+	// so a peer still being sent to without a handshake since then is having trouble.
+	DefaultHealthDegradedAfter = 180
+	// DefaultHealthDeadAfter leaves time for WireGuard's own handshake retries to give up.
+	DefaultHealthDeadAfter = 300
+
+	minHealthThreshold = 30
+	maxHealthThreshold = 24 * 60 * 60
+)
+
+// HealthPolicy says when a running tunnel's peers count as degraded or dead, measured in seconds
+// since their last handshake while traffic is being sent to them, and what to do about a tunnel
+// that dies. Zero thresholds take the defaults.
+type HealthPolicy struct {
+	Action        HealthAction
+	FailoverTo    string `json:",omitempty"`
+	DegradedAfter uint32 `json:",omitempty"`
+	DeadAfter     uint32 `json:",omitempty"`
+}
+
+// Thresholds returns the degraded and dead thresholds in seconds, with the defaults filled in.
+func (policy *HealthPolicy) Thresholds() (degradedAfter uint32, deadAfter uint32) {
+	degradedAfter, deadAfter = DefaultHealthDegradedAfter, DefaultHealthDeadAfter
+	if policy != nil && policy.DegradedAfter != 0 {
+		degradedAfter = policy.DegradedAfter
+	}
+	if policy != nil && policy.DeadAfter != 0 {
+		deadAfter = policy.DeadAfter
+	}
+	return
+}
+
+func (policy *HealthPolicy) Validate() error {
+	switch policy.Action {
+	case HealthNotify, HealthRestart:
+		if len(policy.FailoverTo) > 0 {
+			return errors.New("Only the failover action takes a tunnel to fail over to")
+		}
+	case HealthFailover:
+		if !TunnelNameIsValid(policy.FailoverTo) {
+			return errors.New("Tunnel to fail over to is not valid")
+		}
+	default:
+		return fmt.Errorf("Health action %#q is not valid", policy.Action)
+	}
+	for _, threshold := range []uint32{policy.DegradedAfter, policy.DeadAfter} {
+		if threshold != 0 && (threshold < minHealthThreshold || threshold > maxHealthThreshold) {
+			return fmt.Errorf("Health thresholds must be between %d and %d seconds", minHealthThreshold, maxHealthThreshold)
+		}
+	}
+	degradedAfter, deadAfter := policy.Thresholds()
+	if degradedAfter >= deadAfter {
+		return errors.New("Tunnels must be degraded before they are dead")
+	}
+	return nil
+}
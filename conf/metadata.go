@@ -0,0 +1,286 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.zx2c4.com/wireguard/windows/conf/dpapi"
+	"golang.zx2c4.com/wireguard/windows/l18n"
+)
+
+const metadataFileSuffix = ".meta.dpapi"
+
+// MetadataVersion is the version of the metadata schema written by this build. Metadata of older
+// versions is upgraded when loaded, while that of newer versions is refused rather than silently
+// stripped of the fields we don't know about.
+const MetadataVersion = 3
+
+// Metadata holds what we know about a tunnel beyond its wg-quick configuration. It is stored
+// encrypted next to the configuration.
+type Metadata struct {
+	Version     uint32
+	DisplayName string   `json:",omitempty"`
+	Owner       string   `json:",omitempty"`
+	Tags        []string `json:",omitempty"`
+	Notes       string   `json:",omitempty"`
+	StartAtBoot bool     `json:",omitempty"`
+	// OnDemand rules are tried in order, and the first that matches decides. Added in version 2.
+	OnDemand []OnDemandRule `json:",omitempty"`
+	// Health is what the watchdog does when the tunnel dies. Added in version 3.
+	Health *HealthPolicy `json:",omitempty"`
+}
+
+const (
+	maxDisplayNameLength = 64
+	maxOwnerLength       = 256
+	maxNotesLength       = 8192
+	maxTags              = 32
+)
+
+var allowedTagFormat = regexp.MustCompile("^[a-z0-9_.-]{1,32}$")
+
+// NormalizeTag lowercases a tag, so that tags compare without regard to case.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// Validate checks the metadata against the schema, normalizing and sorting its tags as it goes.
+func (m *Metadata) Validate() error {
+	if m.Version == 0 {
+		m.Version = MetadataVersion
+	} else if m.Version > MetadataVersion {
+		return fmt.Errorf("Metadata version %d is newer than the supported version %d", m.Version, MetadataVersion)
+	}
+	if utf8.RuneCountInString(m.DisplayName) > maxDisplayNameLength {
+		return fmt.Errorf("Display name is longer than %d characters", maxDisplayNameLength)
+	}
+	if utf8.RuneCountInString(m.Owner) > maxOwnerLength {
+		return fmt.Errorf("Owner is longer than %d characters", maxOwnerLength)
+	}
+	if utf8.RuneCountInString(m.Notes) > maxNotesLength {
+		return fmt.Errorf("Notes are longer than %d characters", maxNotesLength)
+	}
+	if len(m.Tags) > maxTags {
+		return fmt.Errorf("There are more than %d tags", maxTags)
+	}
+	tags := make([]string, 0, len(m.Tags))
+	seen := make(map[string]bool, len(m.Tags))
+	for _, tag := range m.Tags {
+		tag = NormalizeTag(tag)
+		if !allowedTagFormat.MatchString(tag) {
+			return fmt.Errorf("Tag %#q is not valid", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	if len(tags) == 0 {
+		tags = nil
+	}
+	m.Tags = tags
+	if len(m.OnDemand) > maxOnDemandRules {
+		return fmt.Errorf("There are more than %d on-demand rules", maxOnDemandRules)
+	}
+	for i := range m.OnDemand {
+		err := m.OnDemand[i].Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if m.Health != nil {
+		err := m.Health.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Metadata) HasTag(tag string) bool {
+	tag = NormalizeTag(tag)
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEmpty reports whether the metadata holds nothing beyond its version.
+func (m *Metadata) IsEmpty() bool {
+	return len(m.DisplayName) == 0 && len(m.Owner) == 0 && len(m.Tags) == 0 && len(m.Notes) == 0 && !m.StartAtBoot && len(m.OnDemand) == 0 && m.Health == nil
+}
+
+// Automation describes the parts of the metadata that have the manager act on the tunnel by
+// itself, starting, stopping or probing it, or returns nothing if there are none. Metadata carried
+// in by an imported configuration should only keep these with the user's consent.
+func (m *Metadata) Automation() []string {
+	var parts []string
+	if m.StartAtBoot {
+		parts = append(parts, l18n.Sprintf("start at boot"))
+	}
+	if len(m.OnDemand) > 0 {
+		parts = append(parts, l18n.Sprintf("%d on-demand rules", len(m.OnDemand)))
+	}
+	if m.Health != nil {
+		parts = append(parts, l18n.Sprintf("health policy"))
+	}
+	return parts
+}
+
+// StripAutomation removes the parts of the metadata described by Automation.
+func (m *Metadata) StripAutomation() {
+	m.StartAtBoot = false
+	m.OnDemand = nil
+	m.Health = nil
+}
+
+// upgradeMetadata brings metadata of an older version up to MetadataVersion. Versions 2 and 3 only
+// added on-demand rules and the health policy, which older metadata simply has none of.
+func upgradeMetadata(m *Metadata) {
+	m.Version = MetadataVersion
+}
+
+func parseMetadata(bytes []byte) (*Metadata, error) {
+	var m Metadata
+	err := json.Unmarshal(bytes, &m)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse metadata: %w", err)
+	}
+	if m.Version > MetadataVersion {
+		return nil, fmt.Errorf("Metadata version %d is newer than the supported version %d", m.Version, MetadataVersion)
+	}
+	if m.Version < MetadataVersion {
+		upgradeMetadata(&m)
+	}
+	err = m.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func metadataPaths(name string) (configPath string, metadataPath string, err error) {
+	if !TunnelNameIsValid(name) {
+		return "", "", errors.New("Tunnel name is not valid")
+	}
+	configFileDir, err := tunnelConfigurationsDirectory()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(configFileDir, name+configFileSuffix), filepath.Join(configFileDir, name+metadataFileSuffix), nil
+}
+
+// LoadMetadataFromName returns the metadata of the named tunnel, which is empty if none has been
+// saved.
+func LoadMetadataFromName(name string) (*Metadata, error) {
+	configPath, metadataPath, err := metadataPaths(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(configPath); err != nil {
+		return nil, err
+	}
+	bytes, err := ioutil.ReadFile(metadataPath)
+	if os.IsNotExist(err) {
+		return &Metadata{Version: MetadataVersion}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	bytes, err = dpapi.Decrypt(bytes, name)
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadata(bytes)
+}
+
+// Save stores the metadata of the named tunnel, which must already exist. Empty metadata
+// removes the sidecar altogether.
+func (m *Metadata) Save(name string) error {
+	err := m.Validate()
+	if err != nil {
+		return err
+	}
+	configPath, metadataPath, err := metadataPaths(name)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(configPath); err != nil {
+		return err
+	}
+	if m.IsEmpty() {
+		err = os.Remove(metadataPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	bytes, err = dpapi.Encrypt(bytes, name)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(metadataPath, bytes)
+}
+
+func deleteMetadata(name string) error {
+	_, metadataPath, err := metadataPaths(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(metadataPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// metadataCommentPrefix marks the comment that carries metadata through exported configuration
+// files. Since it is a comment, other WireGuard implementations ignore it.
+const metadataCommentPrefix = "#! Metadata = "
+
+// ToWgQuickComment returns the comment line that carries the metadata in an exported
+// configuration, or nothing if the metadata is empty.
+func (m *Metadata) ToWgQuickComment() string {
+	if m.IsEmpty() {
+		return ""
+	}
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return ""
+	}
+	return metadataCommentPrefix + string(bytes) + "\n"
+}
+
+// MetadataFromWgQuick extracts the metadata carried by an exported configuration, returning empty
+// metadata if there is none.
+func MetadataFromWgQuick(s string) (*Metadata, error) {
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, metadataCommentPrefix) {
+			return parseMetadata([]byte(strings.TrimPrefix(line, metadataCommentPrefix)))
+		}
+	}
+	return &Metadata{Version: MetadataVersion}, nil
+}
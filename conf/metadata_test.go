@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadataValidate(t *testing.T) {
+	m := Metadata{DisplayName: "Office", Tags: []string{"Work", " vpn ", "work"}}
+	err := m.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != MetadataVersion || !reflect.DeepEqual(m.Tags, []string{"vpn", "work"}) {
+		t.Errorf("Validated metadata is %+v", m)
+	}
+	for _, invalid := range []Metadata{
+		{Version: MetadataVersion + 1},
+		{DisplayName: strings.Repeat("x", maxDisplayNameLength+1)},
+		{Notes: strings.Repeat("x", maxNotesLength+1)},
+		{Tags: []string{"two words"}},
+		{Tags: make([]string, maxTags+1)},
+	} {
+		if invalid.Validate() == nil {
+			t.Errorf("Invalid metadata %+v was accepted", invalid)
+		}
+	}
+}
+
+func TestMetadataWgQuickComment(t *testing.T) {
+	m := Metadata{Version: MetadataVersion, DisplayName: "Office", Owner: "it@example.com", Tags: []string{"work"}, Notes: "Call the help desk\nif it's down", StartAtBoot: true}
+	comment := m.ToWgQuickComment()
+	if strings.Count(comment, "\n") != 1 {
+		t.Fatalf("Comment spans several lines: %q", comment)
+	}
+	config, err := FromWgQuick(comment+testInput, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Peers) != 3 {
+		t.Errorf("Configuration with metadata comment parsed to %d peers", len(config.Peers))
+	}
+	parsed, err := MetadataFromWgQuick(comment + testInput)
+	if err != nil || !reflect.DeepEqual(*parsed, m) {
+		t.Errorf("Metadata from comment is %+v, %v", parsed, err)
+	}
+	parsed, err = MetadataFromWgQuick(testInput)
+	if err != nil || !parsed.IsEmpty() {
+		t.Errorf("Metadata without a comment is %+v, %v", parsed, err)
+	}
+	if (&Metadata{Version: MetadataVersion}).ToWgQuickComment() != "" {
+		t.Error("Empty metadata produced a comment")
+	}
+	_, err = MetadataFromWgQuick(fmt.Sprintf("#! Metadata = {\"Version\":%d}\n", MetadataVersion+1) + testInput)
+	if err == nil {
+		t.Error("Metadata of a newer version was accepted")
+	}
+}
+
+func TestOnDemandRuleValidate(t *testing.T) {
+	for _, invalid := range []OnDemandRule{
+		{Action: "sometimes"},
+		{Action: OnDemandConnect, InterfaceTypes: []InterfaceType{"carrier-pigeon"}},
+		{Action: OnDemandConnect, DNSSuffixes: []string{"..."}},
+		{Action: OnDemandConnect, GatewayMACs: []string{"00:11:22"}},
+		{Action: OnDemandConnect, SSIDs: []string{"an SSID that is far too long to be one"}},
+		{Action: OnDemandConnect, Probe: &ProbeCondition{Host: ":443"}},
+	} {
+		if invalid.Validate() == nil {
+			t.Errorf("Invalid rule %+v was accepted", invalid)
+		}
+	}
+}
+
+func TestHealthPolicyValidate(t *testing.T) {
+	for _, valid := range []HealthPolicy{
+		{Action: HealthNotify},
+		{Action: HealthRestart, DeadAfter: 600},
+		{Action: HealthFailover, FailoverTo: "backup", DegradedAfter: 30, DeadAfter: 60},
+	} {
+		if err := valid.Validate(); err != nil {
+			t.Errorf("Valid policy %+v was refused: %v", valid, err)
+		}
+	}
+	for _, invalid := range []HealthPolicy{
+		{Action: "panic"},
+		{Action: HealthRestart, FailoverTo: "backup"},
+		{Action: HealthFailover},
+		{Action: HealthFailover, FailoverTo: "back/up"},
+		{Action: HealthNotify, DegradedAfter: 10},
+		{Action: HealthNotify, DegradedAfter: 300, DeadAfter: 300},
+		{Action: HealthNotify, DegradedAfter: 600},
+	} {
+		if invalid.Validate() == nil {
+			t.Errorf("Invalid policy %+v was accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// OnDemandAction and InterfaceType values are stored by name, so they must never be renamed.
+type OnDemandAction string
+
+const (
+	OnDemandConnect    OnDemandAction = "connect"
+	OnDemandDisconnect OnDemandAction = "disconnect"
+	OnDemandIgnore     OnDemandAction = "ignore"
+)
+
+type InterfaceType string
+
+const (
+	InterfaceEthernet InterfaceType = "ethernet"
+	InterfaceWiFi     InterfaceType = "wifi"
+	InterfaceCellular InterfaceType = "cellular"
+	InterfaceOther    InterfaceType = "other"
+)
+
+// ProbeCondition matches when Host, given as a host name or address with an optional port, is or
+// isn't reachable, as Reachable says.
+type ProbeCondition struct {
+	Host      string
+	Reachable bool
+}
+
+// OnDemandRule decides what to do with a tunnel when the network matches it. Every condition that
+// is given must hold, and a list condition holds when any of its entries does. The interface
+// conditions must all hold for the same connected interface. A rule without conditions matches
+// any network.
+type OnDemandRule struct {
+	Action         OnDemandAction
+	InterfaceTypes []InterfaceType `json:",omitempty"`
+	DNSSuffixes    []string        `json:",omitempty"`
+	GatewayMACs    []string        `json:",omitempty"`
+	SSIDs          []string        `json:",omitempty"`
+	Probe          *ProbeCondition `json:",omitempty"`
+}
+
+const (
+	maxOnDemandRules     = 64
+	maxOnDemandRuleItems = 64
+	maxSSIDLength        = 32
+)
+
+// NormalizeDNSSuffix lowercases a DNS suffix and strips its surrounding dots, so that suffixes
+// compare as they would be resolved.
+func NormalizeDNSSuffix(suffix string) string {
+	return strings.Trim(strings.ToLower(strings.TrimSpace(suffix)), ".")
+}
+
+// NormalizeMAC returns the canonical form of a MAC address, or nothing if it isn't one.
+func NormalizeMAC(mac string) string {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return ""
+	}
+	return hw.String()
+}
+
+func (rule *OnDemandRule) HasInterfaceConditions() bool {
+	return len(rule.InterfaceTypes) > 0 || len(rule.DNSSuffixes) > 0 || len(rule.GatewayMACs) > 0 || len(rule.SSIDs) > 0
+}
+
+// Validate checks the rule, normalizing its DNS suffixes and MAC addresses as it goes.
+func (rule *OnDemandRule) Validate() error {
+	switch rule.Action {
+	case OnDemandConnect, OnDemandDisconnect, OnDemandIgnore:
+	default:
+		return fmt.Errorf("On-demand action %#q is not valid", rule.Action)
+	}
+	if len(rule.InterfaceTypes) > maxOnDemandRuleItems || len(rule.DNSSuffixes) > maxOnDemandRuleItems || len(rule.GatewayMACs) > maxOnDemandRuleItems || len(rule.SSIDs) > maxOnDemandRuleItems {
+		return fmt.Errorf("On-demand rules may not list more than %d of anything", maxOnDemandRuleItems)
+	}
+	for _, t := range rule.InterfaceTypes {
+		switch t {
+		case InterfaceEthernet, InterfaceWiFi, InterfaceCellular, InterfaceOther:
+		default:
+			return fmt.Errorf("Interface type %#q is not valid", t)
+		}
+	}
+	for i, suffix := range rule.DNSSuffixes {
+		rule.DNSSuffixes[i] = NormalizeDNSSuffix(suffix)
+		if len(rule.DNSSuffixes[i]) == 0 || len(rule.DNSSuffixes[i]) > 253 || strings.ContainsAny(rule.DNSSuffixes[i], " \t,/") {
+			return fmt.Errorf("DNS suffix %#q is not valid", suffix)
+		}
+	}
+	for i, mac := range rule.GatewayMACs {
+		rule.GatewayMACs[i] = NormalizeMAC(mac)
+		if len(rule.GatewayMACs[i]) == 0 {
+			return fmt.Errorf("Gateway MAC address %#q is not valid", mac)
+		}
+	}
+	for _, ssid := range rule.SSIDs {
+		if len(ssid) == 0 || len(ssid) > maxSSIDLength {
+			return fmt.Errorf("SSID %#q is not valid", ssid)
+		}
+	}
+	if rule.Probe != nil {
+		host := rule.Probe.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if len(host) == 0 || strings.ContainsAny(host, " \t/") {
+			return errors.New("Probe host is not valid")
+		}
+	}
+	return nil
+}
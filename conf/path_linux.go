@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// This isn't a Linux program, yes, but having the conf package work across platforms is quite helpful for testing.
+
+var cachedConfigFileDir string
+var cachedRootDir string
+var disableAutoMigration = true
+
+func tunnelConfigurationsDirectory() (string, error) {
+	if cachedConfigFileDir != "" {
+		return cachedConfigFileDir, nil
+	}
+	root, err := RootDirectory()
+	if err != nil {
+		return "", err
+	}
+	c := filepath.Join(root, "Configurations")
+	err = os.MkdirAll(c, os.ModeDir|0700)
+	if err != nil {
+		return "", err
+	}
+	cachedConfigFileDir = c
+	return cachedConfigFileDir, nil
+}
+
+func PresetRootDirectory(root string) {
+	cachedRootDir = root
+	cachedConfigFileDir = ""
+}
+
+func RootDirectory() (string, error) {
+	if cachedRootDir != "" {
+		return cachedRootDir, nil
+	}
+	return "", errors.New("There is no default root directory on Linux, so one must be preset")
+}
@@ -7,6 +7,7 @@ package conf
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -216,7 +217,170 @@ func DeleteName(name string) error {
 	if err != nil {
 		return err
 	}
-	return os.Remove(filepath.Join(configFileDir, name+configFileSuffix))
+	err = os.Remove(filepath.Join(configFileDir, name+configFileSuffix))
+	if err != nil {
+		return err
+	}
+	return deleteMetadata(name)
+}
+
+func writeFileAtomically(path string, bytes []byte) error {
+	err := ioutil.WriteFile(path+".tmp", bytes, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return nil
+}
+
+// renameFileSuffix marks the record of a rename in progress, which is named after the old name
+// and holds the new one. It stays until the rename is done, so that one cut short by a crash is
+// finished by FinishPendingRenames.
+const renameFileSuffix = ".rename"
+
+// renameFile moves one of a tunnel's files to its new name, encrypting it again under that name.
+// It may be repeated after being cut short at any point: the old file is only removed once the new
+// one is written, and when only the case changes, a file already encrypted under the new name is
+// merely given the new case. A file that is under neither name has nothing left to move.
+func renameFile(oldPath string, newPath string, oldName string, newName string, caseOnly bool) error {
+	path := oldPath
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && caseOnly {
+		path = newPath
+		bytes, err = ioutil.ReadFile(path)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if caseOnly {
+		if _, err = dpapi.Decrypt(bytes, newName); err == nil {
+			return os.Rename(path, newPath)
+		}
+	}
+	decrypted, err := dpapi.Decrypt(bytes, oldName)
+	if err != nil {
+		return err
+	}
+	reencrypted, err := dpapi.Encrypt(decrypted, newName)
+	if err != nil {
+		return err
+	}
+	// When only the case changes, the old and new paths may name the same file, so the case is
+	// changed first and the new contents then replace the old.
+	if caseOnly {
+		err = os.Rename(path, newPath)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomically(newPath, reencrypted)
+	}
+	err = writeFileAtomically(newPath, reencrypted)
+	if err != nil {
+		return err
+	}
+	return os.Remove(oldPath)
+}
+
+// renameFiles moves a tunnel's metadata and then its configuration to the new name.
+func renameFiles(configFileDir string, oldName string, newName string) error {
+	caseOnly := strings.EqualFold(oldName, newName)
+	for _, suffix := range []string{metadataFileSuffix, configFileSuffix} {
+		err := renameFile(filepath.Join(configFileDir, oldName+suffix), filepath.Join(configFileDir, newName+suffix), oldName, newName, caseOnly)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenameName renames a tunnel's configuration and metadata, encrypting them again under the new
+// name. Should any step fail, the tunnel is put back as it was, and should the process die part
+// way, FinishPendingRenames completes the rename. Renames that only change case are allowed.
+func RenameName(oldName string, newName string) error {
+	if !TunnelNameIsValid(oldName) || !TunnelNameIsValid(newName) {
+		return errors.New("Tunnel name is not valid")
+	}
+	if oldName == newName {
+		return nil
+	}
+	configFileDir, err := tunnelConfigurationsDirectory()
+	if err != nil {
+		return err
+	}
+	oldPath := filepath.Join(configFileDir, oldName+configFileSuffix)
+	if _, err = os.Stat(oldPath); err != nil {
+		return err
+	}
+	if !strings.EqualFold(oldName, newName) {
+		if _, err = os.Stat(filepath.Join(configFileDir, newName+configFileSuffix)); err == nil {
+			return fmt.Errorf("Tunnel ‘%s’: %w", newName, os.ErrExist)
+		}
+		// Metadata without a configuration belongs to no tunnel, and mustn't be adopted by this one.
+		err = os.Remove(filepath.Join(configFileDir, newName+metadataFileSuffix))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	pendingPath := filepath.Join(configFileDir, oldName+renameFileSuffix)
+	err = writeFileAtomically(pendingPath, []byte(newName))
+	if err != nil {
+		return err
+	}
+	err = renameFiles(configFileDir, oldName, newName)
+	if err != nil {
+		if renameFiles(configFileDir, newName, oldName) == nil {
+			os.Remove(pendingPath)
+		}
+		return err
+	}
+	return os.Remove(pendingPath)
+}
+
+// FinishPendingRenames completes the renames that were cut short, and should be called before
+// tunnels are looked at.
+func FinishPendingRenames() []error {
+	configFileDir, err := tunnelConfigurationsDirectory()
+	if err != nil {
+		return []error{err}
+	}
+	files, err := ioutil.ReadDir(configFileDir)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), renameFileSuffix) {
+			continue
+		}
+		pendingPath := filepath.Join(configFileDir, file.Name())
+		oldName := strings.TrimSuffix(file.Name(), renameFileSuffix)
+		newName, err := ioutil.ReadFile(pendingPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !TunnelNameIsValid(oldName) || !TunnelNameIsValid(string(newName)) {
+			errs = append(errs, fmt.Errorf("Pending rename %s is not valid", file.Name()))
+			continue
+		}
+		err = renameFiles(configFileDir, oldName, string(newName))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Unable to finish renaming ‘%s’ to ‘%s’: %w", oldName, newName, err))
+			continue
+		}
+		err = os.Remove(pendingPath)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
 }
 
 func (config *Config) Delete() error {
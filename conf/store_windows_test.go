@@ -0,0 +1,255 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStorage(t *testing.T) {
+	c, err := FromWgQuick(testInput, "golangTest")
+	if err != nil {
+		t.Errorf("Unable to parse test config: %s", err.Error())
+		return
+	}
+
+	err = c.Save()
+	if err != nil {
+		t.Errorf("Unable to save config: %s", err.Error())
+	}
+
+	configs, err := ListConfigNames()
+	if err != nil {
+		t.Errorf("Unable to list configs: %s", err.Error())
+	}
+
+	found := false
+	for _, name := range configs {
+		if name == "golangTest" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("Unable to find saved config in list")
+	}
+
+	loaded, err := LoadFromName("golangTest")
+	if err != nil {
+		t.Errorf("Unable to load config: %s", err.Error())
+		return
+	}
+
+	if !reflect.DeepEqual(loaded, c) {
+		t.Error("Loaded config is not the same as saved config")
+	}
+
+	k, err := NewPrivateKey()
+	if err != nil {
+		t.Errorf("Unable to generate new private key: %s", err.Error())
+	}
+	c.Interface.PrivateKey = *k
+
+	err = c.Save()
+	if err != nil {
+		t.Errorf("Unable to save config a second time: %s", err.Error())
+	}
+
+	loaded, err = LoadFromName("golangTest")
+	if err != nil {
+		t.Errorf("Unable to load config a second time: %s", err.Error())
+		return
+	}
+
+	if !reflect.DeepEqual(loaded, c) {
+		t.Error("Second loaded config is not the same as second saved config")
+	}
+
+	err = DeleteName("golangTest")
+	if err != nil {
+		t.Errorf("Unable to delete config: %s", err.Error())
+	}
+
+	configs, err = ListConfigNames()
+	if err != nil {
+		t.Errorf("Unable to list configs: %s", err.Error())
+	}
+	found = false
+	for _, name := range configs {
+		if name == "golangTest" {
+			found = true
+			break
+		}
+	}
+	if found {
+		t.Error("Config wasn't actually deleted")
+	}
+}
+
+func TestRename(t *testing.T) {
+	c, err := FromWgQuick(testInput, "golangTest")
+	if err != nil {
+		t.Fatalf("Unable to parse test config: %s", err.Error())
+	}
+	err = c.Save()
+	if err != nil {
+		t.Fatalf("Unable to save config: %s", err.Error())
+	}
+	defer DeleteName("golangTest")
+	defer DeleteName("golangTestRenamed")
+	metadata := Metadata{DisplayName: "Test", Tags: []string{"test"}}
+	err = metadata.Save("golangTest")
+	if err != nil {
+		t.Fatalf("Unable to save metadata: %s", err.Error())
+	}
+
+	err = RenameName("golangTest", "golangTestRenamed")
+	if err != nil {
+		t.Fatalf("Unable to rename config: %s", err.Error())
+	}
+	if _, err = LoadFromName("golangTest"); err == nil {
+		t.Error("Config is still there under the old name")
+	}
+	loaded, err := LoadFromName("golangTestRenamed")
+	if err != nil {
+		t.Fatalf("Unable to load renamed config: %s", err.Error())
+	}
+	if loaded.Name != "golangTestRenamed" || !reflect.DeepEqual(loaded.Peers, c.Peers) {
+		t.Error("Renamed config is not the same as saved config")
+	}
+	loadedMetadata, err := LoadMetadataFromName("golangTestRenamed")
+	if err != nil || loadedMetadata.DisplayName != "Test" {
+		t.Errorf("Metadata of renamed config is %+v, %v", loadedMetadata, err)
+	}
+
+	err = c.Save()
+	if err != nil {
+		t.Fatalf("Unable to save config again: %s", err.Error())
+	}
+	err = RenameName("golangTest", "golangTestRenamed")
+	if err == nil {
+		t.Error("Renaming over an existing config succeeded")
+	}
+	err = DeleteName("golangTest")
+	if err != nil {
+		t.Errorf("Unable to delete config: %s", err.Error())
+	}
+
+	err = RenameName("golangTestRenamed", "GolangTestRenamed")
+	if err != nil {
+		t.Fatalf("Unable to change the case of config: %s", err.Error())
+	}
+	configs, err := ListConfigNames()
+	if err != nil {
+		t.Fatalf("Unable to list configs: %s", err.Error())
+	}
+	found := false
+	for _, name := range configs {
+		if name == "GolangTestRenamed" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Unable to find config under its new case")
+	}
+	if _, err = LoadFromName("GolangTestRenamed"); err != nil {
+		t.Errorf("Unable to load config after changing its case: %s", err.Error())
+	}
+}
+
+func TestFinishPendingRename(t *testing.T) {
+	c, err := FromWgQuick(testInput, "golangTest")
+	if err != nil {
+		t.Fatalf("Unable to parse test config: %s", err.Error())
+	}
+	err = c.Save()
+	if err != nil {
+		t.Fatalf("Unable to save config: %s", err.Error())
+	}
+	defer DeleteName("golangTest")
+	defer DeleteName("golangTestRenamed")
+	metadata := Metadata{DisplayName: "Test"}
+	err = metadata.Save("golangTest")
+	if err != nil {
+		t.Fatalf("Unable to save metadata: %s", err.Error())
+	}
+
+	// Stop as if the process died once the metadata had moved, but not yet the configuration.
+	configFileDir, err := tunnelConfigurationsDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendingPath := filepath.Join(configFileDir, "golangTest"+renameFileSuffix)
+	err = writeFileAtomically(pendingPath, []byte("golangTestRenamed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = renameFile(filepath.Join(configFileDir, "golangTest"+metadataFileSuffix), filepath.Join(configFileDir, "golangTestRenamed"+metadataFileSuffix), "golangTest", "golangTestRenamed", false)
+	if err != nil {
+		t.Fatalf("Unable to move metadata: %s", err.Error())
+	}
+
+	if errs := FinishPendingRenames(); len(errs) != 0 {
+		t.Fatalf("Unable to finish pending renames: %v", errs)
+	}
+	if _, err = os.Stat(pendingPath); !os.IsNotExist(err) {
+		t.Error("Pending rename is still recorded")
+	}
+	if _, err = LoadFromName("golangTest"); err == nil {
+		t.Error("Config is still there under the old name")
+	}
+	if _, err = LoadFromName("golangTestRenamed"); err != nil {
+		t.Errorf("Unable to load renamed config: %s", err.Error())
+	}
+	loadedMetadata, err := LoadMetadataFromName("golangTestRenamed")
+	if err != nil || loadedMetadata.DisplayName != "Test" {
+		t.Errorf("Metadata of renamed config is %+v, %v", loadedMetadata, err)
+	}
+}
+
+func TestRenameOverStaleMetadata(t *testing.T) {
+	c, err := FromWgQuick(testInput, "golangTest")
+	if err != nil {
+		t.Fatalf("Unable to parse test config: %s", err.Error())
+	}
+	err = c.Save()
+	if err != nil {
+		t.Fatalf("Unable to save config: %s", err.Error())
+	}
+	defer DeleteName("golangTest")
+	defer DeleteName("golangTestRenamed")
+
+	// Leave metadata behind under the new name, as deleting a tunnel cut short would.
+	c.Name = "golangTestRenamed"
+	err = c.Save()
+	if err != nil {
+		t.Fatalf("Unable to save config: %s", err.Error())
+	}
+	stale := Metadata{DisplayName: "Stale"}
+	err = stale.Save("golangTestRenamed")
+	if err != nil {
+		t.Fatalf("Unable to save stale metadata: %s", err.Error())
+	}
+	configFileDir, err := tunnelConfigurationsDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(configFileDir, "golangTestRenamed"+configFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RenameName("golangTest", "golangTestRenamed")
+	if err != nil {
+		t.Fatalf("Unable to rename config: %s", err.Error())
+	}
+	if loadedMetadata, err := LoadMetadataFromName("golangTestRenamed"); err == nil && loadedMetadata.DisplayName == "Stale" {
+		t.Error("Renamed config adopted metadata left behind under its new name")
+	}
+}
@@ -0,0 +1,11 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+// This isn't a Linux program, yes, but having the conf package work across platforms is quite helpful for testing.
+
+func startWatchingConfigDir() {
+}
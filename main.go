@@ -6,8 +6,10 @@
 package main
 
 import (
+	"bytes"
 	"debug/pe"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
@@ -21,9 +23,12 @@ import (
 	"golang.org/x/sys/windows/registry"
 	"golang.zx2c4.com/wireguard/tun"
 
+	"golang.zx2c4.com/wireguard/windows/cli"
+	"golang.zx2c4.com/wireguard/windows/conf"
 	"golang.zx2c4.com/wireguard/windows/elevate"
 	"golang.zx2c4.com/wireguard/windows/l18n"
 	"golang.zx2c4.com/wireguard/windows/manager"
+	"golang.zx2c4.com/wireguard/windows/redact"
 	"golang.zx2c4.com/wireguard/windows/ringlogger"
 	"golang.zx2c4.com/wireguard/windows/tunnel"
 	"golang.zx2c4.com/wireguard/windows/ui"
@@ -52,10 +57,18 @@ func usage() {
 		"/uninstalltunnelservice TUNNEL_NAME",
 		"/managerservice",
 		"/tunnelservice CONFIG_PATH",
-		"/ui CMD_READ_HANDLE CMD_WRITE_HANDLE CMD_EVENT_HANDLE LOG_MAPPING_HANDLE",
-		"/dumplog OUTPUT_PATH",
+		"/ui CMD_READ_HANDLE CMD_WRITE_HANDLE LOG_MAPPING_HANDLE",
+		"/dumplog [/redact] OUTPUT_PATH [MAPPING_PATH]",
+		"/diagnostics OUTPUT_ZIP [MAPPING_PATH]",
 		"/update [LOG_FILE]",
 		"/removealladapters [LOG_FILE]",
+		"/cli list [/tag TAG] [/sort name|tag] [/json]",
+		"/cli up TUNNEL_NAME [/wait] [/timeout SECONDS]",
+		"/cli down TUNNEL_NAME [/wait] [/timeout SECONDS]",
+		"/cli show TUNNEL_NAME [/json]",
+		"/cli import CONFIG_PATH [/json]",
+		"/cli export TUNNEL_NAME [OUTPUT_PATH]",
+		"/cli update [/json]",
 	}
 	builder := strings.Builder{}
 	for _, flag := range flags {
@@ -80,6 +93,30 @@ func isWow64Process2(handle windows.Handle, processMachine *uint16, nativeMachin
 	return
 }
 
+// attachParentConsole gives this GUI process the console of whatever started it, so that /cli
+// output can be seen and redirected.
+func attachParentConsole() error {
+	err := attachConsole(attachParentProcess)
+	if err != nil {
+		return err
+	}
+	// Handles that were redirected by the parent are kept; only missing ones go to the console.
+	var conout *os.File
+	for _, f := range []**os.File{&os.Stdout, &os.Stderr} {
+		if *f != nil && (*f).Fd() != 0 && windows.Handle((*f).Fd()) != windows.InvalidHandle {
+			continue
+		}
+		if conout == nil {
+			conout, err = os.OpenFile("CONOUT$", os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+		}
+		*f = conout
+	}
+	return nil
+}
+
 func checkForWow64() {
 	b, err := func() (bool, error) {
 		var processMachine, nativeMachine uint16
@@ -277,7 +314,7 @@ func main() {
 		}
 		return
 	case "/ui":
-		if len(os.Args) != 6 {
+		if len(os.Args) != 5 {
 			usage()
 		}
 		err := elevate.DropAllPrivileges(false)
@@ -292,30 +329,83 @@ func main() {
 		if err != nil {
 			fatal(err)
 		}
-		eventPipe, err := pipeFromHandleArgument(os.Args[4])
+		ringlogger.Global, err = ringlogger.NewRingloggerFromInheritedMappingHandle(os.Args[4], "GUI")
 		if err != nil {
 			fatal(err)
 		}
-		ringlogger.Global, err = ringlogger.NewRingloggerFromInheritedMappingHandle(os.Args[5], "GUI")
+		err = manager.InitializeIPCClient(readPipe, writePipe)
 		if err != nil {
 			fatal(err)
 		}
-		manager.InitializeIPCClient(readPipe, writePipe, eventPipe)
 		ui.RunUI()
 		return
 	case "/dumplog":
-		if len(os.Args) != 3 {
+		args := os.Args[2:]
+		var redactor *redact.Redactor
+		if len(args) > 0 && args[0] == "/redact" {
+			args = args[1:]
+			names, _ := conf.ListConfigNames()
+			redactor = redact.NewDefaultRedactor(names)
+		}
+		if len(args) != 1 && (len(args) != 2 || redactor == nil) {
 			usage()
 		}
-		file, err := os.Create(os.Args[2])
+		file, err := os.Create(args[0])
 		if err != nil {
 			fatal(err)
 		}
 		defer file.Close()
-		err = ringlogger.DumpTo(file, true)
+		err = ringlogger.DumpTo(file, true, redactor)
+		if err != nil {
+			fatal(err)
+		}
+		if len(args) == 2 {
+			mappingFile, err := os.OpenFile(args[1], os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				fatal(err)
+			}
+			defer mappingFile.Close()
+			_, err = redactor.WriteMappingTo(mappingFile)
+			if err != nil {
+				fatal(err)
+			}
+		}
+		return
+	case "/diagnostics":
+		if len(os.Args) != 3 && len(os.Args) != 4 {
+			usage()
+		}
+		// Only the manager knows the update state and the tunnel states it tracks, so it makes the
+		// bundle when it is running, and otherwise one is made here without them.
+		var bundle, mapping []byte
+		err := manager.ConnectIPCClient(manager.NamedPipeDialer(manager.ManagerPipePath))
+		if err == nil {
+			bundle, mapping, err = manager.IPCClientDiagnostics()
+			manager.DisconnectIPCClient()
+		}
+		if err != nil {
+			var bundleBuffer, mappingBuffer bytes.Buffer
+			redactor := redact.NewDefaultRedactor(nil)
+			err = manager.WriteDiagnostics(&bundleBuffer, redactor)
+			if err != nil {
+				fatal(err)
+			}
+			_, err = redactor.WriteMappingTo(&mappingBuffer)
+			if err != nil {
+				fatal(err)
+			}
+			bundle, mapping = bundleBuffer.Bytes(), mappingBuffer.Bytes()
+		}
+		err = ioutil.WriteFile(os.Args[2], bundle, 0666)
 		if err != nil {
 			fatal(err)
 		}
+		if len(os.Args) == 4 {
+			err = ioutil.WriteFile(os.Args[3], mapping, 0600)
+			if err != nil {
+				fatal(err)
+			}
+		}
 		return
 	case "/update":
 		if len(os.Args) != 2 && len(os.Args) != 3 {
@@ -340,7 +430,11 @@ func main() {
 					if progress.BytesTotal > 0 {
 						percent = float64(progress.BytesDownloaded) / float64(progress.BytesTotal) * 100.0
 					}
-					l.Printf("%s: %d/%d (%.2f%%)\n", progress.Activity, progress.BytesDownloaded, progress.BytesTotal, percent)
+					if progress.BytesPerSecond > 0 {
+						l.Printf("%s: %d/%d (%.2f%%, %d B/s, %v remaining, %d retries)\n", progress.Activity, progress.BytesDownloaded, progress.BytesTotal, percent, progress.BytesPerSecond, progress.ETA.Round(time.Second), progress.Retries)
+					} else {
+						l.Printf("%s: %d/%d (%.2f%%)\n", progress.Activity, progress.BytesDownloaded, progress.BytesTotal, percent)
+					}
 				} else {
 					l.Println(progress.Activity)
 				}
@@ -353,6 +447,13 @@ func main() {
 			}
 		}
 		return
+	case "/cli":
+		// A parent without a console, or that has gone, leaves only the handles it redirected.
+		err := attachParentConsole()
+		if err != nil && err != windows.ERROR_INVALID_HANDLE && err != windows.ERROR_INVALID_PARAMETER {
+			fatal(err)
+		}
+		os.Exit(cli.Run(os.Args[2:], manager.NamedPipeDialer(manager.ManagerPipePath), os.Stdout, os.Stderr))
 	case "/removealladapters":
 		if len(os.Args) != 2 && len(os.Args) != 3 {
 			usage()
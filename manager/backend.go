@@ -0,0 +1,41 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+// TunnelBackend carries out what clients ask of the manager. The manager service runs each tunnel
+// as its own Windows service, but anything else, such as a fake for testing, may take its place.
+type TunnelBackend interface {
+	StoredConfig(tunnelName string) (*conf.Config, error)
+	RuntimeConfig(tunnelName string) (*conf.Config, error)
+	StoredMetadata(tunnelName string) (*conf.Metadata, error)
+	SetMetadata(tunnelName string, metadata *conf.Metadata) error
+	Conflicts(tunnelName string) (*ConflictReport, error)
+	Start(tunnelName string) error
+	Stop(tunnelName string) error
+	WaitForStop(tunnelName string) error
+	Delete(tunnelName string) error
+	Rename(tunnelName string, newName string) error
+	State(tunnelName string) (TunnelState, error)
+	Health(tunnelName string) (TunnelHealth, error)
+	GlobalState() TunnelState
+	Create(tunnelConfig *conf.Config) (*Tunnel, error)
+	Tunnels() ([]Tunnel, error)
+	Groups() ([]conf.TunnelGroup, error)
+	SetGroup(group *conf.TunnelGroup) error
+	DeleteGroup(groupName string) error
+	StartGroup(groupName string) error
+	StopGroup(groupName string) error
+	GroupState(groupName string) (TunnelState, error)
+	Quit(stopTunnelsOnQuit bool) error
+	UpdateState() UpdateState
+	UpdateDetails() UpdateDetails
+	Update(peer *Peer)
+	Diagnostics() (bundle []byte, mapping []byte, err error)
+}
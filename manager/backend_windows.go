@@ -0,0 +1,437 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+
+	"golang.zx2c4.com/wireguard/ipc/winpipe"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
+	"golang.zx2c4.com/wireguard/windows/redact"
+	"golang.zx2c4.com/wireguard/windows/services"
+	"golang.zx2c4.com/wireguard/windows/updater"
+)
+
+var quitManagersChan = make(chan struct{}, 1)
+
+// serviceBackend runs each tunnel as its own service, with configurations from the store.
+type serviceBackend struct{}
+
+func (b *serviceBackend) StoredConfig(tunnelName string) (*conf.Config, error) {
+	return conf.LoadFromName(tunnelName)
+}
+
+func (b *serviceBackend) RuntimeConfig(tunnelName string) (*conf.Config, error) {
+	storedConfig, err := conf.LoadFromName(tunnelName)
+	if err != nil {
+		return nil, err
+	}
+	pipePath, err := services.PipePathOfTunnel(storedConfig.Name)
+	if err != nil {
+		return nil, err
+	}
+	localSystem, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+	if err != nil {
+		return nil, err
+	}
+	pipe, err := winpipe.DialPipe(pipePath, nil, localSystem)
+	if err != nil {
+		return nil, err
+	}
+	defer pipe.Close()
+	pipe.SetWriteDeadline(time.Now().Add(time.Second * 2))
+	_, err = pipe.Write([]byte("get=1\n\n"))
+	if err != nil {
+		return nil, err
+	}
+	pipe.SetReadDeadline(time.Now().Add(time.Second * 2))
+	resp, err := ioutil.ReadAll(pipe)
+	if err != nil {
+		return nil, err
+	}
+	return conf.FromUAPI(string(resp), storedConfig)
+}
+
+func (b *serviceBackend) StoredMetadata(tunnelName string) (*conf.Metadata, error) {
+	return conf.LoadMetadataFromName(tunnelName)
+}
+
+func (b *serviceBackend) SetMetadata(tunnelName string, metadata *conf.Metadata) error {
+	err := metadata.Save(tunnelName)
+	if err != nil {
+		return err
+	}
+	triggerOnDemand()
+	return nil
+}
+
+// runningConfigs loads the configurations of the tracked tunnels that are starting or started,
+// other than those excluded.
+func runningConfigs(exclude ...string) []*conf.Config {
+	trackedTunnelsLock.Lock()
+	names := make([]string, 0, len(trackedTunnels))
+nextTunnel:
+	for t, state := range trackedTunnels {
+		if state != TunnelStarted && state != TunnelStarting && state != TunnelUnknown {
+			continue
+		}
+		for _, e := range exclude {
+			if strings.EqualFold(t, e) {
+				continue nextTunnel
+			}
+		}
+		names = append(names, t)
+	}
+	trackedTunnelsLock.Unlock()
+	configs := make([]*conf.Config, 0, len(names))
+	for _, t := range names {
+		c, err := conf.LoadFromName(t)
+		if err != nil {
+			log.Printf("[%s] Unable to load configuration to check for conflicts: %v", t, err)
+			continue
+		}
+		configs = append(configs, c)
+	}
+	return configs
+}
+
+// conflicts analyzes tunnelName against the running tunnels, leaving out the rivals that starting
+// it would stop.
+func (b *serviceBackend) conflicts(tunnelName string) (*conf.Config, *ConflictReport, []string, error) {
+	c, err := conf.LoadFromName(tunnelName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	groups, err := conf.LoadGroups()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rivals := exclusiveRivals(tunnelName, groups)
+	return c, AnalyzeConflicts(c, runningConfigs(append(rivals, tunnelName)...)), rivals, nil
+}
+
+func (b *serviceBackend) Conflicts(tunnelName string) (*ConflictReport, error) {
+	_, report, _, err := b.conflicts(tunnelName)
+	return report, err
+}
+
+// startLock serializes starting tunnels, from checking for conflicts until the tunnel is installed
+// and tracked, so that starts from clients, on-demand rules, and the health monitor can't each
+// find nothing running and bring up conflicting tunnels together.
+var startLock sync.Mutex
+
+func (b *serviceBackend) Start(tunnelName string) error {
+	startLock.Lock()
+	defer startLock.Unlock()
+	c, report, rivals, err := b.conflicts(tunnelName)
+	if err != nil {
+		return err
+	}
+	err = report.Err()
+	if err != nil {
+		return err
+	}
+	for i := range report.Conflicts {
+		log.Printf("[%s] Warning: %s", tunnelName, report.Conflicts[i].String())
+	}
+	for _, rival := range rivals {
+		err = b.Stop(rival)
+		if err != nil && rpc.Code(err) != rpc.ErrorNotFound {
+			log.Printf("[%s] Unable to stop tunnel in the same exclusive group: %v", rival, err)
+		}
+	}
+	path, err := c.Path()
+	if err != nil {
+		return err
+	}
+	return InstallTunnel(path)
+}
+
+func (b *serviceBackend) Stop(tunnelName string) error {
+	time.AfterFunc(time.Second*10, cleanupStaleWintunInterfaces)
+
+	err := UninstallTunnel(tunnelName)
+	if err == windows.ERROR_SERVICE_DOES_NOT_EXIST {
+		_, notExistsError := conf.LoadFromName(tunnelName)
+		if notExistsError == nil {
+			return nil
+		}
+		return rpc.NewError(rpc.ErrorNotFound, err)
+	}
+	return err
+}
+
+func (b *serviceBackend) WaitForStop(tunnelName string) error {
+	serviceName, err := services.ServiceNameOfTunnel(tunnelName)
+	if err != nil {
+		return err
+	}
+	m, err := serviceManager()
+	if err != nil {
+		return err
+	}
+	for {
+		service, err := m.OpenService(serviceName)
+		if err == nil || err == windows.ERROR_SERVICE_MARKED_FOR_DELETE {
+			service.Close()
+			time.Sleep(time.Second / 3)
+		} else {
+			return nil
+		}
+	}
+}
+
+func (b *serviceBackend) Delete(tunnelName string) error {
+	err := b.Stop(tunnelName)
+	if err != nil {
+		return err
+	}
+	err = conf.DeleteName(tunnelName)
+	if err != nil {
+		return err
+	}
+	return conf.RemoveFromGroups(tunnelName)
+}
+
+// Rename stops the tunnel if it is running, since its service, pipe and interface are all named
+// after it, renames its configuration, and starts it again under the new name.
+func (b *serviceBackend) Rename(tunnelName string, newName string) error {
+	if _, err := conf.LoadFromName(tunnelName); err != nil {
+		return err
+	}
+	state, err := b.State(tunnelName)
+	if err != nil {
+		return err
+	}
+	wasRunning := state == TunnelStarting || state == TunnelStarted
+	if wasRunning {
+		err = b.Stop(tunnelName)
+		if err != nil {
+			return err
+		}
+		err = b.WaitForStop(tunnelName)
+		if err != nil {
+			return err
+		}
+	}
+	err = conf.RenameName(tunnelName, newName)
+	if err != nil {
+		if wasRunning {
+			b.Start(tunnelName)
+		}
+		return err
+	}
+	err = conf.RenameInGroups(tunnelName, newName)
+	if err != nil {
+		log.Printf("[%s] Unable to rename tunnel in its groups: %v", newName, err)
+	}
+	renameFailoverTargets(b, tunnelName, newName)
+	IPCServerNotifyTunnelRename(tunnelName, newName)
+	if wasRunning {
+		err = b.Start(newName)
+		if err != nil {
+			return fmt.Errorf("Renamed tunnel, but unable to start it again: %w", err)
+		}
+	}
+	return nil
+}
+
+// Health returns what the health monitor last made of a running tunnel, or HealthUnknown if the
+// tunnel isn't running or hasn't been checked yet.
+func (b *serviceBackend) Health(tunnelName string) (TunnelHealth, error) {
+	if _, err := conf.LoadFromName(tunnelName); err != nil {
+		return HealthUnknown, err
+	}
+	return tunnelHealth(tunnelName), nil
+}
+
+func (b *serviceBackend) State(tunnelName string) (TunnelState, error) {
+	serviceName, err := services.ServiceNameOfTunnel(tunnelName)
+	if err != nil {
+		return 0, err
+	}
+	m, err := serviceManager()
+	if err != nil {
+		return 0, err
+	}
+	service, err := m.OpenService(serviceName)
+	if err != nil {
+		return TunnelStopped, nil
+	}
+	defer service.Close()
+	status, err := service.Query()
+	if err != nil {
+		return TunnelUnknown, nil
+	}
+	switch status.State {
+	case svc.Stopped:
+		return TunnelStopped, nil
+	case svc.StopPending:
+		return TunnelStopping, nil
+	case svc.Running:
+		return TunnelStarted, nil
+	case svc.StartPending:
+		return TunnelStarting, nil
+	default:
+		return TunnelUnknown, nil
+	}
+}
+
+func (b *serviceBackend) GlobalState() TunnelState {
+	return trackedTunnelsGlobalState()
+}
+
+func (b *serviceBackend) Create(tunnelConfig *conf.Config) (*Tunnel, error) {
+	err := tunnelConfig.Save()
+	if err != nil {
+		return nil, err
+	}
+	return &Tunnel{tunnelConfig.Name}, nil
+	// TODO: handle already existing situation
+	// TODO: handle already running and existing situation
+}
+
+func (b *serviceBackend) Tunnels() ([]Tunnel, error) {
+	names, err := conf.ListConfigNames()
+	if err != nil {
+		return nil, err
+	}
+	tunnels := make([]Tunnel, len(names))
+	for i := 0; i < len(tunnels); i++ {
+		(tunnels)[i].Name = names[i]
+	}
+	return tunnels, nil
+	// TODO: account for running ones that aren't in the configuration store somehow
+}
+
+func (b *serviceBackend) Groups() ([]conf.TunnelGroup, error) {
+	return conf.LoadGroups()
+}
+
+func (b *serviceBackend) SetGroup(group *conf.TunnelGroup) error {
+	names, err := conf.ListConfigNames()
+	if err != nil {
+		return err
+	}
+	err = checkGroupMembers(group, names)
+	if err != nil {
+		return err
+	}
+	err = conf.SaveGroup(group)
+	if err != nil {
+		return err
+	}
+	IPCServerNotifyGroupChange(group.Name, trackedTunnelsGroupState(group))
+	return nil
+}
+
+func (b *serviceBackend) DeleteGroup(groupName string) error {
+	return conf.DeleteGroup(groupName)
+}
+
+func (b *serviceBackend) StartGroup(groupName string) error {
+	groups, err := conf.LoadGroups()
+	if err != nil {
+		return err
+	}
+	return startGroup(b, groups, groupName)
+}
+
+func (b *serviceBackend) StopGroup(groupName string) error {
+	groups, err := conf.LoadGroups()
+	if err != nil {
+		return err
+	}
+	return stopGroup(b, groups, groupName)
+}
+
+func (b *serviceBackend) GroupState(groupName string) (TunnelState, error) {
+	groups, err := conf.LoadGroups()
+	if err != nil {
+		return TunnelUnknown, err
+	}
+	group, err := findGroup(groups, groupName)
+	if err != nil {
+		return TunnelUnknown, err
+	}
+	return trackedTunnelsGroupState(group), nil
+}
+
+func (b *serviceBackend) Quit(stopTunnelsOnQuit bool) error {
+	if stopTunnelsOnQuit {
+		names, err := conf.ListConfigNames()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			UninstallTunnel(name)
+		}
+	}
+
+	quitManagersChan <- struct{}{}
+	return nil
+}
+
+func (b *serviceBackend) UpdateState() UpdateState {
+	return currentUpdateState()
+}
+
+func (b *serviceBackend) UpdateDetails() UpdateDetails {
+	return currentUpdateDetails()
+}
+
+// Update installs the update with a copy of the peer's token, because the peer's own is closed
+// along with its connection, which may well be before the update is done with it. The copy is
+// closed once the updater has reported the final result, after which it no longer uses it.
+func (b *serviceBackend) Update(peer *Peer) {
+	var token windows.Token
+	if peer.Token != 0 {
+		err := windows.DuplicateTokenEx(windows.Token(peer.Token), 0, nil, windows.SecurityImpersonation, windows.TokenPrimary, &token)
+		if err != nil {
+			IPCServerNotifyUpdateProgress(updater.DownloadProgress{Error: err})
+			return
+		}
+	}
+	progress := updater.DownloadVerifyAndExecute(uintptr(token))
+	go func() {
+		for {
+			dp := <-progress
+			IPCServerNotifyUpdateProgress(dp)
+			if dp.Complete || dp.Error != nil {
+				if token != 0 {
+					token.Close()
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (b *serviceBackend) Diagnostics() (bundle []byte, mapping []byte, err error) {
+	redactor := redact.NewDefaultRedactor(nil)
+	var buf bytes.Buffer
+	err = writeDiagnostics(&buf, redactor, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	var mappingBuf bytes.Buffer
+	_, err = redactor.WriteMappingTo(&mappingBuf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), mappingBuf.Bytes(), nil
+}
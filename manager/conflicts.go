@@ -0,0 +1,251 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/l18n"
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
+)
+
+// ConflictSeverity says whether a conflict stops a tunnel from starting, or is merely worth
+// knowing about.
+type ConflictSeverity uint32
+
+const (
+	ConflictWarning ConflictSeverity = iota
+	ConflictError
+)
+
+func (s ConflictSeverity) String() string {
+	if s == ConflictError {
+		return "error"
+	}
+	return "warning"
+}
+
+// ConflictKind values are sent on the wire by name, so they must never be renamed.
+type ConflictKind string
+
+const (
+	ConflictDefaultRoute     ConflictKind = "DefaultRoute"
+	ConflictBlocksUntunneled ConflictKind = "BlocksUntunneled"
+	ConflictAllowedIPs       ConflictKind = "AllowedIPs"
+	ConflictAddress          ConflictKind = "Address"
+	ConflictAddressInRoute   ConflictKind = "AddressInRoute"
+	ConflictDNS              ConflictKind = "DNS"
+	ConflictListenPort       ConflictKind = "ListenPort"
+)
+
+// Conflict is one way in which a tunnel clashes with another one that is already running. Ours and
+// Theirs are the clashing values from each tunnel's configuration.
+type Conflict struct {
+	Severity ConflictSeverity
+	Kind     ConflictKind
+	Tunnel   string
+	Ours     string
+	Theirs   string
+}
+
+func (c *Conflict) String() string {
+	switch c.Kind {
+	case ConflictDefaultRoute:
+		return l18n.Sprintf("Both this tunnel and ‘%s’ route all traffic through %s", c.Tunnel, c.Ours)
+	case ConflictBlocksUntunneled:
+		if len(c.Ours) > 0 {
+			return l18n.Sprintf("This tunnel blocks untunneled traffic, which would cut off ‘%s’", c.Tunnel)
+		}
+		return l18n.Sprintf("‘%s’ blocks untunneled traffic, which would cut off this tunnel", c.Tunnel)
+	case ConflictAllowedIPs:
+		if c.Ours == c.Theirs {
+			return l18n.Sprintf("Both this tunnel and ‘%s’ route %s", c.Tunnel, c.Ours)
+		}
+		return l18n.Sprintf("Allowed IPs %s overlap with %s of ‘%s’", c.Ours, c.Theirs, c.Tunnel)
+	case ConflictAddress:
+		if c.Ours == c.Theirs {
+			return l18n.Sprintf("Address %s is already used by ‘%s’", c.Ours, c.Tunnel)
+		}
+		return l18n.Sprintf("Address %s is on the same network as %s of ‘%s’", c.Ours, c.Theirs, c.Tunnel)
+	case ConflictAddressInRoute:
+		return l18n.Sprintf("Address %s is routed through ‘%s’ by its allowed IPs %s", c.Ours, c.Tunnel, c.Theirs)
+	case ConflictDNS:
+		return l18n.Sprintf("DNS servers %s would be blocked by ‘%s’, which only allows %s", c.Ours, c.Tunnel, c.Theirs)
+	case ConflictListenPort:
+		return l18n.Sprintf("Listen port %s is already used by ‘%s’", c.Ours, c.Tunnel)
+	}
+	return l18n.Sprintf("Conflicts with ‘%s’", c.Tunnel)
+}
+
+// ConflictReport lists how a tunnel clashes with those already running.
+type ConflictReport struct {
+	Tunnel    string
+	Conflicts []Conflict
+}
+
+func (r *ConflictReport) HasErrors() bool {
+	for i := range r.Conflicts {
+		if r.Conflicts[i].Severity == ConflictError {
+			return true
+		}
+	}
+	return false
+}
+
+// Err returns an error listing the conflicts that stop the tunnel from starting, or nil if there
+// are none.
+func (r *ConflictReport) Err() error {
+	var reasons []string
+	for i := range r.Conflicts {
+		if r.Conflicts[i].Severity == ConflictError {
+			reasons = append(reasons, r.Conflicts[i].String())
+		}
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	return &rpc.Error{
+		Code:    rpc.ErrorConflict,
+		Message: l18n.Sprintf("Unable to start tunnel ‘%s’ alongside running tunnels:\n%s", r.Tunnel, strings.Join(reasons, "\n")),
+	}
+}
+
+func isDefaultRoute(cidr *conf.IPCidr) bool {
+	return cidr.Cidr == 0 && cidr.IP.IsUnspecified()
+}
+
+// blocksUntunneledTraffic mirrors the tunnel service's decision to install its firewall rules that
+// block everything but its own interface.
+func blocksUntunneledTraffic(config *conf.Config) bool {
+	if len(config.Peers) != 1 {
+		return false
+	}
+	for i := range config.Peers[0].AllowedIPs {
+		if isDefaultRoute(&config.Peers[0].AllowedIPs[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedIPsOf(config *conf.Config) []conf.IPCidr {
+	var cidrs []conf.IPCidr
+	for i := range config.Peers {
+		cidrs = append(cidrs, config.Peers[i].AllowedIPs...)
+	}
+	return cidrs
+}
+
+func networkOf(cidr *conf.IPCidr) net.IPNet {
+	ipNet := cidr.IPNet()
+	ipNet.IP = ipNet.IP.Mask(ipNet.Mask)
+	return ipNet
+}
+
+func overlaps(a, b *conf.IPCidr) bool {
+	if a.Bits() != b.Bits() {
+		return false
+	}
+	netA, netB := networkOf(a), networkOf(b)
+	return netA.Contains(netB.IP) || netB.Contains(netA.IP)
+}
+
+func dnsString(servers []net.IP) string {
+	strs := make([]string, len(servers))
+	for i := range servers {
+		strs[i] = servers[i].String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+func sameDNS(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// AnalyzeConflicts compares config against the configurations of the tunnels that are already
+// running. Conflicts of ConflictError severity would break one tunnel or the other, for example
+// because both claim the default route, while warnings are for overlaps that Windows resolves by
+// preferring the more specific route.
+func AnalyzeConflicts(config *conf.Config, running []*conf.Config) *ConflictReport {
+	report := &ConflictReport{Tunnel: config.Name}
+	add := func(severity ConflictSeverity, kind ConflictKind, other *conf.Config, ours string, theirs string) {
+		report.Conflicts = append(report.Conflicts, Conflict{severity, kind, other.Name, ours, theirs})
+	}
+	ourRoutes := allowedIPsOf(config)
+	for _, other := range running {
+		if other.Name == config.Name {
+			continue
+		}
+
+		if blocksUntunneledTraffic(config) {
+			add(ConflictError, ConflictBlocksUntunneled, other, config.Name, "")
+		} else if blocksUntunneledTraffic(other) {
+			add(ConflictError, ConflictBlocksUntunneled, other, "", other.Name)
+		}
+
+		theirRoutes := allowedIPsOf(other)
+		for i := range ourRoutes {
+			for j := range theirRoutes {
+				ours, theirs := &ourRoutes[i], &theirRoutes[j]
+				if !overlaps(ours, theirs) {
+					continue
+				}
+				// Every route overlaps a default route, and is meant to win over it.
+				if isDefaultRoute(ours) != isDefaultRoute(theirs) {
+					continue
+				}
+				if isDefaultRoute(ours) {
+					add(ConflictError, ConflictDefaultRoute, other, ours.String(), theirs.String())
+				} else if ours.Cidr == theirs.Cidr {
+					add(ConflictError, ConflictAllowedIPs, other, ours.String(), theirs.String())
+				} else {
+					add(ConflictWarning, ConflictAllowedIPs, other, ours.String(), theirs.String())
+				}
+			}
+		}
+
+		for i := range config.Interface.Addresses {
+			ours := &config.Interface.Addresses[i]
+			for j := range other.Interface.Addresses {
+				theirs := &other.Interface.Addresses[j]
+				if ours.IP.Equal(theirs.IP) {
+					add(ConflictError, ConflictAddress, other, ours.IP.String(), theirs.IP.String())
+				} else if overlaps(ours, theirs) {
+					add(ConflictWarning, ConflictAddress, other, ours.String(), theirs.String())
+				}
+			}
+			for j := range theirRoutes {
+				theirs := &theirRoutes[j]
+				route := theirs.IPNet()
+				if theirs.Cidr > 0 && ours.Bits() == theirs.Bits() && route.Contains(ours.IP) {
+					add(ConflictWarning, ConflictAddressInRoute, other, ours.IP.String(), theirs.String())
+				}
+			}
+		}
+
+		// Each tunnel with DNS servers has the firewall block DNS to any others.
+		if len(config.Interface.DNS) > 0 && len(other.Interface.DNS) > 0 && !sameDNS(config.Interface.DNS, other.Interface.DNS) {
+			add(ConflictError, ConflictDNS, other, dnsString(config.Interface.DNS), dnsString(other.Interface.DNS))
+		}
+
+		if config.Interface.ListenPort != 0 && config.Interface.ListenPort == other.Interface.ListenPort {
+			port := strconv.Itoa(int(config.Interface.ListenPort))
+			add(ConflictError, ConflictListenPort, other, port, port)
+		}
+	}
+	return report
+}
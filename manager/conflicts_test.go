@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+func conflictTestConfig(t *testing.T, name string, iface string, peers ...string) *conf.Config {
+	s := "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n" + iface
+	for i, allowedIPs := range peers {
+		s += fmt.Sprintf("\n[Peer]\nPublicKey = %s\nAllowedIPs = %s\n", []string{
+			"xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+			"TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=",
+		}[i], allowedIPs)
+	}
+	config, err := conf.FromWgQuick(s, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestAnalyzeConflicts(t *testing.T) {
+	corporate := conflictTestConfig(t, "corporate", "Address = 10.10.0.2/16\nDNS = 10.10.0.1\nListenPort = 51820\n", "10.10.0.0/16, 172.16.0.0/12")
+	fullTunnel := conflictTestConfig(t, "full", "Address = 192.168.50.2/24\n", "0.0.0.0/0")
+	multiPeerDefault := conflictTestConfig(t, "exit", "Address = 192.168.60.2/24\n", "0.0.0.0/0", "192.168.60.0/24")
+
+	type want struct {
+		severity ConflictSeverity
+		kind     ConflictKind
+		tunnel   string
+	}
+	for _, test := range []struct {
+		name    string
+		config  *conf.Config
+		running []*conf.Config
+		want    []want
+	}{
+		{
+			"lab beside split tunnel",
+			conflictTestConfig(t, "lab", "Address = 10.99.0.2/24\n", "10.99.0.0/24"),
+			[]*conf.Config{corporate},
+			nil,
+		},
+		{
+			"same tunnel is ignored",
+			corporate,
+			[]*conf.Config{corporate},
+			nil,
+		},
+		{
+			"more specific route",
+			conflictTestConfig(t, "lab", "Address = 10.99.0.2/24\n", "10.10.5.0/24"),
+			[]*conf.Config{corporate},
+			[]want{{ConflictWarning, ConflictAllowedIPs, "corporate"}},
+		},
+		{
+			"identical route and address",
+			conflictTestConfig(t, "copy", "Address = 10.10.0.2/32\n", "172.16.0.0/12"),
+			[]*conf.Config{corporate},
+			[]want{
+				{ConflictError, ConflictAllowedIPs, "corporate"},
+				{ConflictError, ConflictAddress, "corporate"},
+				{ConflictWarning, ConflictAddressInRoute, "corporate"},
+			},
+		},
+		{
+			"two default routes",
+			conflictTestConfig(t, "exit2", "Address = 192.168.70.2/24\n", "0.0.0.0/0", "192.168.70.0/24"),
+			[]*conf.Config{multiPeerDefault},
+			[]want{{ConflictError, ConflictDefaultRoute, "exit"}},
+		},
+		{
+			"kill switch cuts off others",
+			conflictTestConfig(t, "lab", "Address = 10.99.0.2/24\n", "10.99.0.0/24"),
+			[]*conf.Config{fullTunnel},
+			[]want{
+				{ConflictError, ConflictBlocksUntunneled, "full"},
+			},
+		},
+		{
+			"different DNS servers and same port",
+			conflictTestConfig(t, "lab", "Address = 10.99.0.2/24\nDNS = 1.1.1.1\nListenPort = 51820\n", "10.99.0.0/24"),
+			[]*conf.Config{corporate},
+			[]want{
+				{ConflictError, ConflictDNS, "corporate"},
+				{ConflictError, ConflictListenPort, "corporate"},
+			},
+		},
+		{
+			"same DNS servers",
+			conflictTestConfig(t, "lab", "Address = 10.99.0.2/24\nDNS = 10.10.0.1\n", "10.99.0.0/24"),
+			[]*conf.Config{corporate},
+			nil,
+		},
+	} {
+		report := AnalyzeConflicts(test.config, test.running)
+		if len(report.Conflicts) != len(test.want) {
+			t.Errorf("%s: got conflicts %+v, want %+v", test.name, report.Conflicts, test.want)
+			continue
+		}
+		wantErrors := false
+		for i, w := range test.want {
+			c := report.Conflicts[i]
+			if c.Severity != w.severity || c.Kind != w.kind || c.Tunnel != w.tunnel {
+				t.Errorf("%s: conflict %d is %+v, want %+v", test.name, i, c, w)
+			}
+			wantErrors = wantErrors || w.severity == ConflictError
+		}
+		if report.HasErrors() != wantErrors || (report.Err() != nil) != wantErrors {
+			t.Errorf("%s: HasErrors is %v, want %v", test.name, report.HasErrors(), wantErrors)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/redact"
+	"golang.zx2c4.com/wireguard/windows/ringlogger"
+	"golang.zx2c4.com/wireguard/windows/services"
+	"golang.zx2c4.com/wireguard/windows/version"
+)
+
+const diagnosticsFormatVersion = 1
+
+type DiagnosticsManifest struct {
+	FormatVersion int
+	Created       time.Time
+	Version       string
+	UserAgent     string
+
+	// UpdateState, UpdateDetails, and TrackedTunnels are only known to the manager, and so are
+	// left out of bundles written without it.
+	UpdateState    string            `json:",omitempty"`
+	UpdateDetails  *UpdateDetails    `json:",omitempty"`
+	TrackedTunnels map[string]string `json:",omitempty"`
+
+	Services []DiagnosticsService
+	Files    []DiagnosticsFile
+	Errors   []string `json:",omitempty"`
+}
+
+type DiagnosticsService struct {
+	Name                    string
+	Tunnel                  string `json:",omitempty"`
+	State                   string
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	Error                   string `json:",omitempty"`
+}
+
+type DiagnosticsFile struct {
+	Name   string
+	Size   int
+	SHA256 string
+}
+
+type diagnosticsBundle struct {
+	zip      *zip.Writer
+	manifest DiagnosticsManifest
+}
+
+func (b *diagnosticsBundle) add(name string, contents []byte) error {
+	w, err := b.zip.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(contents)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(contents)
+	b.manifest.Files = append(b.manifest.Files, DiagnosticsFile{name, len(contents), hex.EncodeToString(hash[:])})
+	return nil
+}
+
+func (b *diagnosticsBundle) noteError(what string, err error) {
+	b.manifest.Errors = append(b.manifest.Errors, fmt.Sprintf("%s: %v", what, err))
+}
+
+func queryServiceForDiagnostics(serviceName string) (status windows.SERVICE_STATUS, err error) {
+	m, err := serviceManager()
+	if err != nil {
+		return
+	}
+	service, err := m.OpenService(serviceName)
+	if err != nil {
+		return
+	}
+	defer service.Close()
+	err = windows.QueryServiceStatus(service.Handle, &status)
+	return
+}
+
+func diagnosticsServiceState(state svc.State) string {
+	switch state {
+	case svc.Stopped:
+		return "stopped"
+	case svc.StartPending:
+		return "starting"
+	case svc.StopPending:
+		return "stopping"
+	case svc.Running:
+		return "running"
+	default:
+		return "unknown"
+	}
+}
+
+func diagnosticsServiceEntry(serviceName string, tunnelToken string) DiagnosticsService {
+	entry := DiagnosticsService{Name: serviceName, Tunnel: tunnelToken}
+	status, err := queryServiceForDiagnostics(serviceName)
+	if err != nil {
+		entry.State = "not installed"
+		return entry
+	}
+	entry.State = diagnosticsServiceState(svc.State(status.CurrentState))
+	if svc.State(status.CurrentState) != svc.Stopped {
+		return entry
+	}
+	entry.Win32ExitCode = status.Win32ExitCode
+	entry.ServiceSpecificExitCode = status.ServiceSpecificExitCode
+	if status.Win32ExitCode == uint32(windows.ERROR_SERVICE_SPECIFIC_ERROR) {
+		entry.Error = services.Error(status.ServiceSpecificExitCode).Error()
+	} else if status.Win32ExitCode != uint32(windows.NO_ERROR) && status.Win32ExitCode != uint32(windows.ERROR_SERVICE_NEVER_STARTED) {
+		entry.Error = windows.Errno(status.Win32ExitCode).Error()
+	}
+	return entry
+}
+
+// redactedConfig renders a configuration with private and preshared keys removed entirely,
+// and everything else passed through the redactor. Runtime statistics are kept as comments.
+func redactedConfig(c *conf.Config, redactor *redact.Redactor, withStats bool) []byte {
+	var output strings.Builder
+	for _, line := range strings.Split(c.ToWgQuick(), "\n") {
+		if strings.HasPrefix(line, "PrivateKey = ") || strings.HasPrefix(line, "PresharedKey = ") {
+			line = "# " + strings.TrimSuffix(line[:strings.IndexByte(line, '=')], " ") + " removed"
+		}
+		output.WriteString(line)
+		output.WriteByte('\n')
+	}
+	if withStats {
+		for _, peer := range c.Peers {
+			output.WriteString(fmt.Sprintf("\n# Peer %s\n", peer.PublicKey.String()))
+			output.WriteString(fmt.Sprintf("# RxBytes = %d\n", peer.RxBytes))
+			output.WriteString(fmt.Sprintf("# TxBytes = %d\n", peer.TxBytes))
+			if !peer.LastHandshakeTime.IsEmpty() {
+				output.WriteString(fmt.Sprintf("# LastHandshakeTime = %s\n", time.Unix(0, 0).Add(time.Duration(peer.LastHandshakeTime)).UTC().Format(time.RFC3339)))
+			}
+		}
+	}
+	return []byte(redactor.RedactString(output.String()))
+}
+
+// WriteDiagnostics writes a zip file to out containing the redacted log, redacted stored and
+// runtime configurations, service states and error codes, and a machine readable manifest.json.
+// The table needed to reverse the redaction is left in redactor, for the caller to save or not.
+// It is for when the manager isn't running; otherwise IPCClientDiagnostics asks the manager for a
+// bundle that also has the update state and the tunnel states that it tracks.
+func WriteDiagnostics(out io.Writer, redactor *redact.Redactor) error {
+	return writeDiagnostics(out, redactor, false)
+}
+
+func writeDiagnostics(out io.Writer, redactor *redact.Redactor, inManager bool) error {
+	b := &diagnosticsBundle{zip: zip.NewWriter(out)}
+	b.manifest.FormatVersion = diagnosticsFormatVersion
+	b.manifest.Created = time.Now().UTC()
+	b.manifest.Version = version.Number
+	b.manifest.UserAgent = version.UserAgent()
+
+	names, err := conf.ListConfigNames()
+	if err != nil {
+		b.noteError("List configurations", err)
+	}
+	redactor.AddRule(redact.NewLiteralRule("tunnel", names))
+
+	if inManager {
+		b.manifest.UpdateState = currentUpdateState().String()
+		updateDetails := currentUpdateDetails()
+		updateDetails.Mirror = redactor.RedactLine(updateDetails.Mirror)
+		updateDetails.LastError = redactor.RedactLine(updateDetails.LastError)
+		b.manifest.UpdateDetails = &updateDetails
+
+		trackedTunnelsLock.Lock()
+		b.manifest.TrackedTunnels = make(map[string]string, len(trackedTunnels))
+		for name, state := range trackedTunnels {
+			b.manifest.TrackedTunnels[redactor.Token("tunnel", name)] = state.String()
+		}
+		trackedTunnelsLock.Unlock()
+	}
+
+	var log bytes.Buffer
+	if ringlogger.Global != nil {
+		_, err = ringlogger.Global.WriteToRedacted(&log, redactor)
+	} else {
+		err = ringlogger.DumpTo(&log, true, redactor)
+	}
+	if err != nil {
+		b.noteError("Dump log", err)
+	}
+	err = b.add("log.txt", log.Bytes())
+	if err != nil {
+		return err
+	}
+
+	b.manifest.Services = append(b.manifest.Services, diagnosticsServiceEntry("WireGuardManager", ""))
+	for _, name := range names {
+		token := redactor.Token("tunnel", name)
+		fileName := "configs/" + strings.Trim(token, "<>")
+		serviceName, err := services.ServiceNameOfTunnel(name)
+		if err == nil {
+			entry := diagnosticsServiceEntry(serviceName, token)
+			entry.Name = strings.Replace(entry.Name, name, token, 1)
+			b.manifest.Services = append(b.manifest.Services, entry)
+		}
+
+		storedConfig, err := conf.LoadFromName(name)
+		if err != nil {
+			b.noteError("Load configuration "+token, err)
+			continue
+		}
+		err = b.add(fileName+".conf", redactedConfig(storedConfig, redactor, false))
+		if err != nil {
+			return err
+		}
+		runtimeConfig, err := (&serviceBackend{}).RuntimeConfig(name)
+		if err != nil {
+			continue
+		}
+		err = b.add(fileName+".runtime.conf", redactedConfig(runtimeConfig, redactor, true))
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest, err := json.MarshalIndent(&b.manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	w, err := b.zip.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(manifest)
+	if err != nil {
+		return err
+	}
+	return b.zip.Close()
+}
@@ -0,0 +1,168 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
+)
+
+// bundleMemberTimeout is how long each member of a bundle may take to start before the bundle is
+// torn down again.
+var bundleMemberTimeout = time.Second * 30
+
+func findGroup(groups []conf.TunnelGroup, groupName string) (*conf.TunnelGroup, error) {
+	for i := range groups {
+		if strings.EqualFold(groups[i].Name, groupName) {
+			return &groups[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Group ‘%s’: %w", groupName, os.ErrNotExist)
+}
+
+// checkGroupMembers makes sure that group is valid and that each of its members is one of tunnels.
+func checkGroupMembers(group *conf.TunnelGroup, tunnels []string) error {
+	err := group.Validate()
+	if err != nil {
+		return err
+	}
+nextMember:
+	for _, member := range group.Members {
+		for _, t := range tunnels {
+			if strings.EqualFold(t, member) {
+				continue nextMember
+			}
+		}
+		return fmt.Errorf("Tunnel ‘%s’: %w", member, os.ErrNotExist)
+	}
+	return nil
+}
+
+// exclusiveRivals returns the tunnels that share an exclusive group with tunnelName, and so must be
+// stopped before it starts.
+func exclusiveRivals(tunnelName string, groups []conf.TunnelGroup) []string {
+	var rivals []string
+	seen := make(map[string]bool)
+	for i := range groups {
+		if groups[i].Kind != conf.GroupExclusive || !groups[i].HasMember(tunnelName) {
+			continue
+		}
+		for _, member := range groups[i].Members {
+			if !strings.EqualFold(member, tunnelName) && !seen[member] {
+				seen[member] = true
+				rivals = append(rivals, member)
+			}
+		}
+	}
+	return rivals
+}
+
+// aggregateTunnelState sums up several tunnels: any transition is reported as such, and otherwise
+// the group is started if any of them is.
+func aggregateTunnelState(states []TunnelState) TunnelState {
+	state := TunnelStopped
+	for _, s := range states {
+		if s == TunnelStarting {
+			return TunnelStarting
+		} else if s == TunnelStopping {
+			return TunnelStopping
+		} else if s == TunnelStarted || s == TunnelUnknown {
+			state = TunnelStarted
+		}
+	}
+	return state
+}
+
+// waitForTunnelStarted polls until the tunnel is started, failing if it stops again after having
+// begun to start.
+func waitForTunnelStarted(backend TunnelBackend, tunnelName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	begun := false
+	for {
+		state, err := backend.State(tunnelName)
+		if err != nil {
+			return err
+		}
+		switch state {
+		case TunnelStarted:
+			return nil
+		case TunnelStopped:
+			if begun {
+				return fmt.Errorf("Tunnel ‘%s’ stopped while starting", tunnelName)
+			}
+		default:
+			begun = true
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for tunnel ‘%s’ to start", tunnelName)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// startBundle starts the members of a bundle one after another, each once the previous one is up.
+// Members that are already starting or started are left as they are. If any fails, the members
+// that this started are stopped again, in reverse order, and the others are left running.
+func startBundle(backend TunnelBackend, group *conf.TunnelGroup) error {
+	var started []string
+	for _, member := range group.Members {
+		state, err := backend.State(member)
+		if err == nil && state != TunnelStarting && state != TunnelStarted {
+			err = backend.Start(member)
+			if err == nil {
+				started = append(started, member)
+			}
+		}
+		if err == nil {
+			err = waitForTunnelStarted(backend, member, bundleMemberTimeout)
+		}
+		if err != nil {
+			for i := len(started) - 1; i >= 0; i-- {
+				backend.Stop(started[i])
+			}
+			return fmt.Errorf("Unable to start group ‘%s’: %w", group.Name, err)
+		}
+	}
+	return nil
+}
+
+// stopGroupMembers stops every member of a group, in reverse order, returning the first failure.
+func stopGroupMembers(backend TunnelBackend, group *conf.TunnelGroup) error {
+	var firstErr error
+	for i := len(group.Members) - 1; i >= 0; i-- {
+		err := backend.Stop(group.Members[i])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// startGroup starts a bundle. Exclusive groups have no meaning as a whole, so are started through
+// one of their members instead.
+func startGroup(backend TunnelBackend, groups []conf.TunnelGroup, groupName string) error {
+	group, err := findGroup(groups, groupName)
+	if err != nil {
+		return err
+	}
+	if group.Kind != conf.GroupBundle {
+		return &rpc.Error{Code: rpc.ErrorInvalidRequest, Message: fmt.Sprintf("Group ‘%s’ is exclusive, so one of its tunnels must be started instead", group.Name)}
+	}
+	return startBundle(backend, group)
+}
+
+func stopGroup(backend TunnelBackend, groups []conf.TunnelGroup, groupName string) error {
+	group, err := findGroup(groups, groupName)
+	if err != nil {
+		return err
+	}
+	return stopGroupMembers(backend, group)
+}
@@ -0,0 +1,267 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+// TunnelHealth values are sent on the wire, so they must never be renumbered.
+type TunnelHealth int
+
+const (
+	HealthUnknown TunnelHealth = iota
+	HealthHealthy
+	HealthDegraded
+	HealthDead
+)
+
+func (h TunnelHealth) String() string {
+	switch h {
+	case HealthHealthy:
+		return "healthy"
+	case HealthDegraded:
+		return "degraded"
+	case HealthDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// healthCheckInterval is how often running tunnels' statistics are sampled.
+var healthCheckInterval = time.Second * 30
+
+// handshakeAge is how long ago the peer's last handshake was, or how long ago the tunnel was
+// started, whichever is more recent, so that a tunnel is not judged by its previous run.
+func handshakeAge(peer *conf.Peer, started time.Time, now time.Time) time.Duration {
+	if !peer.LastHandshakeTime.IsEmpty() {
+		if handshake := time.Unix(0, 0).Add(time.Duration(peer.LastHandshakeTime)); handshake.After(started) {
+			return now.Sub(handshake)
+		}
+	}
+	return now.Sub(started)
+}
+
+// ClassifyHealth judges a running tunnel from two samples of its runtime configuration, taken
+// some time apart, the first of which may be nil. A peer that has received anything since the
+// previous sample, or that has had a recent handshake, is healthy, as is one to which nothing is
+// being sent, since there is then nothing to judge it by. Otherwise it is degraded or dead,
+// depending on how long ago its last handshake was, or the tunnel started, whichever is more
+// recent. The tunnel is dead if all its peers are, and degraded if any are unhealthy.
+func ClassifyHealth(previous *conf.Config, current *conf.Config, policy *conf.HealthPolicy, started time.Time, now time.Time) (TunnelHealth, string) {
+	degradedAfter, deadAfter := policy.Thresholds()
+	dead, degraded := 0, 0
+	var reasons []string
+	for i := range current.Peers {
+		peer := &current.Peers[i]
+		var before *conf.Peer
+		if previous != nil {
+			for j := range previous.Peers {
+				if previous.Peers[j].PublicKey == peer.PublicKey {
+					before = &previous.Peers[j]
+					break
+				}
+			}
+		}
+		if before == nil || peer.RxBytes > before.RxBytes || peer.TxBytes <= before.TxBytes {
+			continue
+		}
+		age := handshakeAge(peer, started, now)
+		if age < time.Duration(degradedAfter)*time.Second {
+			continue
+		}
+		if age >= time.Duration(deadAfter)*time.Second {
+			dead++
+		} else {
+			degraded++
+		}
+		reasons = append(reasons, fmt.Sprintf("peer %s has had no handshake in %s", peer.PublicKey.String(), age.Round(time.Second)))
+	}
+	switch {
+	case len(current.Peers) > 0 && dead == len(current.Peers):
+		return HealthDead, strings.Join(reasons, "; ")
+	case dead+degraded > 0:
+		return HealthDegraded, strings.Join(reasons, "; ")
+	}
+	return HealthHealthy, ""
+}
+
+type tunnelHealthState struct {
+	started time.Time
+	sample  *conf.Config
+	health  TunnelHealth
+}
+
+// healthMonitor samples running tunnels, notifies changes of their health, and carries out their
+// health policies when they die.
+type healthMonitor struct {
+	backend TunnelBackend
+	now     func() time.Time
+	tunnels map[string]*tunnelHealthState
+}
+
+func newHealthMonitor(backend TunnelBackend) *healthMonitor {
+	return &healthMonitor{
+		backend: backend,
+		now:     time.Now,
+		tunnels: make(map[string]*tunnelHealthState),
+	}
+}
+
+// currentHealth holds the last health of each running tunnel, for clients that ask rather than
+// wait for notifications.
+var (
+	currentHealth     = make(map[string]TunnelHealth)
+	currentHealthLock sync.Mutex
+)
+
+func tunnelHealth(tunnelName string) TunnelHealth {
+	currentHealthLock.Lock()
+	defer currentHealthLock.Unlock()
+	return currentHealth[tunnelName]
+}
+
+func (m *healthMonitor) setHealth(tunnelName string, health TunnelHealth, detail string) {
+	currentHealthLock.Lock()
+	if health == HealthUnknown {
+		delete(currentHealth, tunnelName)
+	} else {
+		currentHealth[tunnelName] = health
+	}
+	currentHealthLock.Unlock()
+	IPCServerNotifyTunnelHealth(tunnelName, health, detail)
+}
+
+// check samples every running tunnel once.
+func (m *healthMonitor) check() {
+	tunnels, err := m.backend.Tunnels()
+	if err != nil {
+		log.Printf("Unable to list tunnels to check their health: %v", err)
+		return
+	}
+	now := m.now()
+	running := make(map[string]bool, len(tunnels))
+	dead := make(map[string]*conf.HealthPolicy)
+	for _, tunnel := range tunnels {
+		state, err := m.backend.State(tunnel.Name)
+		if err != nil || state != TunnelStarted {
+			continue
+		}
+		running[tunnel.Name] = true
+		s, ok := m.tunnels[tunnel.Name]
+		if !ok {
+			s = &tunnelHealthState{started: now}
+			m.tunnels[tunnel.Name] = s
+		}
+		sample, err := m.backend.RuntimeConfig(tunnel.Name)
+		if err != nil {
+			continue
+		}
+		metadata, err := m.backend.StoredMetadata(tunnel.Name)
+		if err != nil {
+			metadata = &conf.Metadata{}
+		}
+		health, detail := ClassifyHealth(s.sample, sample, metadata.Health, s.started, now)
+		s.sample = sample
+		if health == s.health {
+			continue
+		}
+		s.health = health
+		if health == HealthHealthy {
+			log.Printf("[%s] Tunnel is healthy", tunnel.Name)
+		} else {
+			log.Printf("[%s] Tunnel is %s: %s", tunnel.Name, health, detail)
+		}
+		m.setHealth(tunnel.Name, health, detail)
+		if health == HealthDead && metadata.Health != nil && metadata.Health.Action != conf.HealthNotify {
+			dead[tunnel.Name] = metadata.Health
+		}
+	}
+	for name := range m.tunnels {
+		if !running[name] {
+			delete(m.tunnels, name)
+			m.setHealth(name, HealthUnknown, "")
+		}
+	}
+	for name, policy := range dead {
+		m.act(name, policy)
+		m.tunnels[name] = &tunnelHealthState{started: m.now(), health: HealthDead}
+	}
+}
+
+// act carries out the policy of a tunnel that has died. Its samples are then thrown away, so that
+// if it was restarted, it gets the full grace period to come back before it may be restarted again.
+func (m *healthMonitor) act(tunnelName string, policy *conf.HealthPolicy) {
+	switch policy.Action {
+	case conf.HealthRestart:
+		log.Printf("[%s] Restarting dead tunnel", tunnelName)
+		err := m.backend.Stop(tunnelName)
+		if err == nil {
+			err = m.backend.WaitForStop(tunnelName)
+		}
+		if err == nil {
+			err = m.backend.Start(tunnelName)
+		}
+		if err != nil {
+			log.Printf("[%s] Unable to restart dead tunnel: %v", tunnelName, err)
+		}
+	case conf.HealthFailover:
+		if strings.EqualFold(policy.FailoverTo, tunnelName) {
+			return
+		}
+		log.Printf("[%s] Failing over dead tunnel to ‘%s’", tunnelName, policy.FailoverTo)
+		err := m.backend.Stop(tunnelName)
+		if err == nil {
+			err = m.backend.WaitForStop(tunnelName)
+		}
+		if err == nil {
+			err = m.backend.Start(policy.FailoverTo)
+		}
+		if err != nil {
+			log.Printf("[%s] Unable to fail over to ‘%s’: %v", tunnelName, policy.FailoverTo, err)
+		}
+	}
+}
+
+// run checks the health of running tunnels every healthCheckInterval until stop is closed.
+func (m *healthMonitor) run(stop <-chan struct{}) {
+	interval := time.NewTicker(healthCheckInterval)
+	defer interval.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-interval.C:
+			m.check()
+		}
+	}
+}
+
+// renameFailoverTargets points the health policies that fail over to a renamed tunnel at its new
+// name.
+func renameFailoverTargets(backend TunnelBackend, oldName string, newName string) {
+	tunnels, err := backend.Tunnels()
+	if err != nil {
+		return
+	}
+	for _, tunnel := range tunnels {
+		metadata, err := backend.StoredMetadata(tunnel.Name)
+		if err != nil || metadata.Health == nil || !strings.EqualFold(metadata.Health.FailoverTo, oldName) {
+			continue
+		}
+		metadata.Health.FailoverTo = newName
+		err = backend.SetMetadata(tunnel.Name, metadata)
+		if err != nil {
+			log.Printf("[%s] Unable to follow renamed failover tunnel: %v", tunnel.Name, err)
+		}
+	}
+}
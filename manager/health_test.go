@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+var healthTestStart = time.Date(2019, 11, 1, 12, 0, 0, 0, time.UTC)
+
+func handshakeAt(t time.Time) conf.HandshakeTime {
+	return conf.HandshakeTime(t.Sub(time.Unix(0, 0)))
+}
+
+// healthSample copies config with the given transfer counters and handshake times for its peers.
+func healthSample(config *conf.Config, rx []conf.Bytes, tx []conf.Bytes, handshakes []time.Time) *conf.Config {
+	sample := *config
+	sample.Peers = append([]conf.Peer(nil), config.Peers...)
+	for i := range sample.Peers {
+		sample.Peers[i].RxBytes = rx[i]
+		sample.Peers[i].TxBytes = tx[i]
+		if !handshakes[i].IsZero() {
+			sample.Peers[i].LastHandshakeTime = handshakeAt(handshakes[i])
+		}
+	}
+	return &sample
+}
+
+func TestClassifyHealth(t *testing.T) {
+	config := conflictTestConfig(t, "office", "Address = 10.10.0.2/16\n", "10.10.0.0/16", "10.20.0.0/16")
+	var never time.Time
+	previous := healthSample(config, []conf.Bytes{100, 100}, []conf.Bytes{100, 100}, []time.Time{never, never})
+	short := &conf.HealthPolicy{Action: conf.HealthNotify, DegradedAfter: 60, DeadAfter: 120}
+	for _, test := range []struct {
+		name     string
+		previous *conf.Config
+		current  *conf.Config
+		policy   *conf.HealthPolicy
+		elapsed  time.Duration
+		want     TunnelHealth
+	}{
+		{"first sample", nil, previous, nil, time.Hour, HealthHealthy},
+		{"idle", previous, previous, nil, time.Hour, HealthHealthy},
+		{"receiving", previous, healthSample(config, []conf.Bytes{200, 200}, []conf.Bytes{200, 200}, []time.Time{never, never}), nil, time.Hour, HealthHealthy},
+		{"recent handshake", previous, healthSample(config, []conf.Bytes{100, 100}, []conf.Bytes{200, 200}, []time.Time{healthTestStart.Add(time.Hour - time.Minute), healthTestStart.Add(time.Hour - time.Minute)}), nil, time.Hour, HealthHealthy},
+		{"starting", previous, healthSample(config, []conf.Bytes{100, 100}, []conf.Bytes{200, 200}, []time.Time{never, never}), nil, time.Minute, HealthHealthy},
+		{"one peer silent", previous, healthSample(config, []conf.Bytes{200, 100}, []conf.Bytes{200, 200}, []time.Time{never, never}), nil, time.Hour, HealthDegraded},
+		{"stale handshakes", previous, healthSample(config, []conf.Bytes{100, 100}, []conf.Bytes{200, 200}, []time.Time{healthTestStart.Add(time.Hour - time.Minute*4), healthTestStart}), nil, time.Hour, HealthDegraded},
+		{"all silent", previous, healthSample(config, []conf.Bytes{100, 100}, []conf.Bytes{200, 200}, []time.Time{never, healthTestStart}), nil, time.Hour, HealthDead},
+		{"short policy", previous, healthSample(config, []conf.Bytes{100, 100}, []conf.Bytes{200, 200}, []time.Time{never, never}), short, time.Minute * 2, HealthDead},
+	} {
+		health, detail := ClassifyHealth(test.previous, test.current, test.policy, healthTestStart, healthTestStart.Add(test.elapsed))
+		if health != test.want || (health == HealthHealthy) != (len(detail) == 0) {
+			t.Errorf("%s: got %s (%q), want %s", test.name, health, detail, test.want)
+		}
+	}
+}
+
+// healthTestBackend adds the runtime configuration and waiting that the health monitor needs to
+// the on-demand test backend.
+type healthTestBackend struct {
+	*onDemandTestBackend
+	runtime map[string]*conf.Config
+}
+
+func (b *healthTestBackend) RuntimeConfig(tunnelName string) (*conf.Config, error) {
+	return b.runtime[tunnelName], nil
+}
+
+func (b *healthTestBackend) WaitForStop(tunnelName string) error {
+	return nil
+}
+
+func TestHealthMonitor(t *testing.T) {
+	office := conflictTestConfig(t, "office", "Address = 10.10.0.2/16\n", "10.10.0.0/16")
+	lab := conflictTestConfig(t, "lab", "Address = 10.99.0.2/24\n", "10.99.0.0/24")
+	backend := &healthTestBackend{
+		onDemandTestBackend: &onDemandTestBackend{
+			configs: map[string]*conf.Config{"office": office, "lab": lab},
+			metadata: map[string]*conf.Metadata{
+				"office": {Version: conf.MetadataVersion, Health: &conf.HealthPolicy{Action: conf.HealthFailover, FailoverTo: "lab"}},
+				"lab":    {Version: conf.MetadataVersion, Health: &conf.HealthPolicy{Action: conf.HealthRestart}},
+			},
+			states: map[string]TunnelState{"office": TunnelStarted, "lab": TunnelStopped},
+		},
+		runtime: make(map[string]*conf.Config),
+	}
+	now := healthTestStart
+	monitor := newHealthMonitor(backend)
+	monitor.now = func() time.Time { return now }
+	var never time.Time
+	var sent conf.Bytes
+	check := func(what string, elapsed time.Duration, want map[string]TunnelHealth, log ...string) {
+		t.Helper()
+		now = now.Add(elapsed)
+		sent += 100
+		backend.runtime["office"] = healthSample(office, []conf.Bytes{0}, []conf.Bytes{sent}, []time.Time{never})
+		backend.runtime["lab"] = healthSample(lab, []conf.Bytes{0}, []conf.Bytes{sent}, []time.Time{healthTestStart})
+		monitor.check()
+		if !reflect.DeepEqual(backend.log, log) {
+			t.Errorf("%s: backend did %q, want %q", what, backend.log, log)
+		}
+		backend.log = nil
+		for _, name := range []string{"office", "lab"} {
+			if health := tunnelHealth(name); health != want[name] {
+				t.Errorf("%s: %s is %s, want %s", what, name, health, want[name])
+			}
+		}
+	}
+
+	check("Started", 0, map[string]TunnelHealth{"office": HealthHealthy})
+	check("No handshake yet", time.Minute, map[string]TunnelHealth{"office": HealthHealthy})
+	check("No handshake for a while", time.Minute*3, map[string]TunnelHealth{"office": HealthDegraded})
+	check("No handshake at all", time.Minute*2, map[string]TunnelHealth{"office": HealthDead}, "stop office", "start lab")
+
+	// The failover tunnel's last handshake is from long before it started, so it is judged from when
+	// it started, and so again once it has been restarted.
+	check("Failed over", time.Minute, map[string]TunnelHealth{"lab": HealthHealthy})
+	check("Failover is degraded", time.Minute*3, map[string]TunnelHealth{"lab": HealthDegraded})
+	check("Failover is dead", time.Minute*2, map[string]TunnelHealth{"lab": HealthDead}, "stop lab", "start lab")
+	check("Restarted", time.Minute, map[string]TunnelHealth{"lab": HealthHealthy})
+	check("Restarted a while ago", time.Minute, map[string]TunnelHealth{"lab": HealthHealthy})
+
+	backend.Stop("lab")
+	backend.log = nil
+	check("Stopped", time.Minute, nil)
+}
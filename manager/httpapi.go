@@ -0,0 +1,535 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
+)
+
+const httpAPIPolicyFileName = "httpapi.json"
+
+// HTTPAPIPolicy enables the HTTP API, for automation that can't speak the IPC protocol, when an
+// administrator places it in the configuration root.
+type HTTPAPIPolicy struct {
+	// Address is the loopback IP address and port on which to listen, such as "127.0.0.1:51821".
+	Address string
+}
+
+func (p *HTTPAPIPolicy) validate() error {
+	host, port, err := net.SplitHostPort(p.Address)
+	if err != nil {
+		return fmt.Errorf("Address %#q is not valid: %w", p.Address, err)
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("Address %#q is not a loopback IP address", p.Address)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("Address %#q has no valid port", p.Address)
+	}
+	return nil
+}
+
+// LoadHTTPAPIPolicy reads the HTTP API policy from the configuration root, which is writable only by
+// administrators. It returns nil and no error if there is no policy file.
+func LoadHTTPAPIPolicy() (*HTTPAPIPolicy, error) {
+	root, err := conf.RootDirectory()
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(root, httpAPIPolicyFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var policy HTTPAPIPolicy
+	err = json.Unmarshal(bytes, &policy)
+	if err != nil {
+		return nil, err
+	}
+	err = policy.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// httpAPIMaxBody bounds request bodies, which are at most a configuration and a little JSON.
+const httpAPIMaxBody = 1 << 20
+
+// httpAPIKeepalive is how often an idle event stream is sent a comment, so that clients and
+// anything in between can tell that it is still alive.
+var httpAPIKeepalive = time.Second * 30
+
+type httpCreateRequest struct {
+	Name          string `json:"name"`
+	Config        string `json:"config"`
+	TrustMetadata bool   `json:"trust_metadata,omitempty"`
+}
+
+type httpConfig struct {
+	Name   string `json:"name"`
+	Config string `json:"config"`
+}
+
+type httpState struct {
+	State string `json:"state"`
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// httpAPI serves the HTTP API on behalf of a backend, to clients that present its bearer token.
+type httpAPI struct {
+	backend TunnelBackend
+	token   []byte
+}
+
+// NewHTTPAPIHandler returns the handler of the HTTP API, which mirrors the IPC methods for managing
+// tunnels and updates, and streams the IPC notifications as server-sent events. Every request but
+// the one for the API's OpenAPI description must carry token as a bearer token, which is all that
+// stands in for the checks made of IPC peers, so it must only be readable by administrators.
+func NewHTTPAPIHandler(backend TunnelBackend, token string) http.Handler {
+	api := &httpAPI{backend, []byte(token)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/openapi.json", api.openAPI)
+	mux.Handle("/v1/tunnels", api.authenticated(api.tunnels))
+	mux.Handle("/v1/tunnels/", api.authenticated(api.tunnel))
+	mux.Handle("/v1/state", api.authenticated(api.globalState))
+	mux.Handle("/v1/update", api.authenticated(api.update))
+	mux.Handle("/v1/events", api.authenticated(api.events))
+	return mux
+}
+
+func (api *httpAPI) authenticated(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		const scheme = "bearer "
+		if len(authorization) <= len(scheme) || !strings.EqualFold(authorization[:len(scheme)], scheme) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(authorization[len(scheme):])), api.token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="WireGuard"`)
+			writeHTTPError(w, http.StatusUnauthorized, errors.New("A valid bearer token is required"))
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	writeHTTPJSON(w, status, &httpError{err.Error()})
+}
+
+// writeBackendError answers with the status that best matches an error from the backend.
+func writeBackendError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, os.ErrNotExist), rpc.Code(err) == rpc.ErrorNotFound:
+		status = http.StatusNotFound
+	case errors.Is(err, os.ErrExist), rpc.Code(err) == rpc.ErrorConflict:
+		status = http.StatusConflict
+	case rpc.Code(err) == rpc.ErrorAccessDenied:
+		status = http.StatusForbidden
+	case rpc.Code(err) == rpc.ErrorInvalidRequest:
+		status = http.StatusBadRequest
+	}
+	writeHTTPError(w, status, err)
+}
+
+// allowMethods answers requests with any other method, returning whether the request may go on.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeHTTPError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", r.Method))
+	return false
+}
+
+func (api *httpAPI) openAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(httpAPIOpenAPI))
+}
+
+func (api *httpAPI) tunnelEntry(tunnelName string, metadata *conf.Metadata) (*TunnelSummary, error) {
+	state, err := api.backend.State(tunnelName)
+	if err != nil {
+		return nil, err
+	}
+	return NewTunnelSummary(tunnelName, state, metadata), nil
+}
+
+func (api *httpAPI) tunnels(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		api.create(w, r)
+		return
+	}
+	infos, err := listTunnels(api.backend, r.URL.Query().Get("tag"), false)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	entries := make([]TunnelSummary, 0, len(infos))
+	for i := range infos {
+		entry, err := api.tunnelEntry(infos[i].Name, &infos[i].Metadata)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		entries = append(entries, *entry)
+	}
+	writeHTTPJSON(w, http.StatusOK, entries)
+}
+
+// create adds a tunnel from its wg-quick configuration, which may carry metadata in a comment, as
+// the command line import does, keeping its automation only if the caller trusts it. Unlike the IPC
+// method, it refuses to replace an existing tunnel.
+func (api *httpAPI) create(w http.ResponseWriter, r *http.Request) {
+	var request httpCreateRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, httpAPIMaxBody)).Decode(&request)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("Request body is invalid: %w", err))
+		return
+	}
+	existing, err := api.backend.Tunnels()
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	imported, err := ParseImport(request.Config, request.Name, request.TrustMetadata, existing)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	metadata := imported.Metadata
+	tunnel, err := api.backend.Create(imported.Config)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	if !metadata.IsEmpty() {
+		err = api.backend.SetMetadata(tunnel.Name, metadata)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+	}
+	entry, err := api.tunnelEntry(tunnel.Name, metadata)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/v1/tunnels/"+tunnel.Name)
+	writeHTTPJSON(w, http.StatusCreated, entry)
+}
+
+// tunnel serves /v1/tunnels/NAME and the resources beneath it.
+func (api *httpAPI) tunnel(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/tunnels/"), "/")
+	if len(path) > 2 || !conf.TunnelNameIsValid(path[0]) {
+		writeHTTPError(w, http.StatusNotFound, fmt.Errorf("No such resource %#q", r.URL.Path))
+		return
+	}
+	tunnelName, resource := path[0], ""
+	if len(path) == 2 {
+		resource = path[1]
+	}
+	switch resource {
+	case "":
+		if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+			return
+		}
+		if r.Method == http.MethodDelete {
+			err := api.backend.Delete(tunnelName)
+			if err != nil {
+				writeBackendError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		metadata, err := api.backend.StoredMetadata(tunnelName)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		entry, err := api.tunnelEntry(tunnelName, metadata)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeHTTPJSON(w, http.StatusOK, entry)
+	case "config":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		config, err := api.backend.StoredConfig(tunnelName)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		metadata, err := api.backend.StoredMetadata(tunnelName)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeHTTPJSON(w, http.StatusOK, &httpConfig{config.Name, metadata.ToWgQuickComment() + config.ToWgQuick()})
+	case "runtime-config":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		config, err := api.backend.RuntimeConfig(tunnelName)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeHTTPJSON(w, http.StatusOK, NewRuntimeInterface(config))
+	case "state":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		state, err := api.backend.State(tunnelName)
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		writeHTTPJSON(w, http.StatusOK, &httpState{state.String()})
+	case "start", "stop":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		var err error
+		if resource == "start" {
+			err = api.backend.Start(tunnelName)
+		} else {
+			err = api.backend.Stop(tunnelName)
+		}
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeHTTPError(w, http.StatusNotFound, fmt.Errorf("No such resource %#q", r.URL.Path))
+	}
+}
+
+func (api *httpAPI) globalState(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeHTTPJSON(w, http.StatusOK, &httpState{api.backend.GlobalState().String()})
+}
+
+// update reports the state of updates, or starts installing one, whose progress is then sent as
+// UpdateProgress events. No user is behind the request, so the installer runs as Local System.
+func (api *httpAPI) update(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		api.backend.Update(&Peer{Elevated: true})
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	writeHTTPJSON(w, http.StatusOK, NewUpdateStatus(api.backend.UpdateState(), api.backend.UpdateDetails()))
+}
+
+// eventStreams holds a channel for each client following events, onto which notifications are
+// put already formatted. A client too slow to keep up has its channel closed and removed, so that
+// it reconnects rather than silently missing events.
+var (
+	eventStreams     = make(map[chan []byte]bool)
+	eventStreamsLock sync.Mutex
+)
+
+const eventStreamBacklog = 64
+
+func subscribeEvents() chan []byte {
+	stream := make(chan []byte, eventStreamBacklog)
+	eventStreamsLock.Lock()
+	eventStreams[stream] = true
+	eventStreamsLock.Unlock()
+	return stream
+}
+
+func unsubscribeEvents(stream chan []byte) {
+	eventStreamsLock.Lock()
+	if eventStreams[stream] {
+		delete(eventStreams, stream)
+		close(stream)
+	}
+	eventStreamsLock.Unlock()
+}
+
+type tunnelChangeEvent struct {
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	GlobalState string `json:"global_state"`
+	Error       string `json:"error,omitempty"`
+}
+
+type groupChangeEvent struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+type tunnelRenameEvent struct {
+	OldName string `json:"old_name"`
+	NewName string `json:"new_name"`
+}
+
+type tunnelHealthEvent struct {
+	Name   string `json:"name"`
+	Health string `json:"health"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type updateProgressEvent struct {
+	Activity        string  `json:"activity,omitempty"`
+	BytesDownloaded uint64  `json:"bytes_downloaded"`
+	BytesTotal      uint64  `json:"bytes_total"`
+	BytesPerSecond  uint64  `json:"bytes_per_second"`
+	ETA             float64 `json:"eta_seconds"`
+	Retries         uint32  `json:"retries,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	Complete        bool    `json:"complete"`
+}
+
+func errorMessage(err *rpc.Error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// httpEvent converts the body of a notification to the form in which it is sent to event streams,
+// with states by name rather than number, as elsewhere in the HTTP API.
+func httpEvent(body interface{}) interface{} {
+	switch n := body.(type) {
+	case nil:
+		return struct{}{}
+	case *TunnelChangeNotification:
+		return &tunnelChangeEvent{n.Name, n.State.String(), n.GlobalState.String(), errorMessage(n.Error)}
+	case *GroupChangeNotification:
+		return &groupChangeEvent{n.Name, n.State.String()}
+	case *TunnelRenameNotification:
+		return &tunnelRenameEvent{n.OldName, n.NewName}
+	case *TunnelHealthNotification:
+		return &tunnelHealthEvent{n.Name, n.Health.String(), n.Detail}
+	case *UpdateFoundNotification:
+		return &httpState{n.State.String()}
+	case *UpdateProgressNotification:
+		return &updateProgressEvent{
+			Activity:        n.Activity,
+			BytesDownloaded: n.BytesDownloaded,
+			BytesTotal:      n.BytesTotal,
+			BytesPerSecond:  n.BytesPerSecond,
+			ETA:             n.ETA.Seconds(),
+			Retries:         n.Retries,
+			Error:           errorMessage(n.Error),
+			Complete:        n.Complete,
+		}
+	}
+	return body
+}
+
+// notifyEventStreams sends a notification to every client following events.
+func notifyEventStreams(notificationType NotificationType, body interface{}) {
+	eventStreamsLock.Lock()
+	defer eventStreamsLock.Unlock()
+	if len(eventStreams) == 0 {
+		return
+	}
+	data, err := json.Marshal(httpEvent(body))
+	if err != nil {
+		log.Printf("Unable to encode %s event: %v", notificationType, err)
+		return
+	}
+	event := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", notificationType, data))
+	for stream := range eventStreams {
+		select {
+		case stream <- event:
+		default:
+			delete(eventStreams, stream)
+			close(stream)
+		}
+	}
+}
+
+// events streams notifications as server-sent events, named by notification type, until the
+// client goes away or falls too far behind.
+func (api *httpAPI) events(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, http.StatusInternalServerError, errors.New("Streaming is not supported"))
+		return
+	}
+	stream := subscribeEvents()
+	defer unsubscribeEvents(stream)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(": connected\n\n"))
+	flusher.Flush()
+	keepalive := time.NewTicker(httpAPIKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event, ok := <-stream:
+			if !ok {
+				return
+			}
+			_, err := w.Write(event)
+			if err != nil {
+				return
+			}
+		case <-keepalive.C:
+			_, err := w.Write([]byte(": keepalive\n\n"))
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
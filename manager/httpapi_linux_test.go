@@ -0,0 +1,382 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+const httpTestToken = "0123456789abcdef0123456789abcdef"
+
+func serveHTTPAPI(t *testing.T, backend TunnelBackend) *httptest.Server {
+	server := httptest.NewServer(NewHTTPAPIHandler(backend, httpTestToken))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// httpCall makes a request with the test token, decoding any JSON response into v.
+func httpCall(t *testing.T, server *httptest.Server, method string, path string, body interface{}, v interface{}) *http.Response {
+	t.Helper()
+	var reader *strings.Reader
+	if s, ok := body.(string); ok {
+		reader = strings.NewReader(s)
+	} else {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = strings.NewReader(string(b))
+	}
+	request, err := http.NewRequest(method, server.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+httpTestToken)
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if v != nil && response.Header.Get("Content-Type") == "application/json" {
+		err = json.NewDecoder(response.Body).Decode(v)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return response
+}
+
+func TestHTTPAPIAuthentication(t *testing.T) {
+	server := serveHTTPAPI(t, newFakeBackend())
+	for _, authorization := range []string{"", "Bearer", "Bearer wrong", "Basic " + httpTestToken, "Bearer " + httpTestToken + "0"} {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/tunnels", nil)
+		if len(authorization) > 0 {
+			request.Header.Set("Authorization", authorization)
+		}
+		response, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(response.Header.Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("Authorization %q returned %s", authorization, response.Status)
+		}
+	}
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/state", nil)
+	request.Header.Set("Authorization", "bearer "+httpTestToken)
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Lowercase scheme returned %s", response.Status)
+	}
+
+	response, err = server.Client().Get(server.URL + "/v1/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var description struct {
+		Paths map[string]map[string]interface{}
+	}
+	err = json.NewDecoder(response.Body).Decode(&description)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("OpenAPI description returned %s, %v", response.Status, err)
+	}
+	for path, methods := range map[string][]string{
+		"/v1/tunnels":                       {"get", "post"},
+		"/v1/tunnels/{name}":                {"get", "delete"},
+		"/v1/tunnels/{name}/config":         {"get"},
+		"/v1/tunnels/{name}/runtime-config": {"get"},
+		"/v1/tunnels/{name}/state":          {"get"},
+		"/v1/tunnels/{name}/start":          {"post"},
+		"/v1/tunnels/{name}/stop":           {"post"},
+		"/v1/state":                         {"get"},
+		"/v1/update":                        {"get", "post"},
+		"/v1/events":                        {"get"},
+	} {
+		for _, method := range methods {
+			if _, ok := description.Paths[path][method]; !ok {
+				t.Errorf("OpenAPI description lacks %s %s", method, path)
+			}
+		}
+	}
+}
+
+func TestHTTPAPITunnels(t *testing.T) {
+	server := serveHTTPAPI(t, newFakeBackend())
+
+	var tunnel TunnelSummary
+	config := "#! Metadata = {\"Version\":1,\"DisplayName\":\"Office\",\"Tags\":[\"work\"]}\n" + testConfig
+	response := httpCall(t, server, http.MethodPost, "/v1/tunnels", &httpCreateRequest{Name: "office", Config: config}, &tunnel)
+	want := TunnelSummary{"office", "stopped", "Office", []string{"work"}}
+	if response.StatusCode != http.StatusCreated || !reflect.DeepEqual(tunnel, want) || response.Header.Get("Location") != "/v1/tunnels/office" {
+		t.Fatalf("Creating tunnel returned %s, %+v", response.Status, tunnel)
+	}
+	var httpErr httpError
+	if response = httpCall(t, server, http.MethodPost, "/v1/tunnels", &httpCreateRequest{Name: "OFFICE", Config: testConfig}, &httpErr); response.StatusCode != http.StatusConflict || len(httpErr.Error) == 0 {
+		t.Errorf("Creating tunnel again returned %s, %+v", response.Status, httpErr)
+	}
+	for _, body := range []interface{}{"{", &httpCreateRequest{Name: "home", Config: "[Interface]\nNonsense = 1\n"}, &httpCreateRequest{Name: "a/b", Config: testConfig}} {
+		if response = httpCall(t, server, http.MethodPost, "/v1/tunnels", body, nil); response.StatusCode != http.StatusBadRequest {
+			t.Errorf("Creating tunnel from %+v returned %s", body, response.Status)
+		}
+	}
+	if response = httpCall(t, server, http.MethodPost, "/v1/tunnels", &httpCreateRequest{Name: "home", Config: testConfig}, nil); response.StatusCode != http.StatusCreated {
+		t.Fatalf("Creating second tunnel returned %s", response.Status)
+	}
+
+	var tunnels []TunnelSummary
+	httpCall(t, server, http.MethodGet, "/v1/tunnels", nil, &tunnels)
+	if len(tunnels) != 2 || tunnels[0].Name != "home" || tunnels[1].Name != "office" {
+		t.Errorf("Listing tunnels returned %+v", tunnels)
+	}
+	tunnels = nil
+	httpCall(t, server, http.MethodGet, "/v1/tunnels?tag=WORK", nil, &tunnels)
+	if !reflect.DeepEqual(tunnels, []TunnelSummary{want}) {
+		t.Errorf("Listing tunnels tagged work returned %+v", tunnels)
+	}
+
+	var stored httpConfig
+	httpCall(t, server, http.MethodGet, "/v1/tunnels/office/config", nil, &stored)
+	if !strings.HasPrefix(stored.Config, "#! Metadata = ") || !strings.Contains(stored.Config, "PrivateKey = ") {
+		t.Errorf("Stored configuration is %q", stored.Config)
+	}
+	var runtime RuntimeInterface
+	httpCall(t, server, http.MethodGet, "/v1/tunnels/office/runtime-config", nil, &runtime)
+	if runtime.Name != "office" || len(runtime.PublicKey) == 0 || len(runtime.Peers) != 1 || len(runtime.Peers[0].AllowedIPs) == 0 {
+		t.Errorf("Runtime configuration is %+v", runtime)
+	}
+
+	if response = httpCall(t, server, http.MethodPost, "/v1/tunnels/office/start", nil, nil); response.StatusCode != http.StatusAccepted {
+		t.Errorf("Starting tunnel returned %s", response.Status)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		var state httpState
+		httpCall(t, server, http.MethodGet, "/v1/tunnels/office/state", nil, &state)
+		if state.State == "started" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Tunnel is still %s", state.State)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	var global httpState
+	httpCall(t, server, http.MethodGet, "/v1/state", nil, &global)
+	if global.State != "started" {
+		t.Errorf("Global state is %s", global.State)
+	}
+	if response = httpCall(t, server, http.MethodPost, "/v1/tunnels/office/stop", nil, nil); response.StatusCode != http.StatusAccepted {
+		t.Errorf("Stopping tunnel returned %s", response.Status)
+	}
+
+	if response = httpCall(t, server, http.MethodGet, "/v1/tunnels/office/start", nil, nil); response.StatusCode != http.StatusMethodNotAllowed || response.Header.Get("Allow") != "POST" {
+		t.Errorf("Getting start returned %s, allowing %q", response.Status, response.Header.Get("Allow"))
+	}
+	for _, path := range []string{"/v1/tunnels/missing/start", "/v1/tunnels/missing/state", "/v1/tunnels/office/nonsense", "/v1/tunnels/office/state/more", "/v1/tunnels/"} {
+		method := http.MethodGet
+		if strings.HasSuffix(path, "/start") {
+			method = http.MethodPost
+		}
+		if response = httpCall(t, server, method, path, nil, nil); response.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s returned %s", method, path, response.Status)
+		}
+	}
+
+	if response = httpCall(t, server, http.MethodDelete, "/v1/tunnels/office", nil, nil); response.StatusCode != http.StatusNoContent {
+		t.Errorf("Deleting tunnel returned %s", response.Status)
+	}
+	if response = httpCall(t, server, http.MethodGet, "/v1/tunnels/office", nil, nil); response.StatusCode != http.StatusNotFound {
+		t.Errorf("Getting deleted tunnel returned %s", response.Status)
+	}
+
+	var update UpdateStatus
+	httpCall(t, server, http.MethodGet, "/v1/update", nil, &update)
+	if update.State != "found update" || update.Channel != "stable" || update.LastChecked != nil {
+		t.Errorf("Update state is %+v", update)
+	}
+}
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvents parses the server-sent events from body, skipping comments, until body is closed.
+func readEvents(body *bufio.Reader, events chan<- sseEvent) {
+	defer close(events)
+	var event sseEvent
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case len(line) == 0:
+			if len(event.name) > 0 {
+				events <- event
+			}
+			event = sseEvent{}
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestHTTPAPIImportAutomation(t *testing.T) {
+	backend := newFakeBackend()
+	server := serveHTTPAPI(t, backend)
+	config := "#! Metadata = {\"Version\":3,\"DisplayName\":\"Lab\",\"StartAtBoot\":true,\"OnDemand\":[{\"Action\":\"connect\"}]}\n" + testConfig
+	if response := httpCall(t, server, http.MethodPost, "/v1/tunnels", &httpCreateRequest{Name: "lab", Config: config}, nil); response.StatusCode != http.StatusCreated {
+		t.Fatalf("Creating tunnel returned %s", response.Status)
+	}
+	if metadata, _ := backend.StoredMetadata("lab"); metadata.DisplayName != "Lab" || len(metadata.Automation()) != 0 {
+		t.Errorf("Untrusted metadata is %+v", metadata)
+	}
+	if response := httpCall(t, server, http.MethodPost, "/v1/tunnels", &httpCreateRequest{Name: "lab2", Config: config, TrustMetadata: true}, nil); response.StatusCode != http.StatusCreated {
+		t.Fatalf("Creating trusted tunnel returned %s", response.Status)
+	}
+	if metadata, _ := backend.StoredMetadata("lab2"); !metadata.StartAtBoot || len(metadata.OnDemand) != 1 {
+		t.Errorf("Trusted metadata is %+v", metadata)
+	}
+}
+
+func TestHTTPAPIEvents(t *testing.T) {
+	server := serveHTTPAPI(t, newFakeBackend())
+	if response := httpCall(t, server, http.MethodPost, "/v1/tunnels", &httpCreateRequest{Name: "office", Config: testConfig}, nil); response.StatusCode != http.StatusCreated {
+		t.Fatalf("Creating tunnel returned %s", response.Status)
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/events", nil)
+	request.Header.Set("Authorization", "Bearer "+httpTestToken)
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Following events returned %s, %s", response.Status, response.Header.Get("Content-Type"))
+	}
+	body := bufio.NewReader(response.Body)
+	if line, err := body.ReadString('\n'); err != nil || line != ": connected\n" {
+		t.Fatalf("Event stream began with %q, %v", line, err)
+	}
+	events := make(chan sseEvent, 100)
+	go readEvents(body, events)
+	next := func(name string) string {
+		t.Helper()
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					t.Fatal("Event stream ended")
+				}
+				if event.name == name {
+					return event.data
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatalf("Timed out waiting for %s event", name)
+			}
+		}
+	}
+
+	httpCall(t, server, http.MethodPost, "/v1/tunnels/office/start", nil, nil)
+	for _, state := range []string{"starting", "started"} {
+		var change tunnelChangeEvent
+		err = json.Unmarshal([]byte(next("TunnelChange")), &change)
+		if err != nil || change.Name != "office" || change.State != state {
+			t.Errorf("TunnelChange event is %+v, %v, want %s", change, err, state)
+		}
+	}
+	IPCServerNotifyTunnelHealth("office", HealthDegraded, "peer has had no handshake in 3m0s")
+	if data := next("TunnelHealth"); data != `{"name":"office","health":"degraded","detail":"peer has had no handshake in 3m0s"}` {
+		t.Errorf("TunnelHealth event is %s", data)
+	}
+	IPCServerNotifyTunnelsChange()
+	if data := next("TunnelsChange"); data != "{}" {
+		t.Errorf("TunnelsChange event is %s", data)
+	}
+
+	httpCall(t, server, http.MethodPost, "/v1/update", nil, nil)
+	var progress updateProgressEvent
+	json.Unmarshal([]byte(next("UpdateProgress")), &progress)
+	if progress.Activity != "Downloading update" || progress.BytesTotal != 100 {
+		t.Errorf("First UpdateProgress event is %+v", progress)
+	}
+	next("UpdateProgress")
+	progress = updateProgressEvent{}
+	json.Unmarshal([]byte(next("UpdateProgress")), &progress)
+	if progress.Error != "Installer failed" {
+		t.Errorf("Last UpdateProgress event is %+v", progress)
+	}
+}
+
+func TestHTTPAPISlowEventStream(t *testing.T) {
+	stream := subscribeEvents()
+	defer unsubscribeEvents(stream)
+	for i := 0; i <= eventStreamBacklog; i++ {
+		IPCServerNotifyTunnelsChange()
+	}
+	received := 0
+	for range stream {
+		received++
+	}
+	if received != eventStreamBacklog {
+		t.Errorf("Slow stream received %d events before being closed", received)
+	}
+}
+
+func TestHTTPAPIPolicy(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:51821", "[::1]:8080", "127.3.2.1:1"} {
+		if err := (&HTTPAPIPolicy{address}).validate(); err != nil {
+			t.Errorf("Address %q was refused: %v", address, err)
+		}
+	}
+	for _, address := range []string{"", "127.0.0.1", "0.0.0.0:51821", "192.168.1.1:80", "localhost:80", "127.0.0.1:0", "127.0.0.1:http"} {
+		if (&HTTPAPIPolicy{address}).validate() == nil {
+			t.Errorf("Address %q was accepted", address)
+		}
+	}
+
+	root := t.TempDir()
+	conf.PresetRootDirectory(root)
+	policy, err := LoadHTTPAPIPolicy()
+	if policy != nil || err != nil {
+		t.Errorf("Missing policy loaded as %+v, %v", policy, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, httpAPIPolicyFileName), []byte(`{"Address": "0.0.0.0:51821"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadHTTPAPIPolicy(); err == nil {
+		t.Error("Policy listening on every address was loaded")
+	}
+	err = ioutil.WriteFile(filepath.Join(root, httpAPIPolicyFileName), []byte(`{"Address": "127.0.0.1:51821"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy, err = LoadHTTPAPIPolicy(); err != nil || policy.Address != "127.0.0.1:51821" {
+		t.Errorf("Policy loaded as %+v, %v", policy, err)
+	}
+}
@@ -0,0 +1,255 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+// httpAPIOpenAPI describes the HTTP API, and is served at /v1/openapi.json. It must be kept in step
+// with httpapi.go, which the tests partly check.
+const httpAPIOpenAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "WireGuard manager HTTP API",
+    "description": "Manages the tunnels of WireGuard for Windows, for automation that cannot use its IPC protocol. It is only served on a loopback address, and only when an administrator has enabled it by placing httpapi.json in the configuration directory. Requests must carry the bearer token found in httpapi-token.txt beside it.",
+    "version": "1"
+  },
+  "servers": [{"url": "http://127.0.0.1:51821"}],
+  "security": [{"bearer": []}],
+  "paths": {
+    "/v1/tunnels": {
+      "get": {
+        "summary": "List tunnels, ordered by name",
+        "parameters": [{"name": "tag", "in": "query", "description": "Only list tunnels with this tag", "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "The tunnels", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Tunnel"}}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      },
+      "post": {
+        "summary": "Create a tunnel from a wg-quick configuration",
+        "description": "A '#! Metadata = ' comment in the configuration, as written by exports, sets the tunnel's metadata. Its start at boot, on-demand rules and health policy are dropped unless trust_metadata is set. Existing tunnels are never replaced.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateRequest"}}}},
+        "responses": {
+          "201": {"description": "The new tunnel", "headers": {"Location": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Tunnel"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/v1/tunnels/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "get": {
+        "summary": "Get a tunnel",
+        "responses": {
+          "200": {"description": "The tunnel", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Tunnel"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "delete": {
+        "summary": "Stop and delete a tunnel",
+        "responses": {
+          "204": {"description": "The tunnel was deleted"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/v1/tunnels/{name}/config": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "get": {
+        "summary": "Get a tunnel's stored configuration, including its private key and metadata",
+        "responses": {
+          "200": {"description": "The configuration", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Config"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/v1/tunnels/{name}/runtime-config": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "get": {
+        "summary": "Get a running tunnel's configuration and statistics, without its private key",
+        "responses": {
+          "200": {"description": "The running configuration", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Interface"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/v1/tunnels/{name}/state": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "get": {
+        "summary": "Get a tunnel's state",
+        "responses": {
+          "200": {"description": "The state", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/State"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/v1/tunnels/{name}/start": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Start a tunnel",
+        "description": "The tunnel starts in the background. TunnelChange events tell when it has started, or failed to.",
+        "responses": {
+          "202": {"description": "The tunnel is starting"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/v1/tunnels/{name}/stop": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Stop a tunnel",
+        "responses": {
+          "202": {"description": "The tunnel is stopping"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/v1/state": {
+      "get": {
+        "summary": "Get the overall state of all tunnels",
+        "responses": {
+          "200": {"description": "The state", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/State"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/v1/update": {
+      "get": {
+        "summary": "Get the state of updates",
+        "responses": {
+          "200": {"description": "The update state", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Update"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      },
+      "post": {
+        "summary": "Download and install the update that was found",
+        "description": "UpdateProgress events report the download and installation.",
+        "responses": {
+          "202": {"description": "The update has started"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/v1/events": {
+      "get": {
+        "summary": "Follow notifications as server-sent events",
+        "description": "Each event is named after its notification: TunnelChange, TunnelsChange, GroupChange, TunnelRename, TunnelHealth, UpdateFound, UpdateProgress, or ManagerStopping. Its data is a JSON object, which is empty for TunnelsChange and ManagerStopping. Clients that fall too far behind are disconnected, and should reconnect and then refresh what they know.",
+        "responses": {
+          "200": {"description": "The event stream", "content": {"text/event-stream": {"schema": {"type": "string"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/v1/openapi.json": {
+      "get": {
+        "summary": "Get this description",
+        "security": [],
+        "responses": {
+          "200": {"description": "This description", "content": {"application/json": {"schema": {"type": "object"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "Name": {"name": "name", "in": "path", "required": true, "schema": {"type": "string", "pattern": "^[a-zA-Z0-9_=+.-]{1,32}$"}}
+    },
+    "schemas": {
+      "TunnelState": {"type": "string", "enum": ["started", "stopped", "starting", "stopping", "unknown"]},
+      "Tunnel": {
+        "type": "object",
+        "required": ["name", "state"],
+        "properties": {
+          "name": {"type": "string"},
+          "state": {"$ref": "#/components/schemas/TunnelState"},
+          "display_name": {"type": "string"},
+          "tags": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "Config": {
+        "type": "object",
+        "required": ["name", "config"],
+        "properties": {
+          "name": {"type": "string"},
+          "config": {"type": "string", "description": "The configuration in wg-quick format"}
+        }
+      },
+      "CreateRequest": {
+        "type": "object",
+        "required": ["name", "config"],
+        "properties": {
+          "name": {"type": "string"},
+          "config": {"type": "string", "description": "The configuration in wg-quick format"},
+          "trust_metadata": {"type": "boolean", "description": "Keep the parts of the metadata that start, stop or probe the tunnel by themselves"}
+        }
+      },
+      "Peer": {
+        "type": "object",
+        "required": ["public_key", "allowed_ips", "latest_handshake", "rx_bytes", "tx_bytes"],
+        "properties": {
+          "public_key": {"type": "string"},
+          "endpoint": {"type": "string"},
+          "allowed_ips": {"type": "array", "items": {"type": "string"}},
+          "latest_handshake": {"type": "integer", "description": "Seconds since the Unix epoch, or 0 if there has been no handshake"},
+          "rx_bytes": {"type": "integer"},
+          "tx_bytes": {"type": "integer"},
+          "persistent_keepalive": {"type": "integer"}
+        }
+      },
+      "Interface": {
+        "type": "object",
+        "required": ["name", "addresses", "peers"],
+        "properties": {
+          "name": {"type": "string"},
+          "public_key": {"type": "string"},
+          "listen_port": {"type": "integer"},
+          "addresses": {"type": "array", "items": {"type": "string"}},
+          "peers": {"type": "array", "items": {"$ref": "#/components/schemas/Peer"}}
+        }
+      },
+      "State": {
+        "type": "object",
+        "required": ["state"],
+        "properties": {"state": {"$ref": "#/components/schemas/TunnelState"}}
+      },
+      "Update": {
+        "type": "object",
+        "required": ["state"],
+        "properties": {
+          "state": {"type": "string"},
+          "channel": {"type": "string"},
+          "mirror": {"type": "string"},
+          "held_back": {"type": "string"},
+          "last_checked": {"type": "string", "format": "date-time"},
+          "last_error": {"type": "string"},
+          "scheduled_for": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {"error": {"type": "string"}}
+      }
+    },
+    "responses": {
+      "BadRequest": {"description": "The request is not valid", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Unauthorized": {"description": "The bearer token is missing or wrong", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "NotFound": {"description": "There is no such tunnel", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Conflict": {"description": "The request conflicts with existing or running tunnels", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    }
+  }
+}
+`
@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+const httpAPITokenFileName = "httpapi-token.txt"
+
+// httpAPITokenSD lets Local System manage the token file and administrators read it, and nobody else
+// near it, whatever the configuration root allows.
+const httpAPITokenSD = "O:SYD:PAI(A;;FA;;;SY)(A;;FR;;;BA)"
+
+// minHTTPAPITokenLength keeps administrators from provisioning tokens that are easily guessed.
+const minHTTPAPITokenLength = 32
+
+// loadHTTPAPIToken reads the bearer token of the HTTP API from the configuration root, after
+// making sure that only administrators may read it, or makes up a new one if there is none.
+// Administrators may provision a token of their own by writing the file before enabling the API.
+func loadHTTPAPIToken() (string, error) {
+	root, err := conf.RootDirectory()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, httpAPITokenFileName)
+	sd, err := windows.SecurityDescriptorFromString(httpAPITokenSD)
+	if err != nil {
+		return "", err
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if err == nil {
+		owner, _, err := sd.Owner()
+		if err != nil {
+			return "", err
+		}
+		dacl, _, err := sd.DACL()
+		if err != nil {
+			return "", err
+		}
+		err = windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, owner, nil, dacl, nil)
+		if err != nil {
+			return "", err
+		}
+		token := strings.TrimSpace(string(bytes))
+		if len(token) < minHTTPAPITokenLength {
+			return "", errors.New("Token is too short")
+		}
+		return token, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var randBytes [32]byte
+	_, err = rand.Read(randBytes[:])
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(randBytes[:])
+	sa := &windows.SecurityAttributes{
+		Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+		SecurityDescriptor: sd,
+	}
+	fileHandle, err := windows.CreateFile(windows.StringToUTF16Ptr(path), windows.GENERIC_WRITE, 0, sa, windows.CREATE_NEW, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	runtime.KeepAlive(sd)
+	if err != nil {
+		return "", err
+	}
+	file := os.NewFile(uintptr(fileHandle), path)
+	_, err = file.WriteString(token + "\r\n")
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return token, nil
+}
+
+// startHTTPAPI serves the HTTP API if an administrator has enabled it, returning the server to close
+// when the manager stops, or nil.
+func startHTTPAPI() *http.Server {
+	policy, err := LoadHTTPAPIPolicy()
+	if err != nil {
+		log.Printf("Unable to load HTTP API policy: %v", err)
+		return nil
+	}
+	if policy == nil {
+		return nil
+	}
+	token, err := loadHTTPAPIToken()
+	if err != nil {
+		log.Printf("Unable to load HTTP API token: %v", err)
+		return nil
+	}
+	listener, err := net.Listen("tcp", policy.Address)
+	if err != nil {
+		log.Printf("Unable to listen for HTTP API clients: %v", err)
+		return nil
+	}
+	server := &http.Server{
+		Handler:           NewHTTPAPIHandler(&serviceBackend{}, token),
+		ReadHeaderTimeout: time.Second * 10,
+		IdleTimeout:       time.Minute * 2,
+	}
+	go func() {
+		defer printPanic()
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP API stopped: %v", err)
+		}
+	}()
+	log.Printf("Serving HTTP API on %s", listener.Addr())
+	return server
+}
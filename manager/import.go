@@ -0,0 +1,63 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"os"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/l18n"
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
+)
+
+// ImportedConfig is a configuration read for import, along with the metadata it carried.
+type ImportedConfig struct {
+	Config   *conf.Config
+	Metadata *conf.Metadata
+	// Ignored describes the automation dropped from Metadata because it wasn't trusted.
+	Ignored []string
+}
+
+// nameTakenError is os.ErrExist, but says which tunnel has the name.
+type nameTakenError struct {
+	name string
+}
+
+func (e *nameTakenError) Error() string {
+	return l18n.Sprintf("Another tunnel already exists with the name ‘%s’", e.name)
+}
+
+func (e *nameTakenError) Is(target error) bool {
+	return target == os.ErrExist
+}
+
+// ParseImport reads a wg-quick configuration as the new tunnel name, along with the metadata it may
+// carry in a comment, refusing a name that any of existing has regardless of case. The metadata
+// came from wherever the file did, so unless trustMetadata is set, its automation is dropped.
+// Configurations that don't parse give errors with ErrorInvalidRequest, and taken names errors
+// that are os.ErrExist.
+func ParseImport(text string, name string, trustMetadata bool, existing []Tunnel) (*ImportedConfig, error) {
+	for _, tunnel := range existing {
+		if strings.EqualFold(tunnel.Name, name) {
+			return nil, &nameTakenError{tunnel.Name}
+		}
+	}
+	config, err := conf.FromWgQuickWithUnknownEncoding(text, name)
+	if err != nil {
+		return nil, rpc.NewError(rpc.ErrorInvalidRequest, err)
+	}
+	metadata, err := conf.MetadataFromWgQuick(text)
+	if err != nil {
+		return nil, rpc.NewError(rpc.ErrorInvalidRequest, err)
+	}
+	imported := &ImportedConfig{Config: config, Metadata: metadata}
+	if !trustMetadata {
+		imported.Ignored = metadata.Automation()
+		metadata.StripAutomation()
+	}
+	return imported, nil
+}
@@ -0,0 +1,38 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
+)
+
+func TestParseImport(t *testing.T) {
+	config := "#! Metadata = {\"Version\":3,\"DisplayName\":\"Lab\",\"Health\":{\"Action\":\"restart\"}}\n" + testConfig
+	existing := []Tunnel{{"Office"}}
+
+	imported, err := ParseImport(config, "lab", false, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Config.Name != "lab" || imported.Metadata.DisplayName != "Lab" || imported.Metadata.Health != nil || len(imported.Ignored) != 1 {
+		t.Errorf("Untrusted import is %+v with metadata %+v", imported, imported.Metadata)
+	}
+	imported, err = ParseImport(config, "lab", true, existing)
+	if err != nil || imported.Metadata.Health == nil || len(imported.Ignored) != 0 {
+		t.Errorf("Trusted import is %+v, %v", imported, err)
+	}
+
+	if _, err = ParseImport(config, "office", true, existing); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Importing over a tunnel differing only in case returned %v", err)
+	}
+	if _, err = ParseImport("[Interface]\nNonsense = 1\n", "lab", true, existing); rpc.Code(err) != rpc.ErrorInvalidRequest {
+		t.Errorf("Importing an invalid configuration returned %v with code %d", err, rpc.Code(err))
+	}
+}
@@ -166,7 +166,11 @@ func InstallTunnel(configPath string) error {
 	}
 
 	err = service.Start()
-	go trackTunnelService(name, service) // Pass off reference to handle.
+	if claimTrackedTunnel(name) {
+		go trackTunnelService(name, service) // Pass off reference to handle.
+	} else {
+		service.Close()
+	}
 	return err
 }
 
@@ -6,12 +6,11 @@
 package manager
 
 import (
-	"encoding/gob"
 	"errors"
-	"os"
 	"sync"
 
 	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
 	"golang.zx2c4.com/wireguard/windows/updater"
 )
 
@@ -29,39 +28,74 @@ const (
 	TunnelStopping
 )
 
-type NotificationType int
+// String returns a stable name for the state, suitable for scripts to match on.
+func (s TunnelState) String() string {
+	switch s {
+	case TunnelStarted:
+		return "started"
+	case TunnelStopped:
+		return "stopped"
+	case TunnelStarting:
+		return "starting"
+	case TunnelStopping:
+		return "stopping"
+	default:
+		return "unknown"
+	}
+}
+
+// NotificationType and MethodType values are sent on the wire by name, so they must never be
+// renamed, though new ones may be added.
+type NotificationType string
 
 const (
-	TunnelChangeNotificationType NotificationType = iota
-	TunnelsChangeNotificationType
-	ManagerStoppingNotificationType
-	UpdateFoundNotificationType
-	UpdateProgressNotificationType
+	TunnelChangeNotificationType    NotificationType = "TunnelChange"
+	TunnelsChangeNotificationType   NotificationType = "TunnelsChange"
+	ManagerStoppingNotificationType NotificationType = "ManagerStopping"
+	UpdateFoundNotificationType     NotificationType = "UpdateFound"
+	UpdateProgressNotificationType  NotificationType = "UpdateProgress"
+	GroupChangeNotificationType     NotificationType = "GroupChange"
+	TunnelRenameNotificationType    NotificationType = "TunnelRename"
+	TunnelHealthNotificationType    NotificationType = "TunnelHealth"
 )
 
-type MethodType int
+type MethodType string
 
 const (
-	StoredConfigMethodType MethodType = iota
-	RuntimeConfigMethodType
-	StartMethodType
-	StopMethodType
-	WaitForStopMethodType
-	DeleteMethodType
-	StateMethodType
-	GlobalStateMethodType
-	CreateMethodType
-	TunnelsMethodType
-	QuitMethodType
-	UpdateStateMethodType
-	UpdateMethodType
+	StoredConfigMethodType   MethodType = "StoredConfig"
+	RuntimeConfigMethodType  MethodType = "RuntimeConfig"
+	StartMethodType          MethodType = "Start"
+	StopMethodType           MethodType = "Stop"
+	WaitForStopMethodType    MethodType = "WaitForStop"
+	DeleteMethodType         MethodType = "Delete"
+	StateMethodType          MethodType = "State"
+	GlobalStateMethodType    MethodType = "GlobalState"
+	CreateMethodType         MethodType = "Create"
+	TunnelsMethodType        MethodType = "Tunnels"
+	QuitMethodType           MethodType = "Quit"
+	UpdateStateMethodType    MethodType = "UpdateState"
+	UpdateMethodType         MethodType = "Update"
+	DiagnosticsMethodType    MethodType = "Diagnostics"
+	UpdateDetailsMethodType  MethodType = "UpdateDetails"
+	ConflictsMethodType      MethodType = "Conflicts"
+	GroupsMethodType         MethodType = "Groups"
+	SetGroupMethodType       MethodType = "SetGroup"
+	DeleteGroupMethodType    MethodType = "DeleteGroup"
+	StartGroupMethodType     MethodType = "StartGroup"
+	StopGroupMethodType      MethodType = "StopGroup"
+	GroupStateMethodType     MethodType = "GroupState"
+	StoredMetadataMethodType MethodType = "StoredMetadata"
+	SetMetadataMethodType    MethodType = "SetMetadata"
+	ListTunnelsMethodType    MethodType = "ListTunnels"
+	RenameMethodType         MethodType = "Rename"
+	HealthMethodType         MethodType = "Health"
 )
 
-var (
-	rpcEncoder *gob.Encoder
-	rpcDecoder *gob.Decoder
-	rpcMutex   sync.Mutex
-)
+var rpcClient *rpc.Client
+
+// callbacksLock guards the callback maps, though callbacks are called without holding it, from a
+// snapshot of the map, so that they may themselves register and unregister callbacks.
+var callbacksLock sync.Mutex
 
 type TunnelChangeCallback struct {
 	cb func(tunnel *Tunnel, state TunnelState, globalState TunnelState, err error)
@@ -93,183 +127,159 @@ type UpdateProgressCallback struct {
 
 var updateProgressCallbacks = make(map[*UpdateProgressCallback]bool)
 
-func InitializeIPCClient(reader *os.File, writer *os.File, events *os.File) {
-	rpcDecoder = gob.NewDecoder(reader)
-	rpcEncoder = gob.NewEncoder(writer)
-	go func() {
-		decoder := gob.NewDecoder(events)
-		for {
-			var notificationType NotificationType
-			err := decoder.Decode(&notificationType)
-			if err != nil {
-				return
-			}
-			switch notificationType {
-			case TunnelChangeNotificationType:
-				var tunnel string
-				err := decoder.Decode(&tunnel)
-				if err != nil || len(tunnel) == 0 {
-					continue
-				}
-				var state TunnelState
-				err = decoder.Decode(&state)
-				if err != nil {
-					continue
-				}
-				var globalState TunnelState
-				err = decoder.Decode(&globalState)
-				if err != nil {
-					continue
-				}
-				var errStr string
-				err = decoder.Decode(&errStr)
-				if err != nil {
-					continue
-				}
-				var retErr error
-				if len(errStr) > 0 {
-					retErr = errors.New(errStr)
-				}
-				if state == TunnelUnknown {
-					continue
-				}
-				t := &Tunnel{tunnel}
-				for cb := range tunnelChangeCallbacks {
-					cb.cb(t, state, globalState, retErr)
-				}
-			case TunnelsChangeNotificationType:
-				for cb := range tunnelsChangeCallbacks {
-					cb.cb()
-				}
-			case ManagerStoppingNotificationType:
-				for cb := range managerStoppingCallbacks {
-					cb.cb()
-				}
-			case UpdateFoundNotificationType:
-				var state UpdateState
-				err = decoder.Decode(&state)
-				if err != nil {
-					continue
-				}
-				for cb := range updateFoundCallbacks {
-					cb.cb(state)
-				}
-			case UpdateProgressNotificationType:
-				var dp updater.DownloadProgress
-				err = decoder.Decode(&dp.Activity)
-				if err != nil {
-					continue
-				}
-				err = decoder.Decode(&dp.BytesDownloaded)
-				if err != nil {
-					continue
-				}
-				err = decoder.Decode(&dp.BytesTotal)
-				if err != nil {
-					continue
-				}
-				var errStr string
-				err = decoder.Decode(&errStr)
-				if err != nil {
-					continue
-				}
-				if len(errStr) > 0 {
-					dp.Error = errors.New(errStr)
-				}
-				err = decoder.Decode(&dp.Complete)
-				if err != nil {
-					continue
-				}
-				for cb := range updateProgressCallbacks {
-					cb.cb(dp)
-				}
-			}
-		}
-	}()
+type GroupChangeCallback struct {
+	cb func(groupName string, state TunnelState)
 }
 
-func rpcDecodeError() error {
-	var str string
-	err := rpcDecoder.Decode(&str)
-	if err != nil {
-		return err
-	}
-	if len(str) == 0 {
-		return nil
-	}
-	return errors.New(str)
+var groupChangeCallbacks = make(map[*GroupChangeCallback]bool)
+
+type TunnelRenameCallback struct {
+	cb func(oldName string, newName string)
 }
 
-func (t *Tunnel) StoredConfig() (c conf.Config, err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+var tunnelRenameCallbacks = make(map[*TunnelRenameCallback]bool)
 
-	err = rpcEncoder.Encode(StoredConfigMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcEncoder.Encode(t.Name)
-	if err != nil {
-		return
-	}
-	err = rpcDecoder.Decode(&c)
-	if err != nil {
-		return
-	}
-	err = rpcDecodeError()
-	return
+type TunnelHealthCallback struct {
+	cb func(tunnel *Tunnel, health TunnelHealth, detail string)
 }
 
-func (t *Tunnel) RuntimeConfig() (c conf.Config, err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+var tunnelHealthCallbacks = make(map[*TunnelHealthCallback]bool)
 
-	err = rpcEncoder.Encode(RuntimeConfigMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcEncoder.Encode(t.Name)
-	if err != nil {
-		return
+func dispatchNotification(name string, decode func(interface{}) error) {
+	switch NotificationType(name) {
+	case TunnelChangeNotificationType:
+		var notification TunnelChangeNotification
+		if decode(&notification) != nil || len(notification.Name) == 0 || notification.State == TunnelUnknown {
+			return
+		}
+		var err error
+		if notification.Error != nil {
+			err = notification.Error
+		}
+		t := &Tunnel{notification.Name}
+		for _, cb := range snapshotTunnelChangeCallbacks() {
+			cb.cb(t, notification.State, notification.GlobalState, err)
+		}
+	case TunnelsChangeNotificationType:
+		for _, cb := range snapshotTunnelsChangeCallbacks() {
+			cb.cb()
+		}
+	case ManagerStoppingNotificationType:
+		for _, cb := range snapshotManagerStoppingCallbacks() {
+			cb.cb()
+		}
+	case UpdateFoundNotificationType:
+		var notification UpdateFoundNotification
+		if decode(&notification) != nil {
+			return
+		}
+		for _, cb := range snapshotUpdateFoundCallbacks() {
+			cb.cb(notification.State)
+		}
+	case UpdateProgressNotificationType:
+		var notification UpdateProgressNotification
+		if decode(&notification) != nil {
+			return
+		}
+		dp := updater.DownloadProgress{
+			Activity:        notification.Activity,
+			BytesDownloaded: notification.BytesDownloaded,
+			BytesTotal:      notification.BytesTotal,
+			BytesPerSecond:  notification.BytesPerSecond,
+			ETA:             notification.ETA,
+			Retries:         notification.Retries,
+			Complete:        notification.Complete,
+		}
+		if notification.Error != nil {
+			dp.Error = notification.Error
+		}
+		for _, cb := range snapshotUpdateProgressCallbacks() {
+			cb.cb(dp)
+		}
+	case GroupChangeNotificationType:
+		var notification GroupChangeNotification
+		if decode(&notification) != nil || len(notification.Name) == 0 {
+			return
+		}
+		for _, cb := range snapshotGroupChangeCallbacks() {
+			cb.cb(notification.Name, notification.State)
+		}
+	case TunnelRenameNotificationType:
+		var notification TunnelRenameNotification
+		if decode(&notification) != nil || len(notification.OldName) == 0 || len(notification.NewName) == 0 {
+			return
+		}
+		for _, cb := range snapshotTunnelRenameCallbacks() {
+			cb.cb(notification.OldName, notification.NewName)
+		}
+	case TunnelHealthNotificationType:
+		var notification TunnelHealthNotification
+		if decode(&notification) != nil || len(notification.Name) == 0 {
+			return
+		}
+		t := &Tunnel{notification.Name}
+		for _, cb := range snapshotTunnelHealthCallbacks() {
+			cb.cb(t, notification.Health, notification.Detail)
+		}
 	}
-	err = rpcDecoder.Decode(&c)
-	if err != nil {
-		return
+}
+
+func call(method MethodType, request interface{}, response interface{}) error {
+	if rpcClient == nil {
+		return errors.New("Not connected to the manager")
 	}
-	err = rpcDecodeError()
-	return
+	return rpcClient.Call(string(method), request, response)
 }
 
-func (t *Tunnel) Start() (err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+func (t *Tunnel) StoredConfig() (conf.Config, error) {
+	var response ConfigResponse
+	err := call(StoredConfigMethodType, &TunnelRequest{t.Name}, &response)
+	return response.Config, err
+}
 
-	err = rpcEncoder.Encode(StartMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcEncoder.Encode(t.Name)
-	if err != nil {
-		return
-	}
-	err = rpcDecodeError()
-	return
+func (t *Tunnel) StoredMetadata() (conf.Metadata, error) {
+	var response MetadataResponse
+	err := call(StoredMetadataMethodType, &TunnelRequest{t.Name}, &response)
+	return response.Metadata, err
 }
 
-func (t *Tunnel) Stop() (err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+func (t *Tunnel) SetMetadata(metadata *conf.Metadata) error {
+	return call(SetMetadataMethodType, &SetMetadataRequest{t.Name, *metadata}, nil)
+}
 
-	err = rpcEncoder.Encode(StopMethodType)
+// Rename gives the tunnel a new name, restarting it under that name if it was running, and
+// returns the renamed tunnel.
+func (t *Tunnel) Rename(newName string) (Tunnel, error) {
+	err := call(RenameMethodType, &RenameRequest{t.Name, newName}, nil)
 	if err != nil {
-		return
+		return Tunnel{}, err
 	}
-	err = rpcEncoder.Encode(t.Name)
+	return Tunnel{newName}, nil
+}
+
+func (t *Tunnel) RuntimeConfig() (conf.Config, error) {
+	var response ConfigResponse
+	err := call(RuntimeConfigMethodType, &TunnelRequest{t.Name}, &response)
+	return response.Config, err
+}
+
+// Conflicts reports how the tunnel clashes with those already running. Start refuses with
+// rpc.ErrorConflict when any of these are errors.
+func (t *Tunnel) Conflicts() (*ConflictReport, error) {
+	var response ConflictsResponse
+	err := call(ConflictsMethodType, &TunnelRequest{t.Name}, &response)
 	if err != nil {
-		return
+		return nil, err
 	}
-	err = rpcDecodeError()
-	return
+	return &response.Report, nil
+}
+
+func (t *Tunnel) Start() error {
+	return call(StartMethodType, &TunnelRequest{t.Name}, nil)
+}
+
+func (t *Tunnel) Stop() error {
+	return call(StopMethodType, &TunnelRequest{t.Name}, nil)
 }
 
 func (t *Tunnel) Toggle() (oldState TunnelState, err error) {
@@ -286,188 +296,286 @@ func (t *Tunnel) Toggle() (oldState TunnelState, err error) {
 	return
 }
 
-func (t *Tunnel) WaitForStop() (err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+func (t *Tunnel) WaitForStop() error {
+	return call(WaitForStopMethodType, &TunnelRequest{t.Name}, nil)
+}
 
-	err = rpcEncoder.Encode(WaitForStopMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcEncoder.Encode(t.Name)
-	if err != nil {
-		return
-	}
-	err = rpcDecodeError()
-	return
+func (t *Tunnel) Delete() error {
+	return call(DeleteMethodType, &TunnelRequest{t.Name}, nil)
 }
 
-func (t *Tunnel) Delete() (err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+func (t *Tunnel) State() (TunnelState, error) {
+	var response StateResponse
+	err := call(StateMethodType, &TunnelRequest{t.Name}, &response)
+	return response.State, err
+}
 
-	err = rpcEncoder.Encode(DeleteMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcEncoder.Encode(t.Name)
-	if err != nil {
-		return
-	}
-	err = rpcDecodeError()
-	return
+func (t *Tunnel) Health() (TunnelHealth, error) {
+	var response HealthResponse
+	err := call(HealthMethodType, &TunnelRequest{t.Name}, &response)
+	return response.Health, err
 }
 
-func (t *Tunnel) State() (tunnelState TunnelState, err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+func IPCClientGlobalState() (TunnelState, error) {
+	var response StateResponse
+	err := call(GlobalStateMethodType, nil, &response)
+	return response.State, err
+}
 
-	err = rpcEncoder.Encode(StateMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcEncoder.Encode(t.Name)
-	if err != nil {
-		return
-	}
-	err = rpcDecoder.Decode(&tunnelState)
-	if err != nil {
-		return
-	}
-	err = rpcDecodeError()
-	return
+func IPCClientNewTunnel(conf *conf.Config) (Tunnel, error) {
+	var response CreateResponse
+	err := call(CreateMethodType, &CreateRequest{*conf}, &response)
+	return response.Tunnel, err
 }
 
-func IPCClientGlobalState() (tunnelState TunnelState, err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+func IPCClientTunnels() ([]Tunnel, error) {
+	var response TunnelsResponse
+	err := call(TunnelsMethodType, nil, &response)
+	return response.Tunnels, err
+}
 
-	err = rpcEncoder.Encode(GlobalStateMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcDecoder.Decode(&tunnelState)
-	if err != nil {
-		return
-	}
-	return
+// IPCClientListTunnels returns the tunnels along with their metadata, only those with the given
+// tag if it isn't empty, ordered by name or else by tag.
+func IPCClientListTunnels(tag string, sortByTag bool) ([]TunnelInfo, error) {
+	var response ListTunnelsResponse
+	err := call(ListTunnelsMethodType, &ListTunnelsRequest{tag, sortByTag}, &response)
+	return response.Tunnels, err
 }
 
-func IPCClientNewTunnel(conf *conf.Config) (tunnel Tunnel, err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+func IPCClientGroups() ([]conf.TunnelGroup, error) {
+	var response GroupsResponse
+	err := call(GroupsMethodType, nil, &response)
+	return response.Groups, err
+}
 
-	err = rpcEncoder.Encode(CreateMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcEncoder.Encode(*conf)
-	if err != nil {
-		return
-	}
-	err = rpcDecoder.Decode(&tunnel)
-	if err != nil {
-		return
-	}
-	err = rpcDecodeError()
-	return
+// IPCClientSetGroup adds a group, or replaces the group of the same name.
+func IPCClientSetGroup(group *conf.TunnelGroup) error {
+	return call(SetGroupMethodType, &GroupRequest{*group}, nil)
 }
 
-func IPCClientTunnels() (tunnels []Tunnel, err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+func IPCClientDeleteGroup(groupName string) error {
+	return call(DeleteGroupMethodType, &GroupNameRequest{groupName}, nil)
+}
 
-	err = rpcEncoder.Encode(TunnelsMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcDecoder.Decode(&tunnels)
-	if err != nil {
-		return
-	}
-	err = rpcDecodeError()
-	return
+// IPCClientStartGroup starts the members of a bundle in order, returning once all are started, or
+// once the bundle has been torn down again because one of them failed.
+func IPCClientStartGroup(groupName string) error {
+	return call(StartGroupMethodType, &GroupNameRequest{groupName}, nil)
 }
 
-func IPCClientQuit(stopTunnelsOnQuit bool) (alreadyQuit bool, err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+func IPCClientStopGroup(groupName string) error {
+	return call(StopGroupMethodType, &GroupNameRequest{groupName}, nil)
+}
 
-	err = rpcEncoder.Encode(QuitMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcEncoder.Encode(stopTunnelsOnQuit)
-	if err != nil {
-		return
-	}
-	err = rpcDecoder.Decode(&alreadyQuit)
-	if err != nil {
-		return
-	}
-	err = rpcDecodeError()
-	return
+func IPCClientGroupState(groupName string) (TunnelState, error) {
+	var response StateResponse
+	err := call(GroupStateMethodType, &GroupNameRequest{groupName}, &response)
+	return response.State, err
 }
 
-func IPCClientUpdateState() (updateState UpdateState, err error) {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+func IPCClientQuit(stopTunnelsOnQuit bool) (bool, error) {
+	var response QuitResponse
+	err := call(QuitMethodType, &QuitRequest{stopTunnelsOnQuit}, &response)
+	return response.AlreadyQuit, err
+}
 
-	err = rpcEncoder.Encode(UpdateStateMethodType)
-	if err != nil {
-		return
-	}
-	err = rpcDecoder.Decode(&updateState)
-	if err != nil {
-		return
-	}
-	return
+func IPCClientUpdateState() (UpdateState, error) {
+	var response UpdateStateResponse
+	err := call(UpdateStateMethodType, nil, &response)
+	return response.State, err
+}
+
+func IPCClientUpdateDetails() (UpdateDetails, error) {
+	var response UpdateDetailsResponse
+	err := call(UpdateDetailsMethodType, nil, &response)
+	return response.Details, err
 }
 
 func IPCClientUpdate() error {
-	rpcMutex.Lock()
-	defer rpcMutex.Unlock()
+	return call(UpdateMethodType, nil, nil)
+}
 
-	return rpcEncoder.Encode(UpdateMethodType)
+func IPCClientDiagnostics() ([]byte, []byte, error) {
+	var response DiagnosticsResponse
+	err := call(DiagnosticsMethodType, nil, &response)
+	return response.Bundle, response.Mapping, err
 }
 
 func IPCClientRegisterTunnelChange(cb func(tunnel *Tunnel, state TunnelState, globalState TunnelState, err error)) *TunnelChangeCallback {
 	s := &TunnelChangeCallback{cb}
+	callbacksLock.Lock()
 	tunnelChangeCallbacks[s] = true
+	callbacksLock.Unlock()
 	return s
 }
 func (cb *TunnelChangeCallback) Unregister() {
+	callbacksLock.Lock()
 	delete(tunnelChangeCallbacks, cb)
+	callbacksLock.Unlock()
 }
 func IPCClientRegisterTunnelsChange(cb func()) *TunnelsChangeCallback {
 	s := &TunnelsChangeCallback{cb}
+	callbacksLock.Lock()
 	tunnelsChangeCallbacks[s] = true
+	callbacksLock.Unlock()
 	return s
 }
 func (cb *TunnelsChangeCallback) Unregister() {
+	callbacksLock.Lock()
 	delete(tunnelsChangeCallbacks, cb)
+	callbacksLock.Unlock()
 }
 func IPCClientRegisterManagerStopping(cb func()) *ManagerStoppingCallback {
 	s := &ManagerStoppingCallback{cb}
+	callbacksLock.Lock()
 	managerStoppingCallbacks[s] = true
+	callbacksLock.Unlock()
 	return s
 }
 func (cb *ManagerStoppingCallback) Unregister() {
+	callbacksLock.Lock()
 	delete(managerStoppingCallbacks, cb)
+	callbacksLock.Unlock()
 }
 func IPCClientRegisterUpdateFound(cb func(updateState UpdateState)) *UpdateFoundCallback {
 	s := &UpdateFoundCallback{cb}
+	callbacksLock.Lock()
 	updateFoundCallbacks[s] = true
+	callbacksLock.Unlock()
 	return s
 }
 func (cb *UpdateFoundCallback) Unregister() {
+	callbacksLock.Lock()
 	delete(updateFoundCallbacks, cb)
+	callbacksLock.Unlock()
 }
 func IPCClientRegisterUpdateProgress(cb func(dp updater.DownloadProgress)) *UpdateProgressCallback {
 	s := &UpdateProgressCallback{cb}
+	callbacksLock.Lock()
 	updateProgressCallbacks[s] = true
+	callbacksLock.Unlock()
 	return s
 }
 func (cb *UpdateProgressCallback) Unregister() {
+	callbacksLock.Lock()
 	delete(updateProgressCallbacks, cb)
+	callbacksLock.Unlock()
+}
+func IPCClientRegisterGroupChange(cb func(groupName string, state TunnelState)) *GroupChangeCallback {
+	s := &GroupChangeCallback{cb}
+	callbacksLock.Lock()
+	groupChangeCallbacks[s] = true
+	callbacksLock.Unlock()
+	return s
+}
+func (cb *GroupChangeCallback) Unregister() {
+	callbacksLock.Lock()
+	delete(groupChangeCallbacks, cb)
+	callbacksLock.Unlock()
+}
+
+func IPCClientRegisterTunnelRename(cb func(oldName string, newName string)) *TunnelRenameCallback {
+	s := &TunnelRenameCallback{cb}
+	callbacksLock.Lock()
+	tunnelRenameCallbacks[s] = true
+	callbacksLock.Unlock()
+	return s
+}
+func (cb *TunnelRenameCallback) Unregister() {
+	callbacksLock.Lock()
+	delete(tunnelRenameCallbacks, cb)
+	callbacksLock.Unlock()
+}
+
+func IPCClientRegisterTunnelHealth(cb func(tunnel *Tunnel, health TunnelHealth, detail string)) *TunnelHealthCallback {
+	s := &TunnelHealthCallback{cb}
+	callbacksLock.Lock()
+	tunnelHealthCallbacks[s] = true
+	callbacksLock.Unlock()
+	return s
+}
+func (cb *TunnelHealthCallback) Unregister() {
+	callbacksLock.Lock()
+	delete(tunnelHealthCallbacks, cb)
+	callbacksLock.Unlock()
+}
+
+func snapshotTunnelChangeCallbacks() []*TunnelChangeCallback {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	callbacks := make([]*TunnelChangeCallback, 0, len(tunnelChangeCallbacks))
+	for cb := range tunnelChangeCallbacks {
+		callbacks = append(callbacks, cb)
+	}
+	return callbacks
+}
+
+func snapshotTunnelsChangeCallbacks() []*TunnelsChangeCallback {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	callbacks := make([]*TunnelsChangeCallback, 0, len(tunnelsChangeCallbacks))
+	for cb := range tunnelsChangeCallbacks {
+		callbacks = append(callbacks, cb)
+	}
+	return callbacks
+}
+
+func snapshotManagerStoppingCallbacks() []*ManagerStoppingCallback {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	callbacks := make([]*ManagerStoppingCallback, 0, len(managerStoppingCallbacks))
+	for cb := range managerStoppingCallbacks {
+		callbacks = append(callbacks, cb)
+	}
+	return callbacks
+}
+
+func snapshotUpdateFoundCallbacks() []*UpdateFoundCallback {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	callbacks := make([]*UpdateFoundCallback, 0, len(updateFoundCallbacks))
+	for cb := range updateFoundCallbacks {
+		callbacks = append(callbacks, cb)
+	}
+	return callbacks
+}
+
+func snapshotUpdateProgressCallbacks() []*UpdateProgressCallback {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	callbacks := make([]*UpdateProgressCallback, 0, len(updateProgressCallbacks))
+	for cb := range updateProgressCallbacks {
+		callbacks = append(callbacks, cb)
+	}
+	return callbacks
+}
+
+func snapshotGroupChangeCallbacks() []*GroupChangeCallback {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	callbacks := make([]*GroupChangeCallback, 0, len(groupChangeCallbacks))
+	for cb := range groupChangeCallbacks {
+		callbacks = append(callbacks, cb)
+	}
+	return callbacks
+}
+
+func snapshotTunnelRenameCallbacks() []*TunnelRenameCallback {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	callbacks := make([]*TunnelRenameCallback, 0, len(tunnelRenameCallbacks))
+	for cb := range tunnelRenameCallbacks {
+		callbacks = append(callbacks, cb)
+	}
+	return callbacks
+}
+
+func snapshotTunnelHealthCallbacks() []*TunnelHealthCallback {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+	callbacks := make([]*TunnelHealthCallback, 0, len(tunnelHealthCallbacks))
+	for cb := range tunnelHealthCallbacks {
+		callbacks = append(callbacks, cb)
+	}
+	return callbacks
 }
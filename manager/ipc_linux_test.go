@@ -0,0 +1,1037 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
+	"golang.zx2c4.com/wireguard/windows/updater"
+)
+
+const testConfig = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.192.122.1/24
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+Endpoint = 192.95.5.67:1234
+AllowedIPs = 10.192.122.3/32
+`
+
+// fakeBackend keeps tunnels in memory, and "starts" them by changing their state a moment later.
+type fakeBackend struct {
+	sync.Mutex
+	startLock sync.Mutex
+	configs   map[string]*conf.Config
+	states    map[string]TunnelState
+	stopped   map[string]chan struct{}
+	meta      map[string]*conf.Metadata
+	groups    []conf.TunnelGroup
+	log       []string
+	quit      bool
+
+	// installDelay stands in for the time that InstallTunnel spends with the service manager.
+	installDelay time.Duration
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		configs: make(map[string]*conf.Config),
+		states:  make(map[string]TunnelState),
+		stopped: make(map[string]chan struct{}),
+		meta:    make(map[string]*conf.Metadata),
+	}
+}
+
+func notFound(tunnelName string) error {
+	return fmt.Errorf("Tunnel ‘%s’: %w", tunnelName, os.ErrNotExist)
+}
+
+func (b *fakeBackend) setState(tunnelName string, state TunnelState) {
+	b.states[tunnelName] = state
+	IPCServerNotifyTunnelChange(tunnelName, state, b.globalState(), nil)
+}
+
+func (b *fakeBackend) globalState() TunnelState {
+	for _, state := range b.states {
+		if state == TunnelStarted {
+			return TunnelStarted
+		}
+	}
+	return TunnelStopped
+}
+
+func (b *fakeBackend) StoredConfig(tunnelName string) (*conf.Config, error) {
+	b.Lock()
+	defer b.Unlock()
+	config, ok := b.configs[tunnelName]
+	if !ok {
+		return nil, notFound(tunnelName)
+	}
+	return config, nil
+}
+
+func (b *fakeBackend) RuntimeConfig(tunnelName string) (*conf.Config, error) {
+	return b.StoredConfig(tunnelName)
+}
+
+func (b *fakeBackend) StoredMetadata(tunnelName string) (*conf.Metadata, error) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.configs[tunnelName]; !ok {
+		return nil, notFound(tunnelName)
+	}
+	if m, ok := b.meta[tunnelName]; ok {
+		metadata := *m
+		return &metadata, nil
+	}
+	return &conf.Metadata{Version: conf.MetadataVersion}, nil
+}
+
+func (b *fakeBackend) SetMetadata(tunnelName string, metadata *conf.Metadata) error {
+	err := metadata.Validate()
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.configs[tunnelName]; !ok {
+		return notFound(tunnelName)
+	}
+	b.meta[tunnelName] = metadata
+	return nil
+}
+
+func (b *fakeBackend) conflicts(tunnelName string) (*ConflictReport, []string, error) {
+	config, ok := b.configs[tunnelName]
+	if !ok {
+		return nil, nil, notFound(tunnelName)
+	}
+	rivals := exclusiveRivals(tunnelName, b.groups)
+	var running []*conf.Config
+nextTunnel:
+	for name, state := range b.states {
+		if name == tunnelName {
+			continue
+		}
+		for _, rival := range rivals {
+			if name == rival {
+				continue nextTunnel
+			}
+		}
+		if state == TunnelStarted || state == TunnelStarting {
+			running = append(running, b.configs[name])
+		}
+	}
+	return AnalyzeConflicts(config, running), rivals, nil
+}
+
+func (b *fakeBackend) Conflicts(tunnelName string) (*ConflictReport, error) {
+	b.Lock()
+	defer b.Unlock()
+	report, _, err := b.conflicts(tunnelName)
+	return report, err
+}
+
+// Start checks for conflicts and then installs the tunnel as the service backend does, under a
+// start lock of its own, with the state lock only held for each step.
+func (b *fakeBackend) Start(tunnelName string) error {
+	b.startLock.Lock()
+	defer b.startLock.Unlock()
+	b.Lock()
+	report, rivals, err := b.conflicts(tunnelName)
+	b.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = report.Err(); err != nil {
+		return err
+	}
+	for _, rival := range rivals {
+		b.Stop(rival)
+	}
+	time.Sleep(b.installDelay)
+	return b.install(tunnelName)
+}
+
+// install brings a tunnel up, refusing, like InstallTunnel, if it is running already.
+func (b *fakeBackend) install(tunnelName string) error {
+	b.Lock()
+	defer b.Unlock()
+	if state := b.states[tunnelName]; state == TunnelStarting || state == TunnelStarted {
+		return errors.New("Tunnel already installed and running")
+	}
+	b.log = append(b.log, "start "+tunnelName)
+	b.stopped[tunnelName] = make(chan struct{})
+	b.setState(tunnelName, TunnelStarting)
+	time.AfterFunc(time.Millisecond*10, func() {
+		b.Lock()
+		defer b.Unlock()
+		if b.states[tunnelName] == TunnelStarting {
+			b.setState(tunnelName, TunnelStarted)
+		}
+	})
+	return nil
+}
+
+func (b *fakeBackend) Stop(tunnelName string) error {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.configs[tunnelName]; !ok {
+		return notFound(tunnelName)
+	}
+	if b.states[tunnelName] == TunnelStopped {
+		return nil
+	}
+	b.stop(tunnelName)
+	return nil
+}
+
+func (b *fakeBackend) stop(tunnelName string) {
+	b.log = append(b.log, "stop "+tunnelName)
+	b.setState(tunnelName, TunnelStopped)
+	if stopped, ok := b.stopped[tunnelName]; ok {
+		close(stopped)
+		delete(b.stopped, tunnelName)
+	}
+}
+
+func (b *fakeBackend) WaitForStop(tunnelName string) error {
+	b.Lock()
+	stopped, ok := b.stopped[tunnelName]
+	b.Unlock()
+	if ok {
+		<-stopped
+	}
+	return nil
+}
+
+func (b *fakeBackend) Delete(tunnelName string) error {
+	err := b.Stop(tunnelName)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	delete(b.configs, tunnelName)
+	delete(b.states, tunnelName)
+	delete(b.meta, tunnelName)
+	return nil
+}
+
+func (b *fakeBackend) Rename(tunnelName string, newName string) error {
+	b.Lock()
+	config, ok := b.configs[tunnelName]
+	if !ok {
+		b.Unlock()
+		return notFound(tunnelName)
+	}
+	for name := range b.configs {
+		if name != tunnelName && strings.EqualFold(name, newName) {
+			b.Unlock()
+			return fmt.Errorf("Tunnel ‘%s’: %w", newName, os.ErrExist)
+		}
+	}
+	wasRunning := b.states[tunnelName] != TunnelStopped
+	b.Unlock()
+	if wasRunning {
+		b.Stop(tunnelName)
+	}
+	b.Lock()
+	renamed := *config
+	renamed.Name = newName
+	b.configs[newName] = &renamed
+	b.states[newName] = TunnelStopped
+	if m, ok := b.meta[tunnelName]; ok {
+		b.meta[newName] = m
+	}
+	delete(b.configs, tunnelName)
+	delete(b.states, tunnelName)
+	delete(b.meta, tunnelName)
+	for i := range b.groups {
+		for j, member := range b.groups[i].Members {
+			if strings.EqualFold(member, tunnelName) {
+				b.groups[i].Members[j] = newName
+			}
+		}
+	}
+	b.log = append(b.log, "rename "+tunnelName+" "+newName)
+	b.Unlock()
+	IPCServerNotifyTunnelRename(tunnelName, newName)
+	if wasRunning {
+		return b.Start(newName)
+	}
+	return nil
+}
+
+func (b *fakeBackend) State(tunnelName string) (TunnelState, error) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.configs[tunnelName]; !ok {
+		return TunnelUnknown, notFound(tunnelName)
+	}
+	return b.states[tunnelName], nil
+}
+
+func (b *fakeBackend) Health(tunnelName string) (TunnelHealth, error) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.configs[tunnelName]; !ok {
+		return HealthUnknown, notFound(tunnelName)
+	}
+	if b.states[tunnelName] != TunnelStarted {
+		return HealthUnknown, nil
+	}
+	return HealthHealthy, nil
+}
+
+func (b *fakeBackend) GlobalState() TunnelState {
+	b.Lock()
+	defer b.Unlock()
+	return b.globalState()
+}
+
+func (b *fakeBackend) Create(tunnelConfig *conf.Config) (*Tunnel, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.configs[tunnelConfig.Name] = tunnelConfig
+	b.states[tunnelConfig.Name] = TunnelStopped
+	return &Tunnel{tunnelConfig.Name}, nil
+}
+
+func (b *fakeBackend) Tunnels() ([]Tunnel, error) {
+	b.Lock()
+	defer b.Unlock()
+	tunnels := make([]Tunnel, 0, len(b.configs))
+	for name := range b.configs {
+		tunnels = append(tunnels, Tunnel{name})
+	}
+	return tunnels, nil
+}
+
+func (b *fakeBackend) Groups() ([]conf.TunnelGroup, error) {
+	b.Lock()
+	defer b.Unlock()
+	return append([]conf.TunnelGroup(nil), b.groups...), nil
+}
+
+func (b *fakeBackend) SetGroup(group *conf.TunnelGroup) error {
+	b.Lock()
+	defer b.Unlock()
+	names := make([]string, 0, len(b.configs))
+	for name := range b.configs {
+		names = append(names, name)
+	}
+	err := checkGroupMembers(group, names)
+	if err != nil {
+		return err
+	}
+	for i := range b.groups {
+		if b.groups[i].Name == group.Name {
+			b.groups[i] = *group
+			return nil
+		}
+	}
+	b.groups = append(b.groups, *group)
+	return nil
+}
+
+func (b *fakeBackend) DeleteGroup(groupName string) error {
+	b.Lock()
+	defer b.Unlock()
+	for i := range b.groups {
+		if b.groups[i].Name == groupName {
+			b.groups = append(b.groups[:i], b.groups[i+1:]...)
+			return nil
+		}
+	}
+	return notFound(groupName)
+}
+
+func (b *fakeBackend) StartGroup(groupName string) error {
+	groups, _ := b.Groups()
+	return startGroup(b, groups, groupName)
+}
+
+func (b *fakeBackend) StopGroup(groupName string) error {
+	groups, _ := b.Groups()
+	return stopGroup(b, groups, groupName)
+}
+
+func (b *fakeBackend) GroupState(groupName string) (TunnelState, error) {
+	b.Lock()
+	defer b.Unlock()
+	group, err := findGroup(b.groups, groupName)
+	if err != nil {
+		return TunnelUnknown, err
+	}
+	var states []TunnelState
+	for _, member := range group.Members {
+		states = append(states, b.states[member])
+	}
+	return aggregateTunnelState(states), nil
+}
+
+func (b *fakeBackend) Quit(stopTunnelsOnQuit bool) error {
+	b.Lock()
+	defer b.Unlock()
+	b.quit = true
+	return nil
+}
+
+func (b *fakeBackend) UpdateState() UpdateState {
+	return UpdateStateFoundUpdate
+}
+
+func (b *fakeBackend) UpdateDetails() UpdateDetails {
+	return UpdateDetails{Channel: "stable", Mirror: "https://mirror.example.com"}
+}
+
+func (b *fakeBackend) Update(peer *Peer) {
+	go func() {
+		IPCServerNotifyUpdateProgress(updater.DownloadProgress{Activity: "Downloading update", BytesTotal: 100})
+		IPCServerNotifyUpdateProgress(updater.DownloadProgress{Activity: "Downloading update", BytesDownloaded: 100, BytesTotal: 100})
+		IPCServerNotifyUpdateProgress(updater.DownloadProgress{Error: errors.New("Installer failed")})
+	}()
+}
+
+func (b *fakeBackend) Diagnostics() ([]byte, []byte, error) {
+	return []byte("bundle"), []byte("mapping"), nil
+}
+
+type tunnelChange struct {
+	name  string
+	state TunnelState
+}
+
+// startManager serves backend on a Unix domain socket, and connects this package's client to it.
+func startManager(t *testing.T, backend TunnelBackend, authorize Authorizer) {
+	listener, err := ListenUnixSocket(filepath.Join(t.TempDir(), "manager.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go IPCServe(listener, backend, authorize)
+	err = ConnectIPCClient(UnixSocketDialer(listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		DisconnectIPCClient()
+		listener.Close()
+	})
+}
+
+func waitForChange(t *testing.T, changes chan tunnelChange, name string, state TunnelState) {
+	for {
+		select {
+		case change := <-changes:
+			if change.name == name && change.state == state {
+				return
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Timed out waiting for ‘%s’ to become %d", name, state)
+		}
+	}
+}
+
+func TestIPCTunnelLifecycle(t *testing.T) {
+	changes := make(chan tunnelChange, 100)
+	cb := IPCClientRegisterTunnelChange(func(tunnel *Tunnel, state TunnelState, globalState TunnelState, err error) {
+		changes <- tunnelChange{tunnel.Name, state}
+	})
+	defer cb.Unregister()
+	startManager(t, newFakeBackend(), AllowAll)
+
+	config, err := conf.FromWgQuick(testConfig, "office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel, err := IPCClientNewTunnel(config)
+	if err != nil || tunnel.Name != "office" {
+		t.Fatalf("Create returned %v, %v", tunnel, err)
+	}
+	tunnels, err := IPCClientTunnels()
+	if err != nil || len(tunnels) != 1 || tunnels[0].Name != "office" {
+		t.Errorf("Tunnels returned %v, %v", tunnels, err)
+	}
+	stored, err := tunnel.StoredConfig()
+	if err != nil || stored.ToWgQuick() != config.ToWgQuick() {
+		t.Errorf("StoredConfig returned %v, %v", stored, err)
+	}
+
+	err = tunnel.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, changes, "office", TunnelStarted)
+	state, err := tunnel.State()
+	if err != nil || state != TunnelStarted {
+		t.Errorf("State returned %d, %v", state, err)
+	}
+	globalState, err := IPCClientGlobalState()
+	if err != nil || globalState != TunnelStarted {
+		t.Errorf("GlobalState returned %d, %v", globalState, err)
+	}
+
+	// WaitForStop must not hold up the call that stops the tunnel.
+	waited := make(chan error, 1)
+	go func() {
+		waited <- tunnel.WaitForStop()
+	}()
+	time.Sleep(time.Millisecond * 50)
+	err = tunnel.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-waited:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("WaitForStop did not return after the tunnel stopped")
+	}
+	waitForChange(t, changes, "office", TunnelStopped)
+
+	err = tunnel.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tunnel.State()
+	if rpc.Code(err) != rpc.ErrorNotFound {
+		t.Errorf("State of deleted tunnel returned %v, want not found", err)
+	}
+	err = (&Tunnel{"missing"}).Start()
+	if rpc.Code(err) != rpc.ErrorNotFound {
+		t.Errorf("Starting a missing tunnel returned %v, want not found", err)
+	}
+}
+
+func TestIPCConflicts(t *testing.T) {
+	changes := make(chan tunnelChange, 100)
+	cb := IPCClientRegisterTunnelChange(func(tunnel *Tunnel, state TunnelState, globalState TunnelState, err error) {
+		changes <- tunnelChange{tunnel.Name, state}
+	})
+	defer cb.Unregister()
+	startManager(t, newFakeBackend(), AllowAll)
+
+	var tunnels [3]Tunnel
+	for i, config := range []string{
+		testConfig,
+		"[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nAddress = 10.200.0.2/24\n\n[Peer]\nPublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\nAllowedIPs = 10.200.0.0/16\n",
+		"[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nAddress = 10.192.122.9/24\n\n[Peer]\nPublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\nAllowedIPs = 10.192.122.3/32\n",
+	} {
+		c, err := conf.FromWgQuick(config, []string{"office", "lab", "clash"}[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnels[i], err = IPCClientNewTunnel(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tunnels[0].Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, changes, "office", TunnelStarted)
+
+	// Unrelated tunnels run side by side.
+	err = tunnels[1].Start()
+	if err != nil {
+		t.Fatalf("Starting a second, unrelated tunnel failed: %v", err)
+	}
+	waitForChange(t, changes, "lab", TunnelStarted)
+
+	report, err := tunnels[2].Conflicts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.HasErrors() || len(report.Conflicts) != 2 || report.Conflicts[0].Tunnel != "office" || report.Conflicts[0].Kind != ConflictAllowedIPs {
+		t.Errorf("Conflicts returned %+v", report)
+	}
+	err = tunnels[2].Start()
+	if rpc.Code(err) != rpc.ErrorConflict || !strings.Contains(err.Error(), "10.192.122.3/32") {
+		t.Errorf("Starting a conflicting tunnel returned %v, want conflict", err)
+	}
+	if state, _ := tunnels[2].State(); state != TunnelStopped {
+		t.Errorf("Conflicting tunnel is %s", state)
+	}
+}
+
+func TestIPCConcurrentStarts(t *testing.T) {
+	backend := newFakeBackend()
+	backend.installDelay = time.Millisecond * 5
+	startManager(t, backend, AllowAll)
+	var tunnels [2]Tunnel
+	for i, name := range []string{"full", "exit"} {
+		c := conflictTestConfig(t, name, "Address = 192.168.50.2/24\n", "0.0.0.0/0")
+		var err error
+		tunnels[i], err = IPCClientNewTunnel(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for round := 0; round < 20; round++ {
+		errs := make(chan error, len(tunnels))
+		for i := range tunnels {
+			go func(tunnel Tunnel) {
+				errs <- tunnel.Start()
+			}(tunnels[i])
+		}
+		started := 0
+		for range tunnels {
+			if <-errs == nil {
+				started++
+			}
+		}
+		if started != 1 {
+			t.Fatalf("Round %d: %d conflicting tunnels started together", round, started)
+		}
+		for i := range tunnels {
+			err := tunnels[i].Stop()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestIPCMetadata(t *testing.T) {
+	startManager(t, newFakeBackend(), AllowAll)
+
+	var tunnels [3]Tunnel
+	for i, name := range []string{"office", "lab", "home"} {
+		c, err := conf.FromWgQuick(testConfig, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnels[i], err = IPCClientNewTunnel(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata, err := tunnels[0].StoredMetadata()
+	if err != nil || !metadata.IsEmpty() || metadata.Version != conf.MetadataVersion {
+		t.Errorf("Metadata before any was set: %+v, %v", metadata, err)
+	}
+	for i, m := range []conf.Metadata{
+		{DisplayName: "Office", Owner: "it@example.com", Tags: []string{"Work", "vpn"}, StartAtBoot: true},
+		{Tags: []string{"work"}, Notes: "Only on weekdays"},
+	} {
+		err = tunnels[i].SetMetadata(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata, err = tunnels[0].StoredMetadata()
+	if err != nil || metadata.DisplayName != "Office" || !metadata.StartAtBoot || !reflect.DeepEqual(metadata.Tags, []string{"vpn", "work"}) {
+		t.Errorf("Metadata after setting it: %+v, %v", metadata, err)
+	}
+	err = tunnels[2].SetMetadata(&conf.Metadata{Tags: []string{"not a tag"}})
+	if err == nil {
+		t.Error("Setting an invalid tag succeeded")
+	}
+	err = (&Tunnel{"missing"}).SetMetadata(&conf.Metadata{Notes: "Nothing"})
+	if rpc.Code(err) != rpc.ErrorNotFound {
+		t.Errorf("Setting metadata of a missing tunnel returned %v", err)
+	}
+
+	names := func(infos []TunnelInfo) []string {
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		return names
+	}
+	infos, err := IPCClientListTunnels("", false)
+	if err != nil || !reflect.DeepEqual(names(infos), []string{"home", "lab", "office"}) {
+		t.Errorf("Listing tunnels returned %v, %v", names(infos), err)
+	}
+	infos, err = IPCClientListTunnels("", true)
+	if err != nil || !reflect.DeepEqual(names(infos), []string{"office", "lab", "home"}) {
+		t.Errorf("Listing tunnels by tag returned %v, %v", names(infos), err)
+	}
+	infos, err = IPCClientListTunnels("WORK", false)
+	if err != nil || !reflect.DeepEqual(names(infos), []string{"lab", "office"}) || infos[0].Metadata.Notes != "Only on weekdays" {
+		t.Errorf("Listing tunnels tagged work returned %+v, %v", infos, err)
+	}
+}
+
+func TestIPCRename(t *testing.T) {
+	changes := make(chan tunnelChange, 100)
+	cb := IPCClientRegisterTunnelChange(func(tunnel *Tunnel, state TunnelState, globalState TunnelState, err error) {
+		changes <- tunnelChange{tunnel.Name, state}
+	})
+	defer cb.Unregister()
+	renames := make(chan [2]string, 10)
+	renameCb := IPCClientRegisterTunnelRename(func(oldName string, newName string) {
+		renames <- [2]string{oldName, newName}
+	})
+	defer renameCb.Unregister()
+	backend := newFakeBackend()
+	startManager(t, backend, AllowAll)
+
+	var tunnels [2]Tunnel
+	for i, name := range []string{"office", "home"} {
+		c, err := conf.FromWgQuick(testConfig, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnels[i], err = IPCClientNewTunnel(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tunnels[0].SetMetadata(&conf.Metadata{DisplayName: "Office"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tunnels[0].Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, changes, "office", TunnelStarted)
+
+	renamed, err := tunnels[0].Rename("work")
+	if err != nil || renamed.Name != "work" {
+		t.Fatalf("Rename returned %v, %v", renamed, err)
+	}
+	select {
+	case rename := <-renames:
+		if rename != [2]string{"office", "work"} {
+			t.Errorf("Rename notification was %q", rename)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for rename notification")
+	}
+	waitForChange(t, changes, "work", TunnelStarted)
+	if _, err = tunnels[0].State(); rpc.Code(err) != rpc.ErrorNotFound {
+		t.Errorf("Old name still has a state: %v", err)
+	}
+	config, err := renamed.StoredConfig()
+	if err != nil || config.Name != "work" {
+		t.Errorf("Renamed configuration is %v, %v", config.Name, err)
+	}
+	if metadata, _ := renamed.StoredMetadata(); metadata.DisplayName != "Office" {
+		t.Errorf("Renamed metadata is %+v", metadata)
+	}
+
+	_, err = renamed.Rename("HOME")
+	if rpc.Code(err) != rpc.ErrorConflict {
+		t.Errorf("Renaming over an existing tunnel returned %v", err)
+	}
+	_, err = (&Tunnel{"missing"}).Rename("other")
+	if rpc.Code(err) != rpc.ErrorNotFound {
+		t.Errorf("Renaming a missing tunnel returned %v", err)
+	}
+	select {
+	case rename := <-renames:
+		t.Errorf("Failed rename sent notification %q", rename)
+	default:
+	}
+}
+
+func TestIPCHealth(t *testing.T) {
+	changes := make(chan tunnelChange, 100)
+	cb := IPCClientRegisterTunnelChange(func(tunnel *Tunnel, state TunnelState, globalState TunnelState, err error) {
+		changes <- tunnelChange{tunnel.Name, state}
+	})
+	defer cb.Unregister()
+	type healthChange struct {
+		name   string
+		health TunnelHealth
+		detail string
+	}
+	healthChanges := make(chan healthChange, 10)
+	healthCb := IPCClientRegisterTunnelHealth(func(tunnel *Tunnel, health TunnelHealth, detail string) {
+		healthChanges <- healthChange{tunnel.Name, health, detail}
+	})
+	defer healthCb.Unregister()
+	startManager(t, newFakeBackend(), AllowAll)
+
+	c, err := conf.FromWgQuick(testConfig, "office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel, err := IPCClientNewTunnel(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health, err := tunnel.Health(); err != nil || health != HealthUnknown {
+		t.Errorf("Stopped tunnel's health is %s, %v", health, err)
+	}
+	err = tunnel.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, changes, "office", TunnelStarted)
+	if health, err := tunnel.Health(); err != nil || health != HealthHealthy {
+		t.Errorf("Started tunnel's health is %s, %v", health, err)
+	}
+	if _, err = (&Tunnel{"missing"}).Health(); rpc.Code(err) != rpc.ErrorNotFound {
+		t.Errorf("Missing tunnel's health returned %v", err)
+	}
+
+	IPCServerNotifyTunnelHealth("office", HealthDead, "peer has had no handshake in 5m0s")
+	select {
+	case change := <-healthChanges:
+		if change != (healthChange{"office", HealthDead, "peer has had no handshake in 5m0s"}) {
+			t.Errorf("Health notification was %+v", change)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for health notification")
+	}
+}
+
+func TestIPCGroups(t *testing.T) {
+	backend := newFakeBackend()
+	startManager(t, backend, AllowAll)
+	for i, name := range []string{"alpha", "beta", "gamma"} {
+		config, err := conf.FromWgQuick(fmt.Sprintf("[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nAddress = 10.%d.0.2/24\n\n[Peer]\nPublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\nAllowedIPs = 10.%d.0.0/24\n", i, i), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = IPCClientNewTunnel(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	logSince := func(start int) []string {
+		backend.Lock()
+		defer backend.Unlock()
+		return append([]string(nil), backend.log[start:]...)
+	}
+
+	err := IPCClientSetGroup(&conf.TunnelGroup{Name: "broken", Kind: conf.GroupBundle, Members: []string{"alpha", "missing"}})
+	if rpc.Code(err) != rpc.ErrorNotFound {
+		t.Errorf("Group with a missing member was saved: %v", err)
+	}
+	err = IPCClientSetGroup(&conf.TunnelGroup{Name: "broken", Kind: "sometimes", Members: []string{"alpha"}})
+	if err == nil {
+		t.Error("Group of unknown kind was saved")
+	}
+	err = IPCClientSetGroup(&conf.TunnelGroup{Name: "lab", Kind: conf.GroupBundle, Members: []string{"alpha", "beta"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IPCClientSetGroup(&conf.TunnelGroup{Name: "sites", Kind: conf.GroupExclusive, Members: []string{"beta", "gamma"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := IPCClientGroups()
+	if err != nil || len(groups) != 2 || groups[0].Name != "lab" || groups[1].Members[1] != "gamma" {
+		t.Errorf("Groups returned %+v, %v", groups, err)
+	}
+
+	err = IPCClientStartGroup("lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log := logSince(0); fmt.Sprint(log) != "[start alpha start beta]" {
+		t.Errorf("Bundle was started as %q", log)
+	}
+	if state, err := IPCClientGroupState("lab"); err != nil || state != TunnelStarted {
+		t.Errorf("GroupState of started bundle returned %s, %v", state, err)
+	}
+	err = IPCClientStopGroup("lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log := logSince(2); fmt.Sprint(log) != "[stop beta stop alpha]" {
+		t.Errorf("Bundle was stopped as %q", log)
+	}
+	if state, err := IPCClientGroupState("lab"); err != nil || state != TunnelStopped {
+		t.Errorf("GroupState of stopped bundle returned %s, %v", state, err)
+	}
+
+	// Starting one member of an exclusive group stops the others.
+	err = (&Tunnel{"beta"}).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&Tunnel{"gamma"}).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log := logSince(4); fmt.Sprint(log) != "[start beta stop beta start gamma]" {
+		t.Errorf("Exclusive group was switched as %q", log)
+	}
+	if state, _ := (&Tunnel{"beta"}).State(); state != TunnelStopped {
+		t.Errorf("Rival tunnel is %s", state)
+	}
+	err = IPCClientStartGroup("sites")
+	if rpc.Code(err) != rpc.ErrorInvalidRequest {
+		t.Errorf("Starting an exclusive group returned %v", err)
+	}
+
+	err = IPCClientDeleteGroup("lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = IPCClientGroupState("lab"); rpc.Code(err) != rpc.ErrorNotFound {
+		t.Errorf("GroupState of deleted group returned %v, want not found", err)
+	}
+}
+
+func TestIPCBundleWithRunningMember(t *testing.T) {
+	backend := newFakeBackend()
+	startManager(t, backend, AllowAll)
+	for _, config := range []*conf.Config{
+		conflictTestConfig(t, "corporate", "Address = 10.10.0.2/16\n", "10.10.0.0/16"),
+		conflictTestConfig(t, "dev", "Address = 10.20.0.2/24\n", "10.20.0.0/24"),
+		conflictTestConfig(t, "clash", "Address = 10.10.9.2/24\n", "10.10.0.0/16"),
+	} {
+		_, err := IPCClientNewTunnel(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, group := range []conf.TunnelGroup{
+		{Name: "work", Kind: conf.GroupBundle, Members: []string{"corporate", "dev"}},
+		{Name: "broken", Kind: conf.GroupBundle, Members: []string{"corporate", "dev", "clash"}},
+	} {
+		err := IPCClientSetGroup(&group)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := (&Tunnel{"corporate"}).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Tunnel{"corporate"}).Start(); err == nil {
+		t.Fatal("Starting a running tunnel succeeded")
+	}
+
+	err = IPCClientStartGroup("work")
+	if err != nil {
+		t.Fatalf("Starting a bundle with a running member failed: %v", err)
+	}
+	err = (&Tunnel{"dev"}).Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the members that the failed start started are stopped again.
+	err = IPCClientStartGroup("broken")
+	if err == nil {
+		t.Fatal("Starting a bundle with a conflicting member succeeded")
+	}
+	backend.Lock()
+	log := fmt.Sprint(backend.log)
+	backend.Unlock()
+	if log != "[start corporate start dev stop dev start dev stop dev]" {
+		t.Errorf("Bundles were started as %q", log)
+	}
+	if state, _ := (&Tunnel{"corporate"}).State(); state != TunnelStarted {
+		t.Errorf("Running member is %s after failed bundle start", state)
+	}
+}
+
+func TestIPCUpdate(t *testing.T) {
+	progress := make(chan updater.DownloadProgress, 10)
+	cb := IPCClientRegisterUpdateProgress(func(dp updater.DownloadProgress) {
+		progress <- dp
+	})
+	defer cb.Unregister()
+	startManager(t, newFakeBackend(), AllowAll)
+
+	state, err := IPCClientUpdateState()
+	if err != nil || state != UpdateStateFoundUpdate {
+		t.Errorf("UpdateState returned %v, %v", state, err)
+	}
+	details, err := IPCClientUpdateDetails()
+	if err != nil || details.Channel != "stable" {
+		t.Errorf("UpdateDetails returned %+v, %v", details, err)
+	}
+	err = IPCClientUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []updater.DownloadProgress
+	for len(received) < 3 {
+		select {
+		case dp := <-progress:
+			received = append(received, dp)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Timed out waiting for update progress, after %d notifications", len(received))
+		}
+	}
+	if received[1].BytesDownloaded != 100 || received[2].Error == nil || received[2].Error.Error() != "Installer failed" {
+		t.Errorf("Update progress arrived as %+v", received)
+	}
+
+	bundle, mapping, err := IPCClientDiagnostics()
+	if err != nil || string(bundle) != "bundle" || string(mapping) != "mapping" {
+		t.Errorf("Diagnostics returned %q, %q, %v", bundle, mapping, err)
+	}
+}
+
+func TestIPCAuthorization(t *testing.T) {
+	var peers []Peer
+	var peersLock sync.Mutex
+	startManager(t, newFakeBackend(), func(peer *Peer, method MethodType) error {
+		peersLock.Lock()
+		peers = append(peers, *peer)
+		peersLock.Unlock()
+		if method == DeleteMethodType {
+			return &rpc.Error{Code: rpc.ErrorAccessDenied, Message: "Deleting tunnels is not allowed"}
+		}
+		return nil
+	})
+
+	_, err := IPCClientTunnels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&Tunnel{"office"}).Delete()
+	if rpc.Code(err) != rpc.ErrorAccessDenied {
+		t.Errorf("Delete returned %v, want access denied", err)
+	}
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	if len(peers) != 2 {
+		t.Fatalf("Authorizer was consulted %d times, want 2", len(peers))
+	}
+	if peers[0].PID != os.Getpid() || peers[0].User != strconv.Itoa(os.Getuid()) || peers[0].Elevated != (os.Getuid() == 0) {
+		t.Errorf("Peer was identified as %+v", peers[0])
+	}
+	if RequireElevated(&Peer{}, DeleteMethodType) == nil || RequireElevated(&Peer{Elevated: true}, DeleteMethodType) != nil {
+		t.Error("RequireElevated did not go by whether the peer is elevated")
+	}
+}
+
+func TestIPCQuit(t *testing.T) {
+	atomic.StoreUint32(&haveQuit, 0)
+	backend := newFakeBackend()
+	startManager(t, backend, AllowAll)
+	alreadyQuit, err := IPCClientQuit(true)
+	if err != nil || alreadyQuit {
+		t.Errorf("First Quit returned %v, %v", alreadyQuit, err)
+	}
+	alreadyQuit, err = IPCClientQuit(true)
+	if err != nil || !alreadyQuit {
+		t.Errorf("Second Quit returned %v, %v", alreadyQuit, err)
+	}
+	backend.Lock()
+	defer backend.Unlock()
+	if !backend.quit {
+		t.Error("Backend was not told to quit")
+	}
+}
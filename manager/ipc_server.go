@@ -6,490 +6,307 @@
 package manager
 
 import (
-	"bytes"
-	"encoding/gob"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
+	"errors"
 	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"golang.org/x/sys/windows"
-	"golang.org/x/sys/windows/svc"
-
-	"golang.zx2c4.com/wireguard/ipc/winpipe"
-
-	"golang.zx2c4.com/wireguard/windows/conf"
-	"golang.zx2c4.com/wireguard/windows/services"
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
 	"golang.zx2c4.com/wireguard/windows/updater"
 )
 
 var managerServices = make(map[*ManagerService]bool)
 var managerServicesLock sync.RWMutex
 var haveQuit uint32
-var quitManagersChan = make(chan struct{}, 1)
 
+// ManagerService serves one client's connection, on behalf of a backend.
 type ManagerService struct {
-	events        *os.File
-	elevatedToken windows.Token
-}
-
-func (s *ManagerService) StoredConfig(tunnelName string) (*conf.Config, error) {
-	return conf.LoadFromName(tunnelName)
+	backend   TunnelBackend
+	peer      *Peer
+	authorize Authorizer
+	conn      *rpc.Conn
 }
 
-func (s *ManagerService) RuntimeConfig(tunnelName string) (*conf.Config, error) {
-	storedConfig, err := conf.LoadFromName(tunnelName)
-	if err != nil {
-		return nil, err
-	}
-	pipePath, err := services.PipePathOfTunnel(storedConfig.Name)
-	if err != nil {
-		return nil, err
-	}
-	localSystem, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
-	if err != nil {
-		return nil, err
-	}
-	pipe, err := winpipe.DialPipe(pipePath, nil, localSystem)
-	if err != nil {
-		return nil, err
-	}
-	defer pipe.Close()
-	pipe.SetWriteDeadline(time.Now().Add(time.Second * 2))
-	_, err = pipe.Write([]byte("get=1\n\n"))
-	if err != nil {
-		return nil, err
-	}
-	pipe.SetReadDeadline(time.Now().Add(time.Second * 2))
-	resp, err := ioutil.ReadAll(pipe)
-	if err != nil {
-		return nil, err
+func (s *ManagerService) Quit(stopTunnelsOnQuit bool) (alreadyQuit bool, err error) {
+	if !atomic.CompareAndSwapUint32(&haveQuit, 0, 1) {
+		return true, nil
 	}
-	return conf.FromUAPI(string(resp), storedConfig)
-}
 
-func (s *ManagerService) Start(tunnelName string) error {
-	// For now, enforce only one tunnel at a time. Later we'll remove this silly restriction.
-	trackedTunnelsLock.Lock()
-	tt := make([]string, 0, len(trackedTunnels))
-	var inTransition string
-	for t, state := range trackedTunnels {
-		tt = append(tt, t)
-		if len(t) > 0 && (state == TunnelStarting || state == TunnelUnknown) {
-			inTransition = t
-			break
-		}
-	}
-	trackedTunnelsLock.Unlock()
-	if len(inTransition) != 0 {
-		return fmt.Errorf("Please allow the tunnel ‘%s’ to finish activating", inTransition)
-	}
-	go func() {
-		for _, t := range tt {
-			s.Stop(t)
-		}
-		for _, t := range tt {
-			state, err := s.State(t)
-			if err == nil && (state == TunnelStarted || state == TunnelStarting) {
-				log.Printf("[%s] Trying again to stop zombie tunnel", t)
-				s.Stop(t)
-				time.Sleep(time.Millisecond * 100)
-			}
-		}
-	}()
-	time.AfterFunc(time.Second*10, cleanupStaleWintunInterfaces)
+	// Work around potential race condition of delivering messages to the wrong process by removing from notifications.
+	managerServicesLock.Lock()
+	delete(managerServices, s)
+	managerServicesLock.Unlock()
 
-	// After that process is started -- it's somewhat asynchronous -- we install the new one.
-	c, err := conf.LoadFromName(tunnelName)
-	if err != nil {
-		return err
-	}
-	path, err := c.Path()
-	if err != nil {
-		return err
-	}
-	return InstallTunnel(path)
+	return false, s.backend.Quit(stopTunnelsOnQuit)
 }
 
-func (s *ManagerService) Stop(tunnelName string) error {
-	time.AfterFunc(time.Second*10, cleanupStaleWintunInterfaces)
-
-	err := UninstallTunnel(tunnelName)
-	if err == windows.ERROR_SERVICE_DOES_NOT_EXIST {
-		_, notExistsError := conf.LoadFromName(tunnelName)
-		if notExistsError == nil {
-			return nil
-		}
+// ipcError attaches a code to the errors that clients are likely to want to act on.
+func ipcError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return rpc.NewError(rpc.ErrorNotFound, err)
+	} else if errors.Is(err, os.ErrExist) {
+		return rpc.NewError(rpc.ErrorConflict, err)
 	}
 	return err
 }
 
-func (s *ManagerService) WaitForStop(tunnelName string) error {
-	serviceName, err := services.ServiceNameOfTunnel(tunnelName)
-	if err != nil {
-		return err
-	}
-	m, err := serviceManager()
-	if err != nil {
-		return err
-	}
-	for {
-		service, err := m.OpenService(serviceName)
-		if err == nil || err == windows.ERROR_SERVICE_MARKED_FOR_DELETE {
-			service.Close()
-			time.Sleep(time.Second / 3)
-		} else {
-			return nil
+func (s *ManagerService) tunnelHandler(handle func(tunnelName string) (interface{}, error)) rpc.Handler {
+	return func(decode func(interface{}) error) (interface{}, error) {
+		var request TunnelRequest
+		err := decode(&request)
+		if err != nil {
+			return nil, err
 		}
+		response, err := handle(request.Name)
+		return response, ipcError(err)
 	}
 }
 
-func (s *ManagerService) Delete(tunnelName string) error {
-	err := s.Stop(tunnelName)
-	if err != nil {
-		return err
-	}
-	return conf.DeleteName(tunnelName)
-}
-
-func (s *ManagerService) State(tunnelName string) (TunnelState, error) {
-	serviceName, err := services.ServiceNameOfTunnel(tunnelName)
-	if err != nil {
-		return 0, err
-	}
-	m, err := serviceManager()
-	if err != nil {
-		return 0, err
-	}
-	service, err := m.OpenService(serviceName)
-	if err != nil {
-		return TunnelStopped, nil
-	}
-	defer service.Close()
-	status, err := service.Query()
-	if err != nil {
-		return TunnelUnknown, nil
-	}
-	switch status.State {
-	case svc.Stopped:
-		return TunnelStopped, nil
-	case svc.StopPending:
-		return TunnelStopping, nil
-	case svc.Running:
-		return TunnelStarted, nil
-	case svc.StartPending:
-		return TunnelStarting, nil
-	default:
-		return TunnelUnknown, nil
-	}
-}
-
-func (s *ManagerService) GlobalState() TunnelState {
-	return trackedTunnelsGlobalState()
-}
-
-func (s *ManagerService) Create(tunnelConfig *conf.Config) (*Tunnel, error) {
-	err := tunnelConfig.Save()
-	if err != nil {
-		return nil, err
+func (s *ManagerService) groupHandler(handle func(groupName string) (interface{}, error)) rpc.Handler {
+	return func(decode func(interface{}) error) (interface{}, error) {
+		var request GroupNameRequest
+		err := decode(&request)
+		if err != nil {
+			return nil, err
+		}
+		response, err := handle(request.Name)
+		return response, ipcError(err)
 	}
-	return &Tunnel{tunnelConfig.Name}, nil
-	// TODO: handle already existing situation
-	// TODO: handle already running and existing situation
 }
 
-func (s *ManagerService) Tunnels() ([]Tunnel, error) {
-	names, err := conf.ListConfigNames()
-	if err != nil {
-		return nil, err
-	}
-	tunnels := make([]Tunnel, len(names))
-	for i := 0; i < len(tunnels); i++ {
-		(tunnels)[i].Name = names[i]
-	}
-	return tunnels, nil
-	// TODO: account for running ones that aren't in the configuration store somehow
+// handle registers handler for method, behind the service's authorizer.
+func (s *ManagerService) handle(server *rpc.Server, method MethodType, handler rpc.Handler) {
+	server.Handle(string(method), func(decode func(interface{}) error) (interface{}, error) {
+		err := s.authorize(s.peer, method)
+		if err != nil {
+			return nil, err
+		}
+		return handler(decode)
+	})
 }
 
-func (s *ManagerService) Quit(stopTunnelsOnQuit bool) (alreadyQuit bool, err error) {
-	if !atomic.CompareAndSwapUint32(&haveQuit, 0, 1) {
-		return true, nil
-	}
-
-	// Work around potential race condition of delivering messages to the wrong process by removing from notifications.
-	managerServicesLock.Lock()
-	delete(managerServices, s)
-	managerServicesLock.Unlock()
-
-	if stopTunnelsOnQuit {
-		names, err := conf.ListConfigNames()
+func (s *ManagerService) register(server *rpc.Server) {
+	s.handle(server, StoredConfigMethodType, s.tunnelHandler(func(tunnelName string) (interface{}, error) {
+		config, err := s.backend.StoredConfig(tunnelName)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-		for _, name := range names {
-			UninstallTunnel(name)
+		return &ConfigResponse{*config}, nil
+	}))
+	s.handle(server, RuntimeConfigMethodType, s.tunnelHandler(func(tunnelName string) (interface{}, error) {
+		config, err := s.backend.RuntimeConfig(tunnelName)
+		if err != nil {
+			return nil, err
 		}
-	}
-
-	quitManagersChan <- struct{}{}
-	return false, nil
-}
-
-func (s *ManagerService) UpdateState() UpdateState {
-	return updateState
-}
-
-func (s *ManagerService) Update() {
-	progress := updater.DownloadVerifyAndExecute(uintptr(s.elevatedToken))
-	go func() {
-		for {
-			dp := <-progress
-			IPCServerNotifyUpdateProgress(dp)
-			if dp.Complete || dp.Error != nil {
-				return
-			}
+		return &ConfigResponse{*config}, nil
+	}))
+	s.handle(server, RenameMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		var request RenameRequest
+		err := decode(&request)
+		if err != nil {
+			return nil, err
 		}
-	}()
-}
-
-func (s *ManagerService) ServeConn(reader io.Reader, writer io.Writer) {
-	decoder := gob.NewDecoder(reader)
-	encoder := gob.NewEncoder(writer)
-	for {
-		var methodType MethodType
-		err := decoder.Decode(&methodType)
+		return nil, ipcError(s.backend.Rename(request.Name, request.NewName))
+	})
+	s.handle(server, StoredMetadataMethodType, s.tunnelHandler(func(tunnelName string) (interface{}, error) {
+		metadata, err := s.backend.StoredMetadata(tunnelName)
 		if err != nil {
-			return
+			return nil, err
 		}
-		switch methodType {
-		case StoredConfigMethodType:
-			var tunnelName string
-			err := decoder.Decode(&tunnelName)
-			if err != nil {
-				return
-			}
-			config, retErr := s.StoredConfig(tunnelName)
-			if config == nil {
-				config = &conf.Config{}
-			}
-			err = encoder.Encode(*config)
-			if err != nil {
-				return
-			}
-			err = encoder.Encode(errToString(retErr))
-			if err != nil {
-				return
-			}
-		case RuntimeConfigMethodType:
-			var tunnelName string
-			err := decoder.Decode(&tunnelName)
-			if err != nil {
-				return
-			}
-			config, retErr := s.RuntimeConfig(tunnelName)
-			if config == nil {
-				config = &conf.Config{}
-			}
-			err = encoder.Encode(*config)
-			if err != nil {
-				return
-			}
-			err = encoder.Encode(errToString(retErr))
-			if err != nil {
-				return
-			}
-		case StartMethodType:
-			var tunnelName string
-			err := decoder.Decode(&tunnelName)
-			if err != nil {
-				return
-			}
-			retErr := s.Start(tunnelName)
-			err = encoder.Encode(errToString(retErr))
-			if err != nil {
-				return
-			}
-		case StopMethodType:
-			var tunnelName string
-			err := decoder.Decode(&tunnelName)
-			if err != nil {
-				return
-			}
-			retErr := s.Stop(tunnelName)
-			err = encoder.Encode(errToString(retErr))
-			if err != nil {
-				return
-			}
-		case WaitForStopMethodType:
-			var tunnelName string
-			err := decoder.Decode(&tunnelName)
-			if err != nil {
-				return
-			}
-			retErr := s.WaitForStop(tunnelName)
-			err = encoder.Encode(errToString(retErr))
-			if err != nil {
-				return
-			}
-		case DeleteMethodType:
-			var tunnelName string
-			err := decoder.Decode(&tunnelName)
-			if err != nil {
-				return
-			}
-			retErr := s.Delete(tunnelName)
-			err = encoder.Encode(errToString(retErr))
-			if err != nil {
-				return
-			}
-		case StateMethodType:
-			var tunnelName string
-			err := decoder.Decode(&tunnelName)
-			if err != nil {
-				return
-			}
-			state, retErr := s.State(tunnelName)
-			err = encoder.Encode(state)
-			if err != nil {
-				return
-			}
-			err = encoder.Encode(errToString(retErr))
-			if err != nil {
-				return
-			}
-		case GlobalStateMethodType:
-			state := s.GlobalState()
-			err = encoder.Encode(state)
-			if err != nil {
-				return
-			}
-		case CreateMethodType:
-			var config conf.Config
-			err := decoder.Decode(&config)
-			if err != nil {
-				return
-			}
-			tunnel, retErr := s.Create(&config)
-			err = encoder.Encode(tunnel)
-			if err != nil {
-				return
-			}
-			err = encoder.Encode(errToString(retErr))
-			if err != nil {
-				return
-			}
-		case TunnelsMethodType:
-			tunnels, retErr := s.Tunnels()
-			err = encoder.Encode(tunnels)
-			if err != nil {
-				return
-			}
-			err = encoder.Encode(errToString(retErr))
-			if err != nil {
-				return
-			}
-		case QuitMethodType:
-			var stopTunnelsOnQuit bool
-			err := decoder.Decode(&stopTunnelsOnQuit)
-			if err != nil {
-				return
-			}
-			alreadyQuit, retErr := s.Quit(stopTunnelsOnQuit)
-			err = encoder.Encode(alreadyQuit)
-			if err != nil {
-				return
-			}
-			err = encoder.Encode(errToString(retErr))
-			if err != nil {
-				return
-			}
-		case UpdateStateMethodType:
-			updateState := s.UpdateState()
-			err = encoder.Encode(updateState)
-			if err != nil {
-				return
-			}
-		case UpdateMethodType:
-			s.Update()
-		default:
-			return
+		return &MetadataResponse{*metadata}, nil
+	}))
+	s.handle(server, SetMetadataMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		var request SetMetadataRequest
+		err := decode(&request)
+		if err != nil {
+			return nil, err
 		}
-	}
-}
-
-func IPCServerListen(reader *os.File, writer *os.File, events *os.File, elevatedToken windows.Token) {
-	service := &ManagerService{
-		events:        events,
-		elevatedToken: elevatedToken,
-	}
-
-	go func() {
-		defer printPanic()
-		managerServicesLock.Lock()
-		managerServices[service] = true
-		managerServicesLock.Unlock()
-		service.ServeConn(reader, writer)
-		managerServicesLock.Lock()
-		delete(managerServices, service)
-		managerServicesLock.Unlock()
-
-	}()
-}
-
-func notifyAll(notificationType NotificationType, ifaces ...interface{}) {
-	if len(managerServices) == 0 {
-		return
-	}
-
-	var buf bytes.Buffer
-	encoder := gob.NewEncoder(&buf)
-	err := encoder.Encode(notificationType)
-	if err != nil {
-		return
-	}
-	for _, iface := range ifaces {
-		err = encoder.Encode(iface)
+		return nil, ipcError(s.backend.SetMetadata(request.Name, &request.Metadata))
+	})
+	s.handle(server, ListTunnelsMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		var request ListTunnelsRequest
+		err := decode(&request)
 		if err != nil {
-			return
+			return nil, err
 		}
-	}
+		tunnels, err := listTunnels(s.backend, request.Tag, request.SortByTag)
+		if err != nil {
+			return nil, err
+		}
+		return &ListTunnelsResponse{tunnels}, nil
+	})
+	s.handle(server, ConflictsMethodType, s.tunnelHandler(func(tunnelName string) (interface{}, error) {
+		report, err := s.backend.Conflicts(tunnelName)
+		if err != nil {
+			return nil, err
+		}
+		return &ConflictsResponse{*report}, nil
+	}))
+	s.handle(server, StartMethodType, s.tunnelHandler(func(tunnelName string) (interface{}, error) {
+		return nil, s.backend.Start(tunnelName)
+	}))
+	s.handle(server, StopMethodType, s.tunnelHandler(func(tunnelName string) (interface{}, error) {
+		return nil, s.backend.Stop(tunnelName)
+	}))
+	s.handle(server, WaitForStopMethodType, s.tunnelHandler(func(tunnelName string) (interface{}, error) {
+		return nil, s.backend.WaitForStop(tunnelName)
+	}))
+	s.handle(server, DeleteMethodType, s.tunnelHandler(func(tunnelName string) (interface{}, error) {
+		return nil, s.backend.Delete(tunnelName)
+	}))
+	s.handle(server, StateMethodType, s.tunnelHandler(func(tunnelName string) (interface{}, error) {
+		state, err := s.backend.State(tunnelName)
+		if err != nil {
+			return nil, err
+		}
+		return &StateResponse{state}, nil
+	}))
+	s.handle(server, HealthMethodType, s.tunnelHandler(func(tunnelName string) (interface{}, error) {
+		health, err := s.backend.Health(tunnelName)
+		if err != nil {
+			return nil, err
+		}
+		return &HealthResponse{health}, nil
+	}))
+	s.handle(server, GlobalStateMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		return &StateResponse{s.backend.GlobalState()}, nil
+	})
+	s.handle(server, CreateMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		var request CreateRequest
+		err := decode(&request)
+		if err != nil {
+			return nil, err
+		}
+		tunnel, err := s.backend.Create(&request.Config)
+		if err != nil {
+			return nil, err
+		}
+		return &CreateResponse{*tunnel}, nil
+	})
+	s.handle(server, TunnelsMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		tunnels, err := s.backend.Tunnels()
+		if err != nil {
+			return nil, err
+		}
+		return &TunnelsResponse{tunnels}, nil
+	})
+	s.handle(server, GroupsMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		groups, err := s.backend.Groups()
+		if err != nil {
+			return nil, err
+		}
+		return &GroupsResponse{groups}, nil
+	})
+	s.handle(server, SetGroupMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		var request GroupRequest
+		err := decode(&request)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ipcError(s.backend.SetGroup(&request.Group))
+	})
+	s.handle(server, DeleteGroupMethodType, s.groupHandler(func(groupName string) (interface{}, error) {
+		return nil, s.backend.DeleteGroup(groupName)
+	}))
+	s.handle(server, StartGroupMethodType, s.groupHandler(func(groupName string) (interface{}, error) {
+		return nil, s.backend.StartGroup(groupName)
+	}))
+	s.handle(server, StopGroupMethodType, s.groupHandler(func(groupName string) (interface{}, error) {
+		return nil, s.backend.StopGroup(groupName)
+	}))
+	s.handle(server, GroupStateMethodType, s.groupHandler(func(groupName string) (interface{}, error) {
+		state, err := s.backend.GroupState(groupName)
+		if err != nil {
+			return nil, err
+		}
+		return &StateResponse{state}, nil
+	}))
+	s.handle(server, QuitMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		var request QuitRequest
+		err := decode(&request)
+		if err != nil {
+			return nil, err
+		}
+		alreadyQuit, err := s.Quit(request.StopTunnels)
+		if err != nil {
+			return nil, err
+		}
+		return &QuitResponse{alreadyQuit}, nil
+	})
+	s.handle(server, UpdateStateMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		return &UpdateStateResponse{s.backend.UpdateState()}, nil
+	})
+	s.handle(server, UpdateDetailsMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		return &UpdateDetailsResponse{s.backend.UpdateDetails()}, nil
+	})
+	s.handle(server, UpdateMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		s.backend.Update(s.peer)
+		return nil, nil
+	})
+	s.handle(server, DiagnosticsMethodType, func(decode func(interface{}) error) (interface{}, error) {
+		bundle, mapping, err := s.backend.Diagnostics()
+		if err != nil {
+			return nil, err
+		}
+		return &DiagnosticsResponse{bundle, mapping}, nil
+	})
+}
 
+// notifyAll sends a notification to every IPC client and event stream. Notify only queues it, so a
+// stuck client can't hold managerServicesLock.
+func notifyAll(notificationType NotificationType, body interface{}) {
 	managerServicesLock.RLock()
 	for m := range managerServices {
-		m.events.SetWriteDeadline(time.Now().Add(time.Second))
-		m.events.Write(buf.Bytes())
+		m.conn.Notify(string(notificationType), body)
 	}
 	managerServicesLock.RUnlock()
+	notifyEventStreams(notificationType, body)
 }
 
-func errToString(err error) string {
-	if err == nil {
-		return ""
-	}
-	return err.Error()
+func IPCServerNotifyTunnelChange(name string, state TunnelState, globalState TunnelState, err error) {
+	notifyAll(TunnelChangeNotificationType, &TunnelChangeNotification{
+		Name:        name,
+		State:       state,
+		GlobalState: globalState,
+		Error:       rpc.AsError(err),
+	})
+}
+
+func IPCServerNotifyGroupChange(name string, state TunnelState) {
+	notifyAll(GroupChangeNotificationType, &GroupChangeNotification{name, state})
+}
+
+func IPCServerNotifyTunnelRename(oldName string, newName string) {
+	notifyAll(TunnelRenameNotificationType, &TunnelRenameNotification{oldName, newName})
 }
 
-func IPCServerNotifyTunnelChange(name string, state TunnelState, err error) {
-	notifyAll(TunnelChangeNotificationType, name, state, trackedTunnelsGlobalState(), errToString(err))
+func IPCServerNotifyTunnelHealth(name string, health TunnelHealth, detail string) {
+	notifyAll(TunnelHealthNotificationType, &TunnelHealthNotification{name, health, detail})
 }
 
 func IPCServerNotifyTunnelsChange() {
-	notifyAll(TunnelsChangeNotificationType)
+	notifyAll(TunnelsChangeNotificationType, nil)
 }
 
 func IPCServerNotifyUpdateFound(state UpdateState) {
-	notifyAll(UpdateFoundNotificationType, state)
+	notifyAll(UpdateFoundNotificationType, &UpdateFoundNotification{state})
 }
 
 func IPCServerNotifyUpdateProgress(dp updater.DownloadProgress) {
-	notifyAll(UpdateProgressNotificationType, dp.Activity, dp.BytesDownloaded, dp.BytesTotal, errToString(dp.Error), dp.Complete)
+	notifyAll(UpdateProgressNotificationType, &UpdateProgressNotification{
+		Activity:        dp.Activity,
+		BytesDownloaded: dp.BytesDownloaded,
+		BytesTotal:      dp.BytesTotal,
+		BytesPerSecond:  dp.BytesPerSecond,
+		ETA:             dp.ETA,
+		Retries:         dp.Retries,
+		Error:           rpc.AsError(dp.Error),
+		Complete:        dp.Complete,
+	})
 }
 
 func IPCServerNotifyManagerStopping() {
-	notifyAll(ManagerStoppingNotificationType)
+	notifyAll(ManagerStoppingNotificationType, nil)
 	time.Sleep(time.Millisecond * 200)
 }
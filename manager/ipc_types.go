@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
+)
+
+// These are the bodies of calls and notifications. They are gob-encoded, so fields may be added
+// freely, as older peers ignore them, but existing fields must keep their names and types. Calls
+// that take or return nothing have no body.
+
+type TunnelRequest struct {
+	Name string
+}
+
+type ConfigResponse struct {
+	Config conf.Config
+}
+
+type MetadataResponse struct {
+	Metadata conf.Metadata
+}
+
+type RenameRequest struct {
+	Name    string
+	NewName string
+}
+
+type SetMetadataRequest struct {
+	Name     string
+	Metadata conf.Metadata
+}
+
+type HealthResponse struct {
+	Health TunnelHealth
+}
+
+type StateResponse struct {
+	State TunnelState
+}
+
+type CreateRequest struct {
+	Config conf.Config
+}
+
+type CreateResponse struct {
+	Tunnel Tunnel
+}
+
+type ConflictsResponse struct {
+	Report ConflictReport
+}
+
+type TunnelsResponse struct {
+	Tunnels []Tunnel
+}
+
+type ListTunnelsRequest struct {
+	Tag       string
+	SortByTag bool
+}
+
+type ListTunnelsResponse struct {
+	Tunnels []TunnelInfo
+}
+
+type GroupsResponse struct {
+	Groups []conf.TunnelGroup
+}
+
+type GroupRequest struct {
+	Group conf.TunnelGroup
+}
+
+type GroupNameRequest struct {
+	Name string
+}
+
+type QuitRequest struct {
+	StopTunnels bool
+}
+
+type QuitResponse struct {
+	AlreadyQuit bool
+}
+
+type UpdateStateResponse struct {
+	State UpdateState
+}
+
+type UpdateDetailsResponse struct {
+	Details UpdateDetails
+}
+
+type DiagnosticsResponse struct {
+	Bundle  []byte
+	Mapping []byte
+}
+
+type TunnelChangeNotification struct {
+	Name        string
+	State       TunnelState
+	GlobalState TunnelState
+	Error       *rpc.Error
+}
+
+type TunnelRenameNotification struct {
+	OldName string
+	NewName string
+}
+
+type TunnelHealthNotification struct {
+	Name   string
+	Health TunnelHealth
+	Detail string
+}
+
+type GroupChangeNotification struct {
+	Name  string
+	State TunnelState
+}
+
+type UpdateFoundNotification struct {
+	State UpdateState
+}
+
+type UpdateProgressNotification struct {
+	Activity        string
+	BytesDownloaded uint64
+	BytesTotal      uint64
+	BytesPerSecond  uint64
+	ETA             time.Duration
+	Retries         uint32
+	Error           *rpc.Error
+	Complete        bool
+}
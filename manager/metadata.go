@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"log"
+	"sort"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+type TunnelInfo struct {
+	Name     string
+	Metadata conf.Metadata
+}
+
+// firstTag is what tunnels are sorted by when sorting by tag. Untagged tunnels sort last.
+func firstTag(info *TunnelInfo) string {
+	if len(info.Metadata.Tags) == 0 {
+		return "\uffff"
+	}
+	return info.Metadata.Tags[0]
+}
+
+// listTunnels returns the tunnels of backend with their metadata, only those with the given tag if
+// it isn't empty, and ordered by name, or by first tag and then name if sortByTag is set. A tunnel
+// whose metadata can't be loaded is listed as if it had none, rather than hiding every tunnel.
+func listTunnels(backend TunnelBackend, tag string, sortByTag bool) ([]TunnelInfo, error) {
+	tunnels, err := backend.Tunnels()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]TunnelInfo, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		metadata, err := backend.StoredMetadata(tunnel.Name)
+		if err != nil {
+			log.Printf("[%s] Unable to load metadata, so listing tunnel without it: %v", tunnel.Name, err)
+			metadata = &conf.Metadata{}
+		}
+		if len(tag) > 0 && !metadata.HasTag(tag) {
+			continue
+		}
+		infos = append(infos, TunnelInfo{tunnel.Name, *metadata})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if sortByTag {
+			a, b := firstTag(&infos[i]), firstTag(&infos[j])
+			if a != b {
+				return a < b
+			}
+		}
+		return conf.TunnelNameIsLess(infos[i].Name, infos[j].Name)
+	})
+	return infos, nil
+}
@@ -0,0 +1,46 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"errors"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+// corruptMetadataBackend fails to load the metadata of one tunnel, as when its sidecar is corrupt.
+type corruptMetadataBackend struct {
+	*onDemandTestBackend
+	corrupt string
+}
+
+func (b *corruptMetadataBackend) StoredMetadata(tunnelName string) (*conf.Metadata, error) {
+	if tunnelName == b.corrupt {
+		return nil, errors.New("Unable to decrypt metadata")
+	}
+	return b.onDemandTestBackend.StoredMetadata(tunnelName)
+}
+
+func TestListTunnelsWithCorruptMetadata(t *testing.T) {
+	backend := &corruptMetadataBackend{
+		onDemandTestBackend: &onDemandTestBackend{
+			configs: map[string]*conf.Config{"home": nil, "lab": nil, "office": nil},
+			metadata: map[string]*conf.Metadata{
+				"office": {Version: conf.MetadataVersion, Tags: []string{"work"}},
+			},
+		},
+		corrupt: "lab",
+	}
+	infos, err := listTunnels(backend, "", false)
+	if err != nil || len(infos) != 3 || infos[1].Name != "lab" || !infos[1].Metadata.IsEmpty() {
+		t.Errorf("Listing tunnels returned %+v, %v", infos, err)
+	}
+	infos, err = listTunnels(backend, "work", true)
+	if err != nil || len(infos) != 1 || infos[0].Name != "office" {
+		t.Errorf("Listing tunnels tagged work returned %+v, %v", infos, err)
+	}
+}
@@ -0,0 +1,280 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+// NetworkInterface describes a connected network interface, other than our own tunnels.
+type NetworkInterface struct {
+	Name        string
+	Type        conf.InterfaceType
+	DNSSuffixes []string
+	GatewayMACs []string
+	SSID        string
+}
+
+type NetworkState struct {
+	Interfaces []NetworkInterface
+}
+
+// NetworkStateProvider tells the on-demand engine what the network looks like. On Windows it
+// queries the system, while tests make up network states of their own.
+type NetworkStateProvider interface {
+	NetworkState() (*NetworkState, error)
+	// Reachable tries to connect to host, which may carry a port.
+	Reachable(host string) bool
+}
+
+func dnsSuffixMatches(suffixes []string, want string) bool {
+	for _, suffix := range suffixes {
+		suffix = conf.NormalizeDNSSuffix(suffix)
+		if suffix == want || strings.HasSuffix(suffix, "."+want) {
+			return true
+		}
+	}
+	return false
+}
+
+func interfaceMatches(rule *conf.OnDemandRule, iface *NetworkInterface) bool {
+	if len(rule.InterfaceTypes) > 0 {
+		found := false
+		for _, t := range rule.InterfaceTypes {
+			found = found || t == iface.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.DNSSuffixes) > 0 {
+		found := false
+		for _, suffix := range rule.DNSSuffixes {
+			found = found || dnsSuffixMatches(iface.DNSSuffixes, suffix)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.GatewayMACs) > 0 {
+		found := false
+		for _, mac := range rule.GatewayMACs {
+			for _, gateway := range iface.GatewayMACs {
+				found = found || conf.NormalizeMAC(gateway) == mac
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.SSIDs) > 0 {
+		found := false
+		for _, ssid := range rule.SSIDs {
+			found = found || (len(iface.SSID) > 0 && ssid == iface.SSID)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func ruleMatches(rule *conf.OnDemandRule, state *NetworkState, reachable func(host string) bool) bool {
+	if rule.HasInterfaceConditions() {
+		found := false
+		for i := range state.Interfaces {
+			if interfaceMatches(rule, &state.Interfaces[i]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	// The probe goes last, as it is by far the slowest to check.
+	if rule.Probe != nil && reachable(rule.Probe.Host) != rule.Probe.Reachable {
+		return false
+	}
+	return true
+}
+
+// EvaluateOnDemand returns the action of the first rule that matches the network state, or
+// OnDemandIgnore if none does. Probes are only made for the rules that get as far as needing them.
+func EvaluateOnDemand(rules []conf.OnDemandRule, state *NetworkState, reachable func(host string) bool) conf.OnDemandAction {
+	for i := range rules {
+		if ruleMatches(&rules[i], state, reachable) {
+			return rules[i].Action
+		}
+	}
+	return conf.OnDemandIgnore
+}
+
+// onDemandSettleTime is how long the network must stay quiet before rules are evaluated, since a
+// single change of network comes with a burst of notifications.
+var onDemandSettleTime = time.Second * 2
+
+// onDemandInterval is how often rules are evaluated without any change to the network, so that
+// probes notice hosts coming and going.
+var onDemandInterval = time.Minute
+
+// onDemandTrigger asks the running engine to evaluate rules again, such as after they change.
+var onDemandTrigger = make(chan struct{}, 1)
+
+func triggerOnDemand() {
+	select {
+	case onDemandTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// onDemandEngine starts and stops tunnels as their on-demand rules decide. It only acts when a
+// tunnel's decision changes, so that the user may still start or stop a tunnel by hand, and have
+// that stick until the network changes in a way that matters to the tunnel.
+type onDemandEngine struct {
+	backend  TunnelBackend
+	provider NetworkStateProvider
+	// decisions holds the last action decided for each tunnel with rules.
+	decisions map[string]conf.OnDemandAction
+	// probes holds the last result of each probe that was actually made, for when a probe can't
+	// be trusted.
+	probes map[string]bool
+}
+
+func newOnDemandEngine(backend TunnelBackend, provider NetworkStateProvider) *onDemandEngine {
+	return &onDemandEngine{
+		backend:   backend,
+		provider:  provider,
+		decisions: make(map[string]conf.OnDemandAction),
+		probes:    make(map[string]bool),
+	}
+}
+
+// probeRoutedBy reports whether the probe of host would go through config's tunnel, in which case
+// it would only tell whether that tunnel works.
+func probeRoutedBy(host string, config *conf.Config) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		for i := range config.Peers {
+			for _, allowedIP := range config.Peers[i].AllowedIPs {
+				ipnet := allowedIP.IPNet()
+				if ipnet.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// evaluate decides every tunnel's action for the current network state and carries out those
+// that have changed. A decision is only remembered once it has been carried out, so one that
+// fails is retried on the next evaluation.
+func (e *onDemandEngine) evaluate() {
+	tunnels, err := e.backend.Tunnels()
+	if err != nil {
+		log.Printf("Unable to list tunnels for on-demand rules: %v", err)
+		return
+	}
+	state, err := e.provider.NetworkState()
+	if err != nil {
+		log.Printf("Unable to determine network state for on-demand rules: %v", err)
+		return
+	}
+	probed := make(map[string]bool)
+	seen := make(map[string]bool, len(tunnels))
+	for _, tunnel := range tunnels {
+		metadata, err := e.backend.StoredMetadata(tunnel.Name)
+		if err != nil || len(metadata.OnDemand) == 0 {
+			continue
+		}
+		seen[tunnel.Name] = true
+		tunnelState, err := e.backend.State(tunnel.Name)
+		if err != nil {
+			continue
+		}
+		running := tunnelState == TunnelStarting || tunnelState == TunnelStarted
+		var config *conf.Config
+		if running {
+			config, _ = e.backend.StoredConfig(tunnel.Name)
+		}
+		reachable := func(host string) bool {
+			if config != nil && probeRoutedBy(host, config) {
+				return e.probes[host]
+			}
+			if result, ok := probed[host]; ok {
+				return result
+			}
+			result := e.provider.Reachable(host)
+			probed[host] = result
+			e.probes[host] = result
+			return result
+		}
+		action := EvaluateOnDemand(metadata.OnDemand, state, reachable)
+		if action == e.decisions[tunnel.Name] {
+			continue
+		}
+		switch {
+		case action == conf.OnDemandConnect && !running:
+			log.Printf("[%s] Starting tunnel, as decided by its on-demand rules", tunnel.Name)
+			err = e.backend.Start(tunnel.Name)
+		case action == conf.OnDemandDisconnect && running:
+			log.Printf("[%s] Stopping tunnel, as decided by its on-demand rules", tunnel.Name)
+			err = e.backend.Stop(tunnel.Name)
+		}
+		if err != nil {
+			// Leave the old decision in place, so that the next evaluation tries again.
+			log.Printf("[%s] Unable to carry out on-demand rules: %v", tunnel.Name, err)
+			continue
+		}
+		e.decisions[tunnel.Name] = action
+	}
+	for name := range e.decisions {
+		if !seen[name] {
+			delete(e.decisions, name)
+		}
+	}
+}
+
+// run evaluates rules once at the start, again once the network settles after each change, and
+// otherwise every onDemandInterval, until stop is closed.
+func (e *onDemandEngine) run(changes <-chan struct{}, stop <-chan struct{}) {
+	e.evaluate()
+	interval := time.NewTicker(onDemandInterval)
+	defer interval.Stop()
+	settle := time.NewTimer(onDemandSettleTime)
+	settle.Stop()
+	for {
+		select {
+		case <-stop:
+			settle.Stop()
+			return
+		case <-changes:
+			settle.Reset(onDemandSettleTime)
+		case <-onDemandTrigger:
+			settle.Reset(onDemandSettleTime)
+		case <-settle.C:
+			e.evaluate()
+		case <-interval.C:
+			e.evaluate()
+		}
+	}
+}
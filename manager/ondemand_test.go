@@ -0,0 +1,216 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+var (
+	officeNetwork = NetworkState{Interfaces: []NetworkInterface{
+		{Name: "Ethernet", Type: conf.InterfaceEthernet, DNSSuffixes: []string{"corp.example.com"}, GatewayMACs: []string{"00:1A:2B:3C:4D:5E"}},
+	}}
+	cafeNetwork = NetworkState{Interfaces: []NetworkInterface{
+		{Name: "Wi-Fi", Type: conf.InterfaceWiFi, DNSSuffixes: []string{"home"}, GatewayMACs: []string{"66:77:88:99:aa:bb"}, SSID: "Free Coffee"},
+	}}
+	homeNetwork = NetworkState{Interfaces: []NetworkInterface{
+		{Name: "Wi-Fi", Type: conf.InterfaceWiFi, SSID: "Our House"},
+		{Name: "Mobile", Type: conf.InterfaceCellular},
+	}}
+)
+
+func onDemandTestRules(t *testing.T) []conf.OnDemandRule {
+	m := conf.Metadata{OnDemand: []conf.OnDemandRule{
+		{Action: conf.OnDemandDisconnect, DNSSuffixes: []string{".Example.com."}, Probe: &conf.ProbeCondition{Host: "intranet.corp.example.com", Reachable: true}},
+		{Action: conf.OnDemandDisconnect, GatewayMACs: []string{"00-1a-2b-3c-4d-5e"}},
+		{Action: conf.OnDemandIgnore, InterfaceTypes: []conf.InterfaceType{conf.InterfaceWiFi}, SSIDs: []string{"Our House"}},
+		{Action: conf.OnDemandConnect, InterfaceTypes: []conf.InterfaceType{conf.InterfaceWiFi, conf.InterfaceCellular}},
+	}}
+	err := m.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.OnDemand
+}
+
+func TestEvaluateOnDemand(t *testing.T) {
+	rules := onDemandTestRules(t)
+	if rules[0].DNSSuffixes[0] != "example.com" || rules[1].GatewayMACs[0] != "00:1a:2b:3c:4d:5e" {
+		t.Errorf("Rules were not normalized: %+v", rules[:2])
+	}
+	for _, test := range []struct {
+		name      string
+		state     NetworkState
+		reachable bool
+		want      conf.OnDemandAction
+		probes    []string
+	}{
+		{"office with intranet", officeNetwork, true, conf.OnDemandDisconnect, []string{"intranet.corp.example.com"}},
+		{"office gateway without intranet", officeNetwork, false, conf.OnDemandDisconnect, []string{"intranet.corp.example.com"}},
+		{"cafe", cafeNetwork, true, conf.OnDemandConnect, nil},
+		{"home wireless beside cellular", homeNetwork, false, conf.OnDemandIgnore, nil},
+		{"no network", NetworkState{}, false, conf.OnDemandIgnore, nil},
+	} {
+		var probes []string
+		action := EvaluateOnDemand(rules, &test.state, func(host string) bool {
+			probes = append(probes, host)
+			return test.reachable
+		})
+		if action != test.want || !reflect.DeepEqual(probes, test.probes) {
+			t.Errorf("%s: got %s after probing %q, want %s after probing %q", test.name, action, probes, test.want, test.probes)
+		}
+	}
+	catchAll := []conf.OnDemandRule{{Action: conf.OnDemandConnect}}
+	if action := EvaluateOnDemand(catchAll, &NetworkState{}, nil); action != conf.OnDemandConnect {
+		t.Errorf("Rule without conditions returned %s", action)
+	}
+}
+
+type onDemandTestNetwork struct {
+	state     NetworkState
+	reachable map[string]bool
+	probes    []string
+}
+
+func (n *onDemandTestNetwork) NetworkState() (*NetworkState, error) {
+	return &n.state, nil
+}
+
+func (n *onDemandTestNetwork) Reachable(host string) bool {
+	n.probes = append(n.probes, host)
+	return n.reachable[host]
+}
+
+// onDemandTestBackend implements only what the engine uses; anything else panics on the nil
+// interface.
+type onDemandTestBackend struct {
+	TunnelBackend
+	configs  map[string]*conf.Config
+	metadata map[string]*conf.Metadata
+	states   map[string]TunnelState
+	failures int
+	log      []string
+}
+
+func (b *onDemandTestBackend) Tunnels() ([]Tunnel, error) {
+	var tunnels []Tunnel
+	for name := range b.configs {
+		tunnels = append(tunnels, Tunnel{name})
+	}
+	return tunnels, nil
+}
+
+func (b *onDemandTestBackend) StoredConfig(tunnelName string) (*conf.Config, error) {
+	return b.configs[tunnelName], nil
+}
+
+func (b *onDemandTestBackend) StoredMetadata(tunnelName string) (*conf.Metadata, error) {
+	if m, ok := b.metadata[tunnelName]; ok {
+		return m, nil
+	}
+	return &conf.Metadata{Version: conf.MetadataVersion}, nil
+}
+
+func (b *onDemandTestBackend) State(tunnelName string) (TunnelState, error) {
+	return b.states[tunnelName], nil
+}
+
+func (b *onDemandTestBackend) Start(tunnelName string) error {
+	b.log = append(b.log, "start "+tunnelName)
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("Unable to start tunnel")
+	}
+	b.states[tunnelName] = TunnelStarted
+	return nil
+}
+
+func (b *onDemandTestBackend) Stop(tunnelName string) error {
+	b.log = append(b.log, "stop "+tunnelName)
+	b.states[tunnelName] = TunnelStopped
+	return nil
+}
+
+func TestOnDemandEngine(t *testing.T) {
+	backend := &onDemandTestBackend{
+		configs: map[string]*conf.Config{
+			"office": conflictTestConfig(t, "office", "Address = 10.10.0.2/16\n", "10.10.0.0/16"),
+			"lab":    conflictTestConfig(t, "lab", "Address = 10.99.0.2/24\n", "10.99.0.0/24"),
+		},
+		metadata: map[string]*conf.Metadata{"office": {Version: conf.MetadataVersion, OnDemand: []conf.OnDemandRule{
+			{Action: conf.OnDemandDisconnect, Probe: &conf.ProbeCondition{Host: "10.10.0.1:80", Reachable: true}},
+			{Action: conf.OnDemandConnect},
+		}}},
+		states: map[string]TunnelState{"office": TunnelStopped, "lab": TunnelStopped},
+	}
+	network := &onDemandTestNetwork{state: cafeNetwork, reachable: make(map[string]bool)}
+	engine := newOnDemandEngine(backend, network)
+	expect := func(what string, log ...string) {
+		t.Helper()
+		if !reflect.DeepEqual(backend.log, log) {
+			t.Errorf("%s: backend did %q, want %q", what, backend.log, log)
+		}
+		backend.log = nil
+	}
+
+	engine.evaluate()
+	expect("Away from the office", "start office")
+
+	// Once the tunnel is up, the probe host is routed through it, so its reachability says nothing
+	// about where we are, and the last probe made without the tunnel stands.
+	network.reachable["10.10.0.1:80"] = true
+	network.probes = nil
+	engine.evaluate()
+	expect("Probe through the tunnel")
+	if len(network.probes) != 0 {
+		t.Errorf("Probed %q through the tunnel", network.probes)
+	}
+
+	// Stopping the tunnel by hand sticks until the decision changes.
+	backend.Stop("office")
+	backend.log = nil
+	network.reachable["10.10.0.1:80"] = false
+	engine.evaluate()
+	expect("Stopped by hand")
+
+	network.reachable["10.10.0.1:80"] = true
+	engine.evaluate()
+	expect("At the office")
+	network.reachable["10.10.0.1:80"] = false
+	engine.evaluate()
+	expect("Away again", "start office")
+}
+
+func TestOnDemandEngineRetriesFailedStart(t *testing.T) {
+	backend := &onDemandTestBackend{
+		configs: map[string]*conf.Config{
+			"office": conflictTestConfig(t, "office", "Address = 10.10.0.2/16\n", "10.10.0.0/16"),
+		},
+		metadata: map[string]*conf.Metadata{"office": {Version: conf.MetadataVersion, OnDemand: []conf.OnDemandRule{
+			{Action: conf.OnDemandConnect},
+		}}},
+		states:   map[string]TunnelState{"office": TunnelStopped},
+		failures: 1,
+	}
+	engine := newOnDemandEngine(backend, &onDemandTestNetwork{state: cafeNetwork})
+
+	engine.evaluate()
+	if backend.states["office"] != TunnelStopped {
+		t.Fatalf("Tunnel is %v after a failed start", backend.states["office"])
+	}
+	engine.evaluate()
+	if backend.states["office"] != TunnelStarted {
+		t.Errorf("Tunnel is %v after the retry, want %v", backend.states["office"], TunnelStarted)
+	}
+	engine.evaluate()
+	if want := []string{"start office", "start office"}; !reflect.DeepEqual(backend.log, want) {
+		t.Errorf("Backend did %q, want %q", backend.log, want)
+	}
+}
@@ -0,0 +1,213 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"log"
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// probeTimeout bounds each probe, which otherwise could hold up evaluating rules for a long while.
+const probeTimeout = time.Second * 3
+
+// probeDefaultPort is used for probe hosts that are given without a port.
+const probeDefaultPort = "443"
+
+// systemNetworkState asks Windows about the network.
+type systemNetworkState struct{}
+
+func interfaceType(ifType winipcfg.IfType) conf.InterfaceType {
+	switch ifType {
+	case winipcfg.IfTypeEthernetCSMACD:
+		return conf.InterfaceEthernet
+	case winipcfg.IfTypeIEEE80211:
+		return conf.InterfaceWiFi
+	case winipcfg.IfTypeWwanpp, winipcfg.IfTypeWwanpp2:
+		return conf.InterfaceCellular
+	}
+	return conf.InterfaceOther
+}
+
+// neighborMACs maps interface indices and IPv4 addresses to the MAC addresses of those neighbors.
+func neighborMACs() map[uint32]map[[4]byte]string {
+	macs := make(map[uint32]map[[4]byte]string)
+	var size uint32
+	err := getIpNetTable(nil, &size, false)
+	if err != windows.ERROR_INSUFFICIENT_BUFFER || size == 0 {
+		return macs
+	}
+	buf := make([]byte, size)
+	table := (*mibIPNetTable)(unsafe.Pointer(&buf[0]))
+	err = getIpNetTable(table, &size, false)
+	if err != nil {
+		return macs
+	}
+	rows := (*[(1 << 28) - 1]mibIPNetRow)(unsafe.Pointer(&table.table[0]))[:table.numEntries:table.numEntries]
+	for i := range rows {
+		if rows[i].physAddrLen == 0 || rows[i].physAddrLen > uint32(len(rows[i].physAddr)) {
+			continue
+		}
+		if macs[rows[i].index] == nil {
+			macs[rows[i].index] = make(map[[4]byte]string)
+		}
+		macs[rows[i].index][rows[i].addr] = net.HardwareAddr(rows[i].physAddr[:rows[i].physAddrLen]).String()
+	}
+	return macs
+}
+
+// connectedSSIDs maps the GUIDs of connected wireless interfaces to the SSIDs they are connected to.
+// Systems without the wireless service simply have none.
+func connectedSSIDs() map[windows.GUID]string {
+	ssids := make(map[windows.GUID]string)
+	if modwlanapi.Load() != nil {
+		return ssids
+	}
+	var version uint32
+	var handle windows.Handle
+	if wlanOpenHandle(wlanClientVersion, 0, &version, &handle) != nil {
+		return ssids
+	}
+	defer wlanCloseHandle(handle, 0)
+	var list *wlanInterfaceInfoList
+	if wlanEnumInterfaces(handle, 0, &list) != nil {
+		return ssids
+	}
+	defer wlanFreeMemory(unsafe.Pointer(list))
+	infos := (*[(1 << 20) - 1]wlanInterfaceInfo)(unsafe.Pointer(&list.interfaceInfo[0]))[:list.numberOfItems:list.numberOfItems]
+	for i := range infos {
+		if infos[i].state != wlanInterfaceStateConnected {
+			continue
+		}
+		var size, valueType uint32
+		var data unsafe.Pointer
+		if wlanQueryInterface(handle, &infos[i].interfaceGUID, wlanIntfOpcodeCurrentConnection, 0, &size, &data, &valueType) != nil {
+			continue
+		}
+		if uintptr(size) >= unsafe.Sizeof(wlanConnectionAttributes{}) {
+			attributes := (*wlanConnectionAttributes)(data)
+			if attributes.ssidLength <= dot11SSIDMaxLength {
+				ssids[infos[i].interfaceGUID] = string(attributes.ssid[:attributes.ssidLength])
+			}
+		}
+		wlanFreeMemory(data)
+	}
+	return ssids
+}
+
+func (systemNetworkState) NetworkState() (*NetworkState, error) {
+	adapters, err := winipcfg.GetAdaptersAddresses(windows.AF_UNSPEC, winipcfg.GAAFlagIncludeGateways|winipcfg.GAAFlagSkipAnycast|winipcfg.GAAFlagSkipMulticast)
+	if err != nil {
+		return nil, err
+	}
+	macs := neighborMACs()
+	ssids := connectedSSIDs()
+	state := &NetworkState{}
+	for _, adapter := range adapters {
+		// Our own tunnels, as well as loopback and other tunnel interfaces, say nothing about which
+		// network we're on.
+		if adapter.OperStatus != winipcfg.IfOperStatusUp || adapter.IfType == winipcfg.IfTypeSoftwareLoopback ||
+			adapter.IfType == winipcfg.IfTypeTunnel || adapter.IfType == winipcfg.IfTypePropVirtual {
+			continue
+		}
+		iface := NetworkInterface{
+			Name: adapter.FriendlyName(),
+			Type: interfaceType(adapter.IfType),
+		}
+		if suffix := adapter.DNSSuffix(); len(suffix) > 0 {
+			iface.DNSSuffixes = append(iface.DNSSuffixes, suffix)
+		}
+		for suffix := adapter.FirstDNSSuffix; suffix != nil; suffix = suffix.Next {
+			iface.DNSSuffixes = append(iface.DNSSuffixes, suffix.String())
+		}
+		for gateway := adapter.FirstGatewayAddress; gateway != nil; gateway = gateway.Next {
+			ip := gateway.Address.IP().To4()
+			if ip == nil {
+				continue
+			}
+			var addr [4]byte
+			copy(addr[:], ip)
+			if mac, ok := macs[adapter.IfIndex][addr]; ok {
+				iface.GatewayMACs = append(iface.GatewayMACs, mac)
+			}
+		}
+		if iface.Type == conf.InterfaceWiFi {
+			if guid, err := adapter.LUID.GUID(); err == nil {
+				iface.SSID = ssids[*guid]
+			}
+		}
+		state.Interfaces = append(state.Interfaces, iface)
+	}
+	return state, nil
+}
+
+func (systemNetworkState) Reachable(host string) bool {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, probeDefaultPort)
+	}
+	conn, err := net.DialTimeout("tcp", host, probeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// watchOnDemandNetworkChanges sends on changes whenever an interface, address or route changes,
+// until the returned function is called.
+func watchOnDemandNetworkChanges(changes chan<- struct{}) (func(), error) {
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	interfaceCallback, err := winipcfg.RegisterInterfaceChangeCallback(func(notificationType winipcfg.MibNotificationType, iface *winipcfg.MibIPInterfaceRow) {
+		notify()
+	})
+	if err != nil {
+		return nil, err
+	}
+	addressCallback, err := winipcfg.RegisterUnicastAddressChangeCallback(func(notificationType winipcfg.MibNotificationType, address *winipcfg.MibUnicastIPAddressRow) {
+		notify()
+	})
+	if err != nil {
+		interfaceCallback.Unregister()
+		return nil, err
+	}
+	routeCallback, err := winipcfg.RegisterRouteChangeCallback(func(notificationType winipcfg.MibNotificationType, route *winipcfg.MibIPforwardRow2) {
+		notify()
+	})
+	if err != nil {
+		interfaceCallback.Unregister()
+		addressCallback.Unregister()
+		return nil, err
+	}
+	return func() {
+		interfaceCallback.Unregister()
+		addressCallback.Unregister()
+		routeCallback.Unregister()
+	}, nil
+}
+
+// runOnDemand runs the on-demand engine against the system's network until stop is closed.
+func runOnDemand(backend TunnelBackend, stop <-chan struct{}) {
+	defer printPanic()
+	changes := make(chan struct{}, 1)
+	unwatch, err := watchOnDemandNetworkChanges(changes)
+	if err != nil {
+		log.Printf("Unable to watch for network changes, so on-demand rules will only be evaluated periodically: %v", err)
+	} else {
+		defer unwatch()
+	}
+	newOnDemandEngine(backend, systemNetworkState{}).run(changes, stop)
+}
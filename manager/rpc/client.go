@@ -0,0 +1,221 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// NotificationHandler is called for each notification, in the order they were sent, with a
+// function that decodes the notification's body.
+type NotificationHandler func(name string, decode func(body interface{}) error)
+
+// Client makes calls to a Server over a connection.
+type Client struct {
+	conn      io.ReadWriteCloser
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *frame
+	err     error
+
+	notify        NotificationHandler
+	notifications notificationQueue
+
+	// Version is the protocol version agreed on with the server.
+	Version uint32
+}
+
+// notificationQueue hands notifications from the reader to the goroutine that calls the handler,
+// without ever blocking the reader, because handlers are allowed to make calls, whose responses
+// the reader must be free to receive.
+type notificationQueue struct {
+	lock    sync.Mutex
+	frames  []*frame
+	ready   chan struct{}
+	stopped bool
+}
+
+func (q *notificationQueue) push(f *frame) {
+	q.lock.Lock()
+	q.frames = append(q.frames, f)
+	q.lock.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *notificationQueue) stop() {
+	q.lock.Lock()
+	q.stopped = true
+	q.lock.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *notificationQueue) pop() (*frame, bool) {
+	for {
+		q.lock.Lock()
+		if len(q.frames) > 0 {
+			f := q.frames[0]
+			q.frames[0] = nil
+			q.frames = q.frames[1:]
+			q.lock.Unlock()
+			return f, true
+		}
+		stopped := q.stopped
+		q.lock.Unlock()
+		if stopped {
+			return nil, false
+		}
+		<-q.ready
+	}
+}
+
+var errClosed = errors.New("Connection to the manager is closed")
+
+// NewClient performs the version handshake over conn, and then starts receiving responses and
+// notifications from it. The handler may be nil if notifications are not of interest.
+func NewClient(conn io.ReadWriteCloser, handler NotificationHandler) (*Client, error) {
+	err := writeFrame(conn, &frame{Type: helloFrame, Version: ProtocolVersion})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hello, err := readFrame(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if hello.Type != helloFrame {
+		conn.Close()
+		return nil, errors.New("Server did not respond with a handshake")
+	}
+	if hello.Error != nil {
+		conn.Close()
+		return nil, hello.Error
+	}
+	if hello.Version < MinimumProtocolVersion {
+		conn.Close()
+		return nil, &Error{Code: ErrorIncompatibleVersion, Message: fmt.Sprintf("Server protocol version %d is too old", hello.Version)}
+	}
+	c := &Client{
+		conn:          conn,
+		pending:       make(map[uint64]chan *frame),
+		notify:        handler,
+		notifications: notificationQueue{ready: make(chan struct{}, 1)},
+		Version:       hello.Version,
+	}
+	if c.Version > ProtocolVersion {
+		c.Version = ProtocolVersion
+	}
+	go c.receive()
+	go c.dispatchNotifications()
+	return c, nil
+}
+
+func (c *Client) receive() {
+	var err error
+	for {
+		var f *frame
+		f, err = readFrame(c.conn)
+		if err != nil {
+			break
+		}
+		switch f.Type {
+		case responseFrame:
+			c.lock.Lock()
+			response, ok := c.pending[f.ID]
+			delete(c.pending, f.ID)
+			c.lock.Unlock()
+			if ok {
+				response <- f
+			}
+		case notificationFrame:
+			c.notifications.push(f)
+		}
+	}
+	if err == io.EOF {
+		err = errClosed
+	}
+	c.lock.Lock()
+	c.err = err
+	for id, response := range c.pending {
+		close(response)
+		delete(c.pending, id)
+	}
+	c.lock.Unlock()
+	c.notifications.stop()
+}
+
+func (c *Client) dispatchNotifications() {
+	for {
+		f, ok := c.notifications.pop()
+		if !ok {
+			return
+		}
+		if c.notify != nil {
+			c.notify(f.Method, func(body interface{}) error {
+				return decodeBody(f.Body, body)
+			})
+		}
+	}
+}
+
+// Call invokes a method on the server, waiting for its response. Either request or response may be
+// nil for methods that take or return nothing. Calls may be made concurrently, and a slow call
+// does not hold up others.
+func (c *Client) Call(method string, request interface{}, response interface{}) error {
+	body, err := encodeBody(request)
+	if err != nil {
+		return err
+	}
+	done := make(chan *frame, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		err = c.err
+		c.lock.Unlock()
+		return err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = done
+	c.lock.Unlock()
+
+	c.writeLock.Lock()
+	err = writeFrame(c.conn, &frame{Type: requestFrame, ID: id, Method: method, Body: body})
+	c.writeLock.Unlock()
+	if err != nil {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+		return err
+	}
+
+	f, ok := <-done
+	if !ok {
+		c.lock.Lock()
+		err = c.err
+		c.lock.Unlock()
+		return err
+	}
+	if f.Error != nil {
+		return f.Error
+	}
+	return decodeBody(f.Body, response)
+}
+
+// Close closes the connection, failing any calls still in flight.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
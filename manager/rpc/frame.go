@@ -0,0 +1,166 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package rpc implements the protocol spoken between the manager and its UI processes. Each
+// message is a length-prefixed frame holding a gob-encoded header and body. After a version
+// handshake, the client may have any number of calls in flight, each tagged with an ID that its
+// response carries back, while the server may interleave notifications at any point.
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion is the version spoken by this side. A peer speaking anything from
+// MinimumProtocolVersion up is compatible, and both then use the lower of their versions.
+const (
+	ProtocolVersion        = 1
+	MinimumProtocolVersion = 1
+)
+
+const maxFrameSize = 1024 * 1024 * 64 /* 64 MiB */
+
+// frameType values are sent on the wire, so they are numbered explicitly and must never change.
+type frameType uint8
+
+const (
+	helloFrame        frameType = 1
+	requestFrame      frameType = 2
+	responseFrame     frameType = 3
+	notificationFrame frameType = 4
+)
+
+type frame struct {
+	Type    frameType
+	Version uint32
+	ID      uint64
+	Method  string
+	Body    []byte
+	Error   *Error
+}
+
+// ErrorCode values are sent on the wire, so they are numbered explicitly and must never change.
+type ErrorCode uint32
+
+const (
+	ErrorUnknown             ErrorCode = 0
+	ErrorInternal            ErrorCode = 1
+	ErrorUnknownMethod       ErrorCode = 2
+	ErrorInvalidRequest      ErrorCode = 3
+	ErrorIncompatibleVersion ErrorCode = 4
+	ErrorNotFound            ErrorCode = 5
+	ErrorAccessDenied        ErrorCode = 6
+	ErrorBusy                ErrorCode = 7
+	ErrorConflict            ErrorCode = 8
+)
+
+// Error is an error that crossed the connection, carrying a code that callers can act on as well
+// as the original message.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NewError makes an Error with the given code out of err, or returns nil if err is nil.
+func NewError(code ErrorCode, err error) *Error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Message: err.Error()}
+}
+
+// AsError converts err to an Error, keeping its code if it already is one, so that it can be sent.
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: ErrorUnknown, Message: err.Error()}
+}
+
+// Code returns the code of the Error in err's chain, or ErrorUnknown if there is none.
+func Code(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ErrorUnknown
+}
+
+func encodeBody(body interface{}) ([]byte, error) {
+	if body == nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(body)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeBody(body []byte, into interface{}) error {
+	if into == nil {
+		return nil
+	}
+	if len(body) == 0 {
+		return &Error{Code: ErrorInvalidRequest, Message: "Message body is missing"}
+	}
+	err := gob.NewDecoder(bytes.NewReader(body)).Decode(into)
+	if err != nil {
+		return &Error{Code: ErrorInvalidRequest, Message: fmt.Sprintf("Message body is invalid: %v", err)}
+	}
+	return nil
+}
+
+func writeFrame(w io.Writer, f *frame) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	err := gob.NewEncoder(&buf).Encode(f)
+	if err != nil {
+		return err
+	}
+	if buf.Len()-4 > maxFrameSize {
+		return errors.New("Frame is too large")
+	}
+	binary.BigEndian.PutUint32(buf.Bytes(), uint32(buf.Len()-4))
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var header [4]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, errors.New("Frame is too large")
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	f := &frame{}
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid frame: %w", err)
+	}
+	return f, nil
+}
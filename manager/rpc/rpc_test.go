@@ -0,0 +1,312 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type echoRequest struct {
+	Text  string
+	Delay time.Duration
+}
+
+type echoResponse struct {
+	Text string
+}
+
+type testNotification struct {
+	Sequence int
+}
+
+func newTestServer() *Server {
+	s := NewServer()
+	s.Handle("Echo", func(decode func(interface{}) error) (interface{}, error) {
+		var request echoRequest
+		err := decode(&request)
+		if err != nil {
+			return nil, err
+		}
+		time.Sleep(request.Delay)
+		return &echoResponse{request.Text}, nil
+	})
+	s.Handle("Fail", func(decode func(interface{}) error) (interface{}, error) {
+		return nil, &Error{Code: ErrorNotFound, Message: "No such tunnel"}
+	})
+	s.Handle("PlainFail", func(decode func(interface{}) error) (interface{}, error) {
+		return nil, errors.New("Something went wrong")
+	})
+	s.Handle("Panic", func(decode func(interface{}) error) (interface{}, error) {
+		panic("oops")
+	})
+	s.Handle("Nothing", func(decode func(interface{}) error) (interface{}, error) {
+		return nil, nil
+	})
+	return s
+}
+
+// connect returns a client connected to a new connection to s over net.Pipe.
+func connect(t *testing.T, s *Server, handler NotificationHandler) (*Client, *Conn) {
+	clientEnd, serverEnd := net.Pipe()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := s.Accept(serverEnd)
+		if err != nil {
+			serverEnd.Close()
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+		conn.Serve()
+	}()
+	client, err := NewClient(clientEnd, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("Server did not accept connection")
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, conn
+}
+
+func TestCall(t *testing.T) {
+	client, conn := connect(t, newTestServer(), nil)
+	if client.Version != ProtocolVersion || conn.Version != ProtocolVersion {
+		t.Errorf("Negotiated versions %d and %d, want %d", client.Version, conn.Version, ProtocolVersion)
+	}
+	var response echoResponse
+	err := client.Call("Echo", &echoRequest{Text: "hello"}, &response)
+	if err != nil || response.Text != "hello" {
+		t.Errorf("Echo returned %q, %v", response.Text, err)
+	}
+	err = client.Call("Nothing", nil, nil)
+	if err != nil {
+		t.Errorf("Call without request or response failed: %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	client, _ := connect(t, newTestServer(), nil)
+	for _, test := range []struct {
+		method  string
+		request interface{}
+		code    ErrorCode
+		message string
+	}{
+		{"Fail", nil, ErrorNotFound, "No such tunnel"},
+		{"PlainFail", nil, ErrorUnknown, "Something went wrong"},
+		{"Panic", nil, ErrorInternal, "Internal error in Panic"},
+		{"Missing", nil, ErrorUnknownMethod, "Unknown method `Missing`"},
+		{"Echo", nil, ErrorInvalidRequest, "Message body is missing"},
+		{"Echo", &testNotification{1}, ErrorInvalidRequest, "Message body is invalid"},
+	} {
+		err := client.Call(test.method, test.request, &echoResponse{})
+		if Code(err) != test.code || err == nil || !strings.HasPrefix(err.Error(), test.message) {
+			t.Errorf("%s returned %v with code %d, want %q with code %d", test.method, err, Code(err), test.message, test.code)
+		}
+	}
+	var response echoResponse
+	err := client.Call("Echo", &echoRequest{Text: "still working"}, &response)
+	if err != nil || response.Text != "still working" {
+		t.Errorf("Connection broken after errors: %v", err)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	client, _ := connect(t, newTestServer(), nil)
+	slowDone := make(chan error, 1)
+	go func() {
+		var response echoResponse
+		slowDone <- client.Call("Echo", &echoRequest{Text: "slow", Delay: time.Second}, &response)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			text := strings.Repeat("x", i)
+			var response echoResponse
+			err := client.Call("Echo", &echoRequest{Text: text, Delay: time.Millisecond * time.Duration(20-i)}, &response)
+			if err != nil || response.Text != text {
+				t.Errorf("Call %d returned %q, %v", i, response.Text, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("Fast calls took %v, so were held up by the slow one", elapsed)
+	}
+	select {
+	case <-slowDone:
+		t.Error("Slow call finished too soon")
+	default:
+	}
+	if err := <-slowDone; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	received := make(chan int, 100)
+	var client *Client
+	client, conn := connect(t, newTestServer(), func(name string, decode func(interface{}) error) {
+		if name != "Test" {
+			t.Errorf("Notification has name %q", name)
+			return
+		}
+		var notification testNotification
+		err := decode(&notification)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Handlers may make calls, without deadlocking the reader.
+		var response echoResponse
+		err = client.Call("Echo", &echoRequest{Text: "from handler"}, &response)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- notification.Sequence
+	})
+	for i := 0; i < 50; i++ {
+		err := conn.Notify("Test", &testNotification{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		select {
+		case sequence := <-received:
+			if sequence != i {
+				t.Fatalf("Notification %d arrived in position %d", sequence, i)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for notifications")
+		}
+	}
+}
+
+func TestStuckClient(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, _ := newTestServer().Accept(serverEnd)
+		accepted <- conn
+	}()
+	writeFrame(clientEnd, &frame{Type: helloFrame, Version: ProtocolVersion})
+	readFrame(clientEnd)
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("Server did not accept connection")
+	}
+
+	// The client never reads again, so notifications must neither block nor pile up without bound.
+	start := time.Now()
+	var err error
+	for i := 0; i < notificationBacklog+2 && err == nil; i++ {
+		err = conn.Notify("Test", &testNotification{i})
+	}
+	if err == nil {
+		t.Fatal("Notifications to a stuck client never failed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("Notifying a stuck client took %v", elapsed)
+	}
+	if err = conn.Notify("Test", &testNotification{0}); err == nil {
+		t.Error("Notification succeeded after the client was disconnected")
+	}
+}
+
+func TestClosedConnection(t *testing.T) {
+	client, conn := connect(t, newTestServer(), nil)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Call("Echo", &echoRequest{Text: "never", Delay: time.Second * 5}, &echoResponse{})
+	}()
+	time.Sleep(time.Millisecond * 50)
+	conn.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Call in flight succeeded after the connection closed")
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("Call in flight was not failed when the connection closed")
+	}
+	if err := client.Call("Nothing", nil, nil); err == nil {
+		t.Error("Call succeeded after the connection closed")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	s := newTestServer()
+
+	oldClient, serverEnd := net.Pipe()
+	told := make(chan *frame, 1)
+	go func() {
+		writeFrame(oldClient, &frame{Type: helloFrame, Version: MinimumProtocolVersion - 1})
+		f, _ := readFrame(oldClient)
+		oldClient.Close()
+		told <- f
+	}()
+	_, err := s.Accept(serverEnd)
+	if Code(err) != ErrorIncompatibleVersion {
+		t.Errorf("Old client was accepted: %v", err)
+	}
+	if f := <-told; f == nil || f.Error == nil || f.Error.Code != ErrorIncompatibleVersion {
+		t.Errorf("Old client was told %+v", f)
+	}
+
+	clientEnd, newServer := net.Pipe()
+	go func() {
+		readFrame(newServer)
+		writeFrame(newServer, &frame{Type: helloFrame, Version: ProtocolVersion + 1})
+		readFrame(newServer)
+	}()
+	client, err := NewClient(clientEnd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Version != ProtocolVersion {
+		t.Errorf("Client agreed on version %d with a newer server, want %d", client.Version, ProtocolVersion)
+	}
+	client.Close()
+
+	rudeClient, serverEnd := net.Pipe()
+	go func() {
+		writeFrame(rudeClient, &frame{Type: requestFrame, Method: "Echo"})
+		rudeClient.Close()
+	}()
+	_, err = s.Accept(serverEnd)
+	if err == nil {
+		t.Error("Client that skipped the handshake was accepted")
+	}
+}
+
+func TestOversizedFrame(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	go func() {
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], maxFrameSize+1)
+		clientEnd.Write(header[:])
+		clientEnd.Close()
+	}()
+	_, err := NewServer().Accept(serverEnd)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("Oversized frame was not rejected: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// Handler serves one method. It decodes its request, if it takes one, with decode, and returns a
+// response, which may be nil, or an error, which is sent to the client as an Error.
+type Handler func(decode func(request interface{}) error) (response interface{}, err error)
+
+// Server dispatches calls to the handlers registered for their methods.
+type Server struct {
+	handlers map[string]Handler
+}
+
+func NewServer() *Server {
+	return &Server{handlers: make(map[string]Handler)}
+}
+
+// Handle registers the handler for a method. It must not be called once connections are being
+// served.
+func (s *Server) Handle(method string, handler Handler) {
+	s.handlers[method] = handler
+}
+
+// notificationBacklog is how many notifications may wait for a client to read them before it is
+// taken to be stuck.
+const notificationBacklog = 64
+
+// Conn is one client's connection to a Server.
+type Conn struct {
+	server        *Server
+	conn          io.ReadWriteCloser
+	writeLock     sync.Mutex
+	notifications chan *frame
+	closed        chan struct{}
+	closeOnce     sync.Once
+
+	// Version is the protocol version agreed on with the client.
+	Version uint32
+}
+
+// Accept performs the version handshake with a new client.
+func (s *Server) Accept(conn io.ReadWriteCloser) (*Conn, error) {
+	hello, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if hello.Type != helloFrame {
+		return nil, errors.New("Client did not start with a handshake")
+	}
+	if hello.Version < MinimumProtocolVersion {
+		versionErr := &Error{Code: ErrorIncompatibleVersion, Message: fmt.Sprintf("Client protocol version %d is too old", hello.Version)}
+		writeFrame(conn, &frame{Type: helloFrame, Version: ProtocolVersion, Error: versionErr})
+		return nil, versionErr
+	}
+	err = writeFrame(conn, &frame{Type: helloFrame, Version: ProtocolVersion})
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		server:        s,
+		conn:          conn,
+		notifications: make(chan *frame, notificationBacklog),
+		closed:        make(chan struct{}),
+		Version:       hello.Version,
+	}
+	if c.Version > ProtocolVersion {
+		c.Version = ProtocolVersion
+	}
+	go c.sendNotifications()
+	return c, nil
+}
+
+func (c *Conn) write(f *frame) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return writeFrame(c.conn, f)
+}
+
+// sendNotifications writes queued notifications until the connection is closed, so that a client
+// that stops reading only ever holds up itself.
+func (c *Conn) sendNotifications() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case f := <-c.notifications:
+			err := c.write(f)
+			if err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *Conn) handle(request *frame) {
+	response := &frame{Type: responseFrame, ID: request.ID}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in %s handler: %v\n%s", request.Method, r, string(debug.Stack()))
+			response.Body = nil
+			response.Error = &Error{Code: ErrorInternal, Message: fmt.Sprintf("Internal error in %s", request.Method)}
+		}
+		err := c.write(response)
+		if err != nil {
+			c.Close()
+		}
+	}()
+	handler, ok := c.server.handlers[request.Method]
+	if !ok {
+		response.Error = &Error{Code: ErrorUnknownMethod, Message: fmt.Sprintf("Unknown method %#q", request.Method)}
+		return
+	}
+	result, err := handler(func(into interface{}) error {
+		return decodeBody(request.Body, into)
+	})
+	if err != nil {
+		response.Error = AsError(err)
+		return
+	}
+	response.Body, err = encodeBody(result)
+	if err != nil {
+		response.Error = &Error{Code: ErrorInternal, Message: fmt.Sprintf("Unable to encode response: %v", err)}
+	}
+}
+
+// Serve handles requests until the connection fails or is closed, each in its own goroutine, and
+// then closes the connection.
+func (c *Conn) Serve() error {
+	defer c.Close()
+	for {
+		f, err := readFrame(c.conn)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if f.Type != requestFrame {
+			return fmt.Errorf("Unexpected frame type %d", f.Type)
+		}
+		go c.handle(f)
+	}
+}
+
+// Notify queues a notification, without waiting for it to be written. Clients read continuously,
+// so one that lets notificationBacklog of them pile up is stuck, and is disconnected, rather than
+// holding up notifications to the others.
+func (c *Conn) Notify(name string, body interface{}) error {
+	encoded, err := encodeBody(body)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case c.notifications <- &frame{Type: notificationFrame, Method: name, Body: encoded}:
+		return nil
+	default:
+		c.Close()
+		return errors.New("Client is not keeping up with notifications")
+	}
+}
+
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -24,6 +24,7 @@ import (
 	"golang.zx2c4.com/wireguard/windows/conf"
 	"golang.zx2c4.com/wireguard/windows/elevate"
 	"golang.zx2c4.com/wireguard/windows/ringlogger"
+	"golang.zx2c4.com/wireguard/windows/ringlogger/forwarder"
 	"golang.zx2c4.com/wireguard/windows/services"
 	"golang.zx2c4.com/wireguard/windows/version"
 )
@@ -41,6 +42,26 @@ func printPanic() {
 	}
 }
 
+func startLogForwarder() *forwarder.Forwarder {
+	policy, err := forwarder.LoadPolicy()
+	if err != nil {
+		log.Printf("Unable to load log forwarding policy: %v", err)
+		return nil
+	}
+	if policy == nil {
+		return nil
+	}
+	tunnelNames, _ := conf.ListConfigNames()
+	logForwarder, err := forwarder.New(policy, forwarder.RingSource(ringlogger.Global), tunnelNames)
+	if err != nil {
+		log.Printf("Unable to start log forwarder: %v", err)
+		return nil
+	}
+	logForwarder.Start()
+	log.Printf("Forwarding log to %d sink(s)", len(policy.Sinks))
+	return logForwarder
+}
+
 func (service *managerService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (svcSpecificEC bool, exitCode uint32) {
 	changes <- svc.Status{State: svc.StartPending}
 
@@ -65,6 +86,10 @@ func (service *managerService) Execute(args []string, r <-chan svc.ChangeRequest
 
 	log.Println("Starting", version.UserAgent())
 
+	if logForwarder := startLogForwarder(); logForwarder != nil {
+		defer logForwarder.Stop()
+	}
+
 	path, err := os.Executable()
 	if err != nil {
 		serviceError = services.ErrorDetermineExecutablePath
@@ -77,6 +102,10 @@ func (service *managerService) Execute(args []string, r <-chan svc.ChangeRequest
 		return
 	}
 
+	for _, err := range conf.FinishPendingRenames() {
+		log.Printf("Unable to finish pending rename: %v", err)
+	}
+
 	err = trackExistingTunnels()
 	if err != nil {
 		serviceError = services.ErrorTrackTunnels
@@ -86,6 +115,36 @@ func (service *managerService) Execute(args []string, r <-chan svc.ChangeRequest
 	conf.RegisterStoreChangeCallback(func() { conf.MigrateUnencryptedConfigs() }) // Ignore return value for now, but could be useful later.
 	conf.RegisterStoreChangeCallback(IPCServerNotifyTunnelsChange)
 
+	var managerPipe Listener
+	managerPipeSD, err := windows.SecurityDescriptorFromString("O:SYD:P(A;;GA;;;SY)(A;;GA;;;BA)")
+	if err == nil {
+		managerPipe, err = ListenNamedPipe(ManagerPipePath, managerPipeSD)
+	}
+	if err != nil {
+		log.Printf("Unable to listen for command line clients: %v", err)
+	} else {
+		defer managerPipe.Close()
+		go func() {
+			defer printPanic()
+			IPCServe(managerPipe, &serviceBackend{}, RequireElevated)
+		}()
+	}
+
+	if httpAPI := startHTTPAPI(); httpAPI != nil {
+		defer httpAPI.Close()
+	}
+
+	stopOnDemand := make(chan struct{})
+	go runOnDemand(&serviceBackend{}, stopOnDemand)
+	defer close(stopOnDemand)
+
+	stopHealthMonitor := make(chan struct{})
+	go func() {
+		defer printPanic()
+		newHealthMonitor(&serviceBackend{}).run(stopHealthMonitor)
+	}()
+	defer close(stopHealthMonitor)
+
 	procs := make(map[uint32]*os.Process)
 	aliveSessions := make(map[uint32]bool)
 	procsLock := sync.Mutex{}
@@ -171,12 +230,7 @@ func (service *managerService) Execute(args []string, r <-chan svc.ChangeRequest
 				log.Printf("Unable to create two inheritable RPC pipes: %v", err)
 				return
 			}
-			ourEvents, theirEvents, theirEventStr, err := inheritableEvents()
-			if err != nil {
-				log.Printf("Unable to create one inheritable events pipe: %v", err)
-				return
-			}
-			IPCServerListen(ourReader, ourWriter, ourEvents, elevatedToken)
+			IPCServerListen(ourReader, ourWriter, elevatedToken)
 			theirLogMapping, theirLogMappingHandle, err := ringlogger.Global.ExportInheritableMappingHandleStr()
 			if err != nil {
 				log.Printf("Unable to export inheritable mapping handle for logging: %v", err)
@@ -194,20 +248,18 @@ func (service *managerService) Execute(args []string, r <-chan svc.ChangeRequest
 			procsLock.Lock()
 			var proc *os.Process
 			if alive := aliveSessions[session]; alive {
-				proc, err = os.StartProcess(path, []string{path, "/ui", theirReaderStr, theirWriterStr, theirEventStr, theirLogMapping}, attr)
+				proc, err = os.StartProcess(path, []string{path, "/ui", theirReaderStr, theirWriterStr, theirLogMapping}, attr)
 			} else {
 				err = errors.New("Session has logged out")
 			}
 			procsLock.Unlock()
 			theirReader.Close()
 			theirWriter.Close()
-			theirEvents.Close()
 			windows.Close(theirLogMappingHandle)
 			runtime.UnlockOSThread()
 			if err != nil {
 				ourReader.Close()
 				ourWriter.Close()
-				ourEvents.Close()
 				log.Printf("Unable to start manager UI process for user '%s@%s' for session %d: %v", username, domain, session, err)
 				return
 			}
@@ -232,7 +284,6 @@ func (service *managerService) Execute(args []string, r <-chan svc.ChangeRequest
 			procsLock.Unlock()
 			ourReader.Close()
 			ourWriter.Close()
-			ourEvents.Close()
 
 			if sessionIsDead {
 				return
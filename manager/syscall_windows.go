@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+//sys	impersonateNamedPipeClient(pipe windows.Handle) (err error) = advapi32.ImpersonateNamedPipeClient
+
+// https://docs.microsoft.com/en-us/windows/win32/api/ipmib/ns-ipmib-mib_ipnetrow_lh
+type mibIPNetRow struct {
+	index       uint32
+	physAddrLen uint32
+	physAddr    [8]byte
+	addr        [4]byte
+	typ         uint32
+}
+
+type mibIPNetTable struct {
+	numEntries uint32
+	table      [1]mibIPNetRow
+}
+
+//sys	getIpNetTable(table *mibIPNetTable, size *uint32, order bool) (ret error) = iphlpapi.GetIpNetTable
+
+const (
+	wlanClientVersion               = 2
+	wlanInterfaceStateConnected     = 1
+	wlanIntfOpcodeCurrentConnection = 7
+	wlanMaxNameLength               = 256
+	dot11SSIDMaxLength              = 32
+)
+
+// https://docs.microsoft.com/en-us/windows/win32/api/wlanapi/ns-wlanapi-wlan_interface_info
+type wlanInterfaceInfo struct {
+	interfaceGUID windows.GUID
+	description   [wlanMaxNameLength]uint16
+	state         uint32
+}
+
+type wlanInterfaceInfoList struct {
+	numberOfItems uint32
+	index         uint32
+	interfaceInfo [1]wlanInterfaceInfo
+}
+
+// wlanConnectionAttributes is the start of WLAN_CONNECTION_ATTRIBUTES, as far as the SSID.
+// https://docs.microsoft.com/en-us/windows/win32/api/wlanapi/ns-wlanapi-wlan_connection_attributes
+type wlanConnectionAttributes struct {
+	state          uint32
+	connectionMode uint32
+	profileName    [wlanMaxNameLength]uint16
+	ssidLength     uint32
+	ssid           [dot11SSIDMaxLength]byte
+}
+
+//sys	wlanOpenHandle(clientVersion uint32, reserved uintptr, negotiatedVersion *uint32, handle *windows.Handle) (ret error) = wlanapi.WlanOpenHandle
+//sys	wlanCloseHandle(handle windows.Handle, reserved uintptr) (ret error) = wlanapi.WlanCloseHandle
+//sys	wlanEnumInterfaces(handle windows.Handle, reserved uintptr, interfaceList **wlanInterfaceInfoList) (ret error) = wlanapi.WlanEnumInterfaces
+//sys	wlanQueryInterface(handle windows.Handle, interfaceGUID *windows.GUID, opcode uint32, reserved uintptr, dataSize *uint32, data *unsafe.Pointer, opcodeValueType *uint32) (ret error) = wlanapi.WlanQueryInterface
+//sys	wlanFreeMemory(memory unsafe.Pointer) = wlanapi.WlanFreeMemory
@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"golang.zx2c4.com/wireguard/windows/manager/rpc"
+)
+
+// Peer describes the process at the other end of a connection, as vouched for by the operating
+// system rather than by the process itself.
+type Peer struct {
+	// PID is the peer's process ID, or 0 if it isn't known.
+	PID int
+
+	// User is the peer's user, as a SID string on Windows, or a numeric user ID on Unix.
+	User string
+
+	// Elevated says whether the peer has administrative rights.
+	Elevated bool
+
+	// Token is the token with which updates requested by the peer are installed, or 0 for none.
+	Token uintptr
+}
+
+// Authorizer decides whether a peer may call a method, returning the error to give it if not.
+type Authorizer func(peer *Peer, method MethodType) error
+
+// AllowAll authorizes every call. It suits connections whose peer was already vetted, such as the
+// UI process that the manager itself starts over inherited pipes.
+func AllowAll(peer *Peer, method MethodType) error {
+	return nil
+}
+
+// RequireElevated only authorizes calls from peers with administrative rights.
+func RequireElevated(peer *Peer, method MethodType) error {
+	if !peer.Elevated {
+		return &rpc.Error{Code: rpc.ErrorAccessDenied, Message: fmt.Sprintf("Calling %s requires administrative rights", method)}
+	}
+	return nil
+}
+
+// Listener accepts connections from clients, identifying the peer behind each one.
+type Listener interface {
+	Accept() (io.ReadWriteCloser, *Peer, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// peerListener identifies the peers of a net.Listener's connections, dropping any that can't be
+// identified.
+type peerListener struct {
+	net.Listener
+	identify func(conn net.Conn) (io.ReadWriteCloser, *Peer, error)
+}
+
+func (l *peerListener) Accept() (io.ReadWriteCloser, *Peer, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, nil, err
+		}
+		identified, peer, err := l.identify(conn)
+		if err != nil {
+			log.Printf("Unable to identify IPC client: %v", err)
+			conn.Close()
+			continue
+		}
+		return identified, peer, nil
+	}
+}
+
+// Dialer connects to the manager.
+type Dialer func() (io.ReadWriteCloser, error)
+
+// IPCServe serves each client that connects to listener, until listener is closed.
+func IPCServe(listener Listener, backend TunnelBackend, authorize Authorizer) error {
+	for {
+		conn, peer, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := IPCServeConn(conn, peer, backend, authorize)
+			if err != nil {
+				log.Printf("IPC client connection failed: %v", err)
+			}
+		}()
+	}
+}
+
+// IPCServeConn serves a single client, returning once it disconnects.
+func IPCServeConn(conn io.ReadWriteCloser, peer *Peer, backend TunnelBackend, authorize Authorizer) error {
+	service := &ManagerService{
+		backend:   backend,
+		peer:      peer,
+		authorize: authorize,
+	}
+	server := rpc.NewServer()
+	service.register(server)
+	rpcConn, err := server.Accept(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	service.conn = rpcConn
+	managerServicesLock.Lock()
+	managerServices[service] = true
+	managerServicesLock.Unlock()
+	err = rpcConn.Serve()
+	managerServicesLock.Lock()
+	delete(managerServices, service)
+	managerServicesLock.Unlock()
+	return err
+}
+
+// ConnectIPCClient connects to the manager, through which the rest of this package's client
+// functions then work, replacing any earlier connection.
+func ConnectIPCClient(dial Dialer) error {
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	client, err := rpc.NewClient(conn, dispatchNotification)
+	if err != nil {
+		return err
+	}
+	DisconnectIPCClient()
+	rpcClient = client
+	return nil
+}
+
+// DisconnectIPCClient closes the connection to the manager, if there is one.
+func DisconnectIPCClient() {
+	if rpcClient != nil {
+		rpcClient.Close()
+		rpcClient = nil
+	}
+}
@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// This isn't a Linux program, yes, but having the manager's IPC work across platforms is quite helpful for testing.
+
+func identifyUnixSocketClient(conn net.Conn) (io.ReadWriteCloser, *Peer, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, nil, errors.New("Connection is not a Unix domain socket")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	var credentials *unix.Ucred
+	err2 := rawConn.Control(func(fd uintptr) {
+		credentials, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err2 != nil {
+		return nil, nil, err2
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	peer := &Peer{
+		PID:      int(credentials.Pid),
+		User:     strconv.FormatUint(uint64(credentials.Uid), 10),
+		Elevated: credentials.Uid == 0,
+	}
+	return conn, peer, nil
+}
+
+// ListenUnixSocket listens on a Unix domain socket, identifying clients by their SO_PEERCRED
+// credentials.
+func ListenUnixSocket(path string) (Listener, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &peerListener{listener, identifyUnixSocketClient}, nil
+}
+
+// UnixSocketDialer connects to a manager listening on a Unix domain socket.
+func UnixSocketDialer(path string) Dialer {
+	return func() (io.ReadWriteCloser, error) {
+		return net.Dial("unix", path)
+	}
+}
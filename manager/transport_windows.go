@@ -0,0 +1,235 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sys/windows"
+
+	"golang.zx2c4.com/wireguard/ipc/winpipe"
+
+	"golang.zx2c4.com/wireguard/windows/elevate"
+)
+
+func makeInheritableAndGetStr(f *os.File) (str string, err error) {
+	sc, err := f.SyscallConn()
+	if err != nil {
+		return
+	}
+	err2 := sc.Control(func(fd uintptr) {
+		err = windows.SetHandleInformation(windows.Handle(fd), windows.HANDLE_FLAG_INHERIT, windows.HANDLE_FLAG_INHERIT)
+		str = strconv.FormatUint(uint64(fd), 10)
+	})
+	if err2 != nil {
+		err = err2
+	}
+	return
+}
+
+func inheritableSocketpairEmulation() (ourReader *os.File, theirReader *os.File, theirReaderStr string, ourWriter *os.File, theirWriter *os.File, theirWriterStr string, err error) {
+	ourReader, theirWriter, err = os.Pipe()
+	if err != nil {
+		return
+	}
+	theirWriterStr, err = makeInheritableAndGetStr(theirWriter)
+	if err != nil {
+		return
+	}
+
+	theirReader, ourWriter, err = os.Pipe()
+	if err != nil {
+		return
+	}
+	theirReaderStr, err = makeInheritableAndGetStr(theirReader)
+	return
+}
+
+// pipePair joins the two halves of the socketpair emulation into one connection.
+type pipePair struct {
+	reader *os.File
+	writer *os.File
+}
+
+func (p *pipePair) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (p *pipePair) Write(b []byte) (int, error) {
+	return p.writer.Write(b)
+}
+
+func (p *pipePair) Close() error {
+	err1 := p.reader.Close()
+	err2 := p.writer.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// IPCServerListen serves the UI process started by the manager over the pipes it inherits. It was
+// started with elevatedToken, which is what vouches for it.
+func IPCServerListen(reader *os.File, writer *os.File, elevatedToken windows.Token) {
+	peer := &Peer{Elevated: true, Token: uintptr(elevatedToken)}
+	tokenUser, err := elevatedToken.GetTokenUser()
+	if err == nil {
+		peer.User = tokenUser.User.Sid.String()
+	}
+	go func() {
+		defer printPanic()
+		err := IPCServeConn(&pipePair{reader, writer}, peer, &serviceBackend{}, AllowAll)
+		if err != nil {
+			log.Printf("UI connection failed: %v", err)
+		}
+	}()
+}
+
+// InitializeIPCClient connects to the manager over the pipes inherited from it.
+func InitializeIPCClient(reader *os.File, writer *os.File) error {
+	return ConnectIPCClient(func() (io.ReadWriteCloser, error) {
+		return &pipePair{reader, writer}, nil
+	})
+}
+
+// namedPipeConn identifies a named pipe client by impersonating it, rather than by its process ID,
+// which may have been reused by the time the process is opened. Windows only allows impersonation
+// once something has been read from the pipe, so the peer is only filled in by the first read,
+// before the server can act on anything the client sends. Its token is kept open for as long as
+// the connection.
+type namedPipeConn struct {
+	net.Conn
+	peer       *Peer
+	identified bool
+	tokenLock  sync.Mutex
+	token      windows.Token
+	closed     bool
+}
+
+func (c *namedPipeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.identified {
+		c.identified = true
+		identifyErr := c.identify()
+		if identifyErr != nil {
+			log.Printf("Unable to identify IPC client: %v", identifyErr)
+			return 0, identifyErr
+		}
+	}
+	return n, err
+}
+
+func (c *namedPipeConn) identify() error {
+	fd, ok := c.Conn.(interface{ Fd() uintptr })
+	if !ok {
+		return errors.New("Named pipe has no handle")
+	}
+	impersonation, err := impersonationToken(windows.Handle(fd.Fd()))
+	if err != nil {
+		return err
+	}
+	defer impersonation.Close()
+	var token windows.Token
+	err = windows.DuplicateTokenEx(impersonation, windows.TOKEN_QUERY|windows.TOKEN_DUPLICATE|windows.TOKEN_ASSIGN_PRIMARY, nil, windows.SecurityImpersonation, windows.TokenPrimary, &token)
+	if err != nil {
+		return err
+	}
+	tokenUser, err := token.GetTokenUser()
+	if err != nil {
+		token.Close()
+		return err
+	}
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+	if c.closed {
+		token.Close()
+		return os.ErrClosed
+	}
+	c.token = token
+	c.peer.User = tokenUser.User.Sid.String()
+	c.peer.Elevated = token.IsElevated() && elevate.TokenIsElevatedOrElevatable(token)
+	c.peer.Token = uintptr(token)
+	return nil
+}
+
+// impersonationToken opens the token of a named pipe's client by impersonating it on this thread.
+// Should reverting fail, the thread is left locked, so that the runtime ends it rather than
+// letting other goroutines run as the client.
+func impersonationToken(pipe windows.Handle) (windows.Token, error) {
+	runtime.LockOSThread()
+	err := impersonateNamedPipeClient(pipe)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return 0, err
+	}
+	var token windows.Token
+	thread, err := windows.GetCurrentThread()
+	if err == nil {
+		err = windows.OpenThreadToken(thread, windows.TOKEN_QUERY|windows.TOKEN_DUPLICATE, true, &token)
+	}
+	revertErr := windows.RevertToSelf()
+	if revertErr != nil {
+		if err == nil {
+			token.Close()
+		}
+		return 0, revertErr
+	}
+	runtime.UnlockOSThread()
+	if err != nil {
+		return 0, err
+	}
+	return token, nil
+}
+
+func (c *namedPipeConn) Close() error {
+	err := c.Conn.Close()
+	c.tokenLock.Lock()
+	c.closed = true
+	if c.token != 0 {
+		c.token.Close()
+		c.token = 0
+	}
+	c.tokenLock.Unlock()
+	return err
+}
+
+func identifyNamedPipeClient(conn net.Conn) (io.ReadWriteCloser, *Peer, error) {
+	peer := &Peer{}
+	return &namedPipeConn{Conn: conn, peer: peer}, peer, nil
+}
+
+// ManagerPipePath is where the manager service listens for command line clients. ProtectedPrefix
+// means only administrators and Local System may create it.
+const ManagerPipePath = `\\.\pipe\ProtectedPrefix\Administrators\WireGuardManager`
+
+// ListenNamedPipe listens on a named pipe, which should be under \\.\pipe\ProtectedPrefix so that
+// other users can't squat on it, identifying clients by impersonating them.
+func ListenNamedPipe(path string, securityDescriptor *windows.SECURITY_DESCRIPTOR) (Listener, error) {
+	listener, err := winpipe.ListenPipe(path, &winpipe.PipeConfig{SecurityDescriptor: securityDescriptor})
+	if err != nil {
+		return nil, err
+	}
+	return &peerListener{listener, identifyNamedPipeClient}, nil
+}
+
+// NamedPipeDialer connects to a manager listening on a named pipe, which must be owned by Local
+// System.
+func NamedPipeDialer(path string) Dialer {
+	return func() (io.ReadWriteCloser, error) {
+		localSystem, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+		if err != nil {
+			return nil, err
+		}
+		return winpipe.DialPipe(path, nil, localSystem)
+	}
+}
@@ -39,7 +39,11 @@ func trackExistingTunnels() error {
 		if err != nil {
 			continue
 		}
-		go trackTunnelService(name, service)
+		if claimTrackedTunnel(name) {
+			go trackTunnelService(name, service)
+		} else {
+			service.Close()
+		}
 	}
 	return nil
 }
@@ -66,35 +70,65 @@ func svcStateToTunState(s svc.State) TunnelState {
 	}
 }
 
-func trackedTunnelsGlobalState() (state TunnelState) {
-	state = TunnelStopped
+func trackedTunnelsGlobalState() TunnelState {
 	trackedTunnelsLock.Lock()
 	defer trackedTunnelsLock.Unlock()
+	states := make([]TunnelState, 0, len(trackedTunnels))
 	for _, s := range trackedTunnels {
-		if s == TunnelStarting {
-			return TunnelStarting
-		} else if s == TunnelStopping {
-			return TunnelStopping
-		} else if s == TunnelStarted || s == TunnelUnknown {
-			state = TunnelStarted
+		states = append(states, s)
+	}
+	return aggregateTunnelState(states)
+}
+
+// trackedTunnelsGroupState sums up the members of a group in the same way as the global state.
+func trackedTunnelsGroupState(group *conf.TunnelGroup) TunnelState {
+	trackedTunnelsLock.Lock()
+	defer trackedTunnelsLock.Unlock()
+	states := make([]TunnelState, 0, len(group.Members))
+	for t, s := range trackedTunnels {
+		if group.HasMember(t) {
+			states = append(states, s)
+		}
+	}
+	return aggregateTunnelState(states)
+}
+
+// notifyTrackedTunnelChange tells clients about a change to a tracked tunnel, and to the state of
+// each group it belongs to.
+func notifyTrackedTunnelChange(tunnelName string, state TunnelState, err error) {
+	IPCServerNotifyTunnelChange(tunnelName, state, trackedTunnelsGlobalState(), err)
+	groups, err := conf.LoadGroups()
+	if err != nil {
+		return
+	}
+	for i := range groups {
+		if groups[i].HasMember(tunnelName) {
+			IPCServerNotifyGroupChange(groups[i].Name, trackedTunnelsGroupState(&groups[i]))
 		}
 	}
-	return
 }
 
+// claimTrackedTunnel adds a tunnel to trackedTunnels, so that it counts as running from the moment
+// its service is installed rather than once its tracker gets going. It returns false if the tunnel
+// is tracked already, in which case no second tracker should be started.
+func claimTrackedTunnel(tunnelName string) bool {
+	trackedTunnelsLock.Lock()
+	defer trackedTunnelsLock.Unlock()
+	if _, found := trackedTunnels[tunnelName]; found {
+		return false
+	}
+	trackedTunnels[tunnelName] = TunnelUnknown
+	return true
+}
+
+// trackTunnelService follows the state of a tunnel's service until it is gone. The tunnel must
+// have been claimed with claimTrackedTunnel.
 func trackTunnelService(tunnelName string, service *mgr.Service) {
 	defer func() {
 		service.Close()
 		log.Printf("[%s] Tunnel service tracker finished", tunnelName)
 	}()
 
-	trackedTunnelsLock.Lock()
-	if _, found := trackedTunnels[tunnelName]; found {
-		trackedTunnelsLock.Unlock()
-		return
-	}
-	trackedTunnels[tunnelName] = TunnelUnknown
-	trackedTunnelsLock.Unlock()
 	defer func() {
 		trackedTunnelsLock.Lock()
 		delete(trackedTunnels, tunnelName)
@@ -115,7 +149,7 @@ func trackTunnelService(tunnelName string, service *mgr.Service) {
 			trackedTunnelsLock.Lock()
 			trackedTunnels[tunnelName] = TunnelStopped
 			trackedTunnelsLock.Unlock()
-			IPCServerNotifyTunnelChange(tunnelName, TunnelStopped, nil)
+			notifyTrackedTunnelChange(tunnelName, TunnelStopped, nil)
 			return true
 		}
 		return false
@@ -150,7 +184,7 @@ func trackTunnelService(tunnelName string, service *mgr.Service) {
 			trackedTunnelsLock.Lock()
 			trackedTunnels[tunnelName] = TunnelStopped
 			trackedTunnelsLock.Unlock()
-			IPCServerNotifyTunnelChange(tunnelName, TunnelStopped, nil)
+			notifyTrackedTunnelChange(tunnelName, TunnelStopped, nil)
 			return
 		case windows.ERROR_SERVICE_NOTIFY_CLIENT_LAGGING:
 			continue
@@ -158,7 +192,7 @@ func trackTunnelService(tunnelName string, service *mgr.Service) {
 			trackedTunnelsLock.Lock()
 			trackedTunnels[tunnelName] = TunnelStopped
 			trackedTunnelsLock.Unlock()
-			IPCServerNotifyTunnelChange(tunnelName, TunnelStopped, fmt.Errorf("Unable to continue monitoring service, so stopping: %w", err))
+			notifyTrackedTunnelChange(tunnelName, TunnelStopped, fmt.Errorf("Unable to continue monitoring service, so stopping: %w", err))
 			service.Control(svc.Stop)
 			return
 		}
@@ -183,7 +217,7 @@ func trackTunnelService(tunnelName string, service *mgr.Service) {
 			trackedTunnelsLock.Lock()
 			trackedTunnels[tunnelName] = state
 			trackedTunnelsLock.Unlock()
-			IPCServerNotifyTunnelChange(tunnelName, state, tunnelError)
+			notifyTrackedTunnelChange(tunnelName, state, tunnelError)
 			lastState = state
 		}
 	}
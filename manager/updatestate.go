@@ -6,11 +6,11 @@
 package manager
 
 import (
-	"log"
+	"errors"
+	"sync"
 	"time"
 
 	"golang.zx2c4.com/wireguard/windows/updater"
-	"golang.zx2c4.com/wireguard/windows/version"
 )
 
 type UpdateState uint32
@@ -19,39 +19,121 @@ const (
 	UpdateStateUnknown UpdateState = iota
 	UpdateStateFoundUpdate
 	UpdateStateUpdatesDisabledUnofficialBuild
+	UpdateStateHeldBackByRollout
+	UpdateStateScheduled
+	UpdateStateDeferred
+	UpdateStateBlockedByPolicy
+	UpdateStateCheckFailed
+	UpdateStateProxyFailed
+	UpdateStateCertificateRejected
 )
 
-var updateState = UpdateStateUnknown
+func (s UpdateState) String() string {
+	switch s {
+	case UpdateStateFoundUpdate:
+		return "found update"
+	case UpdateStateUpdatesDisabledUnofficialBuild:
+		return "updates disabled unofficial build"
+	case UpdateStateHeldBackByRollout:
+		return "held back by rollout"
+	case UpdateStateScheduled:
+		return "scheduled"
+	case UpdateStateDeferred:
+		return "deferred"
+	case UpdateStateBlockedByPolicy:
+		return "blocked by policy"
+	case UpdateStateCheckFailed:
+		return "check failed"
+	case UpdateStateProxyFailed:
+		return "proxy failed"
+	case UpdateStateCertificateRejected:
+		return "certificate rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// UpdateDetails describes where the most recent update check result came from, and which newer
+// version, if any, is being held back because this machine isn't yet in its staged rollout. When
+// the update policy is waiting to install an update automatically, ScheduledFor is the earliest
+// time it might do so.
+type UpdateDetails struct {
+	Channel      string
+	Mirror       string
+	HeldBack     string
+	LastChecked  time.Time
+	LastError    string
+	ScheduledFor time.Time
+}
+
+// updateState and updateDetails are written by the update checker and read by IPC clients and
+// diagnostics, so they are only touched under updateStateLock, and handed out as copies.
+var (
+	updateState     = UpdateStateUnknown
+	updateDetails   UpdateDetails
+	updateStateLock sync.Mutex
+)
+
+func currentUpdateState() UpdateState {
+	updateStateLock.Lock()
+	defer updateStateLock.Unlock()
+	return updateState
+}
+
+func currentUpdateDetails() UpdateDetails {
+	updateStateLock.Lock()
+	defer updateStateLock.Unlock()
+	return updateDetails
+}
 
-func checkForUpdates() {
-	defer printPanic()
+func setUpdateDetails(details UpdateDetails) {
+	updateStateLock.Lock()
+	updateDetails = details
+	updateStateLock.Unlock()
+}
+
+func setUpdateScheduledFor(scheduledFor time.Time) {
+	updateStateLock.Lock()
+	updateDetails.ScheduledFor = scheduledFor
+	updateStateLock.Unlock()
+}
+
+// updateStateForError picks the state that best explains why checking for updates failed. The
+// full error is in UpdateDetails.
+func updateStateForError(err error) UpdateState {
+	switch {
+	case errors.Is(err, updater.ErrProxyUnreachable), errors.Is(err, updater.ErrProxyAuthentication):
+		return UpdateStateProxyFailed
+	case errors.Is(err, updater.ErrCertificate), errors.Is(err, updater.ErrPinMismatch):
+		return UpdateStateCertificateRejected
+	default:
+		return UpdateStateCheckFailed
+	}
+}
 
-	if !version.IsRunningOfficialVersion() {
-		log.Println("Build is not official, so updates are disabled")
-		updateState = UpdateStateUpdatesDisabledUnofficialBuild
-		IPCServerNotifyUpdateFound(updateState)
-		return
+// updatePending says whether an update has been found and is waiting on either the user or policy,
+// in which case a failure to check again doesn't change that.
+func updatePending() bool {
+	switch currentUpdateState() {
+	case UpdateStateFoundUpdate, UpdateStateScheduled, UpdateStateDeferred, UpdateStateBlockedByPolicy:
+		return true
 	}
+	return false
+}
+
+func setUpdateState(state UpdateState) {
+	updateStateLock.Lock()
+	changed := updateState != state
+	updateState = state
+	updateStateLock.Unlock()
+	if changed {
+		IPCServerNotifyUpdateFound(state)
+	}
+}
 
-	first := true
-	for {
-		update, err := updater.CheckForUpdate()
-		if err == nil && update != nil {
-			log.Println("An update is available")
-			updateState = UpdateStateFoundUpdate
-			IPCServerNotifyUpdateFound(updateState)
-			return
-		}
-		if err != nil {
-			log.Printf("Update checker: %v", err)
-			if first {
-				time.Sleep(time.Minute * 4)
-				first = false
-			} else {
-				time.Sleep(time.Minute * 25)
-			}
-		} else {
-			time.Sleep(time.Hour)
-		}
+func errToString(err error) string {
+	if err == nil {
+		return ""
 	}
+	return err.Error()
 }
@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestUpdateStateConcurrency is mostly for the race detector, as the update checker writes the
+// update state while IPC clients read it.
+func TestUpdateStateConcurrency(t *testing.T) {
+	defer setUpdateState(UpdateStateUnknown)
+	defer setUpdateDetails(UpdateDetails{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			setUpdateDetails(UpdateDetails{Channel: "stable", Mirror: fmt.Sprintf("https://mirror%d.example.com", i), LastChecked: time.Now()})
+			setUpdateScheduledFor(time.Now())
+			setUpdateState(UpdateState(i % 3))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			details := currentUpdateDetails()
+			if len(details.Mirror) > 0 && details.Channel != "stable" {
+				t.Errorf("Torn update details %+v", details)
+				return
+			}
+			currentUpdateState()
+			updatePending()
+		}
+	}()
+	wg.Wait()
+	details := currentUpdateDetails()
+	details.Mirror = "changed"
+	if currentUpdateDetails().Mirror == "changed" {
+		t.Error("Update details were not copied")
+	}
+}
@@ -0,0 +1,183 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"log"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"golang.zx2c4.com/wireguard/windows/updater"
+	"golang.zx2c4.com/wireguard/windows/version"
+)
+
+func tunnelsRunning() bool {
+	trackedTunnelsLock.Lock()
+	defer trackedTunnelsLock.Unlock()
+	for _, state := range trackedTunnels {
+		if state != TunnelStopped {
+			return true
+		}
+	}
+	return false
+}
+
+// installAutomatically downloads and installs an update as Local System, forwarding its progress to
+// the UI in the same way as an update started from there.
+func installAutomatically() error {
+	progress := updater.DownloadVerifyAndExecute(0)
+	for {
+		dp := <-progress
+		IPCServerNotifyUpdateProgress(dp)
+		if dp.Error != nil {
+			return dp.Error
+		}
+		if dp.Complete {
+			return nil
+		}
+	}
+}
+
+// followUpdatePolicy waits until the update policy says to install an update, or to leave it to the
+// user, returning true once either has happened. It returns false when it is time to check again,
+// because the update might have been superseded.
+func followUpdatePolicy(update *updater.UpdateFound, recheckAt time.Time) bool {
+	policy := update.Policy()
+	for {
+		decision := policy.Evaluate(time.Now(), update.FirstSeen, update.Mandatory, tunnelsRunning())
+		setUpdateScheduledFor(decision.NotBefore)
+		switch decision.Action {
+		case updater.PolicyNotify:
+			setUpdateState(UpdateStateFoundUpdate)
+			return true
+		case updater.PolicyInstall:
+			log.Printf("Installing version %s automatically, as allowed by the update policy", update.Version)
+			setUpdateState(UpdateStateFoundUpdate)
+			err := installAutomatically()
+			if err == nil {
+				return true
+			}
+			log.Printf("Automatic update failed: %v", err)
+			time.Sleep(time.Until(recheckAt))
+			return false
+		case updater.PolicyDeferred:
+			if currentUpdateState() != UpdateStateDeferred {
+				log.Printf("Version %s is available, but the update policy defers it until %s", update.Version, decision.NotBefore.Format(time.RFC1123))
+			}
+			setUpdateState(UpdateStateDeferred)
+		case updater.PolicyScheduled:
+			if currentUpdateState() != UpdateStateScheduled {
+				log.Printf("Version %s is available, and is scheduled for the maintenance window at %s", update.Version, decision.NotBefore.Format(time.RFC1123))
+			}
+			setUpdateState(UpdateStateScheduled)
+		case updater.PolicyBlocked:
+			if currentUpdateState() != UpdateStateBlockedByPolicy {
+				log.Printf("Version %s is available, but the update policy does not allow installing it while a tunnel is running", update.Version)
+			}
+			setUpdateState(UpdateStateBlockedByPolicy)
+		}
+		now := time.Now()
+		if !now.Before(recheckAt) {
+			return false
+		}
+		wait := time.Minute * 5
+		if !decision.NotBefore.IsZero() && decision.NotBefore.Sub(now) < wait {
+			wait = decision.NotBefore.Sub(now)
+		}
+		if recheckAt.Sub(now) < wait {
+			wait = recheckAt.Sub(now)
+		}
+		time.Sleep(wait)
+	}
+}
+
+var networkChanged = make(chan struct{}, 1)
+
+// watchNetworkChanges wakes the update checker when an address is added, since that usually means
+// a new network, on which the last failed check might now succeed.
+func watchNetworkChanges() (*winipcfg.UnicastAddressChangeCallback, error) {
+	return winipcfg.RegisterUnicastAddressChangeCallback(func(notificationType winipcfg.MibNotificationType, address *winipcfg.MibUnicastIPAddressRow) {
+		if notificationType != winipcfg.MibAddInstance {
+			return
+		}
+		select {
+		case networkChanged <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// waitForNextCheck sleeps for d, or until shortly after the network changes.
+func waitForNextCheck(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-networkChanged:
+		// Give the new network a chance to finish coming up, and coalesce the burst of
+		// notifications from it doing so.
+		time.Sleep(time.Second * 15)
+		select {
+		case <-networkChanged:
+		default:
+		}
+	}
+}
+
+func checkForUpdates() {
+	defer printPanic()
+
+	if !version.IsRunningOfficialVersion() {
+		log.Println("Build is not official, so updates are disabled")
+		setUpdateState(UpdateStateUpdatesDisabledUnofficialBuild)
+		return
+	}
+
+	networkWatcher, err := watchNetworkChanges()
+	if err != nil {
+		log.Printf("Unable to watch for network changes, so updates will only be checked periodically: %v", err)
+	} else {
+		defer networkWatcher.Unregister()
+	}
+
+	time.Sleep(updater.StartupDelay())
+	for {
+		config, err := updater.LoadConfig()
+		if err != nil {
+			config = updater.DefaultConfig()
+		}
+		update, source, err := updater.CheckForUpdate()
+		setUpdateDetails(UpdateDetails{
+			Channel:     source.Channel,
+			Mirror:      source.Mirror,
+			HeldBack:    source.HeldBack,
+			LastChecked: time.Now(),
+			LastError:   errToString(err),
+		})
+		if err == nil && update != nil {
+			if !updatePending() {
+				log.Printf("An update is available on the %s channel from %s", source.Channel, source.Mirror)
+			}
+			if followUpdatePolicy(update, time.Now().Add(config.NextCheck(false))) {
+				return
+			}
+			continue
+		}
+		if err == nil && len(source.HeldBack) > 0 && currentUpdateState() != UpdateStateHeldBackByRollout {
+			log.Printf("Version %s is available, but this machine is not yet included in its staged rollout", source.HeldBack)
+			setUpdateState(UpdateStateHeldBackByRollout)
+		} else if err == nil && len(source.HeldBack) == 0 {
+			setUpdateState(UpdateStateUnknown)
+		}
+		if err != nil {
+			log.Printf("Update checker: %v", err)
+			if !updatePending() {
+				setUpdateState(updateStateForError(err))
+			}
+		}
+		waitForNextCheck(config.NextCheck(err != nil))
+	}
+}
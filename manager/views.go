@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package manager
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+// The views below are what the command line's /json output and the HTTP API report, so that
+// scripts see the same fields whichever way they ask.
+
+// TunnelSummary is a tunnel as listed.
+type TunnelSummary struct {
+	Name        string   `json:"name"`
+	State       string   `json:"state"`
+	DisplayName string   `json:"display_name,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+func NewTunnelSummary(tunnelName string, state TunnelState, metadata *conf.Metadata) *TunnelSummary {
+	return &TunnelSummary{tunnelName, state.String(), metadata.DisplayName, metadata.Tags}
+}
+
+type RuntimePeer struct {
+	PublicKey           string   `json:"public_key"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	LatestHandshake     int64    `json:"latest_handshake"`
+	RxBytes             uint64   `json:"rx_bytes"`
+	TxBytes             uint64   `json:"tx_bytes"`
+	PersistentKeepalive uint16   `json:"persistent_keepalive,omitempty"`
+}
+
+// RuntimeInterface describes a running tunnel much as `wg show` does, but never with its private
+// key.
+type RuntimeInterface struct {
+	Name       string        `json:"name"`
+	PublicKey  string        `json:"public_key,omitempty"`
+	ListenPort uint16        `json:"listen_port,omitempty"`
+	Addresses  []string      `json:"addresses"`
+	Peers      []RuntimePeer `json:"peers"`
+}
+
+func cidrStrings(cidrs []conf.IPCidr) []string {
+	strs := make([]string, len(cidrs))
+	for i := range cidrs {
+		strs[i] = cidrs[i].String()
+	}
+	return strs
+}
+
+// NewRuntimeInterface describes the runtime configuration of a tunnel.
+func NewRuntimeInterface(config *conf.Config) *RuntimeInterface {
+	entry := &RuntimeInterface{
+		Name:       config.Name,
+		ListenPort: config.Interface.ListenPort,
+		Addresses:  cidrStrings(config.Interface.Addresses),
+		Peers:      make([]RuntimePeer, 0, len(config.Peers)),
+	}
+	if !config.Interface.PrivateKey.IsZero() {
+		entry.PublicKey = config.Interface.PrivateKey.Public().String()
+	}
+	for _, peer := range config.Peers {
+		p := RuntimePeer{
+			PublicKey:           peer.PublicKey.String(),
+			AllowedIPs:          cidrStrings(peer.AllowedIPs),
+			RxBytes:             uint64(peer.RxBytes),
+			TxBytes:             uint64(peer.TxBytes),
+			PersistentKeepalive: peer.PersistentKeepalive,
+		}
+		if !peer.Endpoint.IsEmpty() {
+			p.Endpoint = peer.Endpoint.String()
+		}
+		if !peer.LastHandshakeTime.IsEmpty() {
+			p.LatestHandshake = time.Unix(0, 0).Add(time.Duration(peer.LastHandshakeTime)).Unix()
+		}
+		entry.Peers = append(entry.Peers, p)
+	}
+	return entry
+}
+
+// UpdateStatus is the state of updates along with the details behind it. Times that haven't
+// happened are left out.
+type UpdateStatus struct {
+	State        string     `json:"state"`
+	Channel      string     `json:"channel,omitempty"`
+	Mirror       string     `json:"mirror,omitempty"`
+	HeldBack     string     `json:"held_back,omitempty"`
+	LastChecked  *time.Time `json:"last_checked,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	ScheduledFor *time.Time `json:"scheduled_for,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func NewUpdateStatus(state UpdateState, details UpdateDetails) *UpdateStatus {
+	return &UpdateStatus{
+		State:        state.String(),
+		Channel:      details.Channel,
+		Mirror:       details.Mirror,
+		HeldBack:     details.HeldBack,
+		LastChecked:  optionalTime(details.LastChecked),
+		LastError:    details.LastError,
+		ScheduledFor: optionalTime(details.ScheduledFor),
+	}
+}
@@ -0,0 +1,109 @@
+// Code generated by 'go generate'; DO NOT EDIT.
+
+package manager
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var _ unsafe.Pointer
+
+// Do the interface allocations only once for common
+// Errno values.
+const (
+	errnoERROR_IO_PENDING = 997
+)
+
+var (
+	errERROR_IO_PENDING error = syscall.Errno(errnoERROR_IO_PENDING)
+	errERROR_EINVAL     error = syscall.EINVAL
+)
+
+// errnoErr returns common boxed Errno values, to prevent
+// allocations at runtime.
+func errnoErr(e syscall.Errno) error {
+	switch e {
+	case 0:
+		return errERROR_EINVAL
+	case errnoERROR_IO_PENDING:
+		return errERROR_IO_PENDING
+	}
+	// TODO: add more here, after collecting data on the common
+	// error values see on Windows. (perhaps when running
+	// all.bat?)
+	return e
+}
+
+var (
+	modadvapi32 = windows.NewLazySystemDLL("advapi32.dll")
+	modiphlpapi = windows.NewLazySystemDLL("iphlpapi.dll")
+	modwlanapi  = windows.NewLazySystemDLL("wlanapi.dll")
+
+	procImpersonateNamedPipeClient = modadvapi32.NewProc("ImpersonateNamedPipeClient")
+	procGetIpNetTable              = modiphlpapi.NewProc("GetIpNetTable")
+	procWlanCloseHandle            = modwlanapi.NewProc("WlanCloseHandle")
+	procWlanEnumInterfaces         = modwlanapi.NewProc("WlanEnumInterfaces")
+	procWlanFreeMemory             = modwlanapi.NewProc("WlanFreeMemory")
+	procWlanOpenHandle             = modwlanapi.NewProc("WlanOpenHandle")
+	procWlanQueryInterface         = modwlanapi.NewProc("WlanQueryInterface")
+)
+
+func impersonateNamedPipeClient(pipe windows.Handle) (err error) {
+	r1, _, e1 := syscall.Syscall(procImpersonateNamedPipeClient.Addr(), 1, uintptr(pipe), 0, 0)
+	if r1 == 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
+func getIpNetTable(table *mibIPNetTable, size *uint32, order bool) (ret error) {
+	var _p0 uint32
+	if order {
+		_p0 = 1
+	}
+	r0, _, _ := syscall.Syscall(procGetIpNetTable.Addr(), 3, uintptr(unsafe.Pointer(table)), uintptr(unsafe.Pointer(size)), uintptr(_p0))
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func wlanCloseHandle(handle windows.Handle, reserved uintptr) (ret error) {
+	r0, _, _ := syscall.Syscall(procWlanCloseHandle.Addr(), 2, uintptr(handle), uintptr(reserved), 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func wlanEnumInterfaces(handle windows.Handle, reserved uintptr, interfaceList **wlanInterfaceInfoList) (ret error) {
+	r0, _, _ := syscall.Syscall(procWlanEnumInterfaces.Addr(), 3, uintptr(handle), uintptr(reserved), uintptr(unsafe.Pointer(interfaceList)))
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func wlanFreeMemory(memory unsafe.Pointer) {
+	syscall.Syscall(procWlanFreeMemory.Addr(), 1, uintptr(memory), 0, 0)
+	return
+}
+
+func wlanOpenHandle(clientVersion uint32, reserved uintptr, negotiatedVersion *uint32, handle *windows.Handle) (ret error) {
+	r0, _, _ := syscall.Syscall6(procWlanOpenHandle.Addr(), 4, uintptr(clientVersion), uintptr(reserved), uintptr(unsafe.Pointer(negotiatedVersion)), uintptr(unsafe.Pointer(handle)), 0, 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
+
+func wlanQueryInterface(handle windows.Handle, interfaceGUID *windows.GUID, opcode uint32, reserved uintptr, dataSize *uint32, data *unsafe.Pointer, opcodeValueType *uint32) (ret error) {
+	r0, _, _ := syscall.Syscall9(procWlanQueryInterface.Addr(), 7, uintptr(handle), uintptr(unsafe.Pointer(interfaceGUID)), uintptr(opcode), uintptr(reserved), uintptr(unsafe.Pointer(dataSize)), uintptr(unsafe.Pointer(data)), uintptr(unsafe.Pointer(opcodeValueType)), 0, 0)
+	if r0 != 0 {
+		ret = syscall.Errno(r0)
+	}
+	return
+}
@@ -0,0 +1,168 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package redact
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Rule finds sensitive substrings in a line and asks the Redactor for a replacement token.
+type Rule interface {
+	Redact(r *Redactor, line string) string
+}
+
+// Redactor applies a set of rules to text, replacing sensitive values with tokens. The same
+// original value always maps to the same token for the lifetime of the Redactor, so that
+// correlations across lines and files survive redaction.
+type Redactor struct {
+	rules    []Rule
+	lock     sync.Mutex
+	tokens   map[string]string
+	counters map[string]int
+	mapping  []MappingEntry
+}
+
+type MappingEntry struct {
+	Category string
+	Original string
+	Token    string
+}
+
+func NewRedactor(rules ...Rule) *Redactor {
+	return &Redactor{
+		rules:    rules,
+		tokens:   make(map[string]string),
+		counters: make(map[string]int),
+	}
+}
+
+// NewDefaultRedactor returns a redactor for keys, IP addresses, usernames, hostnames, and the
+// given tunnel names.
+func NewDefaultRedactor(tunnelNames []string) *Redactor {
+	return NewRedactor(KeyRule, NewLiteralRule("tunnel", tunnelNames), UsernameRule, IPv6Rule, IPv4Rule, HostnameRule)
+}
+
+func (r *Redactor) AddRule(rule Rule) {
+	r.lock.Lock()
+	r.rules = append(r.rules, rule)
+	r.lock.Unlock()
+}
+
+// Token returns the pseudonym for original in category, allocating a new one if needed.
+func (r *Redactor) Token(category, original string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := category + "\x00" + original
+	if token, ok := r.tokens[key]; ok {
+		return token
+	}
+	r.counters[category]++
+	token := fmt.Sprintf("<%s-%d>", category, r.counters[category])
+	r.tokens[key] = token
+	r.mapping = append(r.mapping, MappingEntry{category, original, token})
+	return token
+}
+
+func (r *Redactor) RedactLine(line string) string {
+	r.lock.Lock()
+	rules := r.rules
+	r.lock.Unlock()
+	for _, rule := range rules {
+		line = rule.Redact(r, line)
+	}
+	return line
+}
+
+func (r *Redactor) RedactString(text string) string {
+	var out bytes.Buffer
+	w := r.NewWriter(&out)
+	io.WriteString(w, text)
+	w.Close()
+	return out.String()
+}
+
+// Mapping returns a copy of the table of tokens handed out so far, sorted by category, and within
+// each category by the number in the token, which is the order in which they were handed out. The
+// sort is stable for this reason, as comparing tokens as strings would put <ipv4-10> before
+// <ipv4-2>.
+func (r *Redactor) Mapping() []MappingEntry {
+	r.lock.Lock()
+	mapping := make([]MappingEntry, len(r.mapping))
+	copy(mapping, r.mapping)
+	r.lock.Unlock()
+	sort.SliceStable(mapping, func(i, j int) bool {
+		return mapping[i].Category < mapping[j].Category
+	})
+	return mapping
+}
+
+// WriteMappingTo writes the token table as tab separated lines. This contains everything that
+// redaction removed, so it should only ever be written somewhere of the user's choosing.
+func (r *Redactor) WriteMappingTo(out io.Writer) (n int64, err error) {
+	for _, entry := range r.Mapping() {
+		var bytes int
+		bytes, err = fmt.Fprintf(out, "%s\t%s\t%s\n", entry.Token, entry.Category, entry.Original)
+		n += int64(bytes)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+type redactingWriter struct {
+	r   *Redactor
+	out io.Writer
+	buf []byte
+}
+
+// NewWriter returns a writer that redacts each complete line before passing it to out. Close
+// flushes any trailing partial line, but does not close out.
+func (r *Redactor) NewWriter(out io.Writer) io.WriteCloser {
+	return &redactingWriter{r: r, out: out}
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		index := bytes.IndexByte(w.buf, '\n')
+		if index < 0 {
+			break
+		}
+		_, err := io.WriteString(w.out, w.r.RedactLine(string(w.buf[:index]))+"\n")
+		w.buf = w.buf[index+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *redactingWriter) Close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w.out, w.r.RedactLine(string(w.buf)))
+	w.buf = nil
+	return err
+}
+
+// RedactReader copies in to out, redacting line by line.
+func (r *Redactor) RedactReader(out io.Writer, in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		_, err := io.WriteString(out, r.RedactLine(scanner.Text())+"\n")
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
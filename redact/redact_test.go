@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package redact
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDefaultRedactor(t *testing.T) {
+	r := NewDefaultRedactor([]string{"office"})
+	input := `2019-11-25 16:44:39.381981: [MGR] Starting UI process for user ‘alice@CORP’ for session 1
+2019-11-25 16:44:40.000000: [TUN] [office] Interface created with endpoint 203.0.113.7:51820
+2019-11-25 16:44:41.000000: [TUN] [office] Sending handshake initiation to peer 1 (203.0.113.7:51820)
+2019-11-25 16:44:42.000000: [TUN] [office] Resolved vpn.example.com to 2001:db8::1 and listening on 0.0.0.0
+2019-11-25 16:44:43.000000: [TUN] [office] PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+`
+	output := r.RedactString(input)
+	for _, secret := range []string{"alice", "CORP", "office", "203.0.113.7", "vpn.example.com", "2001:db8::1", "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="} {
+		if strings.Contains(output, secret) {
+			t.Errorf("Redacted output still contains %#q:\n%s", secret, output)
+		}
+	}
+	for _, kept := range []string{"2019-11-25 16:44:39.381981", "[MGR]", "0.0.0.0", ":51820"} {
+		if !strings.Contains(output, kept) {
+			t.Errorf("Redacted output is missing %#q:\n%s", kept, output)
+		}
+	}
+	if strings.Count(output, "<ipv4-1>") != 2 || strings.Contains(output, "<ipv4-2>") {
+		t.Errorf("Same address was not mapped to the same token:\n%s", output)
+	}
+	if strings.Count(output, "<tunnel-1>") != 4 {
+		t.Errorf("Tunnel name was not consistently redacted:\n%s", output)
+	}
+
+	var mapping bytes.Buffer
+	_, err := r.WriteMappingTo(&mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(mapping.String(), "<ipv4-1>\tipv4\t203.0.113.7\n") {
+		t.Errorf("Mapping table is missing address:\n%s", mapping.String())
+	}
+}
+
+func TestLiteralRuleWordBoundaries(t *testing.T) {
+	r := NewRedactor(NewLiteralRule("tunnel", []string{"wg", "wg0"}))
+	output := r.RedactLine("wg0 wg wg00 xwg [wg]")
+	if output != "<tunnel-1> <tunnel-2> wg00 xwg [<tunnel-2>]" {
+		t.Errorf("Unexpected literal redaction: %#q", output)
+	}
+}
+
+func TestMappingOrder(t *testing.T) {
+	r := NewRedactor()
+	for i := 0; i < 12; i++ {
+		r.Token("ipv4", strings.Repeat("a", i+1))
+		if i%4 == 0 {
+			r.Token("key", strings.Repeat("b", i+1))
+		}
+	}
+	mapping := r.Mapping()
+	var tokens []string
+	for _, entry := range mapping {
+		tokens = append(tokens, entry.Token)
+	}
+	want := "<ipv4-1> <ipv4-2> <ipv4-3> <ipv4-4> <ipv4-5> <ipv4-6> <ipv4-7> <ipv4-8> <ipv4-9> <ipv4-10> <ipv4-11> <ipv4-12> <key-1> <key-2> <key-3>"
+	if got := strings.Join(tokens, " "); got != want {
+		t.Errorf("Mapping is ordered %s", got)
+	}
+}
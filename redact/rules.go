@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package redact
+
+import (
+	"encoding/base64"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type regexpRule struct {
+	category string
+	pattern  *regexp.Regexp
+	valid    func(match string) bool
+}
+
+// NewRegexpRule returns a rule that replaces every match of pattern for which valid returns
+// true, or every match if valid is nil.
+func NewRegexpRule(category string, pattern *regexp.Regexp, valid func(match string) bool) Rule {
+	return &regexpRule{category, pattern, valid}
+}
+
+func (rule *regexpRule) Redact(r *Redactor, line string) string {
+	return rule.pattern.ReplaceAllStringFunc(line, func(match string) string {
+		if rule.valid != nil && !rule.valid(match) {
+			return match
+		}
+		return r.Token(rule.category, match)
+	})
+}
+
+func isRedactableIP(match string, wantV4 bool) bool {
+	ip := net.ParseIP(match)
+	if ip == nil || (ip.To4() != nil) != wantV4 {
+		return false
+	}
+	return !ip.IsUnspecified() && !ip.IsLoopback()
+}
+
+var IPv4Rule = NewRegexpRule("ipv4", regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`), func(match string) bool {
+	return isRedactableIP(match, true)
+})
+
+var IPv6Rule = NewRegexpRule("ipv6", regexp.MustCompile(`(?i)[0-9a-f]{0,4}(?::[0-9a-f]{0,4}){2,7}`), func(match string) bool {
+	return isRedactableIP(match, false)
+})
+
+var KeyRule = NewRegexpRule("key", regexp.MustCompile(`[A-Za-z0-9+/]{42}[AEIMQUYcgkosw048]=`), func(match string) bool {
+	key, err := base64.StdEncoding.DecodeString(match)
+	return err == nil && len(key) == 32
+})
+
+var fileExtensions = map[string]bool{
+	"bin": true, "conf": true, "dll": true, "dpapi": true, "exe": true, "go": true,
+	"log": true, "msi": true, "sig": true, "sys": true, "txt": true, "zip": true,
+}
+
+var HostnameRule = NewRegexpRule("host", regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}\b`), func(match string) bool {
+	return !fileExtensions[strings.ToLower(match[strings.LastIndexByte(match, '.')+1:])]
+})
+
+type usernameRule struct {
+	pattern *regexp.Regexp
+}
+
+// UsernameRule matches the ‘user@domain’ form that the manager uses when logging sessions.
+var UsernameRule Rule = &usernameRule{regexp.MustCompile(`(['‘])([^'’@\s]+)@([^'’\s]+)(['’])`)}
+
+func (rule *usernameRule) Redact(r *Redactor, line string) string {
+	return rule.pattern.ReplaceAllStringFunc(line, func(match string) string {
+		parts := rule.pattern.FindStringSubmatch(match)
+		return parts[1] + r.Token("user", parts[2]) + "@" + r.Token("domain", parts[3]) + parts[4]
+	})
+}
+
+type literalRule struct {
+	category string
+	literals []string
+}
+
+// NewLiteralRule returns a rule that replaces whole-word occurrences of any of literals, which
+// is useful for things like tunnel names that have no recognizable shape of their own.
+func NewLiteralRule(category string, literals []string) Rule {
+	sorted := make([]string, 0, len(literals))
+	for _, literal := range literals {
+		if len(literal) > 0 {
+			sorted = append(sorted, literal)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	return &literalRule{category, sorted}
+}
+
+func isWordByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("_=+.-", c) >= 0
+}
+
+func (rule *literalRule) Redact(r *Redactor, line string) string {
+	for _, literal := range rule.literals {
+		var out strings.Builder
+		last := 0
+		for offset := 0; offset < len(line); {
+			index := strings.Index(line[offset:], literal)
+			if index < 0 {
+				break
+			}
+			start := offset + index
+			end := start + len(literal)
+			if (start == 0 || !isWordByte(line[start-1])) && (end == len(line) || !isWordByte(line[end])) {
+				out.WriteString(line[last:start])
+				out.WriteString(r.Token(rule.category, literal))
+				last = end
+				offset = end
+			} else {
+				offset = start + 1
+			}
+		}
+		out.WriteString(line[last:])
+		line = out.String()
+	}
+	return line
+}
@@ -13,9 +13,11 @@ import (
 	"golang.org/x/sys/windows"
 
 	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/redact"
 )
 
-func DumpTo(out io.Writer, notSystem bool) error {
+// DumpTo writes the on-disk log to out, passing each line through redactor if it is not nil.
+func DumpTo(out io.Writer, notSystem bool, redactor *redact.Redactor) error {
 	var path string
 	if !notSystem {
 		root, err := conf.RootDirectory()
@@ -45,7 +47,11 @@ func DumpTo(out io.Writer, notSystem bool) error {
 		return err
 	}
 	defer rl.Close()
-	_, err = rl.WriteTo(out)
+	if redactor != nil {
+		_, err = rl.WriteToRedacted(out, redactor)
+	} else {
+		_, err = rl.WriteTo(out)
+	}
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,326 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package forwarder
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/redact"
+)
+
+// CursorAll asks a Source for every line it holds, as ringlogger.CursorAll does.
+const CursorAll = ^uint32(0)
+
+// Line is a line read from a Source, with the time it was logged.
+type Line struct {
+	Line  string
+	Stamp time.Time
+}
+
+// Source is a ring log that is followed by cursor, such as a ringlogger.Ringlogger wrapped by
+// RingSource. It is kept apart from the ringlogger package, which only builds on Windows, so that
+// the forwarder can be tested anywhere.
+type Source interface {
+	FollowFromCursor(cursor uint32) (followLines []Line, nextCursor uint32)
+}
+
+// position is where forwarding got to: the ring cursor just after the last line of one read from
+// the ring, together with that line's stamp, which tells whether the cursor is still valid.
+type position struct {
+	// seq counts reads since the forwarder started, ordering positions across the ring's wrapping.
+	seq    uint64
+	cursor uint32
+	stamp  int64
+}
+
+type sinkWorker struct {
+	sink     Sink
+	queue    chan Record
+	ackLock  sync.Mutex
+	acked    position
+	failing  uint32
+	dropping bool
+}
+
+// Forwarder follows a ring log and ships its records to sinks. Each sink has its own bounded
+// queue and retries failed batches with exponential backoff. When the queue of a working sink is
+// full, the forwarder stops reading from the ring until there is room again, but records for a
+// sink whose sends are failing are dropped instead, so that one dead sink can't hold up the rest.
+// The persisted cursor is the oldest position that every working sink has acknowledged.
+type Forwarder struct {
+	policy   *Policy
+	source   Source
+	host     string
+	redactor *redact.Redactor
+	workers  []*sinkWorker
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New makes a forwarder for the sinks in policy. When the policy asks for redaction, tunnelNames
+// are redacted wherever they appear, as when exporting a redacted log.
+func New(policy *Policy, source Source, tunnelNames []string) (*Forwarder, error) {
+	f := &Forwarder{
+		policy: policy,
+		source: source,
+		stop:   make(chan struct{}),
+	}
+	f.host, _ = os.Hostname()
+	if policy.Redact {
+		f.redactor = redact.NewDefaultRedactor(tunnelNames)
+		f.host = f.redactor.Token("host", f.host)
+	}
+	for _, sinkPolicy := range policy.Sinks {
+		sink, err := newSink(sinkPolicy)
+		if err != nil {
+			for _, worker := range f.workers {
+				worker.sink.Close()
+			}
+			return nil, err
+		}
+		f.workers = append(f.workers, &sinkWorker{sink: sink, queue: make(chan Record, policy.QueueSize)})
+	}
+	return f, nil
+}
+
+// Start loads the persisted cursor and begins forwarding in the background.
+func (f *Forwarder) Start() {
+	saved := loadState()
+	for _, worker := range f.workers {
+		worker.acked = position{cursor: saved.Cursor, stamp: saved.Stamp}
+		f.wg.Add(1)
+		go f.runWorker(worker)
+	}
+	f.wg.Add(1)
+	go f.follow(saved)
+}
+
+// Stop makes one last attempt to flush each queue, persists the cursor, and closes all sinks.
+func (f *Forwarder) Stop() {
+	close(f.stop)
+	f.wg.Wait()
+	f.persist()
+	for _, worker := range f.workers {
+		worker.sink.Close()
+	}
+}
+
+func splitTag(line string) (tag, message string) {
+	if strings.HasPrefix(line, "[") {
+		if end := strings.IndexByte(line, ']'); end > 0 {
+			return line[1:end], strings.TrimPrefix(line[end+1:], " ")
+		}
+	}
+	return "", line
+}
+
+// resume returns the lines after the persisted cursor, and the cursor after them. The ring may
+// have been reset while the forwarder wasn't running, leaving the cursor pointing at nothing or at
+// older lines, in which case it falls back to the lines no older than the persisted stamp. That
+// may repeat lines sharing the stamp of the last one sent, but never skips any.
+func (f *Forwarder) resume(saved state) ([]Line, uint32) {
+	all, end := f.source.FollowFromCursor(CursorAll)
+	if saved.Stamp == 0 {
+		return all, end
+	}
+	lines, cursor := f.source.FollowFromCursor(saved.Cursor)
+	if len(lines) > 0 && lines[0].Stamp.UnixNano() >= saved.Stamp {
+		return lines, cursor
+	}
+	if len(lines) == 0 && len(all) > 0 && all[len(all)-1].Stamp.UnixNano() == saved.Stamp {
+		return nil, cursor
+	}
+	var newer []Line
+	for _, line := range all {
+		if line.Stamp.UnixNano() >= saved.Stamp {
+			newer = append(newer, line)
+		}
+	}
+	return newer, end
+}
+
+func (f *Forwarder) record(line Line) Record {
+	tag, message := splitTag(line.Line)
+	if f.redactor != nil {
+		// Tunnel services prefix their lines with the tunnel's name, which might not be among the
+		// names given to New if the tunnel was added since.
+		name, rest := splitTag(message)
+		if tag == "TUN" && len(name) > 0 {
+			message = "[" + f.redactor.Token("tunnel", name) + "] " + f.redactor.RedactLine(rest)
+		} else {
+			message = f.redactor.RedactLine(message)
+		}
+	}
+	return Record{Stamp: line.Stamp, Host: f.host, Tag: tag, Message: message}
+}
+
+// enqueue waits for room in the worker's queue, unless its sink is failing, in which case the
+// record is dropped. It returns false if the forwarder is stopping.
+func (f *Forwarder) enqueue(worker *sinkWorker, record Record) bool {
+	for {
+		select {
+		case worker.queue <- record:
+			worker.dropping = false
+			return true
+		default:
+		}
+		if atomic.LoadUint32(&worker.failing) != 0 {
+			if !worker.dropping {
+				log.Printf("Log forwarder: sink is failing and its queue is full, so dropping records for it")
+				worker.dropping = true
+			}
+			return true
+		}
+		select {
+		case worker.queue <- record:
+			worker.dropping = false
+			return true
+		case <-time.After(time.Duration(f.policy.PollInterval)):
+		case <-f.stop:
+			return false
+		}
+	}
+}
+
+func (f *Forwarder) follow(saved state) {
+	defer f.wg.Done()
+	ticker := time.NewTicker(time.Duration(f.policy.PollInterval))
+	defer ticker.Stop()
+
+	lines, cursor := f.resume(saved)
+	for seq := uint64(1); ; {
+		if len(lines) > 0 {
+			end := &position{seq: seq, cursor: cursor, stamp: lines[len(lines)-1].Stamp.UnixNano()}
+			seq++
+			for i, line := range lines {
+				record := f.record(line)
+				if i == len(lines)-1 {
+					record.end = end
+				}
+				for _, worker := range f.workers {
+					if !f.enqueue(worker, record) {
+						return
+					}
+				}
+			}
+		}
+		f.persist()
+		select {
+		case <-ticker.C:
+		case <-f.stop:
+			return
+		}
+		lines, cursor = f.source.FollowFromCursor(cursor)
+	}
+}
+
+func (f *Forwarder) persist() {
+	var oldest *position
+	for _, worker := range f.workers {
+		if atomic.LoadUint32(&worker.failing) != 0 {
+			continue
+		}
+		worker.ackLock.Lock()
+		acked := worker.acked
+		worker.ackLock.Unlock()
+		if oldest == nil || acked.seq < oldest.seq {
+			oldest = &acked
+		}
+	}
+	if oldest == nil || oldest.seq == 0 {
+		return
+	}
+	err := saveState(state{Cursor: oldest.cursor, Stamp: oldest.stamp})
+	if err != nil {
+		log.Printf("Log forwarder: unable to save cursor: %v", err)
+	}
+}
+
+func (f *Forwarder) backoff(attempt int) time.Duration {
+	d := time.Second << uint(attempt)
+	if d <= 0 || d > time.Duration(f.policy.MaxBackoff) {
+		d = time.Duration(f.policy.MaxBackoff)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sent records that a batch was delivered, acknowledging the last read from the ring that it
+// completes.
+func (worker *sinkWorker) sent(batch []Record) {
+	atomic.StoreUint32(&worker.failing, 0)
+	for i := len(batch) - 1; i >= 0; i-- {
+		if batch[i].end != nil {
+			worker.ackLock.Lock()
+			worker.acked = *batch[i].end
+			worker.ackLock.Unlock()
+			return
+		}
+	}
+}
+
+func (f *Forwarder) runWorker(worker *sinkWorker) {
+	defer f.wg.Done()
+	flush := time.NewTicker(time.Duration(f.policy.FlushInterval))
+	defer flush.Stop()
+	batch := make([]Record, 0, f.policy.BatchSize)
+	send := func() bool {
+		for attempt := 0; len(batch) > 0; attempt++ {
+			err := worker.sink.Send(batch)
+			if err == nil {
+				worker.sent(batch)
+				batch = batch[:0]
+				return true
+			}
+			atomic.StoreUint32(&worker.failing, 1)
+			if attempt == 0 {
+				log.Printf("Log forwarder: unable to send to sink, retrying: %v", err)
+			}
+			select {
+			case <-time.After(f.backoff(attempt)):
+			case <-f.stop:
+				return false
+			}
+		}
+		return true
+	}
+	for {
+		select {
+		case record := <-worker.queue:
+			batch = append(batch, record)
+			if len(batch) >= f.policy.BatchSize && !send() {
+				return
+			}
+		case <-flush.C:
+			if !send() {
+				return
+			}
+		case <-f.stop:
+		drain:
+			for {
+				select {
+				case record := <-worker.queue:
+					batch = append(batch, record)
+				default:
+					break drain
+				}
+			}
+			if len(batch) > 0 {
+				if worker.sink.Send(batch) == nil {
+					worker.sent(batch)
+				} else {
+					atomic.StoreUint32(&worker.failing, 1)
+				}
+			}
+			return
+		}
+	}
+}
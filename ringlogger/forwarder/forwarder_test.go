@@ -0,0 +1,216 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package forwarder
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+var testStamp = time.Unix(1572609600, 0)
+
+// testSource behaves like a ring that hasn't wrapped, whose cursors are indices into lines.
+type testSource struct {
+	lock  sync.Mutex
+	lines []Line
+}
+
+func (s *testSource) FollowFromCursor(cursor uint32) ([]Line, uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cursor == CursorAll {
+		cursor = 0
+	}
+	if int(cursor) >= len(s.lines) {
+		return nil, cursor
+	}
+	return append([]Line(nil), s.lines[cursor:]...), uint32(len(s.lines))
+}
+
+func (s *testSource) write(line string, stamp time.Time) {
+	s.lock.Lock()
+	s.lines = append(s.lines, Line{Line: line, Stamp: stamp})
+	s.lock.Unlock()
+}
+
+type testSink struct {
+	lock    sync.Mutex
+	records []Record
+	down    bool
+}
+
+func (sink *testSink) Send(records []Record) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.down {
+		return errors.New("Sink is down")
+	}
+	sink.records = append(sink.records, records...)
+	return nil
+}
+
+func (sink *testSink) Close() error {
+	return nil
+}
+
+func (sink *testSink) messages() []string {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	var messages []string
+	for _, record := range sink.records {
+		messages = append(messages, record.Message)
+	}
+	return messages
+}
+
+func (sink *testSink) waitFor(t *testing.T, count int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 5); len(sink.messages()) < count; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Sink only received %q", sink.messages())
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+// startTestForwarder starts a forwarder that sends to sinks as quickly as possible, one record at
+// a time.
+func startTestForwarder(t *testing.T, source Source, tunnelNames []string, redact bool, sinks ...*testSink) *Forwarder {
+	t.Helper()
+	policy := &Policy{
+		Redact:        redact,
+		BatchSize:     1,
+		QueueSize:     1,
+		PollInterval:  Duration(time.Millisecond * 10),
+		FlushInterval: Duration(time.Millisecond * 10),
+		MaxBackoff:    Duration(time.Millisecond * 10),
+	}
+	for range sinks {
+		policy.Sinks = append(policy.Sinks, SinkPolicy{Type: "file", Path: filepath.Join(t.TempDir(), "unused.log")})
+	}
+	policy.setDefaults()
+	f, err := New(policy, source, tunnelNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, worker := range f.workers {
+		worker.sink.Close()
+		worker.sink = sinks[i]
+	}
+	f.Start()
+	return f
+}
+
+func TestForwarderResume(t *testing.T) {
+	conf.PresetRootDirectory(t.TempDir())
+	source := &testSource{}
+	source.write("[MGR] one", testStamp)
+	source.write("[MGR] two", testStamp.Add(1))
+	source.write("[MGR] three", testStamp.Add(1))
+
+	sink := &testSink{}
+	f := startTestForwarder(t, source, nil, false, sink)
+	sink.waitFor(t, 3)
+	f.Stop()
+	if saved := loadState(); saved != (state{Cursor: 3, Stamp: testStamp.Add(1).UnixNano()}) {
+		t.Errorf("Saved state is %+v", saved)
+	}
+
+	// A line sharing the stamp of the last one sent is still new.
+	source.write("[MGR] four", testStamp.Add(1))
+	source.write("[MGR] five", testStamp.Add(2))
+	sink = &testSink{}
+	f = startTestForwarder(t, source, nil, false, sink)
+	sink.waitFor(t, 2)
+	f.Stop()
+	if messages := sink.messages(); !reflect.DeepEqual(messages, []string{"four", "five"}) {
+		t.Errorf("Resuming sent %q", messages)
+	}
+
+	// Nothing new was written since.
+	sink = &testSink{}
+	f = startTestForwarder(t, source, nil, false, sink)
+	source.write("[MGR] six", testStamp.Add(3))
+	sink.waitFor(t, 1)
+	f.Stop()
+	if messages := sink.messages(); !reflect.DeepEqual(messages, []string{"six"}) {
+		t.Errorf("Resuming with nothing new sent %q", messages)
+	}
+
+	// The ring was reset, leaving the cursor pointing past its end.
+	source = &testSource{}
+	source.write("[MGR] old", testStamp)
+	source.write("[MGR] seven", testStamp.Add(4))
+	sink = &testSink{}
+	f = startTestForwarder(t, source, nil, false, sink)
+	sink.waitFor(t, 1)
+	f.Stop()
+	if messages := sink.messages(); !reflect.DeepEqual(messages, []string{"seven"}) {
+		t.Errorf("Resuming after a reset sent %q", messages)
+	}
+	if saved := loadState(); saved != (state{Cursor: 2, Stamp: testStamp.Add(4).UnixNano()}) {
+		t.Errorf("Saved state after a reset is %+v", saved)
+	}
+}
+
+func TestForwarderDeadSink(t *testing.T) {
+	conf.PresetRootDirectory(t.TempDir())
+	source := &testSource{}
+	for i := 0; i < 5; i++ {
+		source.write("[MGR] line", testStamp.Add(time.Duration(i)))
+	}
+	live, dead := &testSink{}, &testSink{down: true}
+	f := startTestForwarder(t, source, nil, false, live, dead)
+	live.waitFor(t, 5)
+	f.Stop()
+	if len(dead.messages()) != 0 {
+		t.Errorf("Dead sink received %q", dead.messages())
+	}
+	if saved := loadState(); saved != (state{Cursor: 5, Stamp: testStamp.Add(4).UnixNano()}) {
+		t.Errorf("Saved state is %+v", saved)
+	}
+}
+
+func TestForwarderRedaction(t *testing.T) {
+	conf.PresetRootDirectory(t.TempDir())
+	source := &testSource{}
+	source.write("[MGR] Starting tunnel office", testStamp)
+	source.write("[TUN] [office] Startup complete", testStamp.Add(1))
+	source.write("[TUN] [lab] Startup complete", testStamp.Add(2))
+	sink := &testSink{}
+	f := startTestForwarder(t, source, []string{"office"}, true, sink)
+	sink.waitFor(t, 3)
+	f.Stop()
+	want := []string{"Starting tunnel <tunnel-1>", "[<tunnel-1>] Startup complete", "[<tunnel-2>] Startup complete"}
+	if messages := sink.messages(); !reflect.DeepEqual(messages, want) {
+		t.Errorf("Redacted messages are %q, want %q", messages, want)
+	}
+	if host := sink.records[0].Host; !strings.HasPrefix(host, "<host-") {
+		t.Errorf("Host %q was not redacted", host)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	f := &Forwarder{policy: &Policy{MaxBackoff: Duration(time.Second * 5)}}
+	for _, attempt := range []int{0, 1, 2, 3, 10, 63, 100} {
+		max := time.Second << uint(attempt)
+		if attempt > 2 {
+			max = time.Second * 5
+		}
+		for i := 0; i < 100; i++ {
+			if d := f.backoff(attempt); d < max/2 || d > max {
+				t.Errorf("Backoff for attempt %d is %v, want between %v and %v", attempt, d, max/2, max)
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+const policyFileName = "logforwarder.json"
+const stateFileName = "logforwarder-state.json"
+
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type SinkPolicy struct {
+	// Type is one of "syslog-udp", "syslog-tcp", "syslog-tls", "http", or "file".
+	Type string
+
+	// Address is host:port for syslog sinks.
+	Address    string `json:",omitempty"`
+	Facility   int    `json:",omitempty"`
+	ServerName string `json:",omitempty"`
+	CAFile     string `json:",omitempty"`
+
+	// URL and Headers are for the http sink, which posts JSON arrays of records.
+	URL     string            `json:",omitempty"`
+	Headers map[string]string `json:",omitempty"`
+
+	// Path, MaxSize, and MaxFiles are for the file sink.
+	Path     string `json:",omitempty"`
+	MaxSize  int64  `json:",omitempty"`
+	MaxFiles int    `json:",omitempty"`
+}
+
+type Policy struct {
+	Sinks         []SinkPolicy
+	Redact        bool
+	BatchSize     int
+	QueueSize     int
+	PollInterval  Duration
+	FlushInterval Duration
+	MaxBackoff    Duration
+}
+
+func (p *Policy) setDefaults() {
+	if p.BatchSize <= 0 {
+		p.BatchSize = 100
+	}
+	if p.QueueSize < p.BatchSize {
+		p.QueueSize = p.BatchSize * 20
+	}
+	if p.PollInterval <= 0 {
+		p.PollInterval = Duration(time.Second)
+	}
+	if p.FlushInterval <= 0 {
+		p.FlushInterval = Duration(time.Second * 5)
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = Duration(time.Minute * 5)
+	}
+}
+
+func (p *Policy) validate() error {
+	if len(p.Sinks) == 0 {
+		return errors.New("No sinks configured")
+	}
+	for i, sink := range p.Sinks {
+		switch sink.Type {
+		case "syslog-udp", "syslog-tcp", "syslog-tls":
+			if len(sink.Address) == 0 {
+				return fmt.Errorf("Sink %d is missing an address", i)
+			}
+			if sink.Facility < 0 || sink.Facility > 23 {
+				return fmt.Errorf("Sink %d has an invalid syslog facility", i)
+			}
+		case "http":
+			if len(sink.URL) == 0 {
+				return fmt.Errorf("Sink %d is missing a URL", i)
+			}
+		case "file":
+			if len(sink.Path) == 0 {
+				return fmt.Errorf("Sink %d is missing a path", i)
+			}
+		default:
+			return fmt.Errorf("Sink %d has unknown type %#q", i, sink.Type)
+		}
+	}
+	return nil
+}
+
+// LoadPolicy reads the forwarding policy from the configuration root, which is writable only by
+// administrators. It returns nil and no error if there is no policy file.
+func LoadPolicy() (*Policy, error) {
+	root, err := conf.RootDirectory()
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(root, policyFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	err = json.Unmarshal(bytes, &policy)
+	if err != nil {
+		return nil, err
+	}
+	policy.setDefaults()
+	err = policy.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+type state struct {
+	Cursor uint32
+	Stamp  int64
+}
+
+func stateFilePath() (string, error) {
+	root, err := conf.RootDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, stateFileName), nil
+}
+
+func loadState() (s state) {
+	path, err := stateFilePath()
+	if err != nil {
+		return
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	json.Unmarshal(bytes, &s)
+	return
+}
+
+func saveState(s state) error {
+	path, err := stateFilePath()
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", bytes, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicyDefaults(t *testing.T) {
+	var p Policy
+	p.setDefaults()
+	if p.BatchSize != 100 || p.QueueSize != 2000 || p.PollInterval != Duration(time.Second) || p.FlushInterval != Duration(time.Second*5) || p.MaxBackoff != Duration(time.Minute*5) {
+		t.Errorf("Default policy is %+v", p)
+	}
+	p = Policy{BatchSize: 10, QueueSize: 5, PollInterval: Duration(time.Millisecond)}
+	p.setDefaults()
+	if p.BatchSize != 10 || p.QueueSize != 200 || p.PollInterval != Duration(time.Millisecond) {
+		t.Errorf("Policy with a queue smaller than its batches became %+v", p)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	valid := []SinkPolicy{
+		{Type: "syslog-udp", Address: "192.0.2.1:514"},
+		{Type: "syslog-tls", Address: "logs.example.com:6514", Facility: 23},
+		{Type: "http", URL: "https://logs.example.com/ingest"},
+		{Type: "file", Path: `C:\Logs\wireguard.log`},
+	}
+	p := Policy{Sinks: valid}
+	if err := p.validate(); err != nil {
+		t.Errorf("Valid policy was rejected: %v", err)
+	}
+	for _, sinks := range [][]SinkPolicy{
+		nil,
+		{{Type: "syslog-tcp"}},
+		{{Type: "syslog-udp", Address: "192.0.2.1:514", Facility: 24}},
+		{{Type: "syslog-udp", Address: "192.0.2.1:514", Facility: -1}},
+		{{Type: "http"}},
+		{{Type: "file"}},
+		{{Type: "journald"}},
+		append(valid, SinkPolicy{}),
+	} {
+		p := Policy{Sinks: sinks}
+		if err := p.validate(); err == nil {
+			t.Errorf("Invalid sinks %+v were accepted", sinks)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package forwarder
+
+import (
+	"golang.zx2c4.com/wireguard/windows/ringlogger"
+)
+
+type ringSource struct {
+	rl *ringlogger.Ringlogger
+}
+
+// RingSource follows a ring log for a forwarder.
+func RingSource(rl *ringlogger.Ringlogger) Source {
+	return &ringSource{rl}
+}
+
+func (s *ringSource) FollowFromCursor(cursor uint32) ([]Line, uint32) {
+	if cursor == CursorAll {
+		cursor = ringlogger.CursorAll
+	}
+	followLines, nextCursor := s.rl.FollowFromCursor(cursor)
+	lines := make([]Line, len(followLines))
+	for i := range followLines {
+		lines[i] = Line{followLines[i].Line, followLines[i].Stamp}
+	}
+	return lines, nextCursor
+}
@@ -0,0 +1,292 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package forwarder
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/version"
+)
+
+type Record struct {
+	Stamp   time.Time `json:"timestamp"`
+	Host    string    `json:"host"`
+	Tag     string    `json:"tag"`
+	Message string    `json:"message"`
+
+	// end is set on the last record of each read from the ring, and is where to resume once it
+	// has been sent.
+	end *position
+}
+
+// Sink delivers a batch of records. A returned error means the whole batch should be retried.
+type Sink interface {
+	Send(records []Record) error
+	Close() error
+}
+
+func newSink(policy SinkPolicy) (Sink, error) {
+	switch policy.Type {
+	case "syslog-udp", "syslog-tcp", "syslog-tls":
+		return newSyslogSink(policy)
+	case "http":
+		return &httpSink{url: policy.URL, headers: policy.Headers, client: &http.Client{Timeout: time.Second * 30}}, nil
+	case "file":
+		return newFileSink(policy)
+	}
+	return nil, fmt.Errorf("Unknown sink type %#q", policy.Type)
+}
+
+type syslogSink struct {
+	network   string
+	address   string
+	facility  int
+	tlsConfig *tls.Config
+	conn      net.Conn
+}
+
+func newSyslogSink(policy SinkPolicy) (*syslogSink, error) {
+	sink := &syslogSink{address: policy.Address, facility: policy.Facility}
+	switch policy.Type {
+	case "syslog-udp":
+		sink.network = "udp"
+	case "syslog-tcp":
+		sink.network = "tcp"
+	case "syslog-tls":
+		sink.network = "tcp"
+		sink.tlsConfig = &tls.Config{ServerName: policy.ServerName}
+		if len(policy.CAFile) > 0 {
+			pem, err := ioutil.ReadFile(policy.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			sink.tlsConfig.RootCAs = x509.NewCertPool()
+			if !sink.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New("No certificates found in CA file")
+			}
+		}
+		if len(sink.tlsConfig.ServerName) == 0 {
+			host, _, err := net.SplitHostPort(policy.Address)
+			if err != nil {
+				return nil, err
+			}
+			sink.tlsConfig.ServerName = host
+		}
+	}
+	return sink, nil
+}
+
+func (sink *syslogSink) dial() (err error) {
+	if sink.conn != nil {
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: time.Second * 10}
+	if sink.tlsConfig != nil {
+		sink.conn, err = tls.DialWithDialer(dialer, sink.network, sink.address, sink.tlsConfig)
+	} else {
+		sink.conn, err = dialer.Dial(sink.network, sink.address)
+	}
+	return
+}
+
+// syslogHeaderField makes s fit a header field of an RFC 5424 message, which must be nonempty
+// printable ASCII without spaces, replacing anything else with underscores.
+func syslogHeaderField(s string, maxLength int) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	if len(s) > maxLength {
+		s = s[:maxLength]
+	}
+	field := []byte(s)
+	for i, c := range field {
+		if c < 33 || c > 126 {
+			field[i] = '_'
+		}
+	}
+	return string(field)
+}
+
+// formatRFC5424 formats a record as an RFC 5424 syslog message at informational severity.
+func formatRFC5424(facility int, record *Record) string {
+	const severityInformational = 6
+	host := syslogHeaderField(record.Host, 255)
+	msgID := syslogHeaderField(record.Tag, 32)
+	return fmt.Sprintf("<%d>1 %s %s WireGuard - %s - %s", facility*8+severityInformational, record.Stamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), host, msgID, record.Message)
+}
+
+func (sink *syslogSink) Send(records []Record) error {
+	err := sink.dial()
+	if err != nil {
+		return err
+	}
+	sink.conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	if sink.network == "udp" {
+		for i := range records {
+			_, err = sink.conn.Write([]byte(formatRFC5424(sink.facility, &records[i])))
+			if err != nil {
+				break
+			}
+		}
+	} else {
+		// Stream transports use octet counting framing from RFC 6587 and RFC 5425.
+		var buf bytes.Buffer
+		for i := range records {
+			msg := formatRFC5424(sink.facility, &records[i])
+			fmt.Fprintf(&buf, "%d %s", len(msg), msg)
+		}
+		_, err = sink.conn.Write(buf.Bytes())
+	}
+	if err != nil {
+		sink.conn.Close()
+		sink.conn = nil
+	}
+	return err
+}
+
+func (sink *syslogSink) Close() error {
+	if sink.conn == nil {
+		return nil
+	}
+	err := sink.conn.Close()
+	sink.conn = nil
+	return err
+}
+
+type httpSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (sink *httpSink) Send(records []Record) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, sink.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", version.UserAgent())
+	for key, value := range sink.headers {
+		request.Header.Set(key, value)
+	}
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Log collector returned %s", response.Status)
+	}
+	return nil
+}
+
+func (sink *httpSink) Close() error {
+	sink.client.CloseIdleConnections()
+	return nil
+}
+
+type fileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newFileSink(policy SinkPolicy) (*fileSink, error) {
+	sink := &fileSink{path: policy.Path, maxSize: policy.MaxSize, maxFiles: policy.MaxFiles}
+	if sink.maxSize <= 0 {
+		sink.maxSize = 1024 * 1024 * 10
+	}
+	if sink.maxFiles <= 0 {
+		sink.maxFiles = 5
+	}
+	return sink, nil
+}
+
+func (sink *fileSink) open() error {
+	if sink.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = info.Size()
+	return nil
+}
+
+func (sink *fileSink) rotate() error {
+	sink.Close()
+	for i := sink.maxFiles - 1; i > 0; i-- {
+		from := sink.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", sink.path, i-1)
+		}
+		err := os.Rename(from, fmt.Sprintf("%s.%d", sink.path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if sink.maxFiles == 1 {
+		os.Remove(sink.path)
+	}
+	return sink.open()
+}
+
+func (sink *fileSink) Send(records []Record) error {
+	err := sink.open()
+	if err != nil {
+		return err
+	}
+	var buf strings.Builder
+	for i := range records {
+		fmt.Fprintf(&buf, "%s: [%s] %s\n", records[i].Stamp.Format("2006-01-02 15:04:05.000000"), records[i].Tag, records[i].Message)
+	}
+	if sink.size > 0 && sink.size+int64(buf.Len()) > sink.maxSize {
+		err = sink.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := sink.file.WriteString(buf.String())
+	sink.size += int64(n)
+	if err != nil {
+		sink.Close()
+	}
+	return err
+}
+
+func (sink *fileSink) Close() error {
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package forwarder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatRFC5424(t *testing.T) {
+	stamp := time.Date(2019, 11, 1, 13, 0, 0, 123456000, time.FixedZone("CET", 3600))
+	for _, test := range []struct {
+		record Record
+		want   string
+	}{
+		{Record{Stamp: stamp, Host: "gateway", Tag: "TUN", Message: "[office] Startup complete"}, "<134>1 2019-11-01T12:00:00.123456Z gateway WireGuard - TUN - [office] Startup complete"},
+		{Record{Stamp: stamp, Message: "No host or tag"}, "<134>1 2019-11-01T12:00:00.123456Z - WireGuard - - - No host or tag"},
+		{Record{Stamp: stamp, Host: "my host\n", Tag: "é", Message: "x"}, "<134>1 2019-11-01T12:00:00.123456Z my_host_ WireGuard - __ - x"},
+		{Record{Stamp: stamp, Host: "gateway", Tag: strings.Repeat("t", 40), Message: "x"}, "<134>1 2019-11-01T12:00:00.123456Z gateway WireGuard - " + strings.Repeat("t", 32) + " - x"},
+	} {
+		if got := formatRFC5424(16, &test.record); got != test.want {
+			t.Errorf("Formatted %+v as %q, want %q", test.record, got, test.want)
+		}
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wireguard.log")
+	sink, err := newFileSink(SinkPolicy{Type: "file", Path: path, MaxSize: 60, MaxFiles: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	// Each line is about 40 bytes, so each file only has room for one.
+	for i := 1; i <= 5; i++ {
+		err = sink.Send([]Record{{Stamp: time.Now(), Tag: "TUN", Message: fmt.Sprintf("message %d", i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, suffix := range []string{"", ".1", ".2"} {
+		bytes, err := ioutil.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf(": [TUN] message %d\n", 5-i); !strings.HasSuffix(string(bytes), want) || strings.Count(string(bytes), "\n") != 1 {
+			t.Errorf("%s has %q, want one line ending in %q", filepath.Base(path+suffix), bytes, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Too many files were kept: %v", err)
+	}
+}
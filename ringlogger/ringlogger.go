@@ -17,6 +17,8 @@ import (
 	"unsafe"
 
 	"golang.org/x/sys/windows"
+
+	"golang.zx2c4.com/wireguard/windows/redact"
 )
 
 const (
@@ -163,6 +165,16 @@ func (rl *Ringlogger) WriteTo(out io.Writer) (n int64, err error) {
 	return
 }
 
+func (rl *Ringlogger) WriteToRedacted(out io.Writer, redactor *redact.Redactor) (n int64, err error) {
+	w := redactor.NewWriter(out)
+	n, err = rl.WriteTo(w)
+	if err != nil {
+		return
+	}
+	err = w.Close()
+	return
+}
+
 const CursorAll = ^uint32(0)
 
 type FollowLine struct {
@@ -0,0 +1,11 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+// https://docs.microsoft.com/en-us/windows/console/attachconsole
+const attachParentProcess = ^uint32(0)
+
+//sys	attachConsole(processID uint32) (err error) = kernel32.AttachConsole
@@ -54,6 +54,7 @@ type ListView struct {
 
 	tunnelChangedCB        *manager.TunnelChangeCallback
 	tunnelsChangedCB       *manager.TunnelsChangeCallback
+	tunnelRenamedCB        *manager.TunnelRenameCallback
 	tunnelsUpdateSuspended int32
 }
 
@@ -88,6 +89,7 @@ func NewListView(parent walk.Container) (*ListView, error) {
 
 	tunnelsView.tunnelChangedCB = manager.IPCClientRegisterTunnelChange(tunnelsView.onTunnelChange)
 	tunnelsView.tunnelsChangedCB = manager.IPCClientRegisterTunnelsChange(tunnelsView.onTunnelsChange)
+	tunnelsView.tunnelRenamedCB = manager.IPCClientRegisterTunnelRename(tunnelsView.onTunnelRename)
 
 	return tunnelsView, nil
 }
@@ -101,6 +103,10 @@ func (tv *ListView) Dispose() {
 		tv.tunnelsChangedCB.Unregister()
 		tv.tunnelsChangedCB = nil
 	}
+	if tv.tunnelRenamedCB != nil {
+		tv.tunnelRenamedCB.Unregister()
+		tv.tunnelRenamedCB = nil
+	}
 	tv.TableView.Dispose()
 }
 
@@ -199,6 +205,31 @@ func (tv *ListView) onTunnelChange(tunnel *manager.Tunnel, state manager.TunnelS
 	})
 }
 
+// onTunnelRename renames the tunnel in place, so that it stays selected rather than being removed
+// and added again.
+func (tv *ListView) onTunnelRename(oldName string, newName string) {
+	tv.Synchronize(func() {
+		for i := range tv.model.tunnels {
+			if tv.model.tunnels[i].Name != oldName {
+				continue
+			}
+			old := tv.model.tunnels[i]
+			tv.model.tunnels[i] = manager.Tunnel{Name: newName}
+			if state, ok := tv.model.lastObservedState[old]; ok {
+				tv.model.lastObservedState[tv.model.tunnels[i]] = state
+				delete(tv.model.lastObservedState, old)
+			}
+			wasCurrent := tv.CurrentIndex() == i
+			tv.model.PublishRowsReset()
+			tv.model.Sort(tv.model.SortedColumn(), tv.model.SortOrder())
+			if wasCurrent {
+				tv.selectTunnel(newName)
+			}
+			return
+		}
+	})
+}
+
 func (tv *ListView) onTunnelsChange() {
 	if atomic.LoadInt32(&tv.tunnelsUpdateSuspended) == 0 {
 		tv.Load(true)
@@ -13,6 +13,8 @@ import (
 
 	"github.com/lxn/walk"
 	"golang.zx2c4.com/wireguard/windows/l18n"
+	"golang.zx2c4.com/wireguard/windows/manager"
+	"golang.zx2c4.com/wireguard/windows/redact"
 	"golang.zx2c4.com/wireguard/windows/ringlogger"
 )
 
@@ -75,6 +77,16 @@ func NewLogPage() (*LogPage, error) {
 	saveAction.Triggered().Attach(lp.onSave)
 	contextMenu.Actions().Add(saveAction)
 	lp.ShortcutActions().Add(saveAction)
+	saveRedactedAction := walk.NewAction()
+	saveRedactedAction.SetText(l18n.Sprintf("Save &redacted to file…"))
+	saveRedactedAction.SetShortcut(walk.Shortcut{walk.ModControl | walk.ModShift, walk.KeyS})
+	saveRedactedAction.Triggered().Attach(lp.onSaveRedacted)
+	contextMenu.Actions().Add(saveRedactedAction)
+	lp.ShortcutActions().Add(saveRedactedAction)
+	saveDiagnosticsAction := walk.NewAction()
+	saveDiagnosticsAction.SetText(l18n.Sprintf("Save &diagnostics bundle…"))
+	saveDiagnosticsAction.Triggered().Attach(lp.onSaveDiagnostics)
+	contextMenu.Actions().Add(saveDiagnosticsAction)
 	lp.logView.SetContextMenu(contextMenu)
 	setSelectionStatus := func() {
 		copyAction.SetEnabled(len(lp.logView.SelectedIndexes()) > 0)
@@ -115,6 +127,13 @@ func NewLogPage() (*LogPage, error) {
 	saveButton.SetText(l18n.Sprintf("&Save"))
 	saveButton.Clicked().Attach(lp.onSave)
 
+	saveRedactedButton, err := walk.NewPushButton(buttonsContainer)
+	if err != nil {
+		return nil, err
+	}
+	saveRedactedButton.SetText(l18n.Sprintf("Save &redacted"))
+	saveRedactedButton.Clicked().Attach(lp.onSaveRedacted)
+
 	disposables.Spare()
 
 	return lp, nil
@@ -146,6 +165,20 @@ func (lp *LogPage) onSelectAll() {
 }
 
 func (lp *LogPage) onSave() {
+	lp.saveLog(nil)
+}
+
+func (lp *LogPage) onSaveRedacted() {
+	var names []string
+	if tunnels, err := manager.IPCClientTunnels(); err == nil {
+		for _, tunnel := range tunnels {
+			names = append(names, tunnel.Name)
+		}
+	}
+	lp.saveLog(redact.NewDefaultRedactor(names))
+}
+
+func (lp *LogPage) saveLog(redactor *redact.Redactor) {
 	fd := walk.FileDialog{
 		Filter:   l18n.Sprintf("Text Files (*.txt)|*.txt|All Files (*.*)|*.*"),
 		FilePath: fmt.Sprintf("wireguard-log-%s.txt", time.Now().Format("2006-01-02T150405")),
@@ -162,13 +195,84 @@ func (lp *LogPage) onSave() {
 		fd.FilePath = fd.FilePath + ".txt"
 	}
 
-	writeFileWithOverwriteHandling(form, fd.FilePath, func(file *os.File) error {
+	saved := writeFileWithOverwriteHandling(form, fd.FilePath, func(file *os.File) error {
+		if redactor != nil {
+			if _, err := ringlogger.Global.WriteToRedacted(file, redactor); err != nil {
+				return fmt.Errorf("exportLog: Ringlogger.WriteToRedacted failed: %w", err)
+			}
+			return nil
+		}
 		if _, err := ringlogger.Global.WriteTo(file); err != nil {
 			return fmt.Errorf("exportLog: Ringlogger.WriteTo failed: %w", err)
 		}
 
 		return nil
 	})
+	if !saved || redactor == nil || len(redactor.Mapping()) == 0 {
+		return
+	}
+	lp.offerMappingSave(fd.FilePath, func(file *os.File) error {
+		if _, err := redactor.WriteMappingTo(file); err != nil {
+			return fmt.Errorf("exportLog: Redactor.WriteMappingTo failed: %w", err)
+		}
+		return nil
+	})
+}
+
+func (lp *LogPage) onSaveDiagnostics() {
+	form := lp.Form()
+
+	bundle, mapping, err := manager.IPCClientDiagnostics()
+	if err != nil {
+		showErrorCustom(form, l18n.Sprintf("Unable to create diagnostics bundle"), err.Error())
+		return
+	}
+
+	fd := walk.FileDialog{
+		Filter:   l18n.Sprintf("ZIP Files (*.zip)|*.zip"),
+		FilePath: fmt.Sprintf("wireguard-diagnostics-%s.zip", time.Now().Format("2006-01-02T150405")),
+		Title:    l18n.Sprintf("Export diagnostics bundle to file"),
+	}
+	if ok, _ := fd.ShowSave(form); !ok {
+		return
+	}
+	if !strings.HasSuffix(fd.FilePath, ".zip") {
+		fd.FilePath = fd.FilePath + ".zip"
+	}
+
+	saved := writeFileWithOverwriteHandling(form, fd.FilePath, func(file *os.File) error {
+		if _, err := file.Write(bundle); err != nil {
+			return fmt.Errorf("exportDiagnostics: Write failed: %w", err)
+		}
+		return nil
+	})
+	if !saved || len(mapping) == 0 {
+		return
+	}
+	lp.offerMappingSave(strings.TrimSuffix(fd.FilePath, ".zip"), func(file *os.File) error {
+		if _, err := file.Write(mapping); err != nil {
+			return fmt.Errorf("exportDiagnostics: Write failed: %w", err)
+		}
+		return nil
+	})
+}
+
+func (lp *LogPage) offerMappingSave(basePath string, write func(file *os.File) error) {
+	form := lp.Form()
+
+	if walk.DlgCmdYes != walk.MsgBox(form, l18n.Sprintf("Save redaction table"), l18n.Sprintf("The saved file has had addresses, keys, and names replaced with placeholders.\n\nWould you like to save the table of original values separately? Do not share this table with the log."), walk.MsgBoxYesNo|walk.MsgBoxDefButton2|walk.MsgBoxIconQuestion) {
+		return
+	}
+
+	fd := walk.FileDialog{
+		Filter:   l18n.Sprintf("Text Files (*.txt)|*.txt|All Files (*.*)|*.*"),
+		FilePath: strings.TrimSuffix(basePath, ".txt") + "-mapping.txt",
+		Title:    l18n.Sprintf("Export redaction table to file"),
+	}
+	if ok, _ := fd.ShowSave(form); !ok {
+		return
+	}
+	writeFileWithOverwriteHandling(form, fd.FilePath, write)
 }
 
 type logModel struct {
@@ -7,7 +7,6 @@ package ui
 
 import (
 	"archive/zip"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -275,6 +274,13 @@ func (tp *TunnelsPage) importFiles(paths []string) {
 				walk.MsgBox(tp.Form(), title, message, flags)
 			})
 		}
+		syncedQuestion := func(title string, message string) bool {
+			answer := make(chan bool, 1)
+			tp.Synchronize(func() {
+				answer <- walk.MsgBox(tp.Form(), title, message, walk.MsgBoxYesNo|walk.MsgBoxDefButton2|walk.MsgBoxIconWarning) == walk.DlgCmdYes
+			})
+			return <-answer
+		}
 		type unparsedConfig struct {
 			Name   string
 			Config string
@@ -340,28 +346,44 @@ func (tp *TunnelsPage) importFiles(paths []string) {
 			syncedMsgBox(l18n.Sprintf("Error"), l18n.Sprintf("Could not enumerate existing tunnels: %v", lastErr), walk.MsgBoxIconWarning)
 			return
 		}
-		existingLowerTunnels := make(map[string]bool, len(existingTunnelList))
-		for _, tunnel := range existingTunnelList {
-			existingLowerTunnels[strings.ToLower(tunnel.Name)] = true
-		}
 
-		configCount := 0
-		tp.listView.SetSuspendTunnelsUpdate(true)
+		// Metadata that would have the manager start or probe a tunnel by itself is only kept if the
+		// user vouches for the files it came from.
+		var (
+			imports    []*manager.ImportedConfig
+			automation []string
+		)
 		for _, unparsedConfig := range unparsedConfigs {
-			if existingLowerTunnels[strings.ToLower(unparsedConfig.Name)] {
-				lastErr = errors.New(l18n.Sprintf("Another tunnel already exists with the name ‘%s’", unparsedConfig.Name))
-				continue
-			}
-			config, err := conf.FromWgQuickWithUnknownEncoding(unparsedConfig.Config, unparsedConfig.Name)
+			imported, err := manager.ParseImport(unparsedConfig.Config, unparsedConfig.Name, true, existingTunnelList)
 			if err != nil {
 				lastErr = err
 				continue
 			}
-			_, err = manager.IPCClientNewTunnel(config)
+			if parts := imported.Metadata.Automation(); len(parts) > 0 {
+				automation = append(automation, l18n.Sprintf("%s: %s", unparsedConfig.Name, strings.Join(parts, ", ")))
+			}
+			imports = append(imports, imported)
+		}
+		trustMetadata := len(automation) > 0 && syncedQuestion(l18n.Sprintf("Import automation"),
+			l18n.Sprintf("The selected configuration carries settings that start, stop, or probe tunnels by themselves:\n\n%s\n\nOnly keep these if you trust where the configuration came from. Would you like to keep them?", strings.Join(automation, "\n")))
+
+		configCount := 0
+		tp.listView.SetSuspendTunnelsUpdate(true)
+		for _, imported := range imports {
+			if !trustMetadata {
+				imported.Metadata.StripAutomation()
+			}
+			tunnel, err := manager.IPCClientNewTunnel(imported.Config)
 			if err != nil {
 				lastErr = err
 				continue
 			}
+			if !imported.Metadata.IsEmpty() {
+				err = tunnel.SetMetadata(imported.Metadata)
+				if err != nil {
+					lastErr = err
+				}
+			}
 			configCount++
 		}
 		tp.listView.SetSuspendTunnelsUpdate(false)
@@ -389,13 +411,17 @@ func (tp *TunnelsPage) exportTunnels(filePath string) {
 			if err != nil {
 				return fmt.Errorf("onExportTunnels: tunnel.StoredConfig failed: %w", err)
 			}
+			metadata, err := tunnel.StoredMetadata()
+			if err != nil {
+				return fmt.Errorf("onExportTunnels: tunnel.StoredMetadata failed: %w", err)
+			}
 
 			w, err := writer.Create(tunnel.Name + ".conf")
 			if err != nil {
 				return fmt.Errorf("onExportTunnels: writer.Create failed: %w", err)
 			}
 
-			if _, err := w.Write(([]byte)(cfg.ToWgQuick())); err != nil {
+			if _, err := w.Write(([]byte)(metadata.ToWgQuickComment() + cfg.ToWgQuick())); err != nil {
 				return fmt.Errorf("onExportTunnels: cfg.ToWgQuick failed: %w", err)
 			}
 		}
@@ -444,10 +470,27 @@ func (tp *TunnelsPage) onEditTunnel() {
 
 	if config := runEditDialog(tp.Form(), tunnel); config != nil {
 		go func() {
+			if config.Name != tunnel.Name {
+				renamed, err := tunnel.Rename(config.Name)
+				if err != nil {
+					tp.Synchronize(func() {
+						showErrorCustom(tp.Form(), l18n.Sprintf("Unable to rename tunnel"), err.Error())
+					})
+					return
+				}
+				tunnel = &renamed
+			}
+			if stored, err := tunnel.StoredConfig(); err == nil && stored.ToWgQuick() == config.ToWgQuick() {
+				return
+			}
 			priorState, err := tunnel.State()
+			metadata, metadataErr := tunnel.StoredMetadata()
 			tunnel.Delete()
 			tunnel.WaitForStop()
 			tunnel, err2 := manager.IPCClientNewTunnel(config)
+			if err2 == nil && metadataErr == nil && !metadata.IsEmpty() {
+				tunnel.SetMetadata(&metadata)
+			}
 			if err == nil && err2 == nil && (priorState == manager.TunnelStarting || priorState == manager.TunnelStarted) {
 				tunnel.Start()
 			}
@@ -70,9 +70,10 @@ func RunUI() {
 		}
 		mtw.Synchronize(func() {
 			switch updateState {
-			case manager.UpdateStateFoundUpdate:
+			case manager.UpdateStateFoundUpdate, manager.UpdateStateScheduled, manager.UpdateStateDeferred, manager.UpdateStateBlockedByPolicy:
+				alreadyFound := mtw.updatePage != nil
 				mtw.UpdateFound()
-				if tray != nil {
+				if tray != nil && !alreadyFound {
 					tray.UpdateFound()
 				}
 			case manager.UpdateStateUpdatesDisabledUnofficialBuild:
@@ -6,8 +6,11 @@
 package ui
 
 import (
+	"time"
+
 	"github.com/lxn/walk"
 
+	"golang.zx2c4.com/wireguard/windows/conf"
 	"golang.zx2c4.com/wireguard/windows/l18n"
 	"golang.zx2c4.com/wireguard/windows/manager"
 	"golang.zx2c4.com/wireguard/windows/updater"
@@ -43,6 +46,27 @@ func NewUpdatePage() (*UpdatePage, error) {
 	instructions.SetText(l18n.Sprintf("An update to WireGuard is available. It is highly advisable to update without delay."))
 	instructions.SetMinMaxSize(walk.Size{1, 0}, walk.Size{0, 0})
 
+	source, err := walk.NewTextLabel(up)
+	if err != nil {
+		return nil, err
+	}
+	source.SetMinMaxSize(walk.Size{1, 0}, walk.Size{0, 0})
+	source.SetVisible(false)
+	go func() {
+		details, err := manager.IPCClientUpdateDetails()
+		if err != nil || len(details.Mirror) == 0 {
+			return
+		}
+		text := l18n.Sprintf("Channel: %s, from %s", details.Channel, details.Mirror)
+		if !details.ScheduledFor.IsZero() {
+			text += "\n" + l18n.Sprintf("Your administrator has scheduled this update to install automatically after %s.", details.ScheduledFor.Format("2006-01-02 15:04"))
+		}
+		up.Synchronize(func() {
+			source.SetText(text)
+			source.SetVisible(true)
+		})
+	}()
+
 	status, err := walk.NewTextLabel(up)
 	if err != nil {
 		return nil, err
@@ -111,7 +135,11 @@ func NewUpdatePage() (*UpdatePage, error) {
 			}
 			if len(dp.Activity) > 0 {
 				stateText := dp.Activity
-				status.SetText(l18n.Sprintf("Status: %s", stateText))
+				if dp.BytesPerSecond > 0 && dp.ETA > 0 {
+					status.SetText(l18n.Sprintf("Status: %s (%s/s, %s remaining)", stateText, conf.Bytes(dp.BytesPerSecond).String(), dp.ETA.Round(time.Second).String()))
+				} else {
+					status.SetText(l18n.Sprintf("Status: %s", stateText))
+				}
 			}
 			if dp.BytesTotal > 0 {
 				bar.SetMarqueeMode(false)
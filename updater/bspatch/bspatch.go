@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package bspatch applies patches in the BSDIFF40 format produced by Colin Percival's bsdiff.
+package bspatch
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"io"
+)
+
+const headerSize = 32
+
+var errCorrupt = errors.New("Patch is corrupt")
+
+// offtin decodes bsdiff's sign-magnitude little endian integers.
+func offtin(b []byte) int64 {
+	y := int64(b[7] & 0x7f)
+	for i := 6; i >= 0; i-- {
+		y = y<<8 | int64(b[i])
+	}
+	if b[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
+
+/*
+ * A patch is a 32 byte header of "BSDIFF40", the compressed control block length, the compressed
+ * diff block length, and the new file length, followed by three bzip2 streams. The control block
+ * is a sequence of triples (x, y, z): add x bytes of the diff block to x bytes of the old file,
+ * then copy y bytes of the extra block, and then seek z bytes forward in the old file.
+ */
+
+// Apply reconstructs a new file from the old one and a patch. It does no verification of its
+// own beyond checking that the patch is well formed, so callers must check the result's hash.
+// Patches claiming to produce more than maxNewSize bytes are rejected.
+func Apply(old []byte, patch []byte, maxNewSize int64) ([]byte, error) {
+	if len(patch) < headerSize || !bytes.Equal(patch[:8], []byte("BSDIFF40")) {
+		return nil, errors.New("Patch has an invalid header")
+	}
+	ctrlLen := offtin(patch[8:16])
+	diffLen := offtin(patch[16:24])
+	newSize := offtin(patch[24:32])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || newSize > maxNewSize ||
+		ctrlLen > int64(len(patch)-headerSize) || diffLen > int64(len(patch)-headerSize)-ctrlLen {
+		return nil, errCorrupt
+	}
+	ctrlBlock := bzip2.NewReader(bytes.NewReader(patch[headerSize : headerSize+ctrlLen]))
+	diffBlock := bzip2.NewReader(bytes.NewReader(patch[headerSize+ctrlLen : headerSize+ctrlLen+diffLen]))
+	extraBlock := bzip2.NewReader(bytes.NewReader(patch[headerSize+ctrlLen+diffLen:]))
+
+	newFile := make([]byte, newSize)
+	var ctrl [24]byte
+	var oldPos, newPos int64
+	for newPos < newSize {
+		_, err := io.ReadFull(ctrlBlock, ctrl[:])
+		if err != nil {
+			return nil, errCorrupt
+		}
+		x, y, z := offtin(ctrl[0:8]), offtin(ctrl[8:16]), offtin(ctrl[16:24])
+		if x < 0 || y < 0 || x > newSize-newPos {
+			return nil, errCorrupt
+		}
+		_, err = io.ReadFull(diffBlock, newFile[newPos:newPos+x])
+		if err != nil {
+			return nil, errCorrupt
+		}
+		for i := int64(0); i < x; i++ {
+			if oldPos+i >= 0 && oldPos+i < int64(len(old)) {
+				newFile[newPos+i] += old[oldPos+i]
+			}
+		}
+		newPos += x
+		oldPos += x
+		if y > newSize-newPos {
+			return nil, errCorrupt
+		}
+		_, err = io.ReadFull(extraBlock, newFile[newPos:newPos+y])
+		if err != nil {
+			return nil, errCorrupt
+		}
+		newPos += y
+		oldPos += z
+	}
+	return newFile, nil
+}
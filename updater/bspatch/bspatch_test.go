@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package bspatch
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+const (
+	oldFile     = "The quick brown fox jumps over the lazy dog.\n"
+	newFile     = "The quick brown cat jumps over the lazy dog!\nAnd then some.\n"
+	patchBase64 = "QlNESUZGNDAsAAAAAAAAAC8AAAAAAAAAPAAAAAAAAABCWmg5MUFZJlNZ/X4aoQAABdAASAiAAiAAISmm0GaBfArhdyRThQkP1+GqEEJaaDkxQVkmU1lLsoC/AAAA4ADABAQAGAYgACEpoxCGAaiAst8XckU4UJBLsoC/QlpoOTFBWSZTWXsALLcAAAJVgAAQQAEgAAZDjAAgADEDQNAgA0aOKuYAPXxKeLuSKcKEg9gBZbg="
+)
+
+func TestApply(t *testing.T) {
+	patch, err := base64.StdEncoding.DecodeString(patchBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Apply([]byte(oldFile), patch, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != newFile {
+		t.Errorf("Apply produced %q, want %q", result, newFile)
+	}
+}
+
+func TestApplyCorrupt(t *testing.T) {
+	patch, err := base64.StdEncoding.DecodeString(patchBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bigger := append([]byte{}, patch...)
+	bigger[24] = 0xff
+	lying := append([]byte{}, patch...)
+	lying[8] = 0xff
+	for name, bad := range map[string][]byte{
+		"empty":         nil,
+		"bad magic":     append([]byte("BSDIFF41"), patch[8:]...),
+		"truncated":     patch[:len(patch)-20],
+		"short header":  patch[:20],
+		"bigger output": bigger,
+		"lying lengths": lying,
+	} {
+		_, err = Apply([]byte(oldFile), bad, 1024)
+		if err == nil {
+			t.Errorf("%s: Apply succeeded with a corrupt patch", name)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Config describes where updates come from. The zero value of each field means the official
+// default. Administrators can override it by placing updater.json in the configuration root:
+//
+//	{
+//	  "Channel": "beta",
+//	  "BaseURLs": ["https://mirror.example.com/wireguard/", "https://download.wireguard.com/windows-client/"],
+//	  "TrustedKeys": ["RWRNqGKtBXftKTKPpBPGDMe8jHLnFQ0EdRy8Wg0apV6vTDFLAODD83G4"],
+//	  "AllowDowngrade": false,
+//	  "CheckInterval": "4h",
+//	  "RetryInterval": "30m",
+//	  "Proxy": {"URL": "http://proxy.example.com:3128", "Username": "wireguard", "Password": "secret"},
+//	  "PinnedKeys": ["47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="],
+//	  "Policy": {
+//	    "Mode": "automatic",
+//	    "DeferDays": 3,
+//	    "MaintenanceWindows": [{"Days": ["sat", "sun"], "Start": "02:00", "End": "05:00"}],
+//	    "NeverWhileConnected": true
+//	  }
+//	}
+//
+// Each base URL is tried in order, and must serve the signed list as well as the packages it
+// names. The stable channel uses latest.sig and never offers pre-releases, and any other channel
+// uses latest-$channel.sig. If AllowDowngrade is set, then the highest version on the channel is
+// installed even if it is older than the running one, as is needed when leaving a beta channel.
+// CheckInterval and RetryInterval are how long to wait after a successful and after a failed
+// check, in the format of time.ParseDuration, and default to an hour and 25 minutes.
+// Proxy selects how mirrors are reached, as described by ProxyConfig. PinnedKeys, if given, are
+// base64 SHA-256 hashes of SubjectPublicKeyInfos, one of which must appear in the certificate chain
+// of every mirror, in addition to that chain being valid. Policy controls whether the manager
+// installs updates by itself, as described by Policy.
+type Config struct {
+	Channel        string
+	BaseURLs       []string
+	TrustedKeys    []string
+	AllowDowngrade bool
+	CheckInterval  string
+	RetryInterval  string
+	Proxy          ProxyConfig
+	PinnedKeys     []string
+	Policy         Policy
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Channel:     defaultChannel,
+		BaseURLs:    []string{defaultBaseURL},
+		TrustedKeys: releasePublicKeysBase64,
+	}
+}
+
+func (config *Config) setDefaults() {
+	if len(config.Channel) == 0 {
+		config.Channel = defaultChannel
+	}
+	if len(config.BaseURLs) == 0 {
+		config.BaseURLs = []string{defaultBaseURL}
+	}
+	if len(config.TrustedKeys) == 0 {
+		config.TrustedKeys = releasePublicKeysBase64
+	}
+}
+
+func (config *Config) validate() error {
+	for _, c := range config.Channel {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_') {
+			return errors.New("Invalid update channel name")
+		}
+	}
+	for _, baseURL := range config.BaseURLs {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "https" {
+			return errors.New("Update base URLs must use https")
+		}
+	}
+	_, err := parseInterval("CheckInterval", config.CheckInterval, defaultCheckInterval)
+	if err != nil {
+		return err
+	}
+	_, err = parseInterval("RetryInterval", config.RetryInterval, defaultRetryInterval)
+	if err != nil {
+		return err
+	}
+	err = config.Proxy.validate()
+	if err != nil {
+		return err
+	}
+	_, err = parsePinnedKeys(config.PinnedKeys)
+	if err != nil {
+		return err
+	}
+	return config.Policy.validate()
+}
+
+func (config *Config) allowsPreReleases() bool {
+	return config.Channel != defaultChannel
+}
+
+func (config *Config) listFile() string {
+	if config.Channel == defaultChannel {
+		return latestVersionFile
+	}
+	return "latest-" + config.Channel + ".sig"
+}
+
+func joinURL(baseURL, file string) string {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return baseURL + url.PathEscape(file)
+}
+
+// LoadConfig reads updater.json from the configuration root, which only administrators can write,
+// falling back to the official defaults if it does not exist.
+func LoadConfig() (*Config, error) {
+	root, err := rootDirectory()
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(root, configFileName))
+	if os.IsNotExist(err) {
+		return DefaultConfig(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	err = json.Unmarshal(bytes, config)
+	if err != nil {
+		return nil, err
+	}
+	config.setDefaults()
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -5,10 +5,35 @@
 
 package updater
 
+/*
+ * Rotating the release key:
+ *   1. Generate a new signify keypair, and add its public key to releasePublicKeysBase64,
+ *      keeping the old one, and ship a release containing both.
+ *   2. Once that release has been out for long enough that the old one is no longer in wide
+ *      use, begin signing lists with the new key. Signatures carry the key ID, so clients pick
+ *      the matching key without any trial verification.
+ *   3. In a later release, remove the old public key, and destroy the old secret key.
+ */
+var releasePublicKeysBase64 = []string{
+	"RWRNqGKtBXftKTKPpBPGDMe8jHLnFQ0EdRy8Wg0apV6vTDFLAODD83G4",
+}
+
+const (
+	defaultChannel     = "stable"
+	defaultBaseURL     = "https://download.wireguard.com/windows-client/"
+	latestVersionFile  = "latest.sig"
+	msiArchPrefix      = "wireguard-%s-"
+	msiSuffix          = ".msi"
+	patchInfix         = "-from-"
+	patchSuffix        = ".bsdiff"
+	msiCacheDirectory  = "Updates"
+	listCacheDirectory = "Lists"
+	configFileName     = "updater.json"
+)
+
 const (
-	releasePublicKeyBase64 = "RWRNqGKtBXftKTKPpBPGDMe8jHLnFQ0EdRy8Wg0apV6vTDFLAODD83G4"
-	latestVersionURL       = "https://download.wireguard.com/windows-client/latest.sig"
-	msiURL                 = "https://download.wireguard.com/windows-client/%s"
-	msiArchPrefix          = "wireguard-%s-"
-	msiSuffix              = ".msi"
+	maxFileListSize     = 1024 * 512        /* 512 KiB */
+	maxUpdateSize       = 1024 * 1024 * 100 /* 100 MiB */
+	maxDownloadAttempts = 8
+	maxDownloadBackoff  = 60 /* seconds */
 )
@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+
+	"golang.zx2c4.com/wireguard/windows/updater/bspatch"
+)
+
+// The cache holds the verified package of the version that is currently installed, which is what
+// delta patches are applied to. It lives in the state directory, which on Windows is the
+// configuration root, so only SYSTEM can write to it.
+
+func (u *Updater) msiCachePath() (string, error) {
+	c := filepath.Join(u.StateDirectory, msiCacheDirectory)
+	err := os.MkdirAll(c, os.ModeDir|0700)
+	if err != nil {
+		return "", err
+	}
+	return c, nil
+}
+
+func (u *Updater) installedMsiName() string {
+	return fmt.Sprintf(msiArchPrefix, u.Arch) + u.Version + msiSuffix
+}
+
+// cacheMsi keeps a copy of a verified package, and removes any other packages in the cache except
+// the one for the running version, which may still be needed if this one fails to install.
+func (u *Updater) cacheMsi(path string, name string) error {
+	if strings.ContainsAny(name, `/\`) {
+		return errors.New("Invalid package name")
+	}
+	cache, err := u.msiCachePath()
+	if err != nil {
+		return err
+	}
+	installed := u.installedMsiName()
+	entries, err := ioutil.ReadDir(cache)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() != installed && entry.Name() != name {
+			os.Remove(filepath.Join(cache, entry.Name()))
+		}
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	destination := filepath.Join(cache, name)
+	dst, err := os.OpenFile(destination+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, io.LimitReader(src, maxUpdateSize))
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(destination+".tmp", destination)
+	}
+	if err != nil {
+		os.Remove(destination + ".tmp")
+	}
+	return err
+}
+
+// downloadAndApplyPatch reconstructs the update from the cached package of the running version and
+// a delta patch, and writes it into file only if it matches the full package's hash exactly.
+func (u *Updater) downloadAndApplyPatch(update *UpdateFound, file *os.File, dp *DownloadProgress, progress chan DownloadProgress) error {
+	cache, err := u.msiCachePath()
+	if err != nil {
+		return err
+	}
+	old, err := ioutil.ReadFile(filepath.Join(cache, u.installedMsiName()))
+	if err != nil {
+		return err
+	}
+
+	patchFile, err := u.Installer.Prepare()
+	if err != nil {
+		return err
+	}
+	patchPath := patchFile.Name()
+	defer u.Installer.Cleanup(patchPath)
+	for _, baseURL := range update.mirrors() {
+		err = u.downloadFromMirror(baseURL, update.patchName, update.patchHash, patchFile, dp, progress)
+		if err == nil {
+			break
+		}
+		progress <- DownloadProgress{Activity: fmt.Sprintf("Download from %s failed: %v", baseURL, err)}
+	}
+	patchFile.Close()
+	if err != nil {
+		return err
+	}
+	patch, err := ioutil.ReadFile(patchPath)
+	if err != nil {
+		return err
+	}
+
+	progress <- DownloadProgress{Activity: "Applying delta update"}
+	reconstructed, err := bspatch.Apply(old, patch, maxUpdateSize)
+	if err != nil {
+		return err
+	}
+	hash := blake2b.Sum256(reconstructed)
+	if !hmac.Equal(hash[:], update.hash[:]) {
+		return errors.New("The patched update has the wrong hash")
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(reconstructed)
+	return err
+}
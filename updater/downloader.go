@@ -6,77 +6,153 @@
 package updater
 
 import (
-	"crypto/hmac"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
-	"net/http"
-	"os"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/blake2b"
-
-	"golang.zx2c4.com/wireguard/windows/elevate"
-	"golang.zx2c4.com/wireguard/windows/version"
 )
 
 type DownloadProgress struct {
 	Activity        string
 	BytesDownloaded uint64
 	BytesTotal      uint64
+	BytesPerSecond  uint64
+	ETA             time.Duration
+	Retries         uint32
 	Error           error
 	Complete        bool
 }
 
 type progressHashWatcher struct {
-	dp        *DownloadProgress
-	c         chan DownloadProgress
-	hashState hash.Hash
+	dp           *DownloadProgress
+	c            chan DownloadProgress
+	hashState    hash.Hash
+	started      time.Time
+	bytesAtStart uint64
 }
 
 func (pm *progressHashWatcher) Write(p []byte) (int, error) {
 	bytes := len(p)
+	pm.hashState.Write(p)
 	pm.dp.BytesDownloaded += uint64(bytes)
+	pm.dp.updateRate(pm.started, pm.bytesAtStart)
 	pm.c <- *pm.dp
-	pm.hashState.Write(p)
 	return bytes, nil
 }
 
 type UpdateFound struct {
-	name string
-	hash [blake2b.Size256]byte
+	name   string
+	hash   [blake2b.Size256]byte
+	config *Config
+	Source UpdateSource
+
+	// Version is the version of the update, and Downgrade is set when it is older than ours.
+	Version   string
+	Downgrade bool
+
+	// Mandatory is set when the signed list says that our version is below the minimum.
+	Mandatory bool
+
+	// FirstSeen is when this update was first found, from which policy deferrals are counted.
+	FirstSeen time.Time
+
+	// patchName and patchHash are set when the list has a delta from our version to this one.
+	patchName string
+	patchHash [blake2b.Size256]byte
 }
 
-func CheckForUpdate() (*UpdateFound, error) {
-	if !version.IsRunningOfficialVersion() {
-		return nil, errors.New("Build is not official, so updates are disabled")
+// UpdateSource records which channel and mirror a check result came from, and HeldBack is the
+// newest version on offer that this machine is not yet included in the staged rollout of.
+type UpdateSource struct {
+	Channel  string
+	Mirror   string
+	HeldBack string
+}
+
+// fetchFileList returns the verified list from a mirror. If the mirror says that the list has not
+// changed since we last fetched it, the cached copy is used, after verifying it again, and if that
+// fails, perhaps because the trusted keys have changed, the list is fetched in full.
+func (u *Updater) fetchFileList(baseURL string) (fileList, *listMetadata, error) {
+	listURL := joinURL(baseURL, u.Config.listFile())
+	contents, validators, fromCache, err := u.downloadFileList(listURL, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, metadata, err := readFileList(contents, u.Config.TrustedKeys)
+	if err != nil && fromCache {
+		u.dropCachedList(listURL)
+		contents, validators, fromCache, err = u.downloadFileList(listURL, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		files, metadata, err = readFileList(contents, u.Config.TrustedKeys)
 	}
-	request, err := http.NewRequest(http.MethodGet, latestVersionURL, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	request.Header.Add("User-Agent", version.UserAgent())
-	response, err := http.DefaultClient.Do(request)
+	err = u.verifyAndRecordFreshness(metadata, u.Config.Channel)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer response.Body.Close()
-	var fileList [1024 * 512] /* 512 KiB */ byte
-	bytesRead, err := response.Body.Read(fileList[:])
-	if err != nil && (err != io.EOF || bytesRead == 0) {
-		return nil, err
+	if !fromCache {
+		u.saveCachedList(listURL, contents, validators)
 	}
-	files, err := readFileList(fileList[:bytesRead])
-	if err != nil {
-		return nil, err
+	return files, metadata, nil
+}
+
+// CheckForUpdate tries each configured mirror in order until one of them returns a valid signed
+// list, and reports which one that was, whether or not an update was found.
+func (u *Updater) CheckForUpdate() (update *UpdateFound, source UpdateSource, err error) {
+	source.Channel = u.Config.Channel
+	for _, baseURL := range u.Config.BaseURLs {
+		var files fileList
+		var metadata *listMetadata
+		files, metadata, err = u.fetchFileList(baseURL)
+		if err != nil {
+			err = fmt.Errorf("Mirror %s: %w", baseURL, err)
+			continue
+		}
+		source.Mirror = baseURL
+		update, source.HeldBack, err = u.findCandidate(files, metadata.rollouts)
+		if update != nil {
+			update.config = u.Config
+			update.Source = source
+			if len(metadata.minimumVersion) > 0 {
+				update.Mandatory, err = u.belowMinimum(metadata.minimumVersion)
+				if err != nil {
+					return
+				}
+			}
+			update.FirstSeen, err = u.firstSeen(update.name)
+		}
+		return
 	}
-	return findCandidate(files)
+	return nil, source, err
+}
+
+// Policy returns the administrator's policy for installing updates from the same configuration.
+func (update *UpdateFound) Policy() *Policy {
+	return &update.config.Policy
+}
+
+// mirrors returns the mirror that produced the update first, followed by the other mirrors.
+func (update *UpdateFound) mirrors() []string {
+	mirrors := []string{update.Source.Mirror}
+	for _, baseURL := range update.config.BaseURLs {
+		if baseURL != update.Source.Mirror {
+			mirrors = append(mirrors, baseURL)
+		}
+	}
+	return mirrors
 }
 
 var updateInProgress = uint32(0)
 
-func DownloadVerifyAndExecute(userToken uintptr) (progress chan DownloadProgress) {
+func (u *Updater) DownloadVerifyAndExecute(userToken uintptr) (progress chan DownloadProgress) {
 	progress = make(chan DownloadProgress, 128)
 	progress <- DownloadProgress{Activity: "Initializing"}
 
@@ -85,108 +161,91 @@ func DownloadVerifyAndExecute(userToken uintptr) (progress chan DownloadProgress
 		return
 	}
 
-	doIt := func() {
-		defer atomic.StoreUint32(&updateInProgress, 0)
-
+	doIt := func() error {
 		progress <- DownloadProgress{Activity: "Checking for update"}
-		update, err := CheckForUpdate()
+		update, _, err := u.CheckForUpdate()
 		if err != nil {
-			progress <- DownloadProgress{Error: err}
-			return
+			return err
 		}
 		if update == nil {
-			progress <- DownloadProgress{Error: errors.New("No update was found")}
-			return
+			return errors.New("No update was found")
 		}
 
 		progress <- DownloadProgress{Activity: "Creating temporary file"}
-		file, err := msiTempFile()
+		file, err := u.Installer.Prepare()
 		if err != nil {
-			progress <- DownloadProgress{Error: err}
-			return
+			return err
 		}
-		progress <- DownloadProgress{Activity: fmt.Sprintf("Msi destination is %#q", file.Name())}
+		name := file.Name()
+		progress <- DownloadProgress{Activity: fmt.Sprintf("Msi destination is %#q", name)}
+		defer u.Installer.Cleanup(name)
 		defer func() {
 			if file != nil {
-				name := file.Name()
 				file.Seek(0, io.SeekStart)
 				file.Truncate(0)
 				file.Close()
-				os.Remove(name) // TODO: Do we have any sort of TOCTOU here?
 			}
 		}()
 
-		dp := DownloadProgress{Activity: "Downloading update"}
-		progress <- dp
-		request, err := http.NewRequest(http.MethodGet, fmt.Sprintf(msiURL, update.name), nil)
-		if err != nil {
-			progress <- DownloadProgress{Error: err}
-			return
-		}
-		request.Header.Add("User-Agent", version.UserAgent())
-		request.Header.Set("Accept-Encoding", "identity")
-		response, err := http.DefaultClient.Do(request)
-		if err != nil {
-			progress <- DownloadProgress{Error: err}
-			return
-		}
-		defer response.Body.Close()
-		if response.ContentLength >= 0 {
-			dp.BytesTotal = uint64(response.ContentLength)
-			progress <- dp
-		}
-		hasher, err := blake2b.New256(nil)
-		if err != nil {
-			progress <- DownloadProgress{Error: err}
-			return
-		}
-		pm := &progressHashWatcher{&dp, progress, hasher}
-		_, err = io.Copy(file, io.TeeReader(io.LimitReader(response.Body, 1024*1024*100 /* 100 MiB */), pm))
-		if err != nil {
-			progress <- DownloadProgress{Error: err}
-			return
+		dp := DownloadProgress{}
+		downloaded := false
+		if len(update.patchName) > 0 {
+			err = u.downloadAndApplyPatch(update, file, &dp, progress)
+			if err == nil {
+				downloaded = true
+			} else {
+				progress <- DownloadProgress{Activity: fmt.Sprintf("Delta update failed, so downloading full update: %v", err)}
+			}
 		}
-		if !hmac.Equal(hasher.Sum(nil), update.hash[:]) {
-			progress <- DownloadProgress{Error: errors.New("The downloaded update has the wrong hash")}
-			return
+		if !downloaded {
+			for _, baseURL := range update.mirrors() {
+				err = u.downloadFromMirror(baseURL, update.name, update.hash, file, &dp, progress)
+				if err == nil {
+					break
+				}
+				progress <- DownloadProgress{Activity: fmt.Sprintf("Download from %s failed: %v", baseURL, err)}
+			}
+			if err != nil {
+				return err
+			}
 		}
 
 		// TODO: it would be nice to rename in place from "file.msi.unverified" to "file.msi", but Windows TOCTOU stuff
 		// is hard, so we'll come back to this later.
-		name := file.Name()
 		file.Close()
 		file = nil
 
-		progress <- DownloadProgress{Activity: "Verifying authenticode signature"}
-		if !version.VerifyAuthenticode(name) {
-			os.Remove(name) // TODO: Do we have any sort of TOCTOU here?
-			progress <- DownloadProgress{Error: errors.New("The downloaded update does not have an authentic authenticode signature")}
-			return
+		progress <- DownloadProgress{Activity: "Verifying update"}
+		err = u.Installer.Verify(name)
+		if err != nil {
+			return err
 		}
 
-		progress <- DownloadProgress{Activity: "Installing update"}
-		err = runMsi(name, userToken)
-		os.Remove(name) // TODO: Do we have any sort of TOCTOU here?
+		err = u.cacheMsi(name, update.name)
 		if err != nil {
-			progress <- DownloadProgress{Error: err}
-			return
+			progress <- DownloadProgress{Activity: fmt.Sprintf("Unable to keep a copy of the update for future delta updates: %v", err)}
 		}
 
-		progress <- DownloadProgress{Complete: true}
-	}
-	if userToken == 0 {
-		go func() {
-			err := elevate.DoAsSystem(func() error {
-				doIt()
-				return nil
-			})
-			if err != nil {
-				progress <- DownloadProgress{Error: err}
-			}
-		}()
-	} else {
-		go doIt()
+		progress <- DownloadProgress{Activity: "Installing update"}
+		return u.Installer.Execute(name, userToken)
 	}
+	go func() {
+		var err error
+		runErr := runAsSystem(userToken, func() {
+			err = doIt()
+		})
+		if runErr != nil {
+			err = runErr
+		}
+		// The installer has cleaned up by now, so that anything waiting for the final progress
+		// report sees the result of that too.
+		atomic.StoreUint32(&updateInProgress, 0)
+		if err != nil {
+			progress <- DownloadProgress{Error: err}
+		} else {
+			progress <- DownloadProgress{Complete: true}
+		}
+	}()
 
 	return progress
 }
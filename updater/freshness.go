@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const stateFileName = "updater-state.json"
+
+type persistentState struct {
+	LastIssuedAt map[string]time.Time
+	InstallID    string `json:",omitempty"`
+	Pending      string `json:",omitempty"`
+	PendingSince time.Time
+	ListCache    map[string]listValidators `json:",omitempty"`
+}
+
+var stateLock sync.Mutex
+
+func (u *Updater) loadPersistentState() (state persistentState) {
+	state.LastIssuedAt = make(map[string]time.Time)
+	state.ListCache = make(map[string]listValidators)
+	bytes, err := ioutil.ReadFile(filepath.Join(u.StateDirectory, stateFileName))
+	if err != nil {
+		return
+	}
+	json.Unmarshal(bytes, &state)
+	if state.LastIssuedAt == nil {
+		state.LastIssuedAt = make(map[string]time.Time)
+	}
+	if state.ListCache == nil {
+		state.ListCache = make(map[string]listValidators)
+	}
+	return
+}
+
+func (u *Updater) savePersistentState(state *persistentState) error {
+	path := filepath.Join(u.StateDirectory, stateFileName)
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", bytes, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return nil
+}
+
+// checkFreshness rejects lists that have expired, and lists that were issued before the newest
+// list we have previously accepted on this channel, so that an attacker who captured an old list
+// can't replay it to keep us on an old version. Once a list with an issue time has been seen,
+// lists without one are considered rollbacks too.
+func checkFreshness(metadata *listMetadata, now time.Time, lastIssuedAt time.Time) error {
+	if !metadata.expires.IsZero() && now.After(metadata.expires) {
+		return fmt.Errorf("File list expired at %s", metadata.expires.Format(time.RFC3339))
+	}
+	if !lastIssuedAt.IsZero() {
+		if metadata.issuedAt.IsZero() {
+			return errors.New("File list has no issue time, but a previous one did")
+		}
+		if metadata.issuedAt.Before(lastIssuedAt) {
+			return fmt.Errorf("File list was issued at %s, before previously seen list from %s", metadata.issuedAt.Format(time.RFC3339), lastIssuedAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func (u *Updater) verifyAndRecordFreshness(metadata *listMetadata, channel string) error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state := u.loadPersistentState()
+	err := checkFreshness(metadata, time.Now(), state.LastIssuedAt[channel])
+	if err != nil {
+		return err
+	}
+	if metadata.issuedAt.After(state.LastIssuedAt[channel]) {
+		state.LastIssuedAt[channel] = metadata.issuedAt
+		err = u.savePersistentState(&state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstSeen returns when the package was first found as an update, which starts the clock for
+// policy deferrals. Only the latest package is remembered, so a newer release restarts the clock.
+func (u *Updater) firstSeen(name string) (time.Time, error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state := u.loadPersistentState()
+	if state.Pending == name && !state.PendingSince.IsZero() {
+		return state.PendingSince, nil
+	}
+	state.Pending = name
+	state.PendingSince = time.Now()
+	return state.PendingSince, u.savePersistentState(&state)
+}
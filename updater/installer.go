@@ -0,0 +1,46 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"errors"
+	"os"
+
+	"golang.zx2c4.com/wireguard/windows/version"
+)
+
+// Installer takes a package from download to installation. DownloadVerifyAndExecute calls
+// Prepare for a file to download into, which it closes before calling Verify, and if that
+// succeeds, Execute. Cleanup is called on every path that Prepare returned once the updater is
+// done with it, whether or not anything succeeded.
+type Installer interface {
+	Prepare() (*os.File, error)
+	Verify(path string) error
+	Execute(path string, userToken uintptr) error
+	Cleanup(path string)
+}
+
+// msiInstaller installs authenticode signed MSIs with msiexec.
+type msiInstaller struct{}
+
+func (msiInstaller) Prepare() (*os.File, error) {
+	return msiTempFile()
+}
+
+func (msiInstaller) Verify(path string) error {
+	if !version.VerifyAuthenticode(path) {
+		return errors.New("The downloaded update does not have an authentic authenticode signature")
+	}
+	return nil
+}
+
+func (msiInstaller) Execute(path string, userToken uintptr) error {
+	return runMsi(path, userToken)
+}
+
+func (msiInstaller) Cleanup(path string) {
+	os.Remove(path) // TODO: Do we have any sort of TOCTOU here?
+}
@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// listValidators are what the server said about the last list it sent, which lets us ask whether
+// that list has changed since, and have an empty 304 response instead of the whole list if not.
+type listValidators struct {
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+}
+
+func (u *Updater) listCachePath(listURL string) string {
+	hash := blake2b.Sum256([]byte(listURL))
+	return filepath.Join(u.StateDirectory, listCacheDirectory, hex.EncodeToString(hash[:16])+".sig")
+}
+
+// cachedList returns the last list that verified from listURL. Being on disk, it is no more trusted
+// than a list from the network, so it has to be verified again before use.
+func (u *Updater) cachedList(listURL string) ([]byte, listValidators) {
+	stateLock.Lock()
+	validators, ok := u.loadPersistentState().ListCache[listURL]
+	stateLock.Unlock()
+	if !ok {
+		return nil, listValidators{}
+	}
+	contents, err := ioutil.ReadFile(u.listCachePath(listURL))
+	if err != nil || len(contents) > maxFileListSize {
+		return nil, listValidators{}
+	}
+	return contents, validators
+}
+
+func (u *Updater) saveCachedList(listURL string, contents []byte, validators listValidators) error {
+	if len(validators.ETag) == 0 && len(validators.LastModified) == 0 {
+		u.dropCachedList(listURL)
+		return nil
+	}
+	path := u.listCachePath(listURL)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", contents, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state := u.loadPersistentState()
+	state.ListCache[listURL] = validators
+	return u.savePersistentState(&state)
+}
+
+func (u *Updater) dropCachedList(listURL string) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state := u.loadPersistentState()
+	if _, ok := state.ListCache[listURL]; ok {
+		delete(state.ListCache, listURL)
+		u.savePersistentState(&state)
+	}
+	os.Remove(u.listCachePath(listURL))
+}
+
+// downloadFileList fetches a list, and if conditional is set and the server says that the list we
+// have cached is still current, returns that instead.
+func (u *Updater) downloadFileList(listURL string, conditional bool) (contents []byte, validators listValidators, fromCache bool, err error) {
+	var cached []byte
+	if conditional {
+		cached, validators = u.cachedList(listURL)
+	}
+	request, err := http.NewRequest(http.MethodGet, listURL, nil)
+	if err != nil {
+		return
+	}
+	if cached != nil {
+		if len(validators.ETag) > 0 {
+			request.Header.Set("If-None-Match", validators.ETag)
+		}
+		if len(validators.LastModified) > 0 {
+			request.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
+	response, err := u.do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified && cached != nil {
+		return cached, validators, true, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Unable to fetch file list: %s", response.Status)
+		return
+	}
+	contents, err = ioutil.ReadAll(io.LimitReader(response.Body, maxFileListSize+1))
+	if err != nil {
+		return
+	}
+	if len(contents) > maxFileListSize {
+		err = errors.New("File list is too large")
+		return
+	}
+	validators = listValidators{ETag: response.Header.Get("ETag"), LastModified: response.Header.Get("Last-Modified")}
+	return contents, validators, false, nil
+}
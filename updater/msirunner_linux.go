@@ -14,7 +14,7 @@ import (
 
 // This isn't a Linux program, yes, but having the updater package work across platforms is quite helpful for testing.
 
-func runMsi(msiPath string, userToken uintptr, env []string) error {
+func runMsi(msiPath string, userToken uintptr) error {
 	return exec.Command("qarma", "--info", "--text", fmt.Sprintf("It seems to be working! Were we on Windows, ‘%s’ would be executed.", msiPath)).Run()
 }
 
@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Policy decides whether an update that was found is installed automatically, and when. The zero
+// value only notifies, leaving installation to an administrator in the UI.
+//
+// With the "automatic" mode, an update is installed once all of these hold: it has been known for
+// DeferDays days, unless the signed list marks the running version as below its minimum; the
+// local time is inside one of the MaintenanceWindows, if any are given; and, if
+// NeverWhileConnected is set, no tunnel is running.
+type Policy struct {
+	Mode                string
+	DeferDays           uint
+	MaintenanceWindows  []MaintenanceWindow
+	NeverWhileConnected bool
+}
+
+// MaintenanceWindow is a span of local time, such as {"Days": ["sat", "sun"], "Start": "02:00",
+// "End": "05:00"}. A window with no days applies every day, and one whose end is not after its
+// start runs past midnight into the next day.
+type MaintenanceWindow struct {
+	Days  []string
+	Start string
+	End   string
+}
+
+const (
+	PolicyModeNotify    = "notify"
+	PolicyModeAutomatic = "automatic"
+)
+
+type PolicyAction int
+
+const (
+	PolicyNotify PolicyAction = iota
+	PolicyInstall
+	PolicyDeferred
+	PolicyScheduled
+	PolicyBlocked
+)
+
+// PolicyDecision says what to do with an update now. For deferred and scheduled updates, NotBefore
+// is when the decision may next change.
+type PolicyDecision struct {
+	Action    PolicyAction
+	NotBefore time.Time
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid maintenance window time %#q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseDay(s string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(s, day.String()) || strings.EqualFold(s, day.String()[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid maintenance window day %#q", s)
+}
+
+func (policy *Policy) validate() error {
+	switch policy.Mode {
+	case "", PolicyModeNotify, PolicyModeAutomatic:
+	default:
+		return fmt.Errorf("Invalid update policy mode %#q", policy.Mode)
+	}
+	if policy.DeferDays > 365 {
+		return errors.New("Update policy deferral must be at most 365 days")
+	}
+	for _, window := range policy.MaintenanceWindows {
+		for _, day := range window.Days {
+			if _, err := parseDay(day); err != nil {
+				return err
+			}
+		}
+		if _, err := parseClock(window.Start); err != nil {
+			return err
+		}
+		if _, err := parseClock(window.End); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (window *MaintenanceWindow) appliesOn(day time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, name := range window.Days {
+		if d, err := parseDay(name); err == nil && d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// span returns the occurrence of the window that starts on the same local day as t, if there is
+// one. Windows are validated when the policy is loaded, so parse errors are not expected here.
+func (window *MaintenanceWindow) span(t time.Time) (start, end time.Time, ok bool) {
+	if !window.appliesOn(t.Weekday()) {
+		return
+	}
+	startClock, err1 := parseClock(window.Start)
+	endClock, err2 := parseClock(window.End)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	if endClock <= startClock {
+		endClock += time.Hour * 24
+	}
+	year, month, day := t.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	return midnight.Add(startClock), midnight.Add(endClock), true
+}
+
+// inMaintenanceWindow says whether now is inside a window, or if not, when the next one begins.
+func (policy *Policy) inMaintenanceWindow(now time.Time) (inside bool, next time.Time) {
+	if len(policy.MaintenanceWindows) == 0 {
+		return true, time.Time{}
+	}
+	for i := range policy.MaintenanceWindows {
+		window := &policy.MaintenanceWindows[i]
+		for days := -1; days <= 7; days++ {
+			start, end, ok := window.span(now.AddDate(0, 0, days))
+			if !ok {
+				continue
+			}
+			if !now.Before(start) && now.Before(end) {
+				return true, time.Time{}
+			}
+			if start.After(now) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+	}
+	return false, next
+}
+
+// Evaluate decides what to do with an update that was first seen at firstSeen.
+func (policy *Policy) Evaluate(now time.Time, firstSeen time.Time, mandatory bool, tunnelsRunning bool) PolicyDecision {
+	if policy.Mode != PolicyModeAutomatic {
+		return PolicyDecision{Action: PolicyNotify}
+	}
+	if !mandatory && policy.DeferDays > 0 {
+		deferredUntil := firstSeen.Add(time.Hour * 24 * time.Duration(policy.DeferDays))
+		if now.Before(deferredUntil) {
+			return PolicyDecision{Action: PolicyDeferred, NotBefore: deferredUntil}
+		}
+	}
+	if inside, next := policy.inMaintenanceWindow(now); !inside {
+		return PolicyDecision{Action: PolicyScheduled, NotBefore: next}
+	}
+	if policy.NeverWhileConnected && tunnelsRunning {
+		return PolicyDecision{Action: PolicyBlocked}
+	}
+	return PolicyDecision{Action: PolicyInstall}
+}
@@ -0,0 +1,197 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyConfig selects how the updater reaches the mirrors. URL is a fixed proxy, such as
+// "http://proxy.example.com:3128", and PAC is the URL of a proxy auto-config file, which is only
+// evaluated on Windows. If neither is given, the proxy environment variables apply. Username and
+// Password, if given, are sent to the proxy using basic authentication.
+type ProxyConfig struct {
+	URL      string
+	PAC      string
+	Username string
+	Password string
+}
+
+var (
+	ErrProxyUnreachable    = errors.New("Unable to connect to the proxy")
+	ErrProxyAuthentication = errors.New("The proxy rejected our credentials")
+	ErrCertificate         = errors.New("The server's certificate is not valid")
+	ErrPinMismatch         = errors.New("The server's certificate does not match any pinned key")
+	ErrNameResolution      = errors.New("Unable to resolve the server's name")
+	ErrTimeout             = errors.New("The connection timed out")
+)
+
+func (proxy *ProxyConfig) validate() error {
+	if len(proxy.URL) > 0 && len(proxy.PAC) > 0 {
+		return errors.New("Only one of a proxy URL and a proxy auto-config URL may be given")
+	}
+	if len(proxy.URL) > 0 {
+		u, err := url.Parse(proxy.URL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			return errors.New("Proxy URL must use http, https, or socks5")
+		}
+	}
+	if len(proxy.PAC) > 0 {
+		u, err := url.Parse(proxy.PAC)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file" {
+			return errors.New("Proxy auto-config URL must use http, https, or file")
+		}
+	}
+	return nil
+}
+
+func (proxy *ProxyConfig) withCredentials(u *url.URL) *url.URL {
+	if u == nil || len(proxy.Username) == 0 {
+		return u
+	}
+	withCredentials := *u
+	withCredentials.User = url.UserPassword(proxy.Username, proxy.Password)
+	return &withCredentials
+}
+
+// parseAutoConfigProxy takes the first proxy from a list such as "proxy1:8080; proxy2:3128",
+// optionally of the form "https=proxy:8080", as returned by WinHTTP.
+func parseAutoConfigProxy(proxies string) (*url.URL, error) {
+	fields := strings.FieldsFunc(proxies, func(c rune) bool {
+		return c == ';' || c == ' ' || c == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	proxy := fields[0]
+	if i := strings.IndexByte(proxy, '='); i >= 0 {
+		proxy = proxy[i+1:]
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	return url.Parse(proxy)
+}
+
+func (proxy *ProxyConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	switch {
+	case len(proxy.URL) > 0:
+		fixed, _ := url.Parse(proxy.URL)
+		fixed = proxy.withCredentials(fixed)
+		return func(*http.Request) (*url.URL, error) {
+			return fixed, nil
+		}
+	case len(proxy.PAC) > 0:
+		return func(request *http.Request) (*url.URL, error) {
+			proxies, err := autoConfigProxy(proxy.PAC, request.URL)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to evaluate proxy auto-config file: %w", err)
+			}
+			u, err := parseAutoConfigProxy(proxies)
+			if err != nil {
+				return nil, err
+			}
+			return proxy.withCredentials(u), nil
+		}
+	default:
+		return func(request *http.Request) (*url.URL, error) {
+			u, err := http.ProxyFromEnvironment(request)
+			return proxy.withCredentials(u), err
+		}
+	}
+}
+
+func parsePinnedKeys(pins []string) (map[[sha256.Size]byte]bool, error) {
+	parsed := make(map[[sha256.Size]byte]bool, len(pins))
+	for _, pin := range pins {
+		bytes, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(bytes) != sha256.Size {
+			return nil, fmt.Errorf("Invalid pinned key %#q", pin)
+		}
+		var hash [sha256.Size]byte
+		copy(hash[:], bytes)
+		parsed[hash] = true
+	}
+	return parsed, nil
+}
+
+// verifyPins requires that some certificate in a verified chain, whether the server's own or one of
+// its issuers, has a SubjectPublicKeyInfo whose SHA-256 is pinned.
+func verifyPins(pins map[[sha256.Size]byte]bool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
+		}
+		return ErrPinMismatch
+	}
+}
+
+// newTransport returns a copy of base that goes through the configured proxy, and checks pinned
+// keys, if there are any, in addition to the usual certificate verification.
+func (config *Config) newTransport(base *http.Transport) (*http.Transport, error) {
+	transport := base.Clone()
+	transport.Proxy = config.Proxy.proxyFunc()
+	if len(config.PinnedKeys) > 0 {
+		pins, err := parsePinnedKeys(config.PinnedKeys)
+		if err != nil {
+			return nil, err
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.VerifyConnection = verifyPins(pins)
+	}
+	return transport, nil
+}
+
+// explainConnectionError wraps err with whichever of the exported errors above best describes it,
+// so that administrators get a clue as to what to fix, and so that retrying can stop early when
+// that wouldn't help.
+func explainConnectionError(err error) error {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var netErr net.Error
+	var cause error
+	switch {
+	case errors.Is(err, ErrPinMismatch):
+		return err
+	case strings.Contains(err.Error(), http.StatusText(http.StatusProxyAuthRequired)):
+		cause = ErrProxyAuthentication
+	case errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+		cause = ErrProxyUnreachable
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &invalidErr), errors.As(err, &hostnameErr):
+		cause = ErrCertificate
+	case errors.As(err, &dnsErr):
+		cause = ErrNameResolution
+	case errors.As(err, &netErr) && netErr.Timeout():
+		cause = ErrTimeout
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %v", cause, err)
+}
@@ -0,0 +1,17 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"errors"
+	"net/url"
+)
+
+// This isn't a Linux program, yes, but having the updater package work across platforms is quite helpful for testing.
+
+func autoConfigProxy(pacURL string, target *url.URL) (string, error) {
+	return "", errors.New("Proxy auto-config files are only supported on Windows")
+}
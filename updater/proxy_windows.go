@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"net/url"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"golang.zx2c4.com/wireguard/windows/version"
+)
+
+// autoConfigProxy evaluates a proxy auto-config file with WinHTTP, which fetches and runs it in
+// its own sandboxed script engine, and returns the proxy string it chooses for target, or an
+// empty string for a direct connection.
+func autoConfigProxy(pacURL string, target *url.URL) (string, error) {
+	userAgent, err := windows.UTF16PtrFromString(version.UserAgent())
+	if err != nil {
+		return "", err
+	}
+	session, err := winHttpOpen(userAgent, winHttpAccessTypeNoProxy, nil, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer winHttpCloseHandle(session)
+	options := winHttpAutoProxyOptions{
+		flags:                 winHttpAutoProxyConfigURL,
+		autoLogonIfChallenged: 1,
+	}
+	options.autoConfigURL, err = windows.UTF16PtrFromString(pacURL)
+	if err != nil {
+		return "", err
+	}
+	targetURL, err := windows.UTF16PtrFromString(target.String())
+	if err != nil {
+		return "", err
+	}
+	var info winHttpProxyInfo
+	err = winHttpGetProxyForUrl(session, targetURL, &options, &info)
+	if err != nil {
+		return "", err
+	}
+	if info.proxyBypass != nil {
+		globalFree(uintptr(unsafe.Pointer(info.proxyBypass)))
+	}
+	if info.proxy == nil {
+		return "", nil
+	}
+	defer globalFree(uintptr(unsafe.Pointer(info.proxy)))
+	if info.accessType != winHttpAccessTypeNamedProxy {
+		return "", nil
+	}
+	return windows.UTF16PtrToString(info.proxy), nil
+}
@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+
+	"golang.org/x/crypto/blowfish"
+)
+
+// bcryptHash is the bcrypt_hash of OpenBSD's bcrypt_pbkdf: eksblowfish keyed by the hashed
+// passphrase and salt, encrypting a fixed string, whose words are then written little-endian.
+func bcryptHash(sha2pass []byte, sha2salt []byte) []byte {
+	cipher, _ := blowfish.NewSaltedCipher(sha2pass, sha2salt)
+	for i := 0; i < 64; i++ {
+		blowfish.ExpandKey(sha2salt, cipher)
+		blowfish.ExpandKey(sha2pass, cipher)
+	}
+	out := []byte("OxychromaticBlowfishSwatDynamite")
+	for i := 0; i < 64; i++ {
+		for j := 0; j < len(out); j += blowfish.BlockSize {
+			cipher.Encrypt(out[j:j+blowfish.BlockSize], out[j:j+blowfish.BlockSize])
+		}
+	}
+	for i := 0; i < len(out); i += 4 {
+		binary.LittleEndian.PutUint32(out[i:], binary.BigEndian.Uint32(out[i:]))
+	}
+	return out
+}
+
+// bcryptPBKDF derives a key from a passphrase as signify does to encrypt secret keys. Unlike
+// PBKDF2, the bytes of each block are spread across the key rather than laid out in turn.
+func bcryptPBKDF(passphrase []byte, salt []byte, rounds int, keyLen int) []byte {
+	const hashLen = 32
+	stride := (keyLen + hashLen - 1) / hashLen
+	amount := (keyLen + stride - 1) / stride
+	key := make([]byte, keyLen)
+	sha2pass := sha512.Sum512(passphrase)
+	countSalt := make([]byte, len(salt)+4)
+	copy(countSalt, salt)
+	for count := 1; count <= stride; count++ {
+		binary.BigEndian.PutUint32(countSalt[len(salt):], uint32(count))
+		sha2salt := sha512.Sum512(countSalt)
+		tmp := bcryptHash(sha2pass[:], sha2salt[:])
+		out := append([]byte(nil), tmp...)
+		for i := 1; i < rounds; i++ {
+			sha2salt = sha512.Sum512(tmp)
+			tmp = bcryptHash(sha2pass[:], sha2salt[:])
+			for j := range out {
+				out[j] ^= tmp[j]
+			}
+		}
+		for i := 0; i < amount; i++ {
+			dest := i*stride + count - 1
+			if dest >= keyLen {
+				break
+			}
+			key[dest] = out[i]
+		}
+	}
+	return key
+}
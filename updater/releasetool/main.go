@@ -0,0 +1,311 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+// Command releasetool generates signify keys, and creates, signs, and verifies the file lists that
+// the updater downloads, without needing b2sum or signify:
+//
+//	$ go run ./updater/releasetool generate -p release.pub -s release.sec
+//	$ go run ./updater/releasetool list -expires-in 336h -minimum-version 0.3.1 -o list ./dist
+//	$ go run ./updater/releasetool sign -s release.sec -m list -x list.sec
+//	$ go run ./updater/releasetool verify -p release.pub -x list.sec
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"golang.zx2c4.com/wireguard/windows/updater"
+)
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s COMMAND [OPTIONS]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	fmt.Fprintln(os.Stderr, "  generate -p PUBKEY -s SECKEY [-c COMMENT] [-n]")
+	fmt.Fprintln(os.Stderr, "  list [-o LIST] [-issued-at TIME] [-expires-in DURATION] [-minimum-version VERSION] [-rollout PACKAGE:PERCENT...] DIRECTORY")
+	fmt.Fprintln(os.Stderr, "  sign -s SECKEY -m LIST [-x SIGNED_LIST]")
+	fmt.Fprintln(os.Stderr, "  verify -p PUBKEY [-p PUBKEY...] -x SIGNED_LIST")
+	os.Exit(1)
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func writeOutput(path string, contents []byte, perm os.FileMode) error {
+	if len(path) == 0 || path == "-" {
+		_, err := os.Stdout.Write(contents)
+		return err
+	}
+	return ioutil.WriteFile(path, contents, perm)
+}
+
+func readInput(path string) ([]byte, error) {
+	if len(path) == 0 || path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+func cmdGenerate(args []string) error {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	publicPath := flags.String("p", "", "public key output `file`")
+	secretPath := flags.String("s", "", "secret key output `file`")
+	comment := flags.String("c", "signify", "key `comment`")
+	unencrypted := flags.Bool("n", false, "leave the secret key unencrypted rather than asking for a passphrase")
+	flags.Parse(args)
+	if len(*publicPath) == 0 || len(*secretPath) == 0 || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	var passphrase []byte
+	if !*unencrypted {
+		var err error
+		passphrase, err = readPassphrase("Passphrase: ", true)
+		if err != nil {
+			return err
+		}
+	}
+	publicFile, secretFile, err := generateKey(*comment, passphrase)
+	if err != nil {
+		return err
+	}
+	secret, err := os.OpenFile(*secretPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = secret.Write(secretFile)
+	if closeErr := secret.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*publicPath, publicFile, 0644)
+}
+
+// makeList hashes the packages and patches in a directory, in the format of b2sum -l 256, followed
+// by the metadata lines that readFileList understands.
+func makeList(directory string, issuedAt time.Time, expires time.Time, minimumVersion string, rollouts []string) ([]byte, error) {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && (strings.HasSuffix(entry.Name(), ".msi") || strings.HasSuffix(entry.Name(), ".bsdiff")) {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("No packages found")
+	}
+	sort.Strings(names)
+	var list bytes.Buffer
+	hashed := make(map[string]string, len(names))
+	for _, name := range names {
+		if strings.ContainsAny(name, "\n!") {
+			return nil, fmt.Errorf("Invalid package name %#q", name)
+		}
+		file, err := os.Open(filepath.Join(directory, name))
+		if err != nil {
+			return nil, err
+		}
+		hasher, _ := blake2b.New256(nil)
+		_, err = io.Copy(hasher, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		hashed[name] = hex.EncodeToString(hasher.Sum(nil))
+		fmt.Fprintf(&list, "%s  %s\n", hashed[name], name)
+	}
+	metadata := func(key, value string) {
+		fmt.Fprintf(&list, "%064d  !%s=%s\n", 0, key, value)
+	}
+	if !issuedAt.IsZero() {
+		metadata("issued-at", issuedAt.UTC().Format(time.RFC3339))
+	}
+	if !expires.IsZero() {
+		metadata("expires", expires.UTC().Format(time.RFC3339))
+	}
+	if len(minimumVersion) > 0 {
+		metadata("minimum-version", minimumVersion)
+	}
+	for _, rollout := range rollouts {
+		separator := strings.LastIndexByte(rollout, ':')
+		if separator < 0 || hashed[rollout[:separator]] == "" {
+			return nil, fmt.Errorf("Rollout %#q is not of the form PACKAGE:PERCENT for a package in the list", rollout)
+		}
+		percent, err := strconv.ParseFloat(rollout[separator+1:], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("Rollout %#q has an invalid percentage", rollout)
+		}
+		metadata("rollout", rollout)
+	}
+	return list.Bytes(), nil
+}
+
+func cmdList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	output := flags.String("o", "-", "list output `file`")
+	issuedAtString := flags.String("issued-at", "now", "issue `time` in RFC 3339 format, \"now\", or \"none\"")
+	expiresIn := flags.Duration("expires-in", 0, "`duration` after the issue time at which the list expires")
+	minimumVersion := flags.String("minimum-version", "", "oldest `version` that need not update")
+	var rollouts stringList
+	flags.Var(&rollouts, "rollout", "`package:percent` of machines to offer a package to, which may be given more than once")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	var issuedAt time.Time
+	switch *issuedAtString {
+	case "now":
+		issuedAt = time.Now().Truncate(time.Second)
+	case "none":
+	default:
+		var err error
+		issuedAt, err = time.Parse(time.RFC3339, *issuedAtString)
+		if err != nil {
+			return err
+		}
+	}
+	var expires time.Time
+	if *expiresIn > 0 {
+		if issuedAt.IsZero() {
+			return errors.New("Expiry requires an issue time")
+		}
+		expires = issuedAt.Add(*expiresIn)
+	}
+	list, err := makeList(flags.Arg(0), issuedAt, expires, *minimumVersion, rollouts)
+	if err != nil {
+		return err
+	}
+	return writeOutput(*output, list, 0644)
+}
+
+func cmdSign(args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	secretPath := flags.String("s", "", "secret key `file`")
+	messagePath := flags.String("m", "-", "list `file` to sign")
+	output := flags.String("x", "-", "signed list output `file`")
+	flags.Parse(args)
+	if len(*secretPath) == 0 || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	key, err := readSecretKey(*secretPath, func() ([]byte, error) {
+		return readPassphrase("Passphrase for "+*secretPath+": ", false)
+	})
+	if err != nil {
+		return err
+	}
+	message, err := readInput(*messagePath)
+	if err != nil {
+		return err
+	}
+	comment := "verify with " + strings.TrimSuffix(filepath.Base(*secretPath), ".sec") + ".pub"
+	return writeOutput(*output, signEmbedded(key, comment, message), 0644)
+}
+
+func cmdVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	var publicPaths stringList
+	flags.Var(&publicPaths, "p", "trusted public key `file`, which may be given more than once")
+	signedPath := flags.String("x", "-", "signed list `file`")
+	flags.Parse(args)
+	if len(publicPaths) == 0 || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	var trustedKeys []string
+	for _, path := range publicPaths {
+		key, err := readPublicKey(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		trustedKeys = append(trustedKeys, key)
+	}
+	signed, err := readInput(*signedPath)
+	if err != nil {
+		return err
+	}
+	list, err := updater.VerifySignedList(signed, trustedKeys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Signature verified with key %s\n", keyNumberString(list.KeyID))
+	if !list.IssuedAt.IsZero() {
+		fmt.Printf("Issued at: %s\n", list.IssuedAt.Format(time.RFC3339))
+	}
+	if !list.Expires.IsZero() {
+		fmt.Printf("Expires: %s\n", list.Expires.Format(time.RFC3339))
+		if time.Now().After(list.Expires) {
+			fmt.Println("Warning: this list has expired, so the updater will reject it")
+		}
+	}
+	if len(list.MinimumVersion) > 0 {
+		fmt.Printf("Minimum version: %s\n", list.MinimumVersion)
+	}
+	for name, percent := range list.Rollouts {
+		fmt.Printf("Rollout: %s to %g%% of machines\n", name, percent)
+	}
+	names := make([]string, 0, len(list.Files))
+	for name := range list.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hash := list.Files[name]
+		fmt.Printf("%s  %s\n", hex.EncodeToString(hash[:]), name)
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "generate":
+		err = cmdGenerate(os.Args[2:])
+	case "list":
+		err = cmdList(os.Args[2:])
+	case "sign":
+		err = cmdSign(os.Args[2:])
+	case "verify":
+		err = cmdVerify(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
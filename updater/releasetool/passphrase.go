@@ -0,0 +1,53 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// readPassphrase asks for a passphrase on the terminal rather than standard input, which may be
+// carrying the list being signed, and asks again to confirm it if confirm is set.
+func readPassphrase(prompt string, confirm bool) ([]byte, error) {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	tty, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open terminal to ask for passphrase: %w", err)
+	}
+	defer tty.Close()
+	read := func(prompt string) ([]byte, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		passphrase, err := terminal.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return passphrase, err
+	}
+	passphrase, err := read(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("Passphrase is empty")
+	}
+	if confirm {
+		again, err := read("Confirm passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("Passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
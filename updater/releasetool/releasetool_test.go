@@ -0,0 +1,147 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"golang.zx2c4.com/wireguard/windows/updater"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	publicFile, secretFile, err := generateKey("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPath := filepath.Join(dir, "test.pub")
+	secretPath := filepath.Join(dir, "test.sec")
+	ioutil.WriteFile(publicPath, publicFile, 0644)
+	ioutil.WriteFile(secretPath, secretFile, 0600)
+
+	dist := t.TempDir()
+	packages := map[string][]byte{
+		"wireguard-amd64-0.3.2.msi":               []byte("amd64 package"),
+		"wireguard-x86-0.3.2.msi":                 []byte("x86 package"),
+		"wireguard-amd64-0.3.2-from-0.3.1.bsdiff": []byte("patch"),
+	}
+	for name, contents := range packages {
+		err = ioutil.WriteFile(filepath.Join(dist, name), contents, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dist, "README"), []byte("not a package"), 0644)
+
+	issuedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	list, err := makeList(dist, issuedAt, issuedAt.Add(time.Hour*24*14), "0.3.1", []string{"wireguard-amd64-0.3.2.msi:12.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := readSecretKey(secretPath, func() ([]byte, error) {
+		t.Error("Asked for the passphrase of an unencrypted key")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedKey, err := readPublicKey(publicPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := signEmbedded(key, "verify with test.pub", list)
+
+	verified, err := updater.VerifySignedList(signed, []string{trustedKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verified.Files) != len(packages) {
+		t.Errorf("Signed list has %d files, want %d", len(verified.Files), len(packages))
+	}
+	for name, contents := range packages {
+		if verified.Files[name] != blake2b.Sum256(contents) {
+			t.Errorf("Signed list has the wrong hash for %s", name)
+		}
+	}
+	if verified.KeyID != key.keyNumber || !verified.IssuedAt.Equal(issuedAt) || verified.MinimumVersion != "0.3.1" || verified.Rollouts["wireguard-amd64-0.3.2.msi"] != 12.5 {
+		t.Errorf("Signed list has the wrong metadata: %+v", verified)
+	}
+
+	tampered := bytes.Replace(signed, []byte("0.3.1"), []byte("0.3.0"), 1)
+	_, err = updater.VerifySignedList(tampered, []string{trustedKey})
+	if err == nil {
+		t.Error("Tampered list verified")
+	}
+}
+
+func TestEncryptedKey(t *testing.T) {
+	dir := t.TempDir()
+	publicFile, secretFile, err := generateKey("test", []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPath := filepath.Join(dir, "test.pub")
+	secretPath := filepath.Join(dir, "test.sec")
+	ioutil.WriteFile(publicPath, publicFile, 0644)
+	ioutil.WriteFile(secretPath, secretFile, 0600)
+
+	_, err = readSecretKey(secretPath, func() ([]byte, error) { return []byte("battery staple"), nil })
+	if err == nil {
+		t.Error("Secret key decrypted with the wrong passphrase")
+	}
+	key, err := readSecretKey(secretPath, func() ([]byte, error) { return []byte("correct horse"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedKey, err := readPublicKey(publicPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []byte(fmt.Sprintf("%064d  wireguard-amd64-0.3.2.msi\n", 0))
+	_, err = updater.VerifySignedList(signEmbedded(key, "verify with test.pub", list), []string{trustedKey})
+	if err != nil {
+		t.Errorf("List signed with decrypted key did not verify: %v", err)
+	}
+}
+
+func TestReadPublicKey(t *testing.T) {
+	// This is the format of the release public key, as generated by signify itself.
+	path := filepath.Join(t.TempDir(), "release.pub")
+	ioutil.WriteFile(path, []byte("untrusted comment: signify public key\nRWRNqGKtBXftKTKPpBPGDMe8jHLnFQ0EdRy8Wg0apV6vTDFLAODD83G4\n"), 0644)
+	key, err := readPublicKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "RWRNqGKtBXftKTKPpBPGDMe8jHLnFQ0EdRy8Wg0apV6vTDFLAODD83G4" {
+		t.Errorf("Public key read as %s", key)
+	}
+}
+
+func TestBcryptPBKDF(t *testing.T) {
+	// These vectors come from OpenBSD's bcrypt_pbkdf.
+	for _, test := range []struct {
+		rounds           int
+		passphrase, salt string
+		key              string
+	}{
+		{12, "password", "salt", "1ae42c05d487bc02f64921a4ebe4ea93bcacfe135fda99974c06b7b01fae149a"},
+		{3, "passwordy\x00PASSWORD\x00", "salty\x00SALT\x00", "7f310bd3e78c3280c59ce4595211a2928e8d4ec744c1ed2efc9f764e3388e0ad"},
+		{8, "секретное слово", "посолить немножко", "8df43fc6fe131fc47f0c9e39224bd94c70b6fcc8ee8135faddf61156e6cb2733ea765f315a3e1e4afc35bf8687d189254c1e05a6fe80c0617f9183d67260d6a115c6c94e3603e2303fbb43a76a64523ffda686b1d4518543"},
+	} {
+		key := bcryptPBKDF([]byte(test.passphrase), []byte(test.salt), test.rounds, len(test.key)/2)
+		if hex.EncodeToString(key) != test.key {
+			t.Errorf("Key for %q is %x, want %s", test.passphrase, key, test.key)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+ * These are the formats from OpenBSD's signify, each of which is stored as an untrusted comment
+ * line followed by a base64 line:
+ *
+ *   public key: "Ed" || key number[8] || public key[32]
+ *   secret key: "Ed" || "BK" || kdf rounds[4, big endian] || salt[16] || checksum[8] || key number[8] || secret key[64]
+ *   signature:  "Ed" || key number[8] || signature[64]
+ *
+ * The checksum is the first 8 bytes of the SHA-512 of the secret key. Unless there are zero kdf
+ * rounds, as made by signify -G -n, the secret key is encrypted by XORing it with the output of
+ * bcrypt_pbkdf over the passphrase and salt.
+ */
+
+const (
+	commentPrefix   = "untrusted comment: "
+	publicKeySize   = 2 + 8 + ed25519.PublicKeySize
+	secretKeySize   = 2 + 2 + 4 + 16 + 8 + 8 + ed25519.PrivateKeySize
+	keyNumberOffset = 2 + 2 + 4 + 16 + 8
+	saltOffset      = 2 + 2 + 4
+
+	// kdfRounds is what signify uses for keys it encrypts.
+	kdfRounds = 42
+)
+
+type secretKey struct {
+	keyNumber  [8]byte
+	privateKey ed25519.PrivateKey
+}
+
+func encodeFile(comment string, contents []byte) []byte {
+	return []byte(commentPrefix + comment + "\n" + base64.StdEncoding.EncodeToString(contents) + "\n")
+}
+
+func decodeFile(file []byte, size int) ([]byte, error) {
+	lines := strings.SplitN(string(file), "\n", 3)
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], commentPrefix) {
+		return nil, errors.New("File is missing untrusted comment")
+	}
+	contents, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil {
+		return nil, errors.New("File is not valid base64")
+	}
+	if len(contents) != size || contents[0] != 'E' || contents[1] != 'd' {
+		return nil, errors.New("File has incorrect length or type")
+	}
+	return contents, nil
+}
+
+// xorKDF encrypts or decrypts a secret key in place with the key derived from a passphrase.
+func xorKDF(privateKey []byte, passphrase []byte, salt []byte, rounds int) {
+	xorKey := bcryptPBKDF(passphrase, salt, rounds, len(privateKey))
+	for i := range privateKey {
+		privateKey[i] ^= xorKey[i]
+	}
+}
+
+// generateKey makes a key pair, encrypting the secret key with passphrase unless it is empty.
+func generateKey(comment string, passphrase []byte) (publicFile []byte, secretFile []byte, err error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	var keyNumber [8]byte
+	var salt [16]byte
+	_, err = rand.Read(keyNumber[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = rand.Read(salt[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	checksum := sha512.Sum512(privateKey)
+	rounds := 0
+	if len(passphrase) > 0 {
+		rounds = kdfRounds
+		xorKDF(privateKey, passphrase, salt[:], rounds)
+	}
+
+	var public bytes.Buffer
+	public.WriteString("Ed")
+	public.Write(keyNumber[:])
+	public.Write(publicKey)
+
+	var secret bytes.Buffer
+	secret.WriteString("EdBK")
+	binary.Write(&secret, binary.BigEndian, uint32(rounds))
+	secret.Write(salt[:])
+	secret.Write(checksum[:8])
+	secret.Write(keyNumber[:])
+	secret.Write(privateKey)
+
+	return encodeFile(comment+" public key", public.Bytes()), encodeFile(comment+" secret key", secret.Bytes()), nil
+}
+
+// readSecretKey reads a secret key, asking for its passphrase only if it is encrypted.
+func readSecretKey(path string, passphrase func() ([]byte, error)) (*secretKey, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := decodeFile(file, secretKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if contents[2] != 'B' || contents[3] != 'K' {
+		return nil, errors.New("Secret key has unknown kdf algorithm")
+	}
+	key := &secretKey{privateKey: ed25519.PrivateKey(contents[keyNumberOffset+8:])}
+	copy(key.keyNumber[:], contents[keyNumberOffset:keyNumberOffset+8])
+	rounds := binary.BigEndian.Uint32(contents[4:saltOffset])
+	if rounds > 0 {
+		secret, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		xorKDF(key.privateKey, secret, contents[saltOffset:saltOffset+16], int(rounds))
+	}
+	checksum := sha512.Sum512(key.privateKey)
+	if !bytes.Equal(checksum[:8], contents[keyNumberOffset-8:keyNumberOffset]) {
+		if rounds > 0 {
+			return nil, errors.New("Passphrase is incorrect")
+		}
+		return nil, errors.New("Secret key checksum is incorrect")
+	}
+	return key, nil
+}
+
+// readPublicKey returns the base64 line of a public key file, which is what the updater trusts.
+func readPublicKey(path string) (string, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	contents, err := decodeFile(file, publicKeySize)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(contents), nil
+}
+
+// signEmbedded produces the output of signify -S -e, which is the signature file followed by the
+// message itself.
+func signEmbedded(key *secretKey, comment string, message []byte) []byte {
+	var signature bytes.Buffer
+	signature.WriteString("Ed")
+	signature.Write(key.keyNumber[:])
+	signature.Write(ed25519.Sign(key.privateKey, message))
+	return append(encodeFile(comment, signature.Bytes()), message...)
+}
+
+func keyNumberString(keyNumber [8]byte) string {
+	return fmt.Sprintf("%x", keyNumber[:])
+}
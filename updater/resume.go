@@ -0,0 +1,286 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"crypto/hmac"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// downloadCheckpoint is how much of the temporary file is known to be good, along with the
+// BLAKE2b state after hashing exactly those bytes and the validator the server gave for them.
+// Every attempt begins by restoring it, so that the hash never disagrees with the file.
+type downloadCheckpoint struct {
+	offset    uint64
+	total     uint64
+	hashState []byte
+	validator string
+	resumed   bool
+}
+
+func (cp *downloadCheckpoint) reset() {
+	*cp = downloadCheckpoint{}
+}
+
+func (cp *downloadCheckpoint) restore(file *os.File) (hash.Hash, error) {
+	hasher, err := blake2b.New256(nil)
+	if err != nil {
+		return nil, err
+	}
+	if cp.offset > 0 {
+		unmarshaler, ok := hasher.(encoding.BinaryUnmarshaler)
+		if !ok || unmarshaler.UnmarshalBinary(cp.hashState) != nil {
+			cp.reset()
+			hasher.Reset()
+		}
+	}
+	err = file.Truncate(int64(cp.offset))
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(int64(cp.offset), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return hasher, nil
+}
+
+func (cp *downloadCheckpoint) save(hasher hash.Hash, offset uint64) error {
+	marshaler, ok := hasher.(encoding.BinaryMarshaler)
+	if !ok {
+		return errors.New("Hash state cannot be saved")
+	}
+	hashState, err := marshaler.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	cp.offset = offset
+	cp.hashState = hashState
+	return nil
+}
+
+func (cp *downloadCheckpoint) sum() ([]byte, error) {
+	hasher, err := blake2b.New256(nil)
+	if err != nil {
+		return nil, err
+	}
+	if cp.offset > 0 {
+		err = hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(cp.hashState)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hasher.Sum(nil), nil
+}
+
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("Unable to download update: %s", e.status)
+}
+
+var (
+	errWrongHash = errors.New("The downloaded update has the wrong hash")
+	errTooLarge  = errors.New("The update is too large")
+)
+
+// retryable says whether an error is worth trying the same mirror again for, rather than moving
+// on to the next one.
+func retryable(err error) bool {
+	if errors.Is(err, errWrongHash) || errors.Is(err, errTooLarge) || errors.Is(err, ErrProxyAuthentication) || errors.Is(err, ErrCertificate) || errors.Is(err, ErrPinMismatch) {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code == http.StatusRequestTimeout || statusErr.code == http.StatusTooManyRequests || statusErr.code >= 500
+	}
+	return true
+}
+
+func (u *Updater) downloadBackoff(attempt int) time.Duration {
+	d := u.RetryDelay
+	if d <= 0 {
+		d = defaultRetryDelay
+	}
+	d <<= uint(attempt)
+	if d <= 0 || d > time.Second*maxDownloadBackoff {
+		d = time.Second * maxDownloadBackoff
+	}
+	return d/2 + randomDuration(d/2+1)
+}
+
+// parseContentRange parses "bytes first-last/total", where total may be "*".
+func parseContentRange(header string) (first, total uint64, err error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, errors.New("Content-Range is not in bytes")
+	}
+	slash := strings.IndexByte(header, '/')
+	dash := strings.IndexByte(header, '-')
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, errors.New("Content-Range is malformed")
+	}
+	first, err = strconv.ParseUint(header[6:dash], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if header[slash+1:] != "*" {
+		total, err = strconv.ParseUint(header[slash+1:], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return first, total, nil
+}
+
+func (dp *DownloadProgress) updateRate(since time.Time, bytesAtStart uint64) {
+	elapsed := time.Since(since)
+	if elapsed < time.Second {
+		return
+	}
+	dp.BytesPerSecond = uint64(float64(dp.BytesDownloaded-bytesAtStart) / elapsed.Seconds())
+	if dp.BytesPerSecond > 0 && dp.BytesTotal > dp.BytesDownloaded {
+		dp.ETA = time.Duration(float64(dp.BytesTotal-dp.BytesDownloaded) / float64(dp.BytesPerSecond) * float64(time.Second))
+	} else {
+		dp.ETA = 0
+	}
+}
+
+// downloadAttempt makes one request for the update, asking for a range starting at the checkpoint
+// if there is one, and appends whatever arrives to the file.
+func (u *Updater) downloadAttempt(url string, cp *downloadCheckpoint, file *os.File, dp *DownloadProgress, progress chan DownloadProgress) error {
+	hasher, err := cp.restore(file)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept-Encoding", "identity")
+	if cp.offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", cp.offset))
+		if len(cp.validator) > 0 {
+			request.Header.Set("If-Range", cp.validator)
+		}
+	}
+	response, err := u.do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		first, total, err := parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil || first != cp.offset || (cp.total > 0 && total != cp.total) {
+			cp.reset()
+			return errors.New("Server resumed the download at the wrong place")
+		}
+		cp.resumed = cp.offset > 0
+		if cp.total == 0 {
+			cp.total = total
+		}
+	case http.StatusOK:
+		// Either the server doesn't do ranges or the file changed underneath us, so start over.
+		if cp.offset > 0 {
+			cp.reset()
+			hasher, err = cp.restore(file)
+			if err != nil {
+				return err
+			}
+		}
+		if response.ContentLength >= 0 {
+			cp.total = uint64(response.ContentLength)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		cp.reset()
+		return errors.New("Server could not resume the download")
+	default:
+		return &httpStatusError{response.StatusCode, response.Status}
+	}
+	if cp.total > maxUpdateSize {
+		return errTooLarge
+	}
+	if etag := response.Header.Get("ETag"); len(etag) > 0 && !strings.HasPrefix(etag, "W/") {
+		cp.validator = etag
+	} else {
+		cp.validator = response.Header.Get("Last-Modified")
+	}
+
+	dp.BytesDownloaded = cp.offset
+	dp.BytesTotal = cp.total
+	progress <- *dp
+	pm := &progressHashWatcher{dp: dp, c: progress, hashState: hasher, started: time.Now(), bytesAtStart: cp.offset}
+	// The file is written before the hash, so that after a failed write the hash covers no more
+	// than what made it to disk, and the checkpoint can then truncate away any partial write.
+	_, err = io.Copy(io.MultiWriter(file, pm), io.LimitReader(response.Body, int64(maxUpdateSize-cp.offset)))
+	saveErr := cp.save(hasher, dp.BytesDownloaded)
+	if err != nil {
+		return err
+	}
+	if saveErr != nil {
+		return saveErr
+	}
+	if cp.total > 0 && cp.offset != cp.total {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// downloadFromMirror downloads a file from the signed list into file, resuming with ranges after
+// interruptions and backing off exponentially with jitter between attempts.
+func (u *Updater) downloadFromMirror(baseURL string, name string, expectedHash [blake2b.Size256]byte, file *os.File, dp *DownloadProgress, progress chan DownloadProgress) error {
+	url := joinURL(baseURL, name)
+	dp.Activity = fmt.Sprintf("Downloading %s from %s", name, baseURL)
+	cp := &downloadCheckpoint{}
+	for attempt := 0; ; attempt++ {
+		err := u.downloadAttempt(url, cp, file, dp, progress)
+		if err == nil {
+			var sum []byte
+			sum, err = cp.sum()
+			if err != nil {
+				return err
+			}
+			if hmac.Equal(sum, expectedHash[:]) {
+				return nil
+			}
+			if !cp.resumed {
+				return errWrongHash
+			}
+			// A resume may have spliced together pieces of two different files, if the server
+			// ignored If-Range, so give it one more chance from the beginning.
+			cp.reset()
+			err = errors.New("The resumed download has the wrong hash")
+		}
+		if !retryable(err) || attempt+1 >= maxDownloadAttempts {
+			return err
+		}
+		delay := u.downloadBackoff(attempt)
+		dp.Retries++
+		dp.BytesPerSecond = 0
+		dp.ETA = 0
+		progress <- DownloadProgress{
+			Activity:        fmt.Sprintf("Download interrupted (%v), retrying in %v", err, delay.Round(time.Second/10)),
+			BytesDownloaded: cp.offset,
+			BytesTotal:      cp.total,
+			Retries:         dp.Retries,
+		}
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	installIDSize  = 16
+	rolloutBuckets = 10000
+)
+
+// installID returns this machine's random identifier, creating and persisting it on first use. It
+// never leaves the machine, and is only used to decide where the machine falls in rollouts.
+func (u *Updater) installID() ([]byte, error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state := u.loadPersistentState()
+	id, err := hex.DecodeString(state.InstallID)
+	if err == nil && len(id) == installIDSize {
+		return id, nil
+	}
+	id = make([]byte, installIDSize)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	state.InstallID = hex.EncodeToString(id)
+	err = u.savePersistentState(&state)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// rolloutBucket places a machine in one of rolloutBuckets buckets for a given package. The package
+// name is mixed in so that it isn't always the same machines who go first.
+func rolloutBucket(installID []byte, name string) uint32 {
+	hasher, _ := blake2b.New256(installID)
+	hasher.Write([]byte(name))
+	return uint32(binary.LittleEndian.Uint64(hasher.Sum(nil)[:8]) % rolloutBuckets)
+}
+
+func bucketInRollout(bucket uint32, percent float64) bool {
+	return float64(bucket) < math.Round(percent*rolloutBuckets/100)
+}
+
+// inRollout says whether this machine should consider a package yet. Packages without a rollout
+// percentage are available to everyone.
+func (u *Updater) inRollout(name string, rollouts map[string]float64) (bool, error) {
+	percent, ok := rollouts[name]
+	if !ok {
+		return true, nil
+	}
+	id, err := u.installID()
+	if err != nil {
+		return false, err
+	}
+	return bucketInRollout(rolloutBucket(id, name), percent), nil
+}
@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultCheckInterval = time.Hour
+	defaultRetryInterval = time.Minute * 25
+	minimumCheckInterval = time.Minute * 5
+	maximumCheckInterval = time.Hour * 24 * 7
+	maximumStartupDelay  = time.Minute * 5
+)
+
+// randomDuration returns a uniformly random duration in [0, d). It uses crypto/rand, because
+// math/rand is seeded the same way everywhere, which would keep machines in lockstep.
+func randomDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return time.Duration(binary.LittleEndian.Uint64(b[:]) % uint64(d))
+}
+
+func parseInterval(name, s string, fallback time.Duration) (time.Duration, error) {
+	if len(s) == 0 {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < minimumCheckInterval || d > maximumCheckInterval {
+		return 0, fmt.Errorf("%s must be a duration between %v and %v", name, minimumCheckInterval, maximumCheckInterval)
+	}
+	return d, nil
+}
+
+// NextCheck returns how long to wait before checking for updates again, which is the interval
+// configured for whether or not the last check failed, give or take a quarter, so that machines
+// which happened to check at the same time drift apart.
+func (config *Config) NextCheck(failed bool) time.Duration {
+	var d time.Duration
+	if failed {
+		d, _ = parseInterval("RetryInterval", config.RetryInterval, defaultRetryInterval)
+	} else {
+		d, _ = parseInterval("CheckInterval", config.CheckInterval, defaultCheckInterval)
+	}
+	if d == 0 {
+		d = defaultCheckInterval
+	}
+	return d*3/4 + randomDuration(d/2)
+}
+
+// StartupDelay returns how long to wait before the first check, so that a fleet of machines booted
+// at the same time doesn't check at the same time.
+func StartupDelay() time.Duration {
+	return randomDuration(maximumStartupDelay)
+}
@@ -11,41 +11,137 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/blake2b"
 )
 
 /*
- * Generate with:
- *   $ b2sum -l 256 *.msi > list
+ * Generate with updater/releasetool, which needs nothing outside of this repository, or with:
+ *   $ b2sum -l 256 *.msi *.bsdiff > list
+ *   $ printf '%064d  !issued-at=%s\n' 0 "$(date -u +%Y-%m-%dT%H:%M:%SZ)" >> list
+ *   $ printf '%064d  !expires=%s\n' 0 "$(date -u -d +14days +%Y-%m-%dT%H:%M:%SZ)" >> list
+ *   $ printf '%064d  !minimum-version=%s\n' 0 0.3.1 >> list
+ *   $ printf '%064d  !rollout=%s:%s\n' 0 wireguard-amd64-0.3.2.msi 10 >> list
  *   $ signify -S -e -s release.sec -m list
  *   $ upload ./list.sec
+ *
+ * Metadata lines are dressed up as file hashes of all zeros with names beginning with '!',
+ * which no package name does, so that older clients that don't know about them simply ignore
+ * them as packages for some other architecture. Likewise, delta patches are named
+ * wireguard-$arch-$version-from-$previous.bsdiff, which doesn't end in .msi.
  */
 
 type fileList map[string][blake2b.Size256]byte
 
-func readFileList(input []byte) (fileList, error) {
-	publicKeyBytes, err := base64.StdEncoding.DecodeString(releasePublicKeyBase64)
-	if err != nil || len(publicKeyBytes) != ed25519.PublicKeySize+10 || publicKeyBytes[0] != 'E' || publicKeyBytes[1] != 'd' {
-		return nil, errors.New("Invalid public key")
+type listMetadata struct {
+	keyID          [8]byte
+	issuedAt       time.Time
+	expires        time.Time
+	minimumVersion string
+
+	// rollouts maps package names to the percentage of machines that should consider them.
+	rollouts map[string]float64
+}
+
+type trustedKey struct {
+	id        [8]byte
+	publicKey ed25519.PublicKey
+}
+
+// parseTrustedKeys decodes signify public keys, each of which is "Ed", then an 8 byte key ID,
+// and then the Ed25519 public key itself.
+func parseTrustedKeys(trustedKeys []string) ([]trustedKey, error) {
+	keys := make([]trustedKey, 0, len(trustedKeys))
+	for _, trustedKeyBase64 := range trustedKeys {
+		keyBytes, err := base64.StdEncoding.DecodeString(trustedKeyBase64)
+		if err != nil || len(keyBytes) != ed25519.PublicKeySize+10 || keyBytes[0] != 'E' || keyBytes[1] != 'd' {
+			return nil, errors.New("Invalid public key")
+		}
+		var key trustedKey
+		copy(key.id[:], keyBytes[2:10])
+		for _, other := range keys {
+			if other.id == key.id {
+				return nil, fmt.Errorf("Duplicate public key ID %x", key.id)
+			}
+		}
+		key.publicKey = ed25519.PublicKey(keyBytes[10:])
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("No trusted public keys")
+	}
+	return keys, nil
+}
+
+func parseMetadataLine(metadata *listMetadata, line string) error {
+	components := strings.SplitN(line, "=", 2)
+	if len(components) != 2 {
+		return errors.New("Metadata line is missing a value")
+	}
+	var err error
+	switch components[0] {
+	case "issued-at":
+		metadata.issuedAt, err = time.Parse(time.RFC3339, components[1])
+	case "expires":
+		metadata.expires, err = time.Parse(time.RFC3339, components[1])
+	case "minimum-version":
+		metadata.minimumVersion = components[1]
+	case "rollout":
+		separator := strings.LastIndexByte(components[1], ':')
+		if separator < 0 {
+			return errors.New("Rollout is missing a percentage")
+		}
+		var percent float64
+		percent, err = strconv.ParseFloat(components[1][separator+1:], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return errors.New("Rollout percentage is invalid")
+		}
+		if metadata.rollouts == nil {
+			metadata.rollouts = make(map[string]float64)
+		}
+		metadata.rollouts[components[1][:separator]] = percent
+	}
+	// Unknown metadata is ignored, so that it can be added without breaking older clients.
+	return err
+}
+
+func readFileList(input []byte, trustedKeys []string) (fileList, *listMetadata, error) {
+	keys, err := parseTrustedKeys(trustedKeys)
+	if err != nil {
+		return nil, nil, err
 	}
 	lines := bytes.SplitN(input, []byte{'\n'}, 3)
 	if len(lines) != 3 {
-		return nil, errors.New("Signature input has too few lines")
+		return nil, nil, errors.New("Signature input has too few lines")
 	}
 	if !bytes.HasPrefix(lines[0], []byte("untrusted comment: ")) {
-		return nil, errors.New("Signature input is missing untrusted comment")
+		return nil, nil, errors.New("Signature input is missing untrusted comment")
 	}
 	signatureBytes, err := base64.StdEncoding.DecodeString(string(lines[1]))
 	if err != nil {
-		return nil, errors.New("Signature input is not valid base64")
+		return nil, nil, errors.New("Signature input is not valid base64")
+	}
+	if len(signatureBytes) != ed25519.SignatureSize+10 || signatureBytes[0] != 'E' || signatureBytes[1] != 'd' {
+		return nil, nil, errors.New("Signature input bytes are incorrect length or type")
+	}
+	metadata := &listMetadata{}
+	copy(metadata.keyID[:], signatureBytes[2:10])
+	var publicKey ed25519.PublicKey
+	for _, key := range keys {
+		if key.id == metadata.keyID {
+			publicKey = key.publicKey
+			break
+		}
 	}
-	if len(signatureBytes) != ed25519.SignatureSize+10 || !bytes.Equal(signatureBytes[:10], publicKeyBytes[:10]) {
-		return nil, errors.New("Signature input bytes are incorrect length, type, or keyid")
+	if publicKey == nil {
+		return nil, nil, fmt.Errorf("Signature is by untrusted key ID %x", metadata.keyID)
 	}
-	if !ed25519.Verify(publicKeyBytes[10:], lines[2], signatureBytes[10:]) {
-		return nil, errors.New("Signature is invalid")
+	if !ed25519.Verify(publicKey, lines[2], signatureBytes[10:]) {
+		return nil, nil, errors.New("Signature is invalid")
 	}
 	fileLines := strings.Split(string(lines[2]), "\n")
 	fileHashes := make(map[string][blake2b.Size256]byte, len(fileLines))
@@ -55,18 +151,52 @@ func readFileList(input []byte) (fileList, error) {
 		}
 		components := strings.SplitN(line, "  ", 2)
 		if len(components) != 2 {
-			return nil, errors.New("File hash line has too few components")
+			return nil, nil, errors.New("File hash line has too few components")
 		}
 		maybeHash, err := hex.DecodeString(components[0])
 		if err != nil || len(maybeHash) != blake2b.Size256 {
-			return nil, errors.New("File hash is invalid base64 or incorrect number of bytes")
+			return nil, nil, errors.New("File hash is invalid base64 or incorrect number of bytes")
+		}
+		if strings.HasPrefix(components[1], "!") {
+			err = parseMetadataLine(metadata, components[1][1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
 		}
 		var hash [blake2b.Size256]byte
 		copy(hash[:], maybeHash)
 		fileHashes[components[1]] = hash
 	}
 	if len(fileHashes) == 0 {
-		return nil, errors.New("No file hashes found in signed input")
+		return nil, nil, errors.New("No file hashes found in signed input")
+	}
+	return fileHashes, metadata, nil
+}
+
+// SignedList is the verified contents of a signed list, for use by release tooling.
+type SignedList struct {
+	Files          map[string][blake2b.Size256]byte
+	KeyID          [8]byte
+	IssuedAt       time.Time
+	Expires        time.Time
+	MinimumVersion string
+	Rollouts       map[string]float64
+}
+
+// VerifySignedList checks a signed list against the trusted keys in exactly the way that the
+// updater does, except that it does not check freshness.
+func VerifySignedList(input []byte, trustedKeys []string) (*SignedList, error) {
+	files, metadata, err := readFileList(input, trustedKeys)
+	if err != nil {
+		return nil, err
 	}
-	return fileHashes, nil
+	return &SignedList{
+		Files:          files,
+		KeyID:          metadata.keyID,
+		IssuedAt:       metadata.issuedAt,
+		Expires:        metadata.expires,
+		MinimumVersion: metadata.minimumVersion,
+		Rollouts:       metadata.rollouts,
+	}, nil
 }
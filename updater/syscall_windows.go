@@ -17,3 +17,29 @@ func isWow64Process2(process windows.Handle) (processMachine, nativeMachine uint
 	err = isWow64Process2Internal(process, &processMachine, &nativeMachine)
 	return
 }
+
+//sys	globalFree(hmem uintptr) (handle uintptr, err error) [failretval!=0] = kernel32.GlobalFree
+//sys	winHttpOpen(userAgent *uint16, accessType uint32, proxy *uint16, proxyBypass *uint16, flags uint32) (handle windows.Handle, err error) [failretval==0] = winhttp.WinHttpOpen
+//sys	winHttpCloseHandle(handle windows.Handle) (err error) = winhttp.WinHttpCloseHandle
+//sys	winHttpGetProxyForUrl(session windows.Handle, url *uint16, autoProxyOptions *winHttpAutoProxyOptions, proxyInfo *winHttpProxyInfo) (err error) = winhttp.WinHttpGetProxyForUrl
+
+const (
+	winHttpAccessTypeNoProxy    = 1
+	winHttpAccessTypeNamedProxy = 3
+	winHttpAutoProxyConfigURL   = 0x00000002
+)
+
+type winHttpAutoProxyOptions struct {
+	flags                 uint32
+	autoDetectFlags       uint32
+	autoConfigURL         *uint16
+	reserved1             uintptr
+	reserved2             uint32
+	autoLogonIfChallenged int32
+}
+
+type winHttpProxyInfo struct {
+	accessType  uint32
+	proxy       *uint16
+	proxyBypass *uint16
+}
@@ -0,0 +1,21 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"os"
+	"path/filepath"
+)
+
+func rootDirectory() (string, error) {
+	root := filepath.Join(os.TempDir(), "wireguard-updater")
+	return root, os.MkdirAll(root, 0700)
+}
+
+func runAsSystem(userToken uintptr, f func()) error {
+	f()
+	return nil
+}
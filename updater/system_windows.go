@@ -0,0 +1,27 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/elevate"
+)
+
+func rootDirectory() (string, error) {
+	return conf.RootDirectory()
+}
+
+// runAsSystem runs f as Local System when there is no user token to install with.
+func runAsSystem(userToken uintptr, f func()) error {
+	if userToken != 0 {
+		f()
+		return nil
+	}
+	return elevate.DoAsSystem(func() error {
+		f()
+		return nil
+	})
+}
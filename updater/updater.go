@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package updater
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/windows/version"
+)
+
+// Updater holds everything the update process takes from the outside world, so that it can be
+// pointed at something other than the real download server and the real installer.
+type Updater struct {
+	Client *http.Client
+	Config *Config
+
+	// Version and Arch describe the running installation, and select which packages apply.
+	Version string
+	Arch    string
+
+	// StateDirectory holds list freshness state and the package cache used for delta updates.
+	StateDirectory string
+
+	// Installer provides the file that a package is downloaded into, and verifies and installs it.
+	Installer Installer
+
+	// StallTimeout aborts a request that takes longer than this to produce minimumProgress bytes.
+	StallTimeout time.Duration
+
+	// RetryDelay is the delay before the first retry of a failed download, and doubles each time.
+	RetryDelay time.Duration
+}
+
+const (
+	defaultStallTimeout = time.Second * 60
+	defaultRetryDelay   = time.Second
+	minimumProgress     = 4096
+)
+
+var errStalled = errors.New("Server stopped sending data")
+
+// New returns an Updater for the running installation, configured by updater.json if present.
+func New() (*Updater, error) {
+	if !version.IsRunningOfficialVersion() {
+		return nil, errors.New("Build is not official, so updates are disabled")
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	arch, err := findArch()
+	if err != nil {
+		return nil, err
+	}
+	root, err := rootDirectory()
+	if err != nil {
+		return nil, err
+	}
+	transport, err := config.newTransport(http.DefaultTransport.(*http.Transport))
+	if err != nil {
+		return nil, err
+	}
+	return &Updater{
+		Client:         &http.Client{Transport: transport},
+		Config:         config,
+		Version:        version.Number,
+		Arch:           arch,
+		StateDirectory: root,
+		Installer:      msiInstaller{},
+		StallTimeout:   defaultStallTimeout,
+		RetryDelay:     defaultRetryDelay,
+	}, nil
+}
+
+// CheckForUpdate checks for an update for the running installation.
+func CheckForUpdate() (update *UpdateFound, source UpdateSource, err error) {
+	u, err := New()
+	if err != nil {
+		return nil, source, err
+	}
+	return u.CheckForUpdate()
+}
+
+// DownloadVerifyAndExecute updates the running installation.
+func DownloadVerifyAndExecute(userToken uintptr) (progress chan DownloadProgress) {
+	u, err := New()
+	if err != nil {
+		progress = make(chan DownloadProgress, 1)
+		progress <- DownloadProgress{Error: err}
+		return
+	}
+	return u.DownloadVerifyAndExecute(userToken)
+}
+
+// stallReader cancels its request when the body goes too long without producing a reasonable
+// number of bytes, so that a server which trickles data can't hold an update hostage forever.
+type stallReader struct {
+	io.ReadCloser
+	timer    *time.Timer
+	timeout  time.Duration
+	cancel   context.CancelFunc
+	stalled  *uint32
+	progress int
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && atomic.LoadUint32(r.stalled) != 0 {
+		err = errStalled
+	}
+	r.progress += n
+	if r.progress >= minimumProgress {
+		r.timer.Reset(r.timeout)
+		r.progress = 0
+	}
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.ReadCloser.Close()
+}
+
+func (u *Updater) do(request *http.Request) (*http.Response, error) {
+	request.Header.Set("User-Agent", version.UserAgent())
+	timeout := u.StallTimeout
+	if timeout <= 0 {
+		timeout = defaultStallTimeout
+	}
+	ctx, cancel := context.WithCancel(request.Context())
+	stalled := new(uint32)
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreUint32(stalled, 1)
+		cancel()
+	})
+	response, err := u.Client.Do(request.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		cancel()
+		if atomic.LoadUint32(stalled) != 0 {
+			err = errStalled
+		}
+		return nil, explainConnectionError(err)
+	}
+	response.Body = &stallReader{ReadCloser: response.Body, timer: timer, timeout: timeout, cancel: cancel, stalled: stalled}
+	return response, nil
+}
@@ -6,36 +6,1053 @@
 package updater
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
 )
 
-func TestUpdate(t *testing.T) {
-	update, err := CheckForUpdate()
+// testServer is a local stand-in for the download server, which signs lists with its own key.
+type testServer struct {
+	*httptest.Server
+	lock       sync.Mutex
+	handlers   map[string]http.HandlerFunc
+	privateKey ed25519.PrivateKey
+	publicKey  string
+	keyID      [8]byte
+	requests   map[string]int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{handlers: make(map[string]http.HandlerFunc), requests: make(map[string]int)}
+	s.publicKey, s.privateKey, s.keyID = newSignifyKey(t)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		s.lock.Lock()
+		handler := s.handlers[name]
+		s.requests[name]++
+		s.lock.Unlock()
+		if handler == nil {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newSignifyKey(t *testing.T) (publicKey string, privateKey ed25519.PrivateKey, keyID [8]byte) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
-	if update == nil {
-		t.Error("No update available")
-		return
+	rand.Read(keyID[:])
+	return base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID[:]...), public...)), private, keyID
+}
+
+func (s *testServer) handle(name string, handler http.HandlerFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handlers[name] = handler
+}
+
+func (s *testServer) serve(name string, contents []byte) {
+	s.handle(name, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(contents))
+	})
+}
+
+func (s *testServer) requestCount(name string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[name]
+}
+
+// signList signs a list of the given files and metadata lines with a key, in the format produced
+// by signify -S -e.
+func signList(privateKey ed25519.PrivateKey, keyID [8]byte, files map[string][]byte, metadata ...string) []byte {
+	var list bytes.Buffer
+	for name, contents := range files {
+		hash := blake2b.Sum256(contents)
+		fmt.Fprintf(&list, "%s  %s\n", hex.EncodeToString(hash[:]), name)
 	}
-	t.Log("Found update")
-	progress := DownloadVerifyAndExecute(0, nil)
-	for {
-		dp := <-progress
-		if dp.Error != nil {
-			t.Error(dp.Error)
-			return
-		}
+	for _, line := range metadata {
+		fmt.Fprintf(&list, "%064d  !%s\n", 0, line)
+	}
+	signature := ed25519.Sign(privateKey, list.Bytes())
+	return []byte(fmt.Sprintf("untrusted comment: verify with test.pub\n%s\n%s", base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID[:]...), signature...)), list.Bytes()))
+}
+
+func (s *testServer) serveList(files map[string][]byte, metadata ...string) {
+	s.serve(latestVersionFile, signList(s.privateKey, s.keyID, files, metadata...))
+}
+
+type installation struct {
+	path     string
+	contents []byte
+}
+
+// fakeInstaller downloads into a directory of its own, records what it is asked to do, and fails
+// at whichever step it is told to.
+type fakeInstaller struct {
+	directory  string
+	verifyErr  error
+	executeErr error
+	prepared   []string
+	installed  []installation
+	cleaned    []string
+}
+
+func (f *fakeInstaller) Prepare() (*os.File, error) {
+	file, err := ioutil.TempFile(f.directory, "")
+	if err == nil {
+		f.prepared = append(f.prepared, file.Name())
+	}
+	return file, err
+}
+
+func (f *fakeInstaller) Verify(path string) error {
+	return f.verifyErr
+}
+
+func (f *fakeInstaller) Execute(path string, userToken uintptr) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	f.installed = append(f.installed, installation{path, contents})
+	return f.executeErr
+}
+
+func (f *fakeInstaller) Cleanup(path string) {
+	os.Remove(path)
+	f.cleaned = append(f.cleaned, path)
+}
+
+func (s *testServer) updater(t *testing.T) (*Updater, *fakeInstaller) {
+	installer := &fakeInstaller{directory: t.TempDir()}
+	u := &Updater{
+		Client: s.Client(),
+		Config: &Config{
+			Channel:     defaultChannel,
+			BaseURLs:    []string{s.URL + "/"},
+			TrustedKeys: []string{s.publicKey},
+		},
+		Version:        "0.3.1",
+		Arch:           "amd64",
+		StateDirectory: t.TempDir(),
+		Installer:      installer,
+		StallTimeout:   time.Millisecond * 500,
+		RetryDelay:     time.Millisecond * 10,
+	}
+	return u, installer
+}
+
+func runUpdate(t *testing.T, u *Updater) error {
+	for dp := range u.DownloadVerifyAndExecute(1) {
 		if len(dp.Activity) > 0 {
 			t.Log(dp.Activity)
 		}
-		if dp.BytesTotal > 0 {
-			t.Logf("Downloaded %d of %d", dp.BytesDownloaded, dp.BytesTotal)
+		if dp.Error != nil {
+			return dp.Error
 		}
 		if dp.Complete {
-			t.Log("Complete!")
-			break
+			return nil
+		}
+	}
+	return nil
+}
+
+func randomPackage(t *testing.T, size int) []byte {
+	contents := make([]byte, size)
+	_, err := rand.Read(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestUpdate(t *testing.T) {
+	s := newTestServer(t)
+	msi := randomPackage(t, 1024*1024)
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi, "wireguard-x86-0.3.2.msi": nil}, "issued-at="+time.Now().UTC().Format(time.RFC3339))
+	s.serve("wireguard-amd64-0.3.2.msi", msi)
+	u, installer := s.updater(t)
+
+	update, source, err := u.CheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil || update.name != "wireguard-amd64-0.3.2.msi" || source.Mirror != s.URL+"/" {
+		t.Fatalf("Unexpected update %+v from %+v", update, source)
+	}
+	err = runUpdate(t, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(installer.installed) != 1 || !bytes.Equal(installer.installed[0].contents, msi) {
+		t.Fatal("Installer did not run with the downloaded package")
+	}
+	cached, err := ioutil.ReadFile(filepath.Join(u.StateDirectory, msiCacheDirectory, "wireguard-amd64-0.3.2.msi"))
+	if err != nil || !bytes.Equal(cached, msi) {
+		t.Errorf("Package was not cached for delta updates: %v", err)
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	s := newTestServer(t)
+	msi := randomPackage(t, 1024)
+	_, otherKey, otherKeyID := newSignifyKey(t)
+	s.serve(latestVersionFile, signList(otherKey, otherKeyID, map[string][]byte{"wireguard-amd64-0.3.2.msi": msi}))
+	s.serve("wireguard-amd64-0.3.2.msi", msi)
+	u, _ := s.updater(t)
+	_, _, err := u.CheckForUpdate()
+	if err == nil || !strings.Contains(err.Error(), "untrusted key") {
+		t.Errorf("List signed by an unknown key was accepted: %v", err)
+	}
+
+	// The right key ID with someone else's signature.
+	s.serve(latestVersionFile, signList(otherKey, s.keyID, map[string][]byte{"wireguard-amd64-0.3.2.msi": msi}))
+	_, _, err = u.CheckForUpdate()
+	if err == nil || !strings.Contains(err.Error(), "Signature is invalid") {
+		t.Errorf("List with a forged signature was accepted: %v", err)
+	}
+
+	// A valid list with its contents modified after signing.
+	list := signList(s.privateKey, s.keyID, map[string][]byte{"wireguard-amd64-0.3.2.msi": msi})
+	list = bytes.Replace(list, []byte("0.3.2"), []byte("0.3.3"), 1)
+	s.serve(latestVersionFile, list)
+	_, _, err = u.CheckForUpdate()
+	if err == nil {
+		t.Error("Modified list was accepted")
+	}
+}
+
+func TestWrongHash(t *testing.T) {
+	s := newTestServer(t)
+	msi := randomPackage(t, 1024*64)
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi})
+	s.serve("wireguard-amd64-0.3.2.msi", randomPackage(t, 1024*64))
+	u, installer := s.updater(t)
+	err := runUpdate(t, u)
+	if err == nil || !strings.Contains(err.Error(), "wrong hash") {
+		t.Errorf("Package with the wrong hash was accepted: %v", err)
+	}
+	if len(installer.installed) != 0 {
+		t.Error("Installer ran with a package that has the wrong hash")
+	}
+	if count := s.requestCount("wireguard-amd64-0.3.2.msi"); count != 1 {
+		t.Errorf("Package with the wrong hash was requested %d times, not once", count)
+	}
+}
+
+func TestOversize(t *testing.T) {
+	s := newTestServer(t)
+	s.serve(latestVersionFile, bytes.Repeat([]byte{'A'}, maxFileListSize+1))
+	u, installer := s.updater(t)
+	_, _, err := u.CheckForUpdate()
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("Oversize list was accepted: %v", err)
+	}
+
+	msi := randomPackage(t, 1024)
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi})
+	s.handle("wireguard-amd64-0.3.2.msi", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(maxUpdateSize+1))
+		w.WriteHeader(http.StatusOK)
+		w.Write(msi)
+	})
+	err = runUpdate(t, u)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("Oversize package was accepted: %v", err)
+	}
+	if len(installer.installed) != 0 {
+		t.Error("Installer ran with an oversize package")
+	}
+}
+
+func TestSlowLoris(t *testing.T) {
+	s := newTestServer(t)
+	msi := randomPackage(t, 1024*64)
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi})
+	done := make(chan struct{})
+	defer close(done)
+	s.handle("wireguard-amd64-0.3.2.msi", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(msi)))
+		w.WriteHeader(http.StatusOK)
+		for i := range msi {
+			w.Write(msi[i : i+1])
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(time.Millisecond * 10):
+			case <-r.Context().Done():
+				return
+			case <-done:
+				return
+			}
+		}
+	})
+	u, installer := s.updater(t)
+	start := time.Now()
+	err := runUpdate(t, u)
+	if err != errStalled {
+		t.Errorf("Trickled package was not rejected as stalled: %v", err)
+	}
+	if len(installer.installed) != 0 {
+		t.Error("Installer ran with a trickled package")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*maxDownloadAttempts {
+		t.Errorf("Slow server held the update for %v", elapsed)
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	s := newTestServer(t)
+	msi := randomPackage(t, 1024)
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.0.msi": msi, "wireguard-amd64-0.3.1.msi": msi})
+	s.serve("wireguard-amd64-0.3.0.msi", msi)
+	u, installer := s.updater(t)
+	update, _, err := u.CheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update != nil {
+		t.Errorf("Older version %s was offered as an update", update.name)
+	}
+	err = runUpdate(t, u)
+	if err == nil || len(installer.installed) != 0 {
+		t.Error("Older version was installed")
+	}
+
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.0.msi": msi})
+	u.Config.AllowDowngrade = true
+	update, _, err = u.CheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil || update.Version != "0.3.0" || !update.Downgrade {
+		t.Errorf("Allowed downgrade was not offered: %+v", update)
+	}
+	u.Config.AllowDowngrade = false
+
+	// Once a newer list has been seen, an older one must not be accepted again.
+	now := time.Now().UTC()
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.1.msi": msi}, "issued-at="+now.Format(time.RFC3339))
+	_, _, err = u.CheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi}, "issued-at="+now.Add(-time.Hour).Format(time.RFC3339))
+	_, _, err = u.CheckForUpdate()
+	if err == nil {
+		t.Error("Replayed older list was accepted")
+	}
+}
+
+func TestResume(t *testing.T) {
+	s := newTestServer(t)
+	msi := randomPackage(t, 1024*256)
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi})
+	var ranges []string
+	s.handle("wireguard-amd64-0.3.2.msi", func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			w.Header().Set("Content-Length", fmt.Sprint(len(msi)))
+			w.Header().Set("ETag", `"test"`)
+			w.WriteHeader(http.StatusOK)
+			w.Write(msi[:len(msi)/2])
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set("ETag", `"test"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(msi))
+	})
+	u, installer := s.updater(t)
+	err := runUpdate(t, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || !strings.HasPrefix(ranges[1], "bytes=") || strings.HasPrefix(ranges[1], "bytes=0-") {
+		t.Errorf("Download was not resumed: %q", ranges)
+	}
+	if len(installer.installed) != 1 || !bytes.Equal(installer.installed[0].contents, msi) {
+		t.Error("Installer did not run with the resumed package")
+	}
+}
+
+func TestDeltaFallback(t *testing.T) {
+	s := newTestServer(t)
+	msi := randomPackage(t, 1024*64)
+	patch := []byte("BSDIFF40 but not really")
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi, "wireguard-amd64-0.3.2-from-0.3.1.bsdiff": patch})
+	s.serve("wireguard-amd64-0.3.2.msi", msi)
+	s.serve("wireguard-amd64-0.3.2-from-0.3.1.bsdiff", patch)
+	u, installer := s.updater(t)
+	cache, err := u.msiCachePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(cache, "wireguard-amd64-0.3.1.msi"), randomPackage(t, 1024*64), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runUpdate(t, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.requestCount("wireguard-amd64-0.3.2-from-0.3.1.bsdiff") == 0 {
+		t.Error("Delta patch was not tried")
+	}
+	if len(installer.installed) != 1 || !bytes.Equal(installer.installed[0].contents, msi) {
+		t.Error("Installer did not run with the full package after the delta failed")
+	}
+}
+
+func TestCandidateSelection(t *testing.T) {
+	files := fileList{}
+	for _, name := range []string{
+		"wireguard-amd64-0.3.2.msi",
+		"wireguard-amd64-0.3.10.msi",
+		"wireguard-amd64-0.3.9.msi",
+		"wireguard-amd64-0.4.0-rc1.msi",
+		"wireguard-amd64-0.3.10-rc2.msi",
+		"wireguard-amd64-0.5.0.bsdiff",
+		"wireguard-amd64-not-a-version.msi",
+		"wireguard-arm64-0.9.0.msi",
+	} {
+		files[name] = blake2b.Sum256([]byte(name))
+	}
+	u := &Updater{Config: &Config{Channel: defaultChannel}, Version: "0.3.1", Arch: "amd64"}
+	for i := 0; i < 10; i++ {
+		update, _, err := u.findCandidate(files, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if update == nil || update.name != "wireguard-amd64-0.3.10.msi" {
+			t.Fatalf("Stable channel chose %+v, not the highest stable version", update)
 		}
 	}
+
+	u.Config.Channel = "beta"
+	update, _, err := u.findCandidate(files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil || update.Version != "0.4.0-rc1" {
+		t.Errorf("Beta channel chose %+v, not the highest pre-release", update)
+	}
+
+	// Going back to stable from a pre-release is a downgrade.
+	u.Config.Channel = defaultChannel
+	u.Version = "0.4.0-rc1"
+	update, _, err = u.findCandidate(files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update != nil {
+		t.Errorf("Downgrade to %s was offered without being allowed", update.Version)
+	}
+}
+
+func TestRolloutBucket(t *testing.T) {
+	id := make([]byte, installIDSize)
+	for i := range id {
+		id[i] = byte(i)
+	}
+	if bucket := rolloutBucket(id, "wireguard-amd64-0.3.3.msi"); bucket != 3269 {
+		t.Errorf("Bucket is %d, want 3269", bucket)
+	}
+	if bucketInRollout(3269, 32.69) || !bucketInRollout(3269, 32.7) {
+		t.Error("Rollout percentages with two decimal places are not exact")
+	}
+	included := 0
+	for i := 0; i < rolloutBuckets; i++ {
+		binary.LittleEndian.PutUint64(id, uint64(i))
+		if bucketInRollout(rolloutBucket(id, "wireguard-amd64-0.3.3.msi"), 25) {
+			included++
+		}
+	}
+	if included < rolloutBuckets*23/100 || included > rolloutBuckets*27/100 {
+		t.Errorf("A 25%% rollout included %d of %d machines", included, rolloutBuckets)
+	}
+	if bucketInRollout(0, 0) || !bucketInRollout(rolloutBuckets-1, 100) || !bucketInRollout(99, 1) || bucketInRollout(100, 1) {
+		t.Error("Rollout boundaries are wrong")
+	}
+}
+
+func TestRollout(t *testing.T) {
+	s := newTestServer(t)
+	u, _ := s.updater(t)
+	err := u.savePersistentState(&persistentState{InstallID: "000102030405060708090a0b0c0d0e0f"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := u.installID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := rolloutBucket(id, "wireguard-amd64-0.3.3.msi")
+	if bucket != 3269 {
+		t.Fatalf("Bucket is %d, want 3269", bucket)
+	}
+	justOutside := fmt.Sprintf("rollout=wireguard-amd64-0.3.3.msi:%g", float64(bucket)/100)
+	justInside := fmt.Sprintf("rollout=wireguard-amd64-0.3.3.msi:%g", float64(bucket+1)/100)
+	files := map[string][]byte{"wireguard-amd64-0.3.2.msi": []byte("0.3.2"), "wireguard-amd64-0.3.3.msi": []byte("0.3.3")}
+
+	for _, test := range []struct {
+		metadata string
+		version  string
+		heldBack string
+	}{
+		{"rollout=wireguard-amd64-0.3.3.msi:0", "0.3.2", "0.3.3"},
+		{justOutside, "0.3.2", "0.3.3"},
+		{justInside, "0.3.3", ""},
+		{"rollout=wireguard-amd64-0.3.3.msi:100", "0.3.3", ""},
+		{"rollout=wireguard-amd64-0.3.2.msi:0", "0.3.3", ""},
+	} {
+		// Each list must be newer than the last, or freshness checking rejects it.
+		s.serveList(files, test.metadata)
+		update, source, err := u.CheckForUpdate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if update == nil || update.Version != test.version || source.HeldBack != test.heldBack {
+			t.Errorf("With %s, got update %+v and held back %q, want %s and %q", test.metadata, update, source.HeldBack, test.version, test.heldBack)
+		}
+	}
+
+	// When nothing newer is in the rollout, there's no update, but the check says why.
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.3.msi": []byte("0.3.3")}, "rollout=wireguard-amd64-0.3.3.msi:0")
+	update, source, err := u.CheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update != nil || source.HeldBack != "0.3.3" {
+		t.Errorf("Got update %+v and held back %q, want none and 0.3.3", update, source.HeldBack)
+	}
+}
+
+func TestInstallID(t *testing.T) {
+	s := newTestServer(t)
+	u, _ := s.updater(t)
+	id, err := u.installID()
+	if err != nil || len(id) != installIDSize {
+		t.Fatalf("Install ID is %x: %v", id, err)
+	}
+	again, err := (&Updater{StateDirectory: u.StateDirectory}).installID()
+	if err != nil || !bytes.Equal(id, again) {
+		t.Error("Install ID was not persisted")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	// 2020-01-04 was a Saturday.
+	at := func(day int, clock string) time.Time {
+		parsed, _ := time.Parse("2006-01-02 15:04", fmt.Sprintf("2020-01-%02d %s", day, clock))
+		return parsed
+	}
+	policy := &Policy{
+		Mode:                PolicyModeAutomatic,
+		DeferDays:           2,
+		MaintenanceWindows:  []MaintenanceWindow{{Days: []string{"sat", "Sunday"}, Start: "23:00", End: "02:00"}},
+		NeverWhileConnected: true,
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	firstSeen := at(1, "12:00")
+	for _, test := range []struct {
+		now       time.Time
+		mandatory bool
+		running   bool
+		action    PolicyAction
+		notBefore time.Time
+	}{
+		{at(2, "12:00"), false, false, PolicyDeferred, at(3, "12:00")},
+		{at(2, "12:00"), true, false, PolicyScheduled, at(4, "23:00")},
+		{at(4, "22:59"), false, false, PolicyScheduled, at(4, "23:00")},
+		{at(4, "23:00"), false, false, PolicyInstall, time.Time{}},
+		{at(5, "01:59"), false, false, PolicyInstall, time.Time{}},
+		{at(6, "01:00"), false, false, PolicyInstall, time.Time{}},
+		{at(6, "02:00"), false, false, PolicyScheduled, at(11, "23:00")},
+		{at(5, "00:30"), false, true, PolicyBlocked, time.Time{}},
+	} {
+		decision := policy.Evaluate(test.now, firstSeen, test.mandatory, test.running)
+		if decision.Action != test.action || !decision.NotBefore.Equal(test.notBefore) {
+			t.Errorf("At %s, decided %+v, want %d until %s", test.now, decision, test.action, test.notBefore)
+		}
+	}
+	if (&Policy{}).Evaluate(at(4, "23:30"), firstSeen, true, false).Action != PolicyNotify {
+		t.Error("The default policy does not only notify")
+	}
+	for _, bad := range []Policy{
+		{Mode: "sometimes"},
+		{MaintenanceWindows: []MaintenanceWindow{{Start: "25:00", End: "02:00"}}},
+		{MaintenanceWindows: []MaintenanceWindow{{Days: []string{"someday"}, Start: "01:00", End: "02:00"}}},
+	} {
+		if bad.validate() == nil {
+			t.Errorf("Invalid policy %+v was accepted", bad)
+		}
+	}
+}
+
+func TestFirstSeen(t *testing.T) {
+	s := newTestServer(t)
+	u, _ := s.updater(t)
+	files := map[string][]byte{"wireguard-amd64-0.3.2.msi": nil}
+	s.serveList(files)
+	yesterday := time.Now().Add(-time.Hour * 24).Truncate(time.Second)
+	err := u.savePersistentState(&persistentState{Pending: "wireguard-amd64-0.3.2.msi", PendingSince: yesterday})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, _, err := u.CheckForUpdate()
+	if err != nil || update == nil || !update.FirstSeen.Equal(yesterday) {
+		t.Fatalf("Unexpected update %+v: %v", update, err)
+	}
+	files["wireguard-amd64-0.3.3.msi"] = nil
+	s.serveList(files)
+	newer, _, err := u.CheckForUpdate()
+	if err != nil || newer == nil || newer.Version != "0.3.3" || !newer.FirstSeen.After(yesterday) {
+		t.Errorf("Newer update %+v did not restart the clock: %v", newer, err)
+	}
+}
+
+func TestInstallerCleanup(t *testing.T) {
+	msi := randomPackage(t, 1024*64)
+	for _, test := range []struct {
+		name       string
+		serve      bool
+		verifyErr  error
+		executeErr error
+		installs   int
+	}{
+		{"success", true, nil, nil, 1},
+		{"download failure", false, nil, nil, 0},
+		{"verification failure", true, errors.New("Bad signature"), nil, 0},
+		{"installation failure", true, nil, errors.New("Installer failed"), 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi})
+			if test.serve {
+				s.serve("wireguard-amd64-0.3.2.msi", msi)
+			}
+			u, installer := s.updater(t)
+			installer.verifyErr = test.verifyErr
+			installer.executeErr = test.executeErr
+			err := runUpdate(t, u)
+			wantErr := test.verifyErr
+			if test.executeErr != nil {
+				wantErr = test.executeErr
+			}
+			if !test.serve {
+				if err == nil {
+					t.Error("Update succeeded without a package to download")
+				}
+			} else if err != wantErr {
+				t.Errorf("Update returned %v, want %v", err, wantErr)
+			}
+			if len(installer.installed) != test.installs {
+				t.Errorf("Installer ran %d times, want %d", len(installer.installed), test.installs)
+			}
+			if len(installer.prepared) != 1 || len(installer.cleaned) != 1 || installer.cleaned[0] != installer.prepared[0] {
+				t.Errorf("Prepared %v, but cleaned up %v", installer.prepared, installer.cleaned)
+			}
+			leftovers, _ := ioutil.ReadDir(installer.directory)
+			if len(leftovers) != 0 {
+				t.Errorf("%d temporary files were left behind", len(leftovers))
+			}
+		})
+	}
+}
+
+func (s *testServer) withConfig(t *testing.T, u *Updater, configure func(*Config)) {
+	configure(u.Config)
+	err := u.Config.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := u.Config.newTransport(s.Client().Transport.(*http.Transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Client = &http.Client{Transport: transport}
+}
+
+func TestPinnedKeys(t *testing.T) {
+	s := newTestServer(t)
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": nil})
+	spki := sha256.Sum256(s.Certificate().RawSubjectPublicKeyInfo)
+	u, _ := s.updater(t)
+	s.withConfig(t, u, func(config *Config) {
+		config.PinnedKeys = []string{base64.StdEncoding.EncodeToString(spki[:])}
+	})
+	update, _, err := u.CheckForUpdate()
+	if err != nil || update == nil {
+		t.Fatalf("Pinned server was rejected: %v", err)
+	}
+	u, _ = s.updater(t)
+	s.withConfig(t, u, func(config *Config) {
+		config.PinnedKeys = []string{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))}
+	})
+	_, _, err = u.CheckForUpdate()
+	if !errors.Is(err, ErrPinMismatch) {
+		t.Errorf("Server not matching the pin was accepted: %v", err)
+	}
+}
+
+// newTestProxy starts a proxy that only supports CONNECT, as is used for https, and requires basic
+// authentication as wireguard:secret.
+func newTestProxy(t *testing.T) *httptest.Server {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "Only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("wireguard:secret")) {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		client, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(upstream, buffered)
+		io.Copy(client, upstream)
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestProxy(t *testing.T) {
+	s := newTestServer(t)
+	msi := randomPackage(t, 1024*64)
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi})
+	s.serve("wireguard-amd64-0.3.2.msi", msi)
+	proxy := newTestProxy(t)
+
+	u, installer := s.updater(t)
+	s.withConfig(t, u, func(config *Config) {
+		config.Proxy = ProxyConfig{URL: proxy.URL, Username: "wireguard", Password: "secret"}
+	})
+	err := runUpdate(t, u)
+	if err != nil || len(installer.installed) != 1 {
+		t.Fatalf("Update through proxy failed: %v", err)
+	}
+
+	u, _ = s.updater(t)
+	s.withConfig(t, u, func(config *Config) {
+		config.Proxy = ProxyConfig{URL: proxy.URL, Username: "wireguard", Password: "wrong"}
+	})
+	_, _, err = u.CheckForUpdate()
+	if !errors.Is(err, ErrProxyAuthentication) {
+		t.Errorf("Proxy authentication failure was reported as %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	u, _ = s.updater(t)
+	s.withConfig(t, u, func(config *Config) {
+		config.Proxy = ProxyConfig{URL: "http://" + listener.Addr().String()}
+	})
+	_, _, err = u.CheckForUpdate()
+	if !errors.Is(err, ErrProxyUnreachable) {
+		t.Errorf("Unreachable proxy was reported as %v", err)
+	}
+}
+
+func TestAutoConfigProxyParsing(t *testing.T) {
+	for input, want := range map[string]string{
+		"":                              "",
+		"proxy.example.com:8080":        "http://proxy.example.com:8080",
+		"proxy1:8080; proxy2:3128":      "http://proxy1:8080",
+		"https=secure.example.com:8443": "http://secure.example.com:8443",
+	} {
+		u, err := parseAutoConfigProxy(input)
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if err != nil || got != want {
+			t.Errorf("parseAutoConfigProxy(%q) = %q, %v, want %q", input, got, err, want)
+		}
+	}
+}
+
+func TestListCache(t *testing.T) {
+	s := newTestServer(t)
+	list := signList(s.privateKey, s.keyID, map[string][]byte{"wireguard-amd64-0.3.2.msi": nil})
+	notModified := 0
+	s.handle(latestVersionFile, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"1"`)
+		if r.Header.Get("If-None-Match") == `"1"` {
+			notModified++
+		}
+		http.ServeContent(w, r, latestVersionFile, time.Time{}, bytes.NewReader(list))
+	})
+	u, _ := s.updater(t)
+	for i := 0; i < 3; i++ {
+		update, _, err := u.CheckForUpdate()
+		if err != nil || update == nil {
+			t.Fatalf("Check %d failed: %v", i, err)
+		}
+	}
+	if notModified != 2 {
+		t.Errorf("Server was asked for an unchanged list %d times, want 2", notModified)
+	}
+
+	listURL := joinURL(s.URL+"/", latestVersionFile)
+	err := ioutil.WriteFile(u.listCachePath(listURL), bytes.Replace(list, []byte("0.3.2"), []byte("0.3.9"), 1), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, _, err := u.CheckForUpdate()
+	if err != nil || update == nil || update.Version != "0.3.2" {
+		t.Fatalf("Tampered cache was not replaced: %+v, %v", update, err)
+	}
+	if s.requestCount(latestVersionFile) != 5 {
+		t.Errorf("List was requested %d times, want 5", s.requestCount(latestVersionFile))
+	}
+	cached, _ := u.cachedList(listURL)
+	if !bytes.Equal(cached, list) {
+		t.Error("Cache was not refreshed after failing verification")
+	}
+}
+
+func TestNextCheck(t *testing.T) {
+	config := &Config{CheckInterval: "4h"}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		check, retry := config.NextCheck(false), config.NextCheck(true)
+		if check < time.Hour*3 || check >= time.Hour*5 {
+			t.Errorf("Next check in %v is not near 4h", check)
+		}
+		if retry < defaultRetryInterval*3/4 || retry >= defaultRetryInterval*5/4 {
+			t.Errorf("Retry in %v is not near %v", retry, defaultRetryInterval)
+		}
+		seen[check] = true
+	}
+	if len(seen) < 90 {
+		t.Errorf("Only %d distinct delays were chosen", len(seen))
+	}
+	for _, bad := range []Config{{CheckInterval: "1m"}, {RetryInterval: "30 minutes"}, {CheckInterval: "1000h"}} {
+		if bad.validate() == nil {
+			t.Errorf("Invalid intervals %+v were accepted", bad)
+		}
+	}
+}
+
+func TestCheckFreshness(t *testing.T) {
+	now := time.Date(2019, 11, 1, 12, 0, 0, 0, time.UTC)
+	var never time.Time
+	for _, test := range []struct {
+		name         string
+		metadata     listMetadata
+		lastIssuedAt time.Time
+		valid        bool
+	}{
+		{"no metadata", listMetadata{}, never, true},
+		{"not yet expired", listMetadata{expires: now.Add(time.Hour)}, never, true},
+		{"expired", listMetadata{expires: now.Add(-time.Second)}, never, false},
+		{"first issue time", listMetadata{issuedAt: now}, never, true},
+		{"newer issue time", listMetadata{issuedAt: now}, now.Add(-time.Hour), true},
+		{"same issue time", listMetadata{issuedAt: now}, now, true},
+		{"older issue time", listMetadata{issuedAt: now.Add(-time.Second)}, now, false},
+		{"issue time missing after one was seen", listMetadata{}, now.Add(-time.Hour), false},
+		{"fresh but expired", listMetadata{issuedAt: now, expires: now.Add(-time.Second)}, now.Add(-time.Hour), false},
+	} {
+		err := checkFreshness(&test.metadata, now, test.lastIssuedAt)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestVerifyAndRecordFreshness(t *testing.T) {
+	u := &Updater{StateDirectory: t.TempDir()}
+	issuedAt := time.Date(2019, 11, 1, 12, 0, 0, 0, time.UTC)
+	err := u.verifyAndRecordFreshness(&listMetadata{issuedAt: issuedAt}, "stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded := u.loadPersistentState().LastIssuedAt["stable"]; !recorded.Equal(issuedAt) {
+		t.Errorf("Recorded issue time is %v, want %v", recorded, issuedAt)
+	}
+	if u.verifyAndRecordFreshness(&listMetadata{issuedAt: issuedAt.Add(-time.Hour)}, "stable") == nil {
+		t.Error("Older list was accepted")
+	}
+	if u.verifyAndRecordFreshness(&listMetadata{}, "stable") == nil {
+		t.Error("List without an issue time was accepted after one with")
+	}
+	if u.verifyAndRecordFreshness(&listMetadata{expires: time.Now().Add(-time.Hour), issuedAt: issuedAt}, "stable") == nil {
+		t.Error("Expired list was accepted")
+	}
+	err = u.verifyAndRecordFreshness(&listMetadata{issuedAt: issuedAt.Add(-time.Hour)}, "beta")
+	if err != nil {
+		t.Errorf("Issue time on one channel held back another: %v", err)
+	}
+	err = u.verifyAndRecordFreshness(&listMetadata{issuedAt: issuedAt.Add(time.Hour)}, "stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded := u.loadPersistentState().LastIssuedAt["stable"]; !recorded.Equal(issuedAt.Add(time.Hour)) {
+		t.Errorf("Recorded issue time is %v, want %v", recorded, issuedAt.Add(time.Hour))
+	}
+}
+
+func TestReadFileListKeys(t *testing.T) {
+	public1, _, _ := newSignifyKey(t)
+	public2, private2, keyID2 := newSignifyKey(t)
+	_, private3, keyID3 := newSignifyKey(t)
+	files := map[string][]byte{"wireguard-amd64-0.3.2.msi": nil}
+
+	_, metadata, err := readFileList(signList(private2, keyID2, files), []string{public1, public2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.keyID != keyID2 {
+		t.Errorf("List was verified with key ID %x, want %x", metadata.keyID, keyID2)
+	}
+	_, _, err = readFileList(signList(private3, keyID3, files), []string{public1, public2})
+	if err == nil || !strings.Contains(err.Error(), "untrusted key ID") {
+		t.Errorf("List signed by an unknown key ID was not rejected as such: %v", err)
+	}
+	_, _, err = readFileList(signList(private3, keyID2, files), []string{public1, public2})
+	if err == nil {
+		t.Error("List signed by another key with a trusted key ID was accepted")
+	}
+	_, _, err = readFileList(signList(private2, keyID2, files), []string{public2, public2})
+	if err == nil {
+		t.Error("Duplicate trusted key IDs were accepted")
+	}
+	_, _, err = readFileList(signList(private2, keyID2, files), nil)
+	if err == nil {
+		t.Error("List was accepted without trusted keys")
+	}
+}
+
+func TestReadFileListMetadata(t *testing.T) {
+	public, private, keyID := newSignifyKey(t)
+	files := map[string][]byte{"wireguard-amd64-0.3.2.msi": nil}
+	_, metadata, err := readFileList(signList(private, keyID, files,
+		"issued-at=2019-11-01T12:00:00Z",
+		"expires=2019-11-15T12:00:00Z",
+		"minimum-version=0.3.1",
+		"rollout=wireguard-amd64-0.3.2.msi:12.5",
+		"some-future-thing=ignored",
+	), []string{public})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata.issuedAt.Equal(time.Date(2019, 11, 1, 12, 0, 0, 0, time.UTC)) || !metadata.expires.Equal(time.Date(2019, 11, 15, 12, 0, 0, 0, time.UTC)) || metadata.minimumVersion != "0.3.1" || metadata.rollouts["wireguard-amd64-0.3.2.msi"] != 12.5 {
+		t.Errorf("Metadata was read as %+v", metadata)
+	}
+
+	for _, line := range []string{
+		"issued-at",
+		"issued-at=yesterday",
+		"expires=2019-13-01T00:00:00Z",
+		"rollout=wireguard-amd64-0.3.2.msi",
+		"rollout=wireguard-amd64-0.3.2.msi:150",
+		"rollout=wireguard-amd64-0.3.2.msi:-1",
+		"rollout=wireguard-amd64-0.3.2.msi:lots",
+	} {
+		_, _, err = readFileList(signList(private, keyID, files, line), []string{public})
+		if err == nil {
+			t.Errorf("Malformed metadata line %q was accepted", line)
+		}
+	}
+
+	sign := func(list string) []byte {
+		signature := ed25519.Sign(private, []byte(list))
+		return []byte(fmt.Sprintf("untrusted comment: verify with test.pub\n%s\n%s", base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID[:]...), signature...)), list))
+	}
+	for _, list := range []string{
+		fmt.Sprintf("%064d !issued-at=2019-11-01T12:00:00Z\n%064x  wireguard-amd64-0.3.2.msi\n", 0, 1),
+		fmt.Sprintf("%062d  !issued-at=2019-11-01T12:00:00Z\n%064x  wireguard-amd64-0.3.2.msi\n", 0, 1),
+		fmt.Sprintf("%064d  !issued-at=2019-11-01T12:00:00Z\n", 0),
+	} {
+		_, _, err = readFileList(sign(list), []string{public})
+		if err == nil {
+			t.Errorf("Malformed list %q was accepted", list)
+		}
+	}
+}
+
+func TestMinimumVersion(t *testing.T) {
+	u := &Updater{Version: "0.3.1"}
+	for _, test := range []struct {
+		minimum string
+		below   bool
+		valid   bool
+	}{
+		{"0.3.2", true, true},
+		{"0.3.1", false, true},
+		{"0.3", false, true},
+		{"1.0", true, true},
+		{"0.3.1-beta", false, true},
+		{"0.3.x", false, false},
+		{"latest", false, false},
+	} {
+		below, err := u.belowMinimum(test.minimum)
+		if below != test.below || (err == nil) != test.valid {
+			t.Errorf("Minimum version %q: got %v, %v", test.minimum, below, err)
+		}
+	}
+
+	s := newTestServer(t)
+	msi := randomPackage(t, 1024)
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi}, "minimum-version=0.3.2")
+	u, _ = s.updater(t)
+	update, _, err := u.CheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update == nil || !update.Mandatory {
+		t.Errorf("Update required by the minimum version is not mandatory: %+v", update)
+	}
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi}, "minimum-version=0.3.1")
+	update, _, err = u.CheckForUpdate()
+	if err != nil || update == nil || update.Mandatory {
+		t.Errorf("Update above the minimum version is mandatory: %+v, %v", update, err)
+	}
+	s.serveList(map[string][]byte{"wireguard-amd64-0.3.2.msi": msi}, "minimum-version=latest")
+	_, _, err = u.CheckForUpdate()
+	if err == nil {
+		t.Error("Unparsable minimum version was accepted")
+	}
 }
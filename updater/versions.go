@@ -6,74 +6,86 @@
 package updater
 
 import (
-	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 
 	"golang.zx2c4.com/wireguard/windows/version"
 )
 
-func versionNewerThanUs(candidate string) (bool, error) {
-	candidateParts := strings.Split(candidate, ".")
-	ourParts := strings.Split(version.Number, ".")
-	if len(candidateParts) == 0 || len(ourParts) == 0 {
-		return false, errors.New("Empty version")
-	}
-	l := len(candidateParts)
-	if len(ourParts) > l {
-		l = len(ourParts)
+// findCandidate picks the highest version in the list for our architecture that is on the configured
+// track, which means that pre-releases are only eligible off of the stable channel, and whose
+// rollout includes this machine. It is returned if it is newer than us, or if it is older and the
+// configuration explicitly allows downgrades. If a newer version exists but its rollout doesn't
+// include us yet, then that version is returned as heldBack.
+func (u *Updater) findCandidate(candidates fileList, rollouts map[string]float64) (update *UpdateFound, heldBack string, err error) {
+	ours, err := version.Parse(u.Version)
+	if err != nil {
+		return nil, "", err
 	}
-	for i := 0; i < l; i++ {
-		var err error
-		cP, oP := uint64(0), uint64(0)
-		if i < len(candidateParts) {
-			if len(candidateParts[i]) == 0 {
-				return false, errors.New("Empty version part")
-			}
-			cP, err = strconv.ParseUint(candidateParts[i], 10, 16)
-			if err != nil {
-				return false, errors.New("Invalid version integer part")
-			}
+	prefix := fmt.Sprintf(msiArchPrefix, u.Arch)
+	suffix := msiSuffix
+	var best *UpdateFound
+	var bestVersion, heldBackVersion version.Version
+	for name, hash := range candidates {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
 		}
-		if i < len(ourParts) {
-			if len(ourParts[i]) == 0 {
-				return false, errors.New("Empty version part")
-			}
-			oP, err = strconv.ParseUint(ourParts[i], 10, 16)
-			if err != nil {
-				return false, errors.New("Invalid version integer part")
-			}
+		candidate, err := version.Parse(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix))
+		if err != nil {
+			// Names we can't understand may be from a future naming scheme, so skip them.
+			continue
+		}
+		if candidate.IsPreRelease() && !u.Config.allowsPreReleases() {
+			continue
+		}
+		included, err := u.inRollout(name, rollouts)
+		if err != nil {
+			return nil, "", err
 		}
-		if cP == oP {
+		if !included {
+			if len(heldBack) == 0 || candidate.NewerThan(heldBackVersion) {
+				heldBack = candidate.String()
+				heldBackVersion = candidate
+			}
 			continue
 		}
-		return cP > oP, nil
+		// Ties between equivalent spellings are broken by name, so that the choice doesn't
+		// depend on map iteration order.
+		if best == nil || candidate.NewerThan(bestVersion) || (candidate.Compare(bestVersion) == 0 && name < best.name) {
+			best = &UpdateFound{name: name, hash: hash, Version: candidate.String()}
+			bestVersion = candidate
+		}
+	}
+	if len(heldBack) > 0 && (!heldBackVersion.NewerThan(ours) || (best != nil && !heldBackVersion.NewerThan(bestVersion))) {
+		heldBack = ""
+	}
+	if best == nil {
+		return nil, heldBack, nil
 	}
-	return false, nil
+	switch c := bestVersion.Compare(ours); {
+	case c > 0:
+	case c < 0 && u.Config.AllowDowngrade:
+		best.Downgrade = true
+	default:
+		return nil, heldBack, nil
+	}
+	patchName := strings.TrimSuffix(best.name, suffix) + patchInfix + u.Version + patchSuffix
+	if patchHash, ok := candidates[patchName]; ok {
+		best.patchName = patchName
+		best.patchHash = patchHash
+	}
+	return best, heldBack, nil
 }
 
-func findCandidate(candidates fileList) (*UpdateFound, error) {
-	arch, err := findArch()
+// belowMinimum says whether our version is older than the minimum version a signed list requires.
+func (u *Updater) belowMinimum(minimumVersion string) (bool, error) {
+	minimum, err := version.Parse(minimumVersion)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	prefix := fmt.Sprintf(msiArchPrefix, arch)
-	suffix := msiSuffix
-	for name, hash := range candidates {
-		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
-			version := strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
-			if len(version) > 128 {
-				return nil, errors.New("Version length is too long")
-			}
-			newer, err := versionNewerThanUs(version)
-			if err != nil {
-				return nil, err
-			}
-			if newer {
-				return &UpdateFound{name, hash}, nil
-			}
-		}
+	ours, err := version.Parse(u.Version)
+	if err != nil {
+		return false, err
 	}
-	return nil, nil
+	return minimum.NewerThan(ours), nil
 }
@@ -39,10 +39,24 @@ func errnoErr(e syscall.Errno) error {
 
 var (
 	modkernel32 = windows.NewLazySystemDLL("kernel32.dll")
+	modwinhttp  = windows.NewLazySystemDLL("winhttp.dll")
 
-	procIsWow64Process2 = modkernel32.NewProc("IsWow64Process2")
+	procGlobalFree            = modkernel32.NewProc("GlobalFree")
+	procIsWow64Process2       = modkernel32.NewProc("IsWow64Process2")
+	procWinHttpCloseHandle    = modwinhttp.NewProc("WinHttpCloseHandle")
+	procWinHttpGetProxyForUrl = modwinhttp.NewProc("WinHttpGetProxyForUrl")
+	procWinHttpOpen           = modwinhttp.NewProc("WinHttpOpen")
 )
 
+func globalFree(hmem uintptr) (handle uintptr, err error) {
+	r0, _, e1 := syscall.Syscall(procGlobalFree.Addr(), 1, uintptr(hmem), 0, 0)
+	handle = uintptr(r0)
+	if handle != 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
 func isWow64Process2Internal(process windows.Handle, processMachine *uint16, nativeMachine *uint16) (err error) {
 	r1, _, e1 := syscall.Syscall(procIsWow64Process2.Addr(), 3, uintptr(process), uintptr(unsafe.Pointer(processMachine)), uintptr(unsafe.Pointer(nativeMachine)))
 	if r1 == 0 {
@@ -50,3 +64,28 @@ func isWow64Process2Internal(process windows.Handle, processMachine *uint16, nat
 	}
 	return
 }
+
+func winHttpCloseHandle(handle windows.Handle) (err error) {
+	r1, _, e1 := syscall.Syscall(procWinHttpCloseHandle.Addr(), 1, uintptr(handle), 0, 0)
+	if r1 == 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
+func winHttpGetProxyForUrl(session windows.Handle, url *uint16, autoProxyOptions *winHttpAutoProxyOptions, proxyInfo *winHttpProxyInfo) (err error) {
+	r1, _, e1 := syscall.Syscall6(procWinHttpGetProxyForUrl.Addr(), 4, uintptr(session), uintptr(unsafe.Pointer(url)), uintptr(unsafe.Pointer(autoProxyOptions)), uintptr(unsafe.Pointer(proxyInfo)), 0, 0)
+	if r1 == 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
+func winHttpOpen(userAgent *uint16, accessType uint32, proxy *uint16, proxyBypass *uint16, flags uint32) (handle windows.Handle, err error) {
+	r0, _, e1 := syscall.Syscall6(procWinHttpOpen.Addr(), 5, uintptr(unsafe.Pointer(userAgent)), uintptr(accessType), uintptr(unsafe.Pointer(proxy)), uintptr(unsafe.Pointer(proxyBypass)), uintptr(flags), 0)
+	handle = windows.Handle(r0)
+	if handle == 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
@@ -33,3 +33,7 @@ func OsName() string {
 func VerifyAuthenticode(path string) bool {
 	return true
 }
+
+func IsRunningOfficialVersion() bool {
+	return true
+}
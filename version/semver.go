@@ -0,0 +1,176 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package version
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Version is a release number of one or more dotted numeric parts, optionally followed by a
+// pre-release suffix after a '-' and build metadata after a '+', as in "0.2.0-rc.1+g1234abc".
+// Missing trailing numeric parts are zero, so "0.3" and "0.3.0" are the same version. Otherwise,
+// pre-releases are ordered as in Semantic Versioning 2.0.0, and build metadata is ignored.
+type Version struct {
+	Parts      []uint64
+	PreRelease []string
+	Build      string
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+func isIdentifier(s string) bool {
+	for _, c := range s {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '-') {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+func Parse(s string) (Version, error) {
+	var v Version
+	if len(s) == 0 {
+		return v, errors.New("Empty version")
+	}
+	if len(s) > 128 {
+		return v, errors.New("Version length is too long")
+	}
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		v.Build = s[i+1:]
+		s = s[:i]
+		for _, identifier := range strings.Split(v.Build, ".") {
+			if !isIdentifier(identifier) {
+				return Version{}, errors.New("Invalid version build metadata")
+			}
+		}
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.PreRelease = strings.Split(s[i+1:], ".")
+		s = s[:i]
+		for _, identifier := range v.PreRelease {
+			if !isIdentifier(identifier) || (isDigits(identifier) && len(identifier) > 1 && identifier[0] == '0') {
+				return Version{}, errors.New("Invalid version pre-release part")
+			}
+		}
+	}
+	for _, part := range strings.Split(s, ".") {
+		if !isDigits(part) {
+			return Version{}, errors.New("Invalid version integer part")
+		}
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return Version{}, errors.New("Invalid version integer part")
+		}
+		v.Parts = append(v.Parts, n)
+	}
+	return v, nil
+}
+
+func MustParse(s string) Version {
+	v, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// Current returns the version of the running program.
+func Current() Version {
+	return MustParse(Number)
+}
+
+func (v Version) IsPreRelease() bool {
+	return len(v.PreRelease) > 0
+}
+
+func compareIdentifiers(a, b string) int {
+	aNumeric, bNumeric := isDigits(a), isDigits(b)
+	switch {
+	case aNumeric && bNumeric:
+		if len(a) != len(b) {
+			if len(a) < len(b) {
+				return -1
+			}
+			return 1
+		}
+	case aNumeric:
+		return -1
+	case bNumeric:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// Compare returns -1, 0, or 1 depending on whether v is older than, the same as, or newer than o.
+func (v Version) Compare(o Version) int {
+	l := len(v.Parts)
+	if len(o.Parts) > l {
+		l = len(o.Parts)
+	}
+	for i := 0; i < l; i++ {
+		var a, b uint64
+		if i < len(v.Parts) {
+			a = v.Parts[i]
+		}
+		if i < len(o.Parts) {
+			b = o.Parts[i]
+		}
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(v.PreRelease) == 0 && len(o.PreRelease) == 0:
+		return 0
+	case len(v.PreRelease) == 0:
+		return 1
+	case len(o.PreRelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.PreRelease) && i < len(o.PreRelease); i++ {
+		if c := compareIdentifiers(v.PreRelease[i], o.PreRelease[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.PreRelease) < len(o.PreRelease):
+		return -1
+	case len(v.PreRelease) > len(o.PreRelease):
+		return 1
+	}
+	return 0
+}
+
+func (v Version) NewerThan(o Version) bool {
+	return v.Compare(o) > 0
+}
+
+func (v Version) String() string {
+	parts := make([]string, len(v.Parts))
+	for i, part := range v.Parts {
+		parts[i] = strconv.FormatUint(part, 10)
+	}
+	s := strings.Join(parts, ".")
+	if len(v.PreRelease) > 0 {
+		s += "-" + strings.Join(v.PreRelease, ".")
+	}
+	if len(v.Build) > 0 {
+		s += "+" + v.Build
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package version
+
+import (
+	"testing"
+)
+
+func TestVersionOrdering(t *testing.T) {
+	ordered := []string{
+		"0.1",
+		"0.1.1",
+		"0.2.0-alpha",
+		"0.2.0-alpha.1",
+		"0.2.0-alpha.beta",
+		"0.2.0-beta",
+		"0.2.0-beta.2",
+		"0.2.0-beta.11",
+		"0.2.0-rc1",
+		"0.2.0",
+		"0.2.0.1",
+		"0.10.0",
+		"1.0.0",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, b := MustParse(ordered[i]), MustParse(ordered[j])
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := a.Compare(b); got != want {
+				t.Errorf("Compare(%s, %s) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestVersionEquivalence(t *testing.T) {
+	for _, pair := range [][2]string{
+		{"0.3", "0.3.0"},
+		{"0.3.0", "0.3.0.0"},
+		{"0.3.0+g1234", "0.3.0"},
+		{"0.3.0-rc.1+build.5", "0.3.0-rc.1"},
+	} {
+		if c := MustParse(pair[0]).Compare(MustParse(pair[1])); c != 0 {
+			t.Errorf("Compare(%s, %s) = %d, want 0", pair[0], pair[1], c)
+		}
+	}
+}
+
+func TestVersionParse(t *testing.T) {
+	v, err := Parse("0.2.0-rc.1+g1234abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Parts) != 3 || !v.IsPreRelease() || v.Build != "g1234abc" || v.String() != "0.2.0-rc.1+g1234abc" {
+		t.Errorf("Parsed to %#v", v)
+	}
+	if MustParse("70000.1").Compare(MustParse("1.1")) != 1 {
+		t.Error("Parts larger than 16 bits are not compared correctly")
+	}
+	for _, bad := range []string{"", ".", "1.", ".1", "1..2", "a.b", "1.0-", "1.0-rc..1", "1.0-01", "1.0+", "1.0-r_c", "-1.0", "1.0 "} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q) succeeded", bad)
+		}
+	}
+}